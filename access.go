@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trustedProxies  = flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma-separated addresses, CIDRs or hostnames of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted")
+	authToken       = flag.String("auth.token", os.Getenv("AUTH_TOKEN"), "Bearer token required on /metrics and the other endpoints but the live traffic page")
+	authTokenFile   = flag.String("auth.token-file", os.Getenv("AUTH_TOKEN_FILE"), "File containing the bearer token required on /metrics and the other endpoints but the live traffic page")
+	rateLimit       = flag.Float64("web.rate-limit", 0, "Requests per second allowed per client on /metrics, 0 for unlimited")
+	rateLimitBurst  = flag.Int("web.rate-limit-burst", 5, "Requests a client may make at once before --web.rate-limit applies")
+	accessLog       = flag.Bool("web.access-log", false, "Log every request to /metrics with client address, status and duration")
+	resolveInterval = flag.Duration("allowed-ips.resolve-interval", time.Minute, "How often hostnames in --allowed-ips and --trusted-proxies are resolved again")
+
+	// Parsed from the flags by setupAccessControl
+	allowList, proxyList *addrList
+	bearerToken          string
+)
+
+// addrList is a list of addresses, CIDRs and hostnames. Hostnames are
+// resolved periodically, so a changed DNS record takes effect without a restart.
+type addrList struct {
+	prefixes []netip.Prefix
+	hosts    []string
+
+	mu       sync.RWMutex
+	resolved map[string][]netip.Addr
+}
+
+// parseAddr parses an address in any of the forms found in configs and
+// headers: with a port, in brackets, with an IPv6 zone or IPv4-mapped
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// The zone only names the local interface the address was seen on
+	return addr.WithZone("").Unmap(), true
+}
+
+// parseAddrList parses a comma-separated list of addresses, CIDRs and hostnames
+func parseAddrList(value string) *addrList {
+	l := &addrList{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			l.prefixes = append(l.prefixes, unmapPrefix(prefix))
+		} else if addr, ok := parseAddr(entry); ok {
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			l.hosts = append(l.hosts, entry)
+		}
+	}
+	return l
+}
+
+// unmapPrefix turns an IPv4-mapped CIDR such as ::ffff:10.0.0.0/104 into
+// 10.0.0.0/8, matching the unmapped addresses of parseAddr
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked()
+}
+
+func (l *addrList) empty() bool {
+	return len(l.prefixes) == 0 && len(l.hosts) == 0
+}
+
+func (l *addrList) contains(addr netip.Addr) bool {
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, addrs := range l.resolved {
+		for _, resolved := range addrs {
+			if resolved == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve looks up the hostnames of the list. A hostname that fails to
+// resolve keeps the addresses it had, so a DNS hiccup doesn't lock out scrapers.
+func (l *addrList) resolve() {
+	if len(l.hosts) == 0 {
+		return
+	}
+	for _, host := range l.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		cancel()
+		if err != nil {
+			log.Printf("Error resolving %s, keeping its previous addresses: %v", host, err)
+			continue
+		}
+		for i, addr := range addrs {
+			addrs[i] = addr.WithZone("").Unmap()
+		}
+
+		l.mu.Lock()
+		if l.resolved == nil {
+			l.resolved = make(map[string][]netip.Addr)
+		}
+		l.resolved[host] = addrs
+		l.mu.Unlock()
+	}
+}
+
+// resolvePeriodically keeps the hostnames of the list resolved
+func (l *addrList) resolvePeriodically() {
+	for {
+		time.Sleep(*resolveInterval)
+		l.resolve()
+	}
+}
+
+// validateHostname reports whether s is a syntactically valid DNS name
+func validateHostname(s string) bool {
+	if len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateAccessFlags checks the rate limit and token flags, and that every
+// entry of --allowed-ips and --trusted-proxies that is not an address or
+// CIDR is at least a valid hostname, so a mistyped CIDR isn't looked up
+func validateAccessFlags() error {
+	if *rateLimit < 0 {
+		return fmt.Errorf("--web.rate-limit must not be negative")
+	}
+	if *rateLimitBurst < 1 {
+		return fmt.Errorf("--web.rate-limit-burst must be at least 1")
+	}
+	if _, err := secretValue("auth.token", *authToken, *authTokenFile); err != nil {
+		return err
+	}
+	for _, f := range []struct{ name, value string }{{"allowed-ips", *allowedIPs}, {"trusted-proxies", *trustedProxies}} {
+		for _, host := range parseAddrList(f.value).hosts {
+			if !validateHostname(host) {
+				return fmt.Errorf("invalid --%s entry %q, expected an address, CIDR or hostname", f.name, host)
+			}
+		}
+	}
+	return nil
+}
+
+// secretValue returns a secret given either as --<name> or in the file of
+// --<name>-file, which keeps it out of the process list
+func secretValue(name, value, file string) (string, error) {
+	if value != "" && file != "" {
+		return "", fmt.Errorf("--%s and --%s-file are mutually exclusive", name, name)
+	}
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading --%s-file: %w", name, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("--%s-file %s is empty", name, file)
+	}
+	return secret, nil
+}
+
+// setupAccessControl parses --allowed-ips and --trusted-proxies, starts
+// resolving their hostnames and loads the bearer token
+func setupAccessControl() error {
+	var err error
+	if bearerToken, err = secretValue("auth.token", *authToken, *authTokenFile); err != nil {
+		return err
+	}
+
+	allowList = parseAddrList(*allowedIPs)
+	proxyList = parseAddrList(*trustedProxies)
+	for _, l := range []*addrList{allowList, proxyList} {
+		if len(l.hosts) > 0 {
+			l.resolve()
+			go l.resolvePeriodically()
+		}
+	}
+	return nil
+}
+
+// clientAddr returns the address of the client of a request. The
+// X-Forwarded-For and X-Real-IP headers are only used when the request comes
+// from a trusted proxy; X-Forwarded-For is read from the right, skipping the
+// trusted proxies that appended to it, since entries left of those are
+// under the client's control.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	addr, ok := parseAddr(r.RemoteAddr)
+	if !ok || proxyList == nil || !proxyList.contains(addr) {
+		return addr, ok
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseAddr(hops[i])
+			if !ok {
+				return netip.Addr{}, false
+			}
+			addr = hop
+			if !proxyList.contains(hop) {
+				break
+			}
+		}
+		return addr, true
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return parseAddr(realIP)
+	}
+	return addr, true
+}
+
+// isIPAllowed reports whether the client of a request is in the IP whitelist
+// of the listener it came in on
+func isIPAllowed(r *http.Request) bool {
+	allow := requestPolicy(r).allow
+	if allow == nil || allow.empty() {
+		return true // Allow all if no whitelist specified
+	}
+	addr, ok := clientAddr(r)
+	return ok && allow.contains(addr)
+}
+
+// withIPWhitelist rejects requests from clients not in the IP whitelist
+func withIPWhitelist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isIPAllowed(r) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withBearerToken rejects requests without the bearer token of the listener
+// they came in on, --auth.token by default
+func withBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := requestPolicy(r).token
+		if want == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="networkspeed"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenBucket is the rate limit state of one client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests per client with a token bucket each
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+	swept   time.Time
+}
+
+// allow takes a token from the client's bucket and reports whether there was one
+func (l *rateLimiter) allow(client netip.Addr, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(*rateLimitBurst)
+	// Buckets that refilled completely are the same as new ones
+	if now.Sub(l.swept) > time.Minute {
+		for addr, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()**rateLimit >= burst {
+				delete(l.buckets, addr)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()**rateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// withRateLimit rejects requests of clients exceeding --web.rate-limit
+func withRateLimit(next http.Handler) http.Handler {
+	l := &rateLimiter{buckets: make(map[netip.Addr]*tokenBucket)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *rateLimit > 0 {
+			client, _ := clientAddr(r)
+			if !l.allow(client, time.Now()) {
+				w.Header().Set("Retry-After", fmt.Sprint(int(1 / *rateLimit)+1))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withAccessLog logs the requests when --web.access-log is set
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*accessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		client := r.RemoteAddr
+		if addr, ok := clientAddr(r); ok {
+			client = addr.String()
+		}
+		log.Printf("%s %s %s %d %s %q", client, r.Method, r.URL.RequestURI(), rec.status, time.Since(start).Round(time.Microsecond), r.UserAgent())
+	})
+}
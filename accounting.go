@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Layouts of the bucket keys, in local time
+	accountingHourLayout  = "2006-01-02T15"
+	accountingDayLayout   = "2006-01-02"
+	accountingMonthLayout = "2006-01"
+
+	// How many buckets of each kind are kept
+	accountingKeepHours  = 48
+	accountingKeepDays   = 62
+	accountingKeepMonths = 24
+)
+
+var (
+	accountingFile         = flag.String("accounting.file", "", "File to persist per-interface hourly/daily/monthly byte totals in; empty disables accounting")
+	accountingSaveInterval = flag.Duration("accounting.save-interval", time.Minute, "How often to write the accounting file")
+
+	networkBytesDay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_bytes_day_total",
+			Help: "Bytes transferred by a network interface since the start of the current day (local time)",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	networkBytesMonth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_bytes_month_total",
+			Help: "Bytes transferred by a network interface since the start of the current month (local time)",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	// Accumulated totals, persisted to --accounting.file
+	accounting = struct {
+		sync.Mutex
+		state accountingState
+		// Day and month the period metrics are of
+		day, month string
+		// Interfaces with period metrics
+		published map[string]bool
+	}{
+		state:     accountingState{Interfaces: make(map[string]*interfaceAccounting)},
+		published: make(map[string]bool),
+	}
+)
+
+func init() {
+	registerMetrics("accounting", networkBytesDay)
+	registerMetrics("accounting", networkBytesMonth)
+}
+
+// accountingTotals is the traffic of one interface in one period
+type accountingTotals struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// interfaceAccounting holds the totals of an interface per period
+type interfaceAccounting struct {
+	Hours  map[string]*accountingTotals `json:"hours"`
+	Days   map[string]*accountingTotals `json:"days"`
+	Months map[string]*accountingTotals `json:"months"`
+	// Counters at the last update, to account the difference on the next one
+	LastRxBytes uint64 `json:"last_rx_bytes"`
+	LastTxBytes uint64 `json:"last_tx_bytes"`
+}
+
+// accountingState is the on-disk format of the accounting file
+type accountingState struct {
+	Interfaces map[string]*interfaceAccounting `json:"interfaces"`
+	// 95th percentile billing samples, so the billing window survives restarts
+	Percentile map[string][]percentileSample `json:"percentile,omitempty"`
+	// Traffic baselines of the anomaly score, which take weeks to learn
+	Baseline map[string]*anomalyBaseline `json:"baseline,omitempty"`
+}
+
+func newInterfaceAccounting() *interfaceAccounting {
+	return &interfaceAccounting{
+		Hours:  make(map[string]*accountingTotals),
+		Days:   make(map[string]*accountingTotals),
+		Months: make(map[string]*accountingTotals),
+	}
+}
+
+// counterDelta returns how much a counter grew, treating a decrease as a
+// reset (reboot or re-created interface) after which cur bytes were counted
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// bucket returns the totals for key, creating it if needed
+func bucket(buckets map[string]*accountingTotals, key string) *accountingTotals {
+	t, ok := buckets[key]
+	if !ok {
+		t = &accountingTotals{}
+		buckets[key] = t
+	}
+	return t
+}
+
+// loadAccounting reads the accounting file, if it exists
+func loadAccounting() error {
+	data, err := os.ReadFile(*accountingFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state accountingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Interfaces == nil {
+		state.Interfaces = make(map[string]*interfaceAccounting)
+	}
+	for _, acct := range state.Interfaces {
+		for _, m := range []*map[string]*accountingTotals{&acct.Hours, &acct.Days, &acct.Months} {
+			if *m == nil {
+				*m = make(map[string]*accountingTotals)
+			}
+		}
+	}
+
+	restorePercentiles(state.Percentile)
+	state.Percentile = nil
+	restoreAnomalies(state.Baseline)
+	state.Baseline = nil
+
+	accounting.Lock()
+	accounting.state = state
+	accounting.Unlock()
+	return nil
+}
+
+// pruneBuckets keeps only the newest keep buckets; keys sort chronologically
+func pruneBuckets(buckets map[string]*accountingTotals, keep int) {
+	if len(buckets) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-keep] {
+		delete(buckets, k)
+	}
+}
+
+// saveAccounting atomically writes the accounting file
+func saveAccounting() error {
+	percentile := percentileSnapshot()
+	baseline := anomalySnapshot()
+
+	accounting.Lock()
+	for _, acct := range accounting.state.Interfaces {
+		pruneBuckets(acct.Hours, accountingKeepHours)
+		pruneBuckets(acct.Days, accountingKeepDays)
+		pruneBuckets(acct.Months, accountingKeepMonths)
+	}
+	accounting.state.Percentile, accounting.state.Baseline = percentile, baseline
+	data, err := json.Marshal(accounting.state)
+	accounting.state.Percentile, accounting.state.Baseline = nil, nil
+	accounting.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*accountingFile), filepath.Base(*accountingFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *accountingFile)
+}
+
+// accountStats adds the traffic since the previous cycle to the current
+// hour, day and month and updates the period metrics
+func accountStats(stats []interfaceStats) {
+	if *accountingFile == "" {
+		return
+	}
+	accounting.Lock()
+	defer accounting.Unlock()
+
+	// At the start of a day or month the metrics of interfaces missing from
+	// the cycle, being down, start over too
+	now := time.Now().Local()
+	day, month := now.Format(accountingDayLayout), now.Format(accountingMonthLayout)
+	if day != accounting.day || month != accounting.month {
+		for name := range accounting.published {
+			acct := accounting.state.Interfaces[name]
+			publishAccountingTotals(networkBytesDay, name, acct.Days[day])
+			publishAccountingTotals(networkBytesMonth, name, acct.Months[month])
+		}
+		accounting.day, accounting.month = day, month
+	}
+
+	for _, s := range stats {
+		acct, ok := accounting.state.Interfaces[s.Name]
+		if !ok {
+			// Start counting from now rather than attributing the traffic
+			// since boot to the current hour
+			acct = newInterfaceAccounting()
+			acct.LastRxBytes, acct.LastTxBytes = s.RxBytes, s.TxBytes
+			accounting.state.Interfaces[s.Name] = acct
+		}
+		rx := counterDelta(s.RxBytes, acct.LastRxBytes)
+		tx := counterDelta(s.TxBytes, acct.LastTxBytes)
+		acct.LastRxBytes, acct.LastTxBytes = s.RxBytes, s.TxBytes
+
+		local := s.Time.Local()
+		for _, b := range []*accountingTotals{
+			bucket(acct.Hours, local.Format(accountingHourLayout)),
+			bucket(acct.Days, local.Format(accountingDayLayout)),
+			bucket(acct.Months, local.Format(accountingMonthLayout)),
+		} {
+			b.RxBytes += rx
+			b.TxBytes += tx
+		}
+
+		publishAccountingTotals(networkBytesDay, s.Name, acct.Days[local.Format(accountingDayLayout)])
+		publishAccountingTotals(networkBytesMonth, s.Name, acct.Months[local.Format(accountingMonthLayout)])
+		accounting.published[s.Name] = true
+	}
+}
+
+// publishAccountingTotals sets the period metric of an interface, to zero
+// for a period without traffic
+func publishAccountingTotals(vec *prometheus.GaugeVec, name string, t *accountingTotals) {
+	if t == nil {
+		t = &accountingTotals{}
+	}
+	vec.With(prometheus.Labels{"interface": name, "direction": "receive"}).Set(float64(t.RxBytes))
+	vec.With(prometheus.Labels{"interface": name, "direction": "transmit"}).Set(float64(t.TxBytes))
+}
+
+// forgetAccounting drops the period metrics of a removed interface; its
+// totals stay in the accounting file
+func forgetAccounting(name string) {
+	accounting.Lock()
+	defer accounting.Unlock()
+	delete(accounting.published, name)
+	networkBytesDay.DeletePartialMatch(prometheus.Labels{"interface": name})
+	networkBytesMonth.DeletePartialMatch(prometheus.Labels{"interface": name})
+}
+
+// saveAccountingPeriodically persists the totals every --accounting.save-interval
+func saveAccountingPeriodically() {
+	for {
+		time.Sleep(*accountingSaveInterval)
+		if err := saveAccounting(); err != nil {
+			log.Printf("Error saving accounting file %s: %v", *accountingFile, err)
+		}
+	}
+}
+
+// accountingPeriodJSON is one bucket in the /api/v1/accounting response
+type accountingPeriodJSON struct {
+	Period  string `json:"period"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+type interfaceAccountingJSON struct {
+	Hours  []accountingPeriodJSON `json:"hours"`
+	Days   []accountingPeriodJSON `json:"days"`
+	Months []accountingPeriodJSON `json:"months"`
+}
+
+// sortedPeriods returns the buckets in chronological order
+func sortedPeriods(buckets map[string]*accountingTotals) []accountingPeriodJSON {
+	periods := make([]accountingPeriodJSON, 0, len(buckets))
+	for k, t := range buckets {
+		periods = append(periods, accountingPeriodJSON{Period: k, RxBytes: t.RxBytes, TxBytes: t.TxBytes})
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Period < periods[j].Period })
+	return periods
+}
+
+// handleAccounting serves the hourly/daily/monthly totals, optionally for a
+// single interface with ?iface=eth0
+func handleAccounting(w http.ResponseWriter, r *http.Request) {
+	if *accountingFile == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "accounting is disabled"})
+		return
+	}
+	only := r.URL.Query().Get("iface")
+
+	resp := make(map[string]interfaceAccountingJSON)
+	accounting.Lock()
+	for name, acct := range accounting.state.Interfaces {
+		if only != "" && name != only {
+			continue
+		}
+		resp[name] = interfaceAccountingJSON{
+			Hours:  sortedPeriods(acct.Hours),
+			Days:   sortedPeriods(acct.Days),
+			Months: sortedPeriods(acct.Months),
+		}
+	}
+	accounting.Unlock()
+
+	if only != "" && len(resp) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "interface not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"interfaces": resp})
+}
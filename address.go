@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"math"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var addressInterval = flag.Duration("address.interval", 30*time.Second, "How often to read the IP addresses of the interfaces")
+
+var (
+	addressInfoDesc = prometheus.NewDesc("network_interface_address_info",
+		"IP address configured on the network interface", []string{"interface", "address", "family", "scope"}, nil)
+	addressLifetimeDesc = prometheus.NewDesc("network_interface_address_valid_lifetime_seconds",
+		"Remaining valid lifetime of a dynamic address, e.g. of a DHCP lease or SLAAC", []string{"interface", "address"}, nil)
+	addressChangesDesc = prometheus.NewDesc("network_interface_address_changes_total",
+		"Number of times the set of addresses of the network interface changed", []string{"interface"}, nil)
+
+	// Result of the last address dump by interface, and the changes seen
+	addressSnapshot = struct {
+		sync.Mutex
+		byIface map[string][]ifaceAddress
+		changes map[string]uint64
+	}{
+		byIface: make(map[string][]ifaceAddress),
+		changes: make(map[string]uint64),
+	}
+)
+
+func init() {
+	registerCollector("address", "IPv4 and IPv6 addresses of the interfaces via rtnetlink", false, startAddressCollector)
+}
+
+// ifaceAddress is an address of an RTM_GETADDR dump
+type ifaceAddress struct {
+	prefix netip.Prefix
+	scope  string
+	// When a dynamic address expires, zero for permanent addresses
+	expires time.Time
+}
+
+// Names of the RT_SCOPE_* values as shown by ip address
+var addressScopes = map[uint8]string{
+	unix.RT_SCOPE_UNIVERSE: "global",
+	unix.RT_SCOPE_SITE:     "site",
+	unix.RT_SCOPE_LINK:     "link",
+	unix.RT_SCOPE_HOST:     "host",
+	unix.RT_SCOPE_NOWHERE:  "nowhere",
+}
+
+// readAddresses dumps the addresses of all interfaces, leaving out the
+// host scope addresses of the loopback interface
+func readAddresses(c *netlinkConn) (map[string][]ifaceAddress, error) {
+	names, err := linkNames(c)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, unix.SizeofIfAddrmsg)
+	req[0] = unix.AF_UNSPEC
+	replies, err := c.execute(unix.RTM_GETADDR, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	byIface := make(map[string][]ifaceAddress)
+	for _, reply := range replies {
+		if len(reply) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		// struct ifaddrmsg: family, prefixlen, flags, scope, index
+		prefixLen, scope := int(reply[1]), reply[3]
+		name, ok := names[binary.NativeEndian.Uint32(reply[4:8])]
+		if !ok || scope == unix.RT_SCOPE_HOST {
+			continue
+		}
+		attrs := nlAttrMap(reply[unix.SizeofIfAddrmsg:])
+		// IFA_LOCAL is the address of the interface, IFA_ADDRESS the peer
+		// on point-to-point links; IPv6 only has IFA_ADDRESS
+		raw := attrs[unix.IFA_LOCAL]
+		if raw == nil {
+			raw = attrs[unix.IFA_ADDRESS]
+		}
+		addr, ok := netip.AddrFromSlice(raw)
+		if !ok {
+			continue
+		}
+		a := ifaceAddress{prefix: netip.PrefixFrom(addr, prefixLen), scope: addressScopes[scope]}
+		if a.scope == "" {
+			a.scope = "unknown"
+		}
+		// struct ifa_cacheinfo: preferred, valid, cstamp, tstamp
+		if ci := attrs[unix.IFA_CACHEINFO]; len(ci) >= 8 {
+			if valid := binary.NativeEndian.Uint32(ci[4:8]); valid != math.MaxUint32 {
+				a.expires = time.Now().Add(time.Duration(valid) * time.Second)
+			}
+		}
+		byIface[name] = append(byIface[name], a)
+	}
+	for _, addrs := range byIface {
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].prefix.String() < addrs[j].prefix.String() })
+	}
+	return byIface, nil
+}
+
+// addressKey is the set of addresses of an interface, to detect changes
+func addressKey(addrs []ifaceAddress) string {
+	keys := make([]string, len(addrs))
+	for i, a := range addrs {
+		keys[i] = a.prefix.String()
+	}
+	return strings.Join(keys, " ")
+}
+
+// startAddressCollector opens the netlink socket for the address dumps
+func startAddressCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("address", addressCollector{})
+	go collectAddresses(c)
+	return nil
+}
+
+// collectAddresses periodically refreshes the address snapshot, counting the
+// interfaces whose addresses changed since the previous dump
+func collectAddresses(c *netlinkConn) {
+	first := true
+	for {
+		byIface, err := readAddresses(c)
+		if err != nil {
+			log.Printf("Error reading interface addresses: %v", err)
+		} else {
+			addressSnapshot.Lock()
+			if !first {
+				for name, addrs := range byIface {
+					if addressKey(addrs) != addressKey(addressSnapshot.byIface[name]) {
+						addressSnapshot.changes[name]++
+					}
+				}
+				for name := range addressSnapshot.byIface {
+					if _, ok := byIface[name]; !ok {
+						addressSnapshot.changes[name]++
+					}
+				}
+			}
+			addressSnapshot.byIface = byIface
+			addressSnapshot.Unlock()
+			first = false
+		}
+		time.Sleep(*addressInterval)
+	}
+}
+
+// forgetAddresses drops the change count of a removed interface
+func forgetAddresses(name string) {
+	addressSnapshot.Lock()
+	defer addressSnapshot.Unlock()
+	delete(addressSnapshot.changes, name)
+	delete(addressSnapshot.byIface, name)
+}
+
+// addressCollector exports the last address snapshot
+type addressCollector struct{}
+
+func (addressCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- addressInfoDesc
+	ch <- addressLifetimeDesc
+	ch <- addressChangesDesc
+}
+
+func (addressCollector) Collect(ch chan<- prometheus.Metric) {
+	addressSnapshot.Lock()
+	defer addressSnapshot.Unlock()
+	for name, addrs := range addressSnapshot.byIface {
+		for _, a := range addrs {
+			family := "ipv4"
+			if a.prefix.Addr().Is6() {
+				family = "ipv6"
+			}
+			address := a.prefix.String()
+			ch <- prometheus.MustNewConstMetric(addressInfoDesc, prometheus.GaugeValue, 1, name, address, family, a.scope)
+			if !a.expires.IsZero() {
+				ch <- prometheus.MustNewConstMetric(addressLifetimeDesc, prometheus.GaugeValue, max(time.Until(a.expires).Seconds(), 0), name, address)
+			}
+		}
+	}
+	for name, changes := range addressSnapshot.changes {
+		ch <- prometheus.MustNewConstMetric(addressChangesDesc, prometheus.CounterValue, float64(changes), name)
+	}
+}
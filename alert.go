@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Values of an interface the alert rules compare, by name; false while
+// unknown, e.g. the utilization without a link speed
+var alertMetrics = map[string]func(alertSample) (float64, bool){
+	"speed":          func(s alertSample) (float64, bool) { return s.rxSpeed + s.txSpeed, true },
+	"rx_speed":       func(s alertSample) (float64, bool) { return s.rxSpeed, true },
+	"tx_speed":       func(s alertSample) (float64, bool) { return s.txSpeed, true },
+	"utilization":    func(s alertSample) (float64, bool) { return s.utilization(max(s.rxSpeed, s.txSpeed)) },
+	"rx_utilization": func(s alertSample) (float64, bool) { return s.utilization(s.rxSpeed) },
+	"tx_utilization": func(s alertSample) (float64, bool) { return s.utilization(s.txSpeed) },
+	"errors":         func(s alertSample) (float64, bool) { return s.errors, s.hasRates },
+	"drops":          func(s alertSample) (float64, bool) { return s.drops, s.hasRates },
+}
+
+// Multipliers of the suffixes of speed thresholds, in bits per second
+var alertSpeedUnits = map[string]float64{"": 1, "k": 1e3, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12}
+
+// How often firing alerts are sent to Alertmanager again, as Prometheus does,
+// so they don't resolve by their end time
+const alertmanagerResendInterval = time.Minute
+
+// alertRule is a parsed --alert.rule, e.g. "uplink_busy: eth0 utilization > 90% for 5m"
+type alertRule struct {
+	name       string
+	condition  string
+	interfaces *regexp.Regexp
+	metric     string
+	op         string
+	threshold  float64
+	duration   time.Duration
+}
+
+// parseAlertRule parses "name: interface-regex metric op value [for duration]",
+// with "increasing" for "> 0"
+func parseAlertRule(s string) (*alertRule, error) {
+	name, rest, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || !model.LabelName(strings.TrimSpace(name)).IsValid() {
+		return nil, fmt.Errorf("invalid alert rule %q, expected name: interface metric op value [for duration]", s)
+	}
+	r := &alertRule{name: strings.TrimSpace(name)}
+	fields := strings.Fields(rest)
+	if n := len(fields); n >= 2 && fields[n-2] == "for" {
+		d, err := time.ParseDuration(fields[n-1])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %q in alert rule %s", fields[n-1], r.name)
+		}
+		r.duration, fields = d, fields[:n-2]
+	}
+	if len(fields) == 3 && fields[2] == "increasing" {
+		fields = append(fields[:2], ">", "0")
+	}
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid alert rule %q, expected name: interface metric op value [for duration]", s)
+	}
+	var err error
+	if r.interfaces, err = regexp.Compile("^(?:" + fields[0] + ")$"); err != nil {
+		return nil, fmt.Errorf("invalid interface pattern in alert rule %s: %w", r.name, err)
+	}
+	r.metric, r.op = fields[1], fields[2]
+	if _, ok := alertMetrics[r.metric]; !ok {
+		return nil, fmt.Errorf("unknown metric %q in alert rule %s, expected speed, rx_speed, tx_speed, utilization, rx_utilization, tx_utilization, errors or drops", r.metric, r.name)
+	}
+	switch r.op {
+	case ">", ">=", "<", "<=":
+	default:
+		return nil, fmt.Errorf("invalid operator %q in alert rule %s, expected >, >=, < or <=", r.op, r.name)
+	}
+	if r.threshold, err = parseAlertThreshold(r.metric, fields[3]); err != nil {
+		return nil, fmt.Errorf("invalid value in alert rule %s: %w", r.name, err)
+	}
+	r.condition = strings.Join(strings.Fields(rest), " ")
+	return r, nil
+}
+
+// parseAlertThreshold parses the value of a rule: a percentage for the
+// utilizations, bits per second with an optional k, M, G or T suffix for the
+// speeds and events per second for errors and drops
+func parseAlertThreshold(metric, s string) (float64, error) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(metric, "utilization"):
+		s = strings.TrimSuffix(s, "%")
+	case strings.HasSuffix(metric, "speed"):
+		if i := strings.IndexAny(s, "kKMGT"); i > 0 {
+			multiplier = alertSpeedUnits[s[i:]]
+			if multiplier == 0 {
+				return 0, fmt.Errorf("invalid speed %q", s)
+			}
+			s = s[:i]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v * multiplier, nil
+}
+
+// matches compares a value against the threshold of the rule
+func (r *alertRule) matches(v float64) bool {
+	switch r.op {
+	case ">":
+		return v > r.threshold
+	case ">=":
+		return v >= r.threshold
+	case "<":
+		return v < r.threshold
+	}
+	return v <= r.threshold
+}
+
+// formatValue formats a value of the metric of the rule for notifications
+func (r *alertRule) formatValue(v float64) string {
+	switch {
+	case strings.HasSuffix(r.metric, "utilization"):
+		return strconv.FormatFloat(v, 'f', 1, 64) + "%"
+	case strings.HasSuffix(r.metric, "speed"):
+		return formatBitRate(v)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64) + "/s"
+}
+
+// alertRulesFlag collects the rules of repeated or semicolon-separated
+// --alert.rule flags
+type alertRulesFlag []*alertRule
+
+func (a *alertRulesFlag) String() string {
+	rules := make([]string, len(*a))
+	for i, r := range *a {
+		rules[i] = r.name + ": " + r.condition
+	}
+	return strings.Join(rules, ";")
+}
+
+func (a *alertRulesFlag) Set(value string) error {
+	for _, rule := range strings.Split(value, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseAlertRule(rule)
+		if err != nil {
+			return err
+		}
+		*a = append(*a, r)
+	}
+	return nil
+}
+
+// alertWebhook is a destination of --alert.webhook
+type alertWebhook struct {
+	format, url string
+}
+
+// alertWebhooksFlag collects the destinations of repeated --alert.webhook
+// flags, as format=url or just the URL for generic JSON
+type alertWebhooksFlag []alertWebhook
+
+func (a *alertWebhooksFlag) String() string {
+	hooks := make([]string, len(*a))
+	for i, w := range *a {
+		hooks[i] = w.format + "=" + w.url
+	}
+	return strings.Join(hooks, ",")
+}
+
+func (a *alertWebhooksFlag) Set(value string) error {
+	w := alertWebhook{format: "json", url: value}
+	if format, u, ok := strings.Cut(value, "="); ok && !strings.Contains(format, "/") {
+		w.format, w.url = format, u
+	}
+	switch w.format {
+	case "json", "slack", "alertmanager":
+	default:
+		return fmt.Errorf("invalid webhook format %q, expected json, slack or alertmanager", w.format)
+	}
+	if u, err := url.Parse(w.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid webhook URL %q", w.url)
+	}
+	*a = append(*a, w)
+	return nil
+}
+
+// resendInterval is how often a firing alert is sent to the webhook again, 0
+// for never
+func (w alertWebhook) resendInterval() time.Duration {
+	if w.format == "alertmanager" {
+		return alertmanagerResendInterval
+	}
+	return *alertRepeatInterval
+}
+
+var (
+	alertRules          alertRulesFlag
+	alertWebhooks       alertWebhooksFlag
+	alertRepeatInterval = flag.Duration("alert.repeat-interval", 0, "How often a firing alert is sent to the json and slack webhooks again; 0 only notifies when it fires and resolves")
+
+	alertFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "exporter_alert_firing",
+			Help: "Whether the alert rule fires for the interface (1) or not (0)",
+		},
+		[]string{"rule", "interface"},
+	)
+	alertNotificationErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "exporter_alert_notification_errors_total",
+			Help: "Number of alert notifications that could not be sent to a webhook, by format",
+		},
+		[]string{"format"},
+	)
+
+	// Alerts pending or firing by rule and interface, and the counters of
+	// the previous cycle for the error and drop rates
+	alerts = struct {
+		sync.Mutex
+		active   map[alertKey]*alertInstance
+		previous map[string]interfaceStats
+	}{
+		active:   make(map[alertKey]*alertInstance),
+		previous: make(map[string]interfaceStats),
+	}
+
+	// Notifications on their way to the webhooks
+	alertQueue = make(chan alertNotification, 256)
+)
+
+func init() {
+	flag.Var(&alertRules, "alert.rule", `Alert rule as "name: interface-regex metric op value [for duration]", e.g. "uplink_busy: eth0 utilization > 90% for 5m" or "drops: eth.* drops increasing"; repeatable or semicolon-separated`)
+	flag.Var(&alertWebhooks, "alert.webhook", "Webhook to notify of firing and resolved alerts as format=url with format json, slack or alertmanager, or just the URL for json; repeatable")
+
+	if v := os.Getenv("ALERT_RULES"); v != "" {
+		if err := alertRules.Set(v); err != nil {
+			log.Fatalf("Invalid ALERT_RULES: %v", err)
+		}
+	}
+
+	registerMetrics("alert", alertFiring)
+	registerMetrics("alert", alertNotificationErrors)
+}
+
+type alertKey struct {
+	rule  int
+	iface string
+}
+
+// alertInstance is a rule matching an interface, pending until it has
+// matched for the duration of the rule
+type alertInstance struct {
+	since  time.Time
+	firing bool
+	value  float64
+	// When the alert was last sent to each webhook
+	sent []time.Time
+}
+
+// alertSample is what the rules of an interface are evaluated against
+type alertSample struct {
+	rxSpeed, txSpeed float64
+	linkSpeed        uint64
+	errors, drops    float64
+	hasRates         bool
+}
+
+// utilization returns a speed in percent of the link speed, if known
+func (s alertSample) utilization(speed float64) (float64, bool) {
+	if s.linkSpeed == 0 {
+		return 0, false
+	}
+	return speed / float64(s.linkSpeed) * 100, true
+}
+
+// alertNotification is a firing or resolved alert sent to a webhook
+type alertNotification struct {
+	webhook              alertWebhook
+	rule                 *alertRule
+	iface, status, value string
+	startsAt, resolvedAt time.Time
+}
+
+// validateAlertFlags checks that alert rules have somewhere to go
+func validateAlertFlags() error {
+	if len(alertRules) > 0 && len(alertWebhooks) == 0 {
+		return fmt.Errorf("--alert.rule requires --alert.webhook")
+	}
+	if *alertRepeatInterval < 0 {
+		return fmt.Errorf("invalid --alert.repeat-interval %s", *alertRepeatInterval)
+	}
+	return nil
+}
+
+// evaluateAlerts evaluates the rules against the interfaces of a collection
+// cycle, queueing notifications for the alerts that fire or resolve
+func evaluateAlerts(stats []interfaceStats, now time.Time) {
+	if len(alertRules) == 0 {
+		return
+	}
+	alerts.Lock()
+	defer alerts.Unlock()
+
+	seen := make(map[alertKey]bool)
+	present := make(map[string]bool, len(stats))
+	for _, s := range stats {
+		present[s.Name] = true
+		// A cycle without a speed, e.g. after a gap, leaves the alerts of
+		// the interface as they are
+		if !s.HasSpeed {
+			for key := range alerts.active {
+				if key.iface == s.Name {
+					seen[key] = true
+				}
+			}
+			continue
+		}
+		sample := alertSample{rxSpeed: s.RxSpeed, txSpeed: s.TxSpeed}
+		if prev, ok := alerts.previous[s.Name]; ok {
+			if elapsed := s.Time.Sub(prev.Time).Seconds(); elapsed > 0 {
+				sample.errors = float64(counterDelta(s.RxErrors+s.TxErrors, prev.RxErrors+prev.TxErrors)) / elapsed
+				sample.drops = float64(counterDelta(s.RxDrops+s.TxDrops, prev.RxDrops+prev.TxDrops)) / elapsed
+				sample.hasRates = true
+			}
+		}
+		alerts.previous[s.Name] = s
+
+		for i, r := range alertRules {
+			if !r.interfaces.MatchString(s.Name) {
+				continue
+			}
+			if strings.HasSuffix(r.metric, "utilization") && sample.linkSpeed == 0 {
+				sample.linkSpeed = linkSpeedBits(s.Name)
+			}
+			key := alertKey{i, s.Name}
+			v, ok := alertMetrics[r.metric](sample)
+			if !ok || !r.matches(v) {
+				continue
+			}
+			seen[key] = true
+			a, ok := alerts.active[key]
+			if !ok {
+				a = &alertInstance{since: now, sent: make([]time.Time, len(alertWebhooks))}
+				alerts.active[key] = a
+			}
+			a.value = v
+			if !a.firing && now.Sub(a.since) >= r.duration {
+				a.firing = true
+				alertFiring.WithLabelValues(r.name, s.Name).Set(1)
+			}
+			if a.firing {
+				for j, w := range alertWebhooks {
+					if d := w.resendInterval(); a.sent[j].IsZero() || (d > 0 && now.Sub(a.sent[j]) >= d) {
+						queueAlert(w, r, s.Name, "firing", a, time.Time{})
+						a.sent[j] = now
+					}
+				}
+			}
+		}
+	}
+
+	// Alerts that no longer match, including those of removed interfaces
+	for key, a := range alerts.active {
+		if seen[key] {
+			continue
+		}
+		delete(alerts.active, key)
+		if a.firing {
+			r := alertRules[key.rule]
+			if present[key.iface] {
+				alertFiring.WithLabelValues(r.name, key.iface).Set(0)
+			} else {
+				alertFiring.DeleteLabelValues(r.name, key.iface)
+			}
+			for _, w := range alertWebhooks {
+				queueAlert(w, r, key.iface, "resolved", a, now)
+			}
+		}
+	}
+	for name, prev := range alerts.previous {
+		if now.Sub(prev.Time) > *cleanupInterval {
+			delete(alerts.previous, name)
+		}
+	}
+}
+
+// queueAlert queues a notification without blocking the collection cycle
+func queueAlert(w alertWebhook, r *alertRule, iface, status string, a *alertInstance, resolvedAt time.Time) {
+	n := alertNotification{webhook: w, rule: r, iface: iface, status: status,
+		value: r.formatValue(a.value), startsAt: a.since.Add(r.duration), resolvedAt: resolvedAt}
+	select {
+	case alertQueue <- n:
+	default:
+		alertNotificationErrors.WithLabelValues(w.format).Inc()
+		log.Printf("Dropping %s notification of alert %s for %s, the webhooks are too slow", status, r.name, iface)
+	}
+}
+
+// sendAlerts sends the queued notifications to their webhooks
+func sendAlerts() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	hostname, _ := os.Hostname()
+	for n := range alertQueue {
+		if err := sendAlert(client, hostname, n); err != nil {
+			alertNotificationErrors.WithLabelValues(n.webhook.format).Inc()
+			log.Printf("Error sending alert %s for %s to %s: %v", n.rule.name, n.iface, n.webhook.url, err)
+		}
+	}
+}
+
+// sendAlert posts a notification in the format of its webhook
+func sendAlert(client *http.Client, hostname string, n alertNotification) error {
+	summary := fmt.Sprintf("[FIRING] %s on %s: %s is at %s (%s)", n.rule.name, hostname, n.iface, n.value, n.rule.condition)
+	if n.status == "resolved" {
+		summary = fmt.Sprintf("[RESOLVED] %s on %s: %s (%s)", n.rule.name, hostname, n.iface, n.rule.condition)
+	}
+	target := n.webhook.url
+	var payload any
+	switch n.webhook.format {
+	case "slack":
+		payload = map[string]string{"text": summary}
+	case "alertmanager":
+		labels := map[string]string{"alertname": n.rule.name, "interface": n.iface, "instance": hostname}
+		for k, v := range staticLabels {
+			labels[k] = v
+		}
+		// Firing alerts end unless sent again, as Prometheus does
+		endsAt := n.resolvedAt
+		if endsAt.IsZero() {
+			endsAt = time.Now().Add(4 * alertmanagerResendInterval)
+		}
+		payload = []map[string]any{{
+			"labels":      labels,
+			"annotations": map[string]string{"summary": summary, "condition": n.rule.condition, "value": n.value},
+			"startsAt":    n.startsAt.Format(time.RFC3339),
+			"endsAt":      endsAt.Format(time.RFC3339),
+		}}
+		target = strings.TrimSuffix(target, "/") + "/api/v2/alerts"
+	default:
+		alert := map[string]any{
+			"status":    n.status,
+			"rule":      n.rule.name,
+			"condition": n.rule.condition,
+			"interface": n.iface,
+			"value":     n.value,
+			"hostname":  hostname,
+			"labels":    staticLabels,
+			"starts_at": n.startsAt.Format(time.RFC3339),
+		}
+		if !n.resolvedAt.IsZero() {
+			alert["ends_at"] = n.resolvedAt.Format(time.RFC3339)
+		}
+		payload = alert
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Baseline samples are the average rate over 1 minute intervals
+const anomalySampleInterval = time.Minute
+
+// Minimum standard deviation the score divides by, as a fraction of the
+// mean and in bits per second, so that nearly constant or idle traffic
+// doesn't turn every small change into a large score
+const (
+	anomalyMinRelativeStddev = 0.1
+	anomalyMinStddev         = 1e3
+)
+
+var (
+	anomalySeason  = flag.String("anomaly.season", "", "Season of the traffic baseline of the anomaly score: week, one baseline per hour of the week, or day, per hour of the day; empty disables")
+	anomalyHistory = flag.Int("anomaly.history", 4, "Number of past seasons the baseline mostly reflects; older ones fade out exponentially")
+
+	networkAnomalyScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_traffic_anomaly_score",
+			Help: "Deviation of the speed of the last minute from the baseline of the hour in standard deviations, negative below the baseline",
+		},
+		[]string{"interface", "direction"},
+	)
+	networkBaseline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_traffic_baseline_bits",
+			Help: "Mean speed of the hour of the season in bits per second, as learned by the anomaly score",
+		},
+		[]string{"interface", "direction"},
+	)
+	networkBaselineStddev = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_traffic_baseline_stddev_bits",
+			Help: "Standard deviation of the speed of the hour of the season in bits per second, as learned by the anomaly score",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	// Baselines and open intervals per interface
+	anomalies = struct {
+		sync.Mutex
+		byIface map[string]*anomalyState
+	}{
+		byIface: make(map[string]*anomalyState),
+	}
+)
+
+func init() {
+	registerMetrics("anomaly", networkAnomalyScore)
+	registerMetrics("anomaly", networkBaseline)
+	registerMetrics("anomaly", networkBaselineStddev)
+}
+
+// anomalySlot is the exponentially weighted mean and variance of the speed in
+// one hour of the season
+type anomalySlot struct {
+	Mean     float64 `json:"m"`
+	Variance float64 `json:"v"`
+	Count    int     `json:"n"`
+}
+
+// anomalyBaseline is the persisted baseline of an interface, a slot per hour
+// of the season and direction
+type anomalyBaseline struct {
+	Season string        `json:"season"`
+	Rx     []anomalySlot `json:"rx"`
+	Tx     []anomalySlot `json:"tx"`
+}
+
+// anomalyState tracks the open interval and the baseline of an interface
+type anomalyState struct {
+	start            time.Time
+	startRx, startTx uint64
+	baseline         *anomalyBaseline
+}
+
+// validateAnomalyFlags checks the --anomaly.season and --anomaly.history flags
+func validateAnomalyFlags() error {
+	switch *anomalySeason {
+	case "", "week", "day":
+	default:
+		return fmt.Errorf("invalid --anomaly.season %q, expected week or day", *anomalySeason)
+	}
+	if *anomalyHistory < 1 {
+		return fmt.Errorf("invalid --anomaly.history %d, expected at least 1", *anomalyHistory)
+	}
+	return nil
+}
+
+// anomalySlots returns the number of slots of the season
+func anomalySlots() int {
+	if *anomalySeason == "week" {
+		return 7 * 24
+	}
+	return 24
+}
+
+// anomalySlotOf returns the slot of a time, its hour of the week or day in
+// local time
+func anomalySlotOf(t time.Time) int {
+	t = t.Local()
+	if *anomalySeason == "week" {
+		return int(t.Weekday())*24 + t.Hour()
+	}
+	return t.Hour()
+}
+
+func newAnomalyBaseline() *anomalyBaseline {
+	return &anomalyBaseline{
+		Season: *anomalySeason,
+		Rx:     make([]anomalySlot, anomalySlots()),
+		Tx:     make([]anomalySlot, anomalySlots()),
+	}
+}
+
+// score returns how many standard deviations v is from the mean of the
+// slot, false until the slot has seen a full hour
+func (s *anomalySlot) score(v float64) (float64, bool) {
+	if s.Count < int(time.Hour/anomalySampleInterval) {
+		return 0, false
+	}
+	stddev := math.Max(math.Sqrt(s.Variance), math.Max(anomalyMinRelativeStddev*s.Mean, anomalyMinStddev))
+	return (v - s.Mean) / stddev, true
+}
+
+// add folds a sample into the slot. The first samples are averaged equally;
+// after as many as the slot gets in --anomaly.history seasons, each new one
+// weighs as much as that share.
+func (s *anomalySlot) add(v float64) {
+	n := *anomalyHistory * int(time.Hour/anomalySampleInterval)
+	s.Count++
+	alpha := 1 / float64(min(s.Count, n))
+	diff := v - s.Mean
+	s.Mean += alpha * diff
+	s.Variance = (1 - alpha) * (s.Variance + alpha*diff*diff)
+}
+
+// updateAnomalies closes finished 1 minute intervals, scores their average
+// speed against the baseline of their hour and then adds it to the baseline
+func updateAnomalies(stats []interfaceStats) {
+	if *anomalySeason == "" {
+		return
+	}
+	anomalies.Lock()
+	defer anomalies.Unlock()
+
+	for _, s := range stats {
+		interval := s.Time.Truncate(anomalySampleInterval)
+		st, ok := anomalies.byIface[s.Name]
+		if !ok {
+			st = &anomalyState{}
+			anomalies.byIface[s.Name] = st
+		}
+		if st.baseline == nil {
+			st.baseline = newAnomalyBaseline()
+		}
+		if st.start.IsZero() {
+			st.start, st.startRx, st.startTx = s.Time, s.RxBytes, s.TxBytes
+			continue
+		}
+		if !interval.After(st.start) {
+			continue
+		}
+
+		elapsed := s.Time.Sub(st.start).Seconds()
+		slot := anomalySlotOf(st.start)
+		speeds := []float64{
+			float64(counterDelta(s.RxBytes, st.startRx)) * bytesToBits / elapsed,
+			float64(counterDelta(s.TxBytes, st.startTx)) * bytesToBits / elapsed,
+		}
+		// After a gap, e.g. a suspend, the average spans more than an
+		// interval and is left out
+		if elapsed <= 2*anomalySampleInterval.Seconds() {
+			for i, slots := range [][]anomalySlot{st.baseline.Rx, st.baseline.Tx} {
+				labels := prometheus.Labels{"interface": s.Name, "direction": []string{"receive", "transmit"}[i]}
+				if score, ok := slots[slot].score(speeds[i]); ok {
+					networkAnomalyScore.With(labels).Set(score)
+				} else {
+					networkAnomalyScore.Delete(labels)
+				}
+				slots[slot].add(speeds[i])
+				networkBaseline.With(labels).Set(slots[slot].Mean)
+				networkBaselineStddev.With(labels).Set(math.Sqrt(slots[slot].Variance))
+			}
+		}
+		st.start, st.startRx, st.startTx = s.Time, s.RxBytes, s.TxBytes
+	}
+}
+
+// forgetAnomalies drops the state and the series of a removed interface. Its
+// baseline goes too and is left out of the next accounting file.
+func forgetAnomalies(name string) {
+	anomalies.Lock()
+	defer anomalies.Unlock()
+	delete(anomalies.byIface, name)
+	labels := prometheus.Labels{"interface": name}
+	networkAnomalyScore.DeletePartialMatch(labels)
+	networkBaseline.DeletePartialMatch(labels)
+	networkBaselineStddev.DeletePartialMatch(labels)
+}
+
+// anomalySnapshot returns a copy of the baselines for persisting
+func anomalySnapshot() map[string]*anomalyBaseline {
+	anomalies.Lock()
+	defer anomalies.Unlock()
+	snapshot := make(map[string]*anomalyBaseline, len(anomalies.byIface))
+	for name, st := range anomalies.byIface {
+		if st.baseline != nil {
+			b := *st.baseline
+			b.Rx = append([]anomalySlot(nil), b.Rx...)
+			b.Tx = append([]anomalySlot(nil), b.Tx...)
+			snapshot[name] = &b
+		}
+	}
+	return snapshot
+}
+
+// restoreAnomalies loads persisted baselines, dropping those learned for
+// another season; the open interval starts fresh
+func restoreAnomalies(baselines map[string]*anomalyBaseline) {
+	anomalies.Lock()
+	defer anomalies.Unlock()
+	for name, b := range baselines {
+		if b.Season != *anomalySeason || len(b.Rx) != anomalySlots() || len(b.Tx) != anomalySlots() {
+			continue
+		}
+		anomalies.byIface[name] = &anomalyState{baseline: b}
+	}
+}
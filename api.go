@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// interfacesResponse is the document returned by /api/v1/interfaces
+type interfacesResponse struct {
+	Timestamp  int64           `json:"timestamp"`
+	Interfaces []interfaceJSON `json:"interfaces"`
+}
+
+// apiInterfaceJSON adds the metadata only served by the API
+func apiInterfaceJSON(s interfaceStats) interfaceJSON {
+	j := interfaceToJSON(s)
+	j.LinkSpeedBits = linkSpeedBits(s.Name)
+	return j
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleInterfaces serves the current stats of all interfaces
+func handleInterfaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := currentStats()
+	resp := interfacesResponse{
+		Timestamp:  time.Now().Unix(),
+		Interfaces: make([]interfaceJSON, 0, len(stats)),
+	}
+	for _, s := range stats {
+		resp.Interfaces = append(resp.Interfaces, apiInterfaceJSON(s))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInterface serves the current stats of the interface named in the path
+func handleInterface(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/interfaces/")
+	if name == "" {
+		handleInterfaces(w, r)
+		return
+	}
+	for _, s := range currentStats() {
+		if s.Name == name {
+			writeJSON(w, http.StatusOK, apiInterfaceJSON(s))
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "interface not found"})
+}
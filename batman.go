@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var batmanInterval = flag.Duration("batman.interval", 15*time.Second, "How often to read the originators and neighbors of the batman-adv mesh interfaces")
+
+// Generic netlink family, commands and attributes, from linux/batman_adv.h
+const (
+	batmanFamily            = "batadv"
+	batmanCmdGetMesh        = 1
+	batmanCmdGetHardif      = 5
+	batmanCmdGetOriginators = 8
+	batmanCmdGetNeighbors   = 9
+	batmanAttrAlgoName      = 2
+	batmanAttrMeshIfindex   = 3
+	batmanAttrHardIfindex   = 6
+	batmanAttrHardIfname    = 7
+	batmanAttrOrigAddress   = 9
+	batmanAttrActive        = 15
+	batmanAttrFlagBest      = 22
+	batmanAttrLastSeenMsecs = 23
+	batmanAttrNeighAddress  = 24
+	batmanAttrTQ            = 25
+	batmanAttrThroughput    = 26
+)
+
+// Unit of BATADV_ATTR_THROUGHPUT, 100 kbit/s
+const batmanThroughputUnit = 100e3
+
+var (
+	batmanMeshDesc = prometheus.NewDesc("network_batman_mesh_info",
+		"batman-adv mesh interface and its routing algorithm", []string{"interface", "algorithm"}, nil)
+	batmanOriginatorsDesc = prometheus.NewDesc("network_batman_originators",
+		"Number of originators, mesh nodes, the mesh interface has a route to", []string{"interface"}, nil)
+	batmanHardInterfaceDesc = prometheus.NewDesc("network_batman_hard_interface_active",
+		"1 if the hard interface of the mesh interface is active, 0 otherwise", []string{"interface", "hard_interface"}, nil)
+	batmanNeighborTQDesc = prometheus.NewDesc("network_batman_neighbor_tq",
+		"Transmit quality to the direct neighbor from 0 to 255, with B.A.T.M.A.N. IV", []string{"interface", "hard_interface", "neighbor"}, nil)
+	batmanNeighborThroughputDesc = prometheus.NewDesc("network_batman_neighbor_throughput_bits",
+		"Estimated throughput to the direct neighbor in bits per second, with B.A.T.M.A.N. V", []string{"interface", "hard_interface", "neighbor"}, nil)
+	batmanNeighborLastSeenDesc = prometheus.NewDesc("network_batman_neighbor_last_seen_seconds",
+		"Seconds since the last packet of the direct neighbor", []string{"interface", "hard_interface", "neighbor"}, nil)
+
+	// Result of the last batman-adv dump
+	batmanSnapshot struct {
+		sync.Mutex
+		meshes []batmanMesh
+	}
+)
+
+func init() {
+	registerCollector("batman", "batman-adv mesh originators and neighbor link quality via generic netlink", false, startBatmanCollector)
+}
+
+type batmanMesh struct {
+	iface, algorithm string
+	originators      int
+	hardIfaces       map[string]bool
+	neighbors        map[batmanNeighborKey]*batmanNeighbor
+}
+
+type batmanNeighborKey struct{ hardIface, address string }
+
+type batmanNeighbor struct {
+	lastSeen time.Duration
+	// Transmit quality with IV, throughput with V
+	tq, throughput       float64
+	hasTQ, hasThroughput bool
+}
+
+// readBatmanMesh reads the hard interfaces, originators and neighbors of a
+// mesh interface
+func readBatmanMesh(c *genlConn, index uint32, name string) (batmanMesh, error) {
+	m := batmanMesh{iface: name, hardIfaces: make(map[string]bool), neighbors: make(map[batmanNeighborKey]*batmanNeighbor)}
+	meshAttr := nlAttrU32(batmanAttrMeshIfindex, index)
+
+	replies, err := c.execute(batmanCmdGetMesh, 0, meshAttr)
+	if err != nil {
+		return m, err
+	}
+	for _, reply := range replies {
+		m.algorithm = nlString(nlAttrMap(reply)[batmanAttrAlgoName])
+	}
+
+	// Names of the hard interfaces by index, as the other dumps only have
+	// the index
+	hardNames := make(map[uint32]string)
+	if replies, err = c.execute(batmanCmdGetHardif, unix.NLM_F_DUMP, meshAttr); err != nil {
+		return m, err
+	}
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		hardIndex, _ := nlUint(attrs[batmanAttrHardIfindex])
+		hardName := nlString(attrs[batmanAttrHardIfname])
+		hardNames[uint32(hardIndex)] = hardName
+		_, active := attrs[batmanAttrActive]
+		m.hardIfaces[hardName] = active
+	}
+	neighbor := func(attrs map[uint16][]byte) *batmanNeighbor {
+		hardIndex, _ := nlUint(attrs[batmanAttrHardIfindex])
+		key := batmanNeighborKey{hardNames[uint32(hardIndex)], net.HardwareAddr(attrs[batmanAttrNeighAddress]).String()}
+		if n, ok := m.neighbors[key]; ok {
+			return n
+		}
+		n := &batmanNeighbor{}
+		if msecs, ok := nlUint(attrs[batmanAttrLastSeenMsecs]); ok {
+			n.lastSeen = time.Duration(msecs) * time.Millisecond
+		}
+		m.neighbors[key] = n
+		return n
+	}
+
+	if replies, err = c.execute(batmanCmdGetNeighbors, unix.NLM_F_DUMP, meshAttr); err != nil {
+		return m, err
+	}
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		n := neighbor(attrs)
+		if v, ok := nlUint(attrs[batmanAttrThroughput]); ok {
+			n.throughput, n.hasThroughput = float64(v)*batmanThroughputUnit, true
+		}
+	}
+
+	// An entry per originator and next hop; the best one is the route. With
+	// IV, the entries of the direct neighbors as originators have their TQ.
+	if replies, err = c.execute(batmanCmdGetOriginators, unix.NLM_F_DUMP, meshAttr); err != nil {
+		return m, err
+	}
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		if _, best := attrs[batmanAttrFlagBest]; best {
+			m.originators++
+		}
+		tq, ok := nlUint(attrs[batmanAttrTQ])
+		if !ok || string(attrs[batmanAttrOrigAddress]) != string(attrs[batmanAttrNeighAddress]) {
+			continue
+		}
+		n := neighbor(attrs)
+		n.tq, n.hasTQ = float64(tq), true
+	}
+	return m, nil
+}
+
+// readBatmanMeshes reads all batman-adv mesh interfaces
+func readBatmanMeshes(rt *netlinkConn, c *genlConn) ([]batmanMesh, error) {
+	links, err := dumpLinks(rt)
+	if err != nil {
+		return nil, err
+	}
+	var meshes []batmanMesh
+	for _, l := range links {
+		if l.kind() != "batadv" {
+			continue
+		}
+		m, err := readBatmanMesh(c, l.index, nlString(l.attrs[unix.IFLA_IFNAME]))
+		if err != nil {
+			return nil, err
+		}
+		meshes = append(meshes, m)
+	}
+	return meshes, nil
+}
+
+// startBatmanCollector opens the netlink socket for the link dumps
+func startBatmanCollector() error {
+	rt, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("batman", batmanCollector{})
+	go collectBatman(rt)
+	return nil
+}
+
+// collectBatman periodically refreshes the batman-adv snapshot. The family
+// appears once the batman-adv module is loaded, with the first mesh
+// interface.
+func collectBatman(rt *netlinkConn) {
+	var c *genlConn
+	for {
+		var meshes []batmanMesh
+		if c == nil {
+			c, _ = dialGenetlink(batmanFamily)
+		}
+		if c != nil {
+			var err error
+			if meshes, err = readBatmanMeshes(rt, c); err != nil {
+				log.Printf("Error reading batman-adv mesh interfaces: %v", err)
+				c.Close()
+				c = nil
+			}
+		}
+		batmanSnapshot.Lock()
+		batmanSnapshot.meshes = meshes
+		batmanSnapshot.Unlock()
+		time.Sleep(*batmanInterval)
+	}
+}
+
+// batmanCollector exports the last batman-adv snapshot
+type batmanCollector struct{}
+
+func (batmanCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- batmanMeshDesc
+	ch <- batmanOriginatorsDesc
+	ch <- batmanHardInterfaceDesc
+	ch <- batmanNeighborTQDesc
+	ch <- batmanNeighborThroughputDesc
+	ch <- batmanNeighborLastSeenDesc
+}
+
+func (batmanCollector) Collect(ch chan<- prometheus.Metric) {
+	batmanSnapshot.Lock()
+	defer batmanSnapshot.Unlock()
+	for _, m := range batmanSnapshot.meshes {
+		ch <- prometheus.MustNewConstMetric(batmanMeshDesc, prometheus.GaugeValue, 1, m.iface, m.algorithm)
+		ch <- prometheus.MustNewConstMetric(batmanOriginatorsDesc, prometheus.GaugeValue, float64(m.originators), m.iface)
+		for hardIface, active := range m.hardIfaces {
+			ch <- prometheus.MustNewConstMetric(batmanHardInterfaceDesc, prometheus.GaugeValue, boolToFloat(active), m.iface, hardIface)
+		}
+		for k, n := range m.neighbors {
+			ch <- prometheus.MustNewConstMetric(batmanNeighborLastSeenDesc, prometheus.GaugeValue, n.lastSeen.Seconds(), m.iface, k.hardIface, k.address)
+			if n.hasTQ {
+				ch <- prometheus.MustNewConstMetric(batmanNeighborTQDesc, prometheus.GaugeValue, n.tq, m.iface, k.hardIface, k.address)
+			}
+			if n.hasThroughput {
+				ch <- prometheus.MustNewConstMetric(batmanNeighborThroughputDesc, prometheus.GaugeValue, n.throughput, m.iface, k.hardIface, k.address)
+			}
+		}
+	}
+}
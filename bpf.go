@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Minimal eBPF loader built directly on the bpf(2) syscall. The programs used
+// by the exporter are tiny and hand-assembled, which avoids pulling in a
+// compiler toolchain or a full eBPF library.
+
+// Instruction classes, sizes and operations used by the hand-written programs
+const (
+	bpfLdImmDW   = unix.BPF_LD | unix.BPF_IMM | unix.BPF_DW
+	bpfLdAbsB    = unix.BPF_LD | unix.BPF_ABS | unix.BPF_B
+	bpfLdAbsH    = unix.BPF_LD | unix.BPF_ABS | unix.BPF_H
+	bpfLdIndB    = unix.BPF_LD | unix.BPF_IND | unix.BPF_B
+	bpfLdIndH    = unix.BPF_LD | unix.BPF_IND | unix.BPF_H
+	bpfLdxMemW   = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfStMemW    = unix.BPF_ST | unix.BPF_MEM | unix.BPF_W
+	bpfStxMemW   = unix.BPF_STX | unix.BPF_MEM | unix.BPF_W
+	bpfStxXaddDW = unix.BPF_STX | unix.BPF_XADD | unix.BPF_DW
+	bpfMov64Reg  = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	bpfMov64Imm  = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	bpfAdd64Imm  = unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_K
+	bpfAdd64Reg  = unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_X
+	bpfSub64Reg  = unix.BPF_ALU64 | unix.BPF_SUB | unix.BPF_X
+	bpfAnd64Imm  = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+	bpfLsh64Imm  = unix.BPF_ALU64 | unix.BPF_LSH | unix.BPF_K
+	bpfRsh64Imm  = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+	bpfJa        = unix.BPF_JMP | unix.BPF_JA
+	bpfJeqImm    = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJneImm    = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	bpfCall      = unix.BPF_JMP | unix.BPF_CALL
+	bpfExit      = unix.BPF_JMP | unix.BPF_EXIT
+
+	// Helper function IDs
+	bpfFuncMapLookupElem = 1
+)
+
+// Registers
+const (
+	bpfR0 = iota
+	bpfR1
+	bpfR2
+	bpfR3
+	bpfR4
+	bpfR5
+	bpfR6
+	bpfR7
+	bpfR8
+	bpfR9
+	bpfR10
+)
+
+// bpfInsn mirrors struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// ldMapFd loads a map file descriptor into dst; it occupies two instruction slots
+func ldMapFd(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{
+		insn(bpfLdImmDW, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd)),
+		insn(0, 0, 0, 0, 0),
+	}
+}
+
+// mapAdd emits code that adds the value in register val to the u64 stored in
+// array map fd at the given key. Clobbers r0-r5.
+func mapAdd(fd int, key int32, val uint8) []bpfInsn {
+	return mapAddAt(fd, insn(bpfStMemW, bpfR10, 0, -4, key), val)
+}
+
+// mapAddReg is mapAdd with the key taken from register key
+func mapAddReg(fd int, key, val uint8) []bpfInsn {
+	return mapAddAt(fd, insn(bpfStxMemW, bpfR10, key, -4, 0), val)
+}
+
+// mapAddAt emits mapAdd with storeKey writing the key to the stack at r10-4
+func mapAddAt(fd int, storeKey bpfInsn, val uint8) []bpfInsn {
+	prog := []bpfInsn{storeKey}
+	prog = append(prog, ldMapFd(bpfR1, fd)...)
+	return append(prog,
+		insn(bpfMov64Reg, bpfR2, bpfR10, 0, 0),
+		insn(bpfAdd64Imm, bpfR2, 0, 0, -4),
+		insn(bpfCall, 0, 0, 0, bpfFuncMapLookupElem),
+		insn(bpfJeqImm, bpfR0, 0, 1, 0),
+		insn(bpfStxXaddDW, bpfR0, val, 0, 0),
+	)
+}
+
+// bpfAsm assembles a program with jumps to labels, for programs too long to
+// count jump offsets by hand
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(insns ...bpfInsn) {
+	a.insns = append(a.insns, insns...)
+}
+
+// label marks the position of the next instruction
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// jump emits a jump instruction to a label, comparing dst against imm for
+// conditional jumps
+func (a *bpfAsm) jump(code, dst uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(insn(code, dst, 0, 0, imm))
+}
+
+// program resolves the jumps and returns the instructions
+func (a *bpfAsm) program() []bpfInsn {
+	for at, label := range a.jumps {
+		target, ok := a.labels[label]
+		if !ok {
+			panic("undefined BPF label " + label)
+		}
+		a.insns[at].off = int16(target - at - 1)
+	}
+	return a.insns
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// bpfCreateArrayMap creates a BPF_MAP_TYPE_ARRAY of u64 values with u32 keys
+func bpfCreateArrayMap(entries uint32) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{
+		mapType:    unix.BPF_MAP_TYPE_ARRAY,
+		keySize:    4,
+		valueSize:  8,
+		maxEntries: entries,
+	}
+	fd, err := bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("creating BPF map: %w", err)
+	}
+	return fd, nil
+}
+
+// bpfLookupU64 reads the u64 value at key from an array map
+func bpfLookupU64(fd int, key uint32) (uint64, error) {
+	var value uint64
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{
+		mapFd: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpfSyscall(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	return value, err
+}
+
+// bpfLoadProgram loads the instructions as a program of the given type and
+// returns its file descriptor. The verifier log is included in the error.
+func bpfLoadProgram(progType uint32, insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: progType,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if err != nil {
+		verifierLog := strings.TrimRight(string(logBuf), "\x00")
+		return -1, fmt.Errorf("loading BPF program: %w: %s", err, strings.TrimSpace(verifierLog))
+	}
+	return fd, nil
+}
+
+// bpfLinkCreate attaches a program to target and returns the link file
+// descriptor. The attachment is released when the link fd is closed.
+func bpfLinkCreate(progFd, targetFd int, attachType uint32) (int, error) {
+	attr := struct {
+		progFd     uint32
+		targetFd   uint32
+		attachType uint32
+		flags      uint32
+	}{
+		progFd:     uint32(progFd),
+		targetFd:   uint32(targetFd),
+		attachType: attachType,
+	}
+	fd, err := bpfSyscall(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("attaching BPF program: %w", err)
+	}
+	return fd, nil
+}
+
+// Offsets in struct bpf_prog_info of the fields read by bpfProgramInfo, and
+// its size up to them
+const (
+	bpfProgInfoName      = 64
+	bpfProgInfoRunTimeNs = 192
+	bpfProgInfoRunCnt    = 200
+	sizeofBpfProgInfo    = 208
+)
+
+// bpfProgram is what bpfProgramInfo reads of a loaded program. The run
+// statistics are only counted with the sysctl kernel.bpf_stats_enabled.
+type bpfProgram struct {
+	name          string
+	runTime       uint64 // nanoseconds
+	runCount      uint64
+	hasRunCounter bool
+}
+
+// bpfProgramInfo reads the name and run statistics of a loaded program by
+// its ID, which needs CAP_SYS_ADMIN
+func bpfProgramInfo(id uint32) (bpfProgram, error) {
+	getFd := struct {
+		progID    uint32
+		nextID    uint32
+		openFlags uint32
+	}{progID: id}
+	fd, err := bpfSyscall(unix.BPF_PROG_GET_FD_BY_ID, unsafe.Pointer(&getFd), unsafe.Sizeof(getFd))
+	if err != nil {
+		return bpfProgram{}, fmt.Errorf("opening BPF program %d: %w", id, err)
+	}
+	defer unix.Close(fd)
+
+	info := make([]byte, sizeofBpfProgInfo)
+	attr := struct {
+		bpfFd   uint32
+		infoLen uint32
+		info    uint64
+	}{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(len(info)),
+		info:    uint64(uintptr(unsafe.Pointer(&info[0]))),
+	}
+	_, err = bpfSyscall(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(info)
+	if err != nil {
+		return bpfProgram{}, fmt.Errorf("reading BPF program %d: %w", id, err)
+	}
+	// Older kernels fill in less and report the length they know
+	p := bpfProgram{name: nlString(info[bpfProgInfoName : bpfProgInfoName+unix.BPF_OBJ_NAME_LEN])}
+	if attr.infoLen >= sizeofBpfProgInfo {
+		p.runTime = binary.NativeEndian.Uint64(info[bpfProgInfoRunTimeNs:])
+		p.runCount = binary.NativeEndian.Uint64(info[bpfProgInfoRunCnt:])
+		p.hasRunCounter = true
+	}
+	return p, nil
+}
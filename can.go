@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var canInterval = flag.Duration("can.interval", 15*time.Second, "How often to read the CAN controller state and error statistics")
+
+// Names of the CAN_STATE_* controller states
+var canStates = []string{"error-active", "error-warning", "error-passive", "bus-off", "stopped", "sleeping"}
+
+var (
+	canStateDesc = prometheus.NewDesc("network_can_state",
+		"1 for the current state of the CAN controller, 0 for the others", []string{"interface", "state"}, nil)
+	canBusErrorsDesc = prometheus.NewDesc("network_can_bus_errors_total",
+		"Bus errors detected by the CAN controller", []string{"interface"}, nil)
+	canStateTransitionsDesc = prometheus.NewDesc("network_can_state_transitions_total",
+		"Transitions of the CAN controller to the error-warning, error-passive or bus-off state", []string{"interface", "state"}, nil)
+	canArbitrationLostDesc = prometheus.NewDesc("network_can_arbitration_lost_total",
+		"Frames the CAN controller lost the bus arbitration for", []string{"interface"}, nil)
+	canRestartsDesc = prometheus.NewDesc("network_can_restarts_total",
+		"Restarts of the CAN controller after bus-off", []string{"interface"}, nil)
+	canErrorCounterDesc = prometheus.NewDesc("network_can_error_counter",
+		"Current receive or transmit error counter (REC/TEC) of the CAN controller", []string{"interface", "direction"}, nil)
+	canBitrateDesc = prometheus.NewDesc("network_can_bitrate_bits",
+		"Configured bitrate of the CAN bus in bits per second", []string{"interface"}, nil)
+
+	// Result of the last link dump by interface name
+	canSnapshot struct {
+		sync.Mutex
+		byIface map[string]canController
+	}
+)
+
+func init() {
+	registerCollector("can", "CAN bus controller state, bus errors and restarts via rtnetlink", false, startCANCollector)
+}
+
+type canController struct {
+	state        string
+	hasStats     bool
+	busErrors    uint32
+	errorWarning uint32
+	errorPassive uint32
+	busOff       uint32
+	arbitration  uint32
+	restarts     uint32
+	hasBerr      bool
+	rxErr, txErr uint16
+	bitrate      uint32
+}
+
+// parseCAN decodes the CAN link data and struct can_device_stats of a link
+func parseCAN(l rtLink) canController {
+	info := nlAttrMap(l.attrs[unix.IFLA_LINKINFO])
+	data := nlAttrMap(info[unix.IFLA_INFO_DATA])
+	var c canController
+	if state, ok := nlUint(data[unix.IFLA_CAN_STATE]); ok && state < uint64(len(canStates)) {
+		c.state = canStates[state]
+	}
+	// struct can_berr_counter: txerr, rxerr
+	if b := data[unix.IFLA_CAN_BERR_COUNTER]; len(b) >= 4 {
+		c.hasBerr = true
+		c.txErr = binary.NativeEndian.Uint16(b[0:2])
+		c.rxErr = binary.NativeEndian.Uint16(b[2:4])
+	}
+	// struct can_bittiming starts with the bitrate
+	if b := data[unix.IFLA_CAN_BITTIMING]; len(b) >= 4 {
+		c.bitrate = binary.NativeEndian.Uint32(b[0:4])
+	}
+	// struct can_device_stats: bus_error, error_warning, error_passive,
+	// bus_off, arbitration_lost, restarts
+	if b := info[unix.IFLA_INFO_XSTATS]; len(b) >= 24 {
+		c.hasStats = true
+		c.busErrors = binary.NativeEndian.Uint32(b[0:4])
+		c.errorWarning = binary.NativeEndian.Uint32(b[4:8])
+		c.errorPassive = binary.NativeEndian.Uint32(b[8:12])
+		c.busOff = binary.NativeEndian.Uint32(b[12:16])
+		c.arbitration = binary.NativeEndian.Uint32(b[16:20])
+		c.restarts = binary.NativeEndian.Uint32(b[20:24])
+	}
+	return c
+}
+
+// readCANControllers dumps the links and decodes those of CAN controllers
+func readCANControllers(c *netlinkConn) (map[string]canController, error) {
+	links, err := dumpLinks(c)
+	if err != nil {
+		return nil, err
+	}
+	byIface := make(map[string]canController)
+	for _, l := range links {
+		// vcan and vxcan have no controller, only the generic statistics
+		if l.kind() == "can" {
+			byIface[nlString(l.attrs[unix.IFLA_IFNAME])] = parseCAN(l)
+		}
+	}
+	return byIface, nil
+}
+
+// startCANCollector starts reading the CAN controllers
+func startCANCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("can", canCollector{})
+	go collectCAN(c)
+	return nil
+}
+
+// collectCAN periodically refreshes the CAN snapshot
+func collectCAN(c *netlinkConn) {
+	for {
+		byIface, err := readCANControllers(c)
+		if err != nil {
+			log.Printf("Error reading CAN interfaces: %v", err)
+		} else {
+			canSnapshot.Lock()
+			canSnapshot.byIface = byIface
+			canSnapshot.Unlock()
+		}
+		time.Sleep(*canInterval)
+	}
+}
+
+// canCollector exports the last CAN snapshot
+type canCollector struct{}
+
+func (canCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- canStateDesc
+	ch <- canBusErrorsDesc
+	ch <- canStateTransitionsDesc
+	ch <- canArbitrationLostDesc
+	ch <- canRestartsDesc
+	ch <- canErrorCounterDesc
+	ch <- canBitrateDesc
+}
+
+func (canCollector) Collect(ch chan<- prometheus.Metric) {
+	canSnapshot.Lock()
+	defer canSnapshot.Unlock()
+	for name, c := range canSnapshot.byIface {
+		if c.state != "" {
+			for _, state := range canStates {
+				ch <- prometheus.MustNewConstMetric(canStateDesc, prometheus.GaugeValue, boolToFloat(state == c.state), name, state)
+			}
+		}
+		if c.hasStats {
+			ch <- prometheus.MustNewConstMetric(canBusErrorsDesc, prometheus.CounterValue, float64(c.busErrors), name)
+			ch <- prometheus.MustNewConstMetric(canStateTransitionsDesc, prometheus.CounterValue, float64(c.errorWarning), name, "error-warning")
+			ch <- prometheus.MustNewConstMetric(canStateTransitionsDesc, prometheus.CounterValue, float64(c.errorPassive), name, "error-passive")
+			ch <- prometheus.MustNewConstMetric(canStateTransitionsDesc, prometheus.CounterValue, float64(c.busOff), name, "bus-off")
+			ch <- prometheus.MustNewConstMetric(canArbitrationLostDesc, prometheus.CounterValue, float64(c.arbitration), name)
+			ch <- prometheus.MustNewConstMetric(canRestartsDesc, prometheus.CounterValue, float64(c.restarts), name)
+		}
+		if c.hasBerr {
+			ch <- prometheus.MustNewConstMetric(canErrorCounterDesc, prometheus.GaugeValue, float64(c.rxErr), name, "receive")
+			ch <- prometheus.MustNewConstMetric(canErrorCounterDesc, prometheus.GaugeValue, float64(c.txErr), name, "transmit")
+		}
+		if c.bitrate != 0 {
+			ch <- prometheus.MustNewConstMetric(canBitrateDesc, prometheus.GaugeValue, float64(c.bitrate), name)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Mount point of the unified (v2) cgroup hierarchy, relative to sysfs
+	cgroupRoot = "fs/cgroup"
+	// How often the cgroup tree is rescanned for new or removed units
+	cgroupRescanInterval = 30 * time.Second
+)
+
+// Map slots written by the cgroup_skb programs
+const (
+	cgroupKeyIngressBytes = iota
+	cgroupKeyIngressPackets
+	cgroupKeyEgressBytes
+	cgroupKeyEgressPackets
+	cgroupMapEntries
+)
+
+var (
+	cgroupPattern = flag.String("cgroup.pattern", "system.slice/*.service", "Glob (relative to <path.sysfs>/"+cgroupRoot+") of cgroups to account per unit")
+
+	cgroupBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_cgroup_bytes_total",
+			Help: "Total number of bytes sent or received by processes in a cgroup",
+		},
+		[]string{"unit", "direction"},
+	)
+
+	cgroupPackets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_cgroup_packets_total",
+			Help: "Total number of packets sent or received by processes in a cgroup",
+		},
+		[]string{"unit", "direction"},
+	)
+
+	// Attached cgroups keyed by their path
+	cgroupAttachments = struct {
+		sync.Mutex
+		byPath map[string]*cgroupAttachment
+	}{
+		byPath: make(map[string]*cgroupAttachment),
+	}
+)
+
+func init() {
+	registerMetrics("cgroup", cgroupBytes)
+	registerMetrics("cgroup", cgroupPackets)
+
+	// Off by default as it needs CAP_BPF and cgroup v2
+	registerCollector("cgroup", "per-unit traffic via eBPF cgroup_skb programs", false, startCgroupCollector).
+		requires(capBPF, capNetAdmin).
+		checks(checkCgroupFlags)
+}
+
+// cgroupAttachment holds the BPF objects accounting traffic of one cgroup
+type cgroupAttachment struct {
+	// Path relative to the cgroup root, unique for nested cgroups too
+	unit  string
+	mapFd int
+	fds   []int // programs and links, closed on detach
+}
+
+// cgroupSkbProgram counts skb->len and packets into the map at the given slots
+// and always lets the packet through
+func cgroupSkbProgram(mapFd int, bytesKey, packetsKey int32) []bpfInsn {
+	prog := []bpfInsn{
+		insn(bpfMov64Reg, bpfR6, bpfR1, 0, 0),
+		insn(bpfLdxMemW, bpfR7, bpfR6, 0, 0), // r7 = skb->len
+	}
+	prog = append(prog, mapAdd(mapFd, bytesKey, bpfR7)...)
+	prog = append(prog, insn(bpfMov64Imm, bpfR7, 0, 0, 1))
+	prog = append(prog, mapAdd(mapFd, packetsKey, bpfR7)...)
+	return append(prog,
+		insn(bpfMov64Imm, bpfR0, 0, 0, 1),
+		insn(bpfExit, 0, 0, 0, 0),
+	)
+}
+
+// attachCgroup loads ingress and egress accounting programs into the cgroup at path
+func attachCgroup(path string) (*cgroupAttachment, error) {
+	cgroupFd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(cgroupFd)
+
+	mapFd, err := bpfCreateArrayMap(cgroupMapEntries)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := filepath.Rel(sysFilePath(cgroupRoot), path)
+	if err != nil {
+		unix.Close(mapFd)
+		return nil, err
+	}
+	a := &cgroupAttachment{unit: unit, mapFd: mapFd}
+
+	hooks := []struct {
+		attachType          uint32
+		bytesKey, packetKey int32
+	}{
+		{unix.BPF_CGROUP_INET_INGRESS, cgroupKeyIngressBytes, cgroupKeyIngressPackets},
+		{unix.BPF_CGROUP_INET_EGRESS, cgroupKeyEgressBytes, cgroupKeyEgressPackets},
+	}
+	for _, hook := range hooks {
+		progFd, err := bpfLoadProgram(unix.BPF_PROG_TYPE_CGROUP_SKB, cgroupSkbProgram(mapFd, hook.bytesKey, hook.packetKey))
+		if err != nil {
+			a.close()
+			return nil, err
+		}
+		a.fds = append(a.fds, progFd)
+		linkFd, err := bpfLinkCreate(progFd, cgroupFd, hook.attachType)
+		if err != nil {
+			a.close()
+			return nil, err
+		}
+		a.fds = append(a.fds, linkFd)
+	}
+	return a, nil
+}
+
+// close detaches the programs and releases the map
+func (a *cgroupAttachment) close() {
+	for _, fd := range a.fds {
+		unix.Close(fd)
+	}
+	unix.Close(a.mapFd)
+}
+
+// rescanCgroups attaches to newly created cgroups matching the pattern and
+// drops the ones that have disappeared
+func rescanCgroups() {
+	matches, err := filepath.Glob(filepath.Join(sysFilePath(cgroupRoot), *cgroupPattern))
+	if err != nil {
+		log.Printf("Error matching cgroup pattern %q: %v", *cgroupPattern, err)
+		return
+	}
+
+	cgroupAttachments.Lock()
+	defer cgroupAttachments.Unlock()
+
+	current := make(map[string]bool, len(matches))
+	for _, path := range matches {
+		current[path] = true
+		if _, ok := cgroupAttachments.byPath[path]; ok {
+			continue
+		}
+		a, err := attachCgroup(path)
+		if err != nil {
+			log.Printf("Error attaching to cgroup %s: %v", path, err)
+			continue
+		}
+		cgroupAttachments.byPath[path] = a
+	}
+
+	for path, a := range cgroupAttachments.byPath {
+		if current[path] {
+			continue
+		}
+		a.close()
+		delete(cgroupAttachments.byPath, path)
+		cgroupBytes.DeletePartialMatch(prometheus.Labels{"unit": a.unit})
+		cgroupPackets.DeletePartialMatch(prometheus.Labels{"unit": a.unit})
+	}
+}
+
+// checkCgroupFlags validates --cgroup.pattern
+func checkCgroupFlags() error {
+	if *cgroupPattern == "" {
+		return fmt.Errorf("--cgroup.pattern must not be empty")
+	}
+	return nil
+}
+
+// startCgroupCollector starts accounting the cgroups matching --cgroup.pattern
+func startCgroupCollector() error {
+	go collectCgroupStats()
+	return nil
+}
+
+// collectCgroupStats periodically copies the BPF counters into the metrics
+func collectCgroupStats() {
+	var lastScan time.Time
+	for {
+		if time.Since(lastScan) >= cgroupRescanInterval {
+			rescanCgroups()
+			lastScan = time.Now()
+		}
+
+		cgroupAttachments.Lock()
+		for _, a := range cgroupAttachments.byPath {
+			counters := make([]uint64, cgroupMapEntries)
+			for key := range counters {
+				value, err := bpfLookupU64(a.mapFd, uint32(key))
+				if err != nil {
+					log.Printf("Error reading BPF map for cgroup %s: %v", a.unit, err)
+					break
+				}
+				counters[key] = value
+			}
+
+			cgroupBytes.With(prometheus.Labels{"unit": a.unit, "direction": "receive"}).Set(float64(counters[cgroupKeyIngressBytes]))
+			cgroupBytes.With(prometheus.Labels{"unit": a.unit, "direction": "transmit"}).Set(float64(counters[cgroupKeyEgressBytes]))
+			cgroupPackets.With(prometheus.Labels{"unit": a.unit, "direction": "receive"}).Set(float64(counters[cgroupKeyIngressPackets]))
+			cgroupPackets.With(prometheus.Labels{"unit": a.unit, "direction": "transmit"}).Set(float64(counters[cgroupKeyEgressPackets]))
+		}
+		cgroupAttachments.Unlock()
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// flagValidators check the flags outside the collectors, in the order main
+// runs them
+var flagValidators = []func() error{
+	validateMetricsPrefix,
+	validateStaticLabels,
+	validateInterfaceCleanup,
+	validateCollectionWorkers,
+	validateSpeedUnit,
+	validateQuotaFlags,
+	validatePercentileWindow,
+	validateAnomalyFlags,
+	validateEWMAFlags,
+	validateDDoSFlags,
+	validateFlapFlags,
+	validateAlertFlags,
+	validateRulesFlags,
+	validateInfluxFlags,
+	validateKafkaFlags,
+	validateStatsdFlags,
+	validateNetflowFlags,
+	validateSflowFlags,
+	validateMQTTFlags,
+	validateAccessFlags,
+	validateWebListeners,
+	func() error {
+		_, err := parseSpeedWindows(*speedWindows)
+		return err
+	},
+}
+
+// Flags whose values are credentials, or URLs containing them, and are not
+// printed by check-config
+var secretFlags = map[string]bool{
+	"auth.token":     true,
+	"alert.webhook":  true,
+	"gnmi.password":  true,
+	"influxdb.token": true,
+	"mqtt.password":  true,
+}
+
+// Flags whose values are URLs that may carry credentials in their userinfo
+var urlFlags = map[string]bool{
+	"influxdb.url":    true,
+	"mqtt.broker":     true,
+	"pushgateway.url": true,
+}
+
+// redactFlag returns the value of a flag as check-config prints it
+func redactFlag(f *flag.Flag) string {
+	value := f.Value.String()
+	switch {
+	case value == "":
+		return value
+	case secretFlags[f.Name]:
+		return "<redacted>"
+	case urlFlags[f.Name]:
+		u, err := url.Parse(value)
+		if err != nil {
+			return "<redacted>"
+		}
+		if u.User == nil {
+			return value
+		}
+		u.User = nil
+		return strings.Replace(u.String(), "//", "//<redacted>@", 1)
+	case f.Name == "snmp.targets":
+		// The communities of [community@]host[:port]
+		targets := strings.Split(value, ",")
+		for i, t := range targets {
+			if at := strings.LastIndex(t, "@"); at >= 0 {
+				targets[i] = "<redacted>" + t[at:]
+			}
+		}
+		return strings.Join(targets, ",")
+	}
+	return value
+}
+
+// runCheckConfig implements the check-config subcommand: it validates the
+// flags, environment variables included, and those of the enabled
+// collectors without starting anything, then prints the effective
+// configuration. It reports whether the configuration is valid.
+func runCheckConfig(w io.Writer) bool {
+	var errs []error
+	for _, validate := range flagValidators {
+		if err := validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var names []string
+	for _, c := range enabledCollectors() {
+		names = append(names, c.name)
+		if c.check == nil {
+			continue
+		}
+		if err := c.check(); err != nil {
+			errs = append(errs, fmt.Errorf("collector %s: %w", c.name, err))
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+	fmt.Fprintf(w, "# Enabled collectors: %s\n", strings.Join(names, ", "))
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "--%s=%s\n", f.Name, redactFlag(f))
+	})
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "# Configuration has %d error(s)\n", len(errs))
+		return false
+	}
+	fmt.Fprintln(w, "# Configuration is valid")
+	return true
+}
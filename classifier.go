@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// htons converts a 16-bit value to network byte order, as found in
+// __sk_buff.protocol
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
+
+// packetClassifier is an eBPF socket filter on a packet socket bound to one
+// interface, counting the packets it sees into an array map. The filter
+// returns 0 for every packet, so nothing is ever copied to userspace.
+type packetClassifier struct {
+	index                 int
+	sockFd, progFd, mapFd int
+	counters              []uint64
+	time                  time.Time
+}
+
+// attachPacketClassifier loads the program built for a map of the given
+// number of entries and attaches it to the interface
+func attachPacketClassifier(index, entries int, program func(mapFd int) []bpfInsn) (*packetClassifier, error) {
+	c := &packetClassifier{index: index, sockFd: -1, progFd: -1, counters: make([]uint64, entries)}
+	var err error
+	if c.mapFd, err = bpfCreateArrayMap(uint32(entries)); err != nil {
+		return nil, err
+	}
+	if c.progFd, err = bpfLoadProgram(unix.BPF_PROG_TYPE_SOCKET_FILTER, program(c.mapFd)); err != nil {
+		c.close()
+		return nil, err
+	}
+	// Bound only after the filter is attached, so nothing is ever queued.
+	// Sockets of type SOCK_DGRAM see the packets from the network header on.
+	if c.sockFd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0); err != nil {
+		c.close()
+		return nil, fmt.Errorf("opening packet socket: %w", err)
+	}
+	if err := unix.SetsockoptInt(c.sockFd, unix.SOL_SOCKET, unix.SO_ATTACH_BPF, c.progFd); err != nil {
+		c.close()
+		return nil, fmt.Errorf("attaching BPF program: %w", err)
+	}
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: index}
+	if err := unix.Bind(c.sockFd, sa); err != nil {
+		c.close()
+		return nil, fmt.Errorf("binding packet socket: %w", err)
+	}
+	return c, nil
+}
+
+// close detaches the classifier and releases the map
+func (c *packetClassifier) close() {
+	for _, fd := range []int{c.sockFd, c.progFd, c.mapFd} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// read reads the map and returns the counters, those of the previous read,
+// nil on the first one, and the seconds in between
+func (c *packetClassifier) read() (counters, previous []uint64, elapsed float64, err error) {
+	now := time.Now()
+	counters = make([]uint64, len(c.counters))
+	for key := range counters {
+		if counters[key], err = bpfLookupU64(c.mapFd, uint32(key)); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if !c.time.IsZero() {
+		previous, elapsed = c.counters, now.Sub(c.time).Seconds()
+	}
+	c.counters, c.time = counters, now
+	return counters, previous, elapsed, nil
+}
+
+// counterRate returns the rate of a counter between two reads, 0 on the first
+func counterRate(counters, previous []uint64, key int, elapsed float64) float64 {
+	if previous == nil || elapsed <= 0 {
+		return 0
+	}
+	return float64(counters[key]-previous[key]) / elapsed
+}
+
+// packetClassifiers keeps a classifier attached to each selected interface
+// of the main collection loop
+type packetClassifiers struct {
+	name     string
+	selected *regexp.Regexp
+	entries  int
+	program  func(mapFd int) []bpfInsn
+	byIface  map[string]*packetClassifier
+}
+
+// refresh attaches to new interfaces, detaches from removed ones and
+// returns the classifiers by interface name
+func (p *packetClassifiers) refresh() map[string]*packetClassifier {
+	if p.byIface == nil {
+		p.byIface = make(map[string]*packetClassifier)
+	}
+	current := make(map[string]int)
+	for _, s := range currentStats() {
+		if !p.selected.MatchString(s.Name) {
+			continue
+		}
+		if iface, err := net.InterfaceByName(s.Name); err == nil {
+			current[s.Name] = iface.Index
+		}
+	}
+	for name, c := range p.byIface {
+		// Recreated interfaces get a new index and a new classifier
+		if index, ok := current[name]; !ok || index != c.index {
+			c.close()
+			delete(p.byIface, name)
+		}
+	}
+	for name, index := range current {
+		if _, ok := p.byIface[name]; ok {
+			continue
+		}
+		c, err := attachPacketClassifier(index, p.entries, p.program)
+		if err != nil {
+			log.Printf("Error attaching the %s classifier to %s: %v", p.name, name, err)
+			continue
+		}
+		p.byIface[name] = c
+	}
+	return p.byIface
+}
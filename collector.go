@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// collector is an optional data source, toggled with --collector.<name>
+type collector struct {
+	name    string
+	enabled *bool
+	// check validates the collector's flags without side effects; optional
+	check func() error
+	// start begins collecting in the background, after check passed
+	start func() error
+	// Capabilities the collector can't work without
+	capabilities []capability
+}
+
+// Collectors by name, registered from init functions
+var collectors = make(map[string]*collector)
+
+// Names of the collectors startCollectors started, set before serving
+var startedCollectors = make(map[string]bool)
+
+// registerCollector adds a collector and its --collector.<name> flag
+func registerCollector(name, help string, enabledByDefault bool, start func() error) *collector {
+	if _, ok := collectors[name]; ok {
+		panic("collector registered twice: " + name)
+	}
+	c := &collector{
+		name:    name,
+		enabled: flag.Bool("collector."+name, enabledByDefault, "Enable the "+name+" collector: "+help),
+		start:   start,
+	}
+	collectors[name] = c
+	return c
+}
+
+// requires declares the capabilities the collector needs
+func (c *collector) requires(caps ...capability) *collector {
+	c.capabilities = append(c.capabilities, caps...)
+	return c
+}
+
+// checks declares the function validating the collector's flags
+func (c *collector) checks(check func() error) *collector {
+	c.check = check
+	return c
+}
+
+// enabledCollectors returns the enabled collectors by name. Setting any of a
+// collector's own flags (--<name>.*) enables it too, unless
+// --collector.<name> is given.
+func enabledCollectors() []*collector {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if name, ok := strings.CutPrefix(f.Name, "collector."); ok {
+			explicit[name] = true
+		}
+	})
+	flag.Visit(func(f *flag.Flag) {
+		name, _, ok := strings.Cut(f.Name, ".")
+		if c, registered := collectors[name]; ok && registered && !explicit[name] {
+			*c.enabled = true
+		}
+	})
+
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var enabled []*collector
+	for _, name := range names {
+		if c := collectors[name]; *c.enabled {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+// startCollectors starts the enabled collectors, skipping those that lack
+// capabilities
+func startCollectors() error {
+	var enabled []string
+	for _, c := range enabledCollectors() {
+		if missing := missingCapabilities(c.capabilities); len(missing) > 0 {
+			log.Printf("Disabling collector %s for lack of privileges: missing %s", c.name, formatCapabilities(missing))
+			continue
+		}
+		if c.check != nil {
+			if err := c.check(); err != nil {
+				return fmt.Errorf("collector %s: %w", c.name, err)
+			}
+		}
+		if err := c.start(); err != nil {
+			return fmt.Errorf("collector %s: %w", c.name, err)
+		}
+		enabled = append(enabled, c.name)
+		startedCollectors[c.name] = true
+	}
+	log.Printf("Enabled collectors: %s", strings.Join(enabled, ", "))
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var compatNodeExporterNames = flag.Bool("compat.node-exporter-names", false, "Also export the interface counters under node_exporter's node_network_* names, for existing dashboards and recording rules")
+
+// node_exporter's netdev metrics, labeled with device like there
+var nodeNetworkDescs = struct {
+	receiveBytes, transmitBytes     *prometheus.Desc
+	receivePackets, transmitPackets *prometheus.Desc
+	receiveErrs, transmitErrs       *prometheus.Desc
+	receiveDrop, transmitDrop       *prometheus.Desc
+}{
+	receiveBytes:    nodeNetworkDesc("receive_bytes_total", "Network device statistic receive_bytes."),
+	transmitBytes:   nodeNetworkDesc("transmit_bytes_total", "Network device statistic transmit_bytes."),
+	receivePackets:  nodeNetworkDesc("receive_packets_total", "Network device statistic receive_packets."),
+	transmitPackets: nodeNetworkDesc("transmit_packets_total", "Network device statistic transmit_packets."),
+	receiveErrs:     nodeNetworkDesc("receive_errs_total", "Network device statistic receive_errs."),
+	transmitErrs:    nodeNetworkDesc("transmit_errs_total", "Network device statistic transmit_errs."),
+	receiveDrop:     nodeNetworkDesc("receive_drop_total", "Network device statistic receive_drop."),
+	transmitDrop:    nodeNetworkDesc("transmit_drop_total", "Network device statistic transmit_drop."),
+}
+
+func nodeNetworkDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc("node_network_"+name, help, []string{"device"}, nil)
+}
+
+// nodeNetworkCollector exports the counters of the last collection cycle
+// under node_exporter's names
+type nodeNetworkCollector struct{}
+
+func (nodeNetworkCollector) Describe(ch chan<- *prometheus.Desc) {
+	d := nodeNetworkDescs
+	for _, desc := range []*prometheus.Desc{d.receiveBytes, d.transmitBytes, d.receivePackets, d.transmitPackets, d.receiveErrs, d.transmitErrs, d.receiveDrop, d.transmitDrop} {
+		ch <- desc
+	}
+}
+
+func (nodeNetworkCollector) Collect(ch chan<- prometheus.Metric) {
+	d := nodeNetworkDescs
+	for _, s := range currentStats() {
+		for desc, value := range map[*prometheus.Desc]uint64{
+			d.receiveBytes:    s.RxBytes,
+			d.transmitBytes:   s.TxBytes,
+			d.receivePackets:  s.RxPackets,
+			d.transmitPackets: s.TxPackets,
+			d.receiveErrs:     s.RxErrors,
+			d.transmitErrs:    s.TxErrors,
+			d.receiveDrop:     s.RxDrops,
+			d.transmitDrop:    s.TxDrops,
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), s.Name)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	conntrackFile     = "net/nf_conntrack"
+	conntrackAcctFile = "sys/net/netfilter/nf_conntrack_acct"
+)
+
+var (
+	conntrackTopN     = flag.Int("conntrack.top-n", 10, "Number of top talkers to export from conntrack accounting")
+	conntrackKeys     = flag.String("conntrack.keys", "src,dst", "Comma-separated flow fields to aggregate top talkers by (src, dst, proto, sport, dport)")
+	conntrackInterval = flag.Duration("conntrack.interval", 15*time.Second, "How often to dump the conntrack table")
+
+	// Created once the aggregation keys are known
+	conntrackTopBytes   *prometheus.GaugeVec
+	conntrackTopPackets *prometheus.GaugeVec
+	conntrackTopFlows   *prometheus.GaugeVec
+)
+
+func init() {
+	registerCollector("conntrack", "top talkers from conntrack accounting", false, startConntrackCollector).
+		requires(capNetAdmin, capDACReadSearch).
+		checks(checkConntrackFlags)
+}
+
+// Flow fields available as aggregation keys
+var conntrackKeyFields = map[string]func(f *conntrackFlow) string{
+	"src":   func(f *conntrackFlow) string { return f.src },
+	"dst":   func(f *conntrackFlow) string { return f.dst },
+	"proto": func(f *conntrackFlow) string { return f.proto },
+	"sport": func(f *conntrackFlow) string { return f.sport },
+	"dport": func(f *conntrackFlow) string { return f.dport },
+}
+
+// conntrackFlow is one entry of the conntrack table. The src/dst/ports are
+// taken from the original direction tuple, the reply fields from the reply
+// tuple, which differs from the swapped original under NAT.
+type conntrackFlow struct {
+	family, proto, protoNum                    string
+	src, dst, sport, dport                     string
+	replySrc, replyDst, replySport, replyDport string
+	zone                                       string
+	origPackets, origBytes                     uint64
+	replyPackets, replyBytes                   uint64
+}
+
+// parseConntrackLine parses a line of /proc/net/nf_conntrack. The first
+// occurrence of each tuple field belongs to the original direction, the
+// second one to the reply direction.
+func parseConntrackLine(line string) (conntrackFlow, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return conntrackFlow{}, false
+	}
+	f := conntrackFlow{family: fields[0], proto: fields[2], protoNum: fields[3]}
+	seen := make(map[string]bool, 8)
+	for _, field := range fields[3:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		reply := seen[key]
+		seen[key] = true
+		switch key {
+		case "src":
+			if reply {
+				f.replySrc = value
+			} else {
+				f.src = value
+			}
+		case "dst":
+			if reply {
+				f.replyDst = value
+			} else {
+				f.dst = value
+			}
+		case "sport":
+			if reply {
+				f.replySport = value
+			} else {
+				f.sport = value
+			}
+		case "dport":
+			if reply {
+				f.replyDport = value
+			} else {
+				f.dport = value
+			}
+		case "packets":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			if reply {
+				f.replyPackets = n
+			} else {
+				f.origPackets = n
+			}
+		case "bytes":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			if reply {
+				f.replyBytes = n
+			} else {
+				f.origBytes = n
+			}
+		case "zone":
+			f.zone = value
+		}
+	}
+	return f, f.src != ""
+}
+
+// readConntrack dumps the whole conntrack table
+func readConntrack() ([]conntrackFlow, error) {
+	file, err := os.Open(procFilePath(conntrackFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var flows []conntrackFlow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if f, ok := parseConntrackLine(scanner.Text()); ok {
+			flows = append(flows, f)
+		}
+	}
+	return flows, scanner.Err()
+}
+
+// parseConntrackKeys validates the -conntrack.keys flag
+func parseConntrackKeys(value string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if _, ok := conntrackKeyFields[key]; !ok {
+			return nil, fmt.Errorf("unknown conntrack aggregation key %q", key)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one conntrack aggregation key is required")
+	}
+	return keys, nil
+}
+
+// setupConntrackMetrics creates and registers the top talker metrics with the
+// configured aggregation keys as labels
+func setupConntrackMetrics(keys []string) {
+	conntrackTopBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_conntrack_top_bytes",
+			Help: "Bytes accounted to the currently tracked flows of a top talker",
+		},
+		append(append([]string{}, keys...), "direction"),
+	)
+	conntrackTopPackets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_conntrack_top_packets",
+			Help: "Packets accounted to the currently tracked flows of a top talker",
+		},
+		append(append([]string{}, keys...), "direction"),
+	)
+	conntrackTopFlows = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_conntrack_top_flows",
+			Help: "Number of currently tracked flows of a top talker",
+		},
+		keys,
+	)
+	registerMetrics("conntrack", conntrackTopBytes)
+	registerMetrics("conntrack", conntrackTopPackets)
+	registerMetrics("conntrack", conntrackTopFlows)
+}
+
+// conntrackAggregate is the sum of all flows sharing the same key values
+type conntrackAggregate struct {
+	labels                   []string
+	flows                    int
+	origPackets, origBytes   uint64
+	replyPackets, replyBytes uint64
+}
+
+// aggregateConntrack groups flows by keys and returns the topN aggregates
+// ordered by total bytes
+func aggregateConntrack(flows []conntrackFlow, keys []string, topN int) []*conntrackAggregate {
+	byKey := make(map[string]*conntrackAggregate)
+	for i := range flows {
+		f := &flows[i]
+		labels := make([]string, len(keys))
+		for j, key := range keys {
+			labels[j] = conntrackKeyFields[key](f)
+		}
+		id := strings.Join(labels, "\x00")
+		agg, ok := byKey[id]
+		if !ok {
+			agg = &conntrackAggregate{labels: labels}
+			byKey[id] = agg
+		}
+		agg.flows++
+		agg.origPackets += f.origPackets
+		agg.origBytes += f.origBytes
+		agg.replyPackets += f.replyPackets
+		agg.replyBytes += f.replyBytes
+	}
+
+	aggregates := make([]*conntrackAggregate, 0, len(byKey))
+	for _, agg := range byKey {
+		aggregates = append(aggregates, agg)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].origBytes+aggregates[i].replyBytes > aggregates[j].origBytes+aggregates[j].replyBytes
+	})
+	if len(aggregates) > topN {
+		aggregates = aggregates[:topN]
+	}
+	return aggregates
+}
+
+// checkConntrackFlags validates --conntrack.top-n and --conntrack.keys
+func checkConntrackFlags() error {
+	if *conntrackTopN <= 0 {
+		return fmt.Errorf("--conntrack.top-n must be positive")
+	}
+	_, err := parseConntrackKeys(*conntrackKeys)
+	return err
+}
+
+// startConntrackCollector starts exporting the conntrack top talkers
+func startConntrackCollector() error {
+	keys, err := parseConntrackKeys(*conntrackKeys)
+	if err != nil {
+		return err
+	}
+	setupConntrackMetrics(keys)
+	go collectConntrackTopTalkers(keys)
+	return nil
+}
+
+// collectConntrackTopTalkers periodically dumps conntrack and exports the top talkers
+func collectConntrackTopTalkers(keys []string) {
+	if acct, err := os.ReadFile(procFilePath(conntrackAcctFile)); err == nil && strings.TrimSpace(string(acct)) != "1" {
+		log.Printf("Warning: %s is disabled, conntrack byte and packet counters will be zero", procFilePath(conntrackAcctFile))
+	}
+
+	for {
+		flows, err := readConntrack()
+		if err != nil {
+			log.Printf("Error reading %s: %v", procFilePath(conntrackFile), err)
+			time.Sleep(*conntrackInterval)
+			continue
+		}
+
+		// Top talkers change between dumps, so start from a clean slate
+		conntrackTopBytes.Reset()
+		conntrackTopPackets.Reset()
+		conntrackTopFlows.Reset()
+		for _, agg := range aggregateConntrack(flows, keys, *conntrackTopN) {
+			original := append(append([]string{}, agg.labels...), "original")
+			reply := append(append([]string{}, agg.labels...), "reply")
+			conntrackTopBytes.WithLabelValues(original...).Set(float64(agg.origBytes))
+			conntrackTopBytes.WithLabelValues(reply...).Set(float64(agg.replyBytes))
+			conntrackTopPackets.WithLabelValues(original...).Set(float64(agg.origPackets))
+			conntrackTopPackets.WithLabelValues(reply...).Set(float64(agg.replyPackets))
+			conntrackTopFlows.WithLabelValues(agg.labels...).Set(float64(agg.flows))
+		}
+
+		time.Sleep(*conntrackInterval)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	networkCounterSource = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_counter_source_info",
+			Help: "Source of the counters of the interface: procfs for /proc/net/dev, sysfs for /sys/class/net/<interface>/statistics",
+		},
+		[]string{"interface", "source"},
+	)
+
+	// Last published counter source by interface
+	counterSources = struct {
+		sync.Mutex
+		byIface map[string]string
+	}{byIface: make(map[string]string)}
+)
+
+func init() {
+	registerMetrics("info", networkCounterSource)
+}
+
+// updateCounterSources publishes the counter source of each interface,
+// logging when an interface switches to the sysfs statistics
+func updateCounterSources(stats []interfaceStats) {
+	counterSources.Lock()
+	defer counterSources.Unlock()
+	for _, s := range stats {
+		previous, ok := counterSources.byIface[s.Name]
+		if ok && previous == s.Source {
+			continue
+		}
+		if ok {
+			log.Printf("Counters of %s switched from %s to %s", s.Name, previous, s.Source)
+			networkCounterSource.DeletePartialMatch(prometheus.Labels{"interface": s.Name})
+		}
+		counterSources.byIface[s.Name] = s.Source
+		networkCounterSource.With(prometheus.Labels{"interface": s.Name, "source": s.Source}).Set(1)
+	}
+}
+
+// forgetCounterSource drops the counter source of a removed interface
+func forgetCounterSource(name string) {
+	counterSources.Lock()
+	defer counterSources.Unlock()
+	delete(counterSources.byIface, name)
+	networkCounterSource.DeletePartialMatch(prometheus.Labels{"interface": name})
+}
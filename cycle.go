@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectionDeadline = flag.Duration("collection.deadline", 2*time.Second, "Abort a collection cycle that takes longer than this and count it in exporter_collection_timeouts_total; 0 disables")
+
+	collectionTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "exporter_collection_timeouts_total",
+			Help: "Number of collection cycles aborted for exceeding --collection.deadline",
+		},
+	)
+	collectionDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "exporter_collection_duration_seconds",
+			Help: "Duration of the last collection cycle in seconds",
+		},
+	)
+)
+
+func init() {
+	registerMetrics("exporter", collectionTimeouts)
+	registerMetrics("exporter", collectionDuration)
+}
+
+// collectCycle reads the interface stats within --collection.deadline. On a
+// timeout the cycle is counted and ok is false; the next cycle computes its
+// speeds relative to the last complete one.
+func collectCycle() (stats []interfaceStats, ok bool) {
+	ctx := context.Background()
+	if *collectionDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *collectionDeadline)
+		defer cancel()
+	}
+	start := time.Now()
+	stats, err := speedCollector.CollectContext(ctx)
+	collectionDuration.Set(time.Since(start).Seconds())
+	if errors.Is(err, context.DeadlineExceeded) {
+		collectionTimeouts.Inc()
+		log.Printf("Collection cycle aborted after %s, exceeding --collection.deadline", time.Since(start))
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading %s: %v", procFilePath("net/dev"), err)
+		return nil, false
+	}
+	return stats, true
+}
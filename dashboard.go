@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed web/index.html
+var dashboardHTML []byte
+
+// handleDashboard serves the built-in live traffic page at /
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	// "/" matches every path not handled elsewhere
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
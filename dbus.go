@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// D-Bus message types and header fields
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+const dbusDefaultSystemBus = "unix:path=/run/dbus/system_bus_socket"
+
+// dbusConn is a minimal D-Bus client making method calls on the system bus,
+// like mqttPublisher only implementing what the exporter needs
+type dbusConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// dbusObjectPath is a decoded object path, to tell it apart from a string
+type dbusObjectPath string
+
+// dialSystemBus connects and authenticates to the system bus
+func dialSystemBus() (*dbusConn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = dbusDefaultSystemBus
+	}
+	path, ok := strings.CutPrefix(address, "unix:path=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported D-Bus address %q", address)
+	}
+	path, _, _ = strings.Cut(path, ",")
+	conn, err := net.DialTimeout("unix", path, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// auth runs the SASL EXTERNAL handshake, authenticating by the uid the
+// bus sees on the socket
+func (c *dbusConn) auth() error {
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+// call calls a method with arguments of the given signature, which may
+// only contain basic types, and returns the decoded reply body
+func (c *dbusConn) call(dest, path, iface, member, signature string, args ...any) ([]any, error) {
+	c.serial++
+	body := &dbusEncoder{}
+	for i, sig := range signature {
+		body.basic(byte(sig), args[i])
+	}
+
+	msg := &dbusEncoder{}
+	msg.b = append(msg.b, 'l', dbusMethodCall, 0, 1)
+	msg.basic('u', uint32(len(body.b)))
+	msg.basic('u', c.serial)
+	fields := []struct {
+		code byte
+		sig  byte
+		v    any
+	}{
+		{dbusFieldPath, 'o', path},
+		{dbusFieldInterface, 's', iface},
+		{dbusFieldMember, 's', member},
+		{dbusFieldDestination, 's', dest},
+		{dbusFieldSignature, 'g', signature},
+	}
+	lengthAt := len(msg.b)
+	msg.basic('u', uint32(0))
+	start := len(msg.b)
+	for _, f := range fields {
+		if f.sig == 'g' && signature == "" {
+			continue
+		}
+		msg.align(8)
+		msg.b = append(msg.b, f.code, 1, f.sig, 0)
+		msg.basic(f.sig, f.v)
+	}
+	binary.LittleEndian.PutUint32(msg.b[lengthAt:], uint32(len(msg.b)-start))
+	msg.align(8)
+	msg.b = append(msg.b, body.b...)
+
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(msg.b); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		// Signals like NameAcquired are not of interest
+		if reply.replySerial != c.serial {
+			continue
+		}
+		if reply.msgType == dbusError {
+			detail := ""
+			if len(reply.body) > 0 {
+				detail, _ = reply.body[0].(string)
+			}
+			return nil, fmt.Errorf("%s: %s", reply.errorName, detail)
+		}
+		return reply.body, nil
+	}
+}
+
+type dbusMessage struct {
+	msgType     byte
+	replySerial uint32
+	errorName   string
+	body        []any
+}
+
+// readMessage reads and decodes the next message
+func (c *dbusConn) readMessage() (dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, fixed); err != nil {
+		return dbusMessage{}, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if fixed[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen := order.Uint32(fixed[4:8])
+	fieldsLen := order.Uint32(fixed[12:16])
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	if bodyLen > 64<<20 || fieldsLen > 64<<20 {
+		return dbusMessage{}, fmt.Errorf("D-Bus message too large")
+	}
+	data := make([]byte, headerLen+bodyLen)
+	copy(data, fixed)
+	if _, err := io.ReadFull(c.r, data[16:]); err != nil {
+		return dbusMessage{}, err
+	}
+
+	m := dbusMessage{msgType: fixed[1]}
+	header := &dbusDecoder{b: data[:16+fieldsLen], order: order, pos: 12}
+	fields, err := header.value("a(yv)")
+	if err != nil {
+		return m, err
+	}
+	signature := ""
+	for _, f := range fields.([]any) {
+		field := f.([]any)
+		switch field[0].(byte) {
+		case dbusFieldReplySerial:
+			m.replySerial, _ = field[1].(uint32)
+		case dbusFieldErrorName:
+			m.errorName, _ = field[1].(string)
+		case dbusFieldSignature:
+			signature, _ = field[1].(string)
+		}
+	}
+	body := &dbusDecoder{b: data[headerLen:], order: order}
+	for sig := signature; sig != ""; {
+		n := dbusTypeLen(sig)
+		v, err := body.value(sig[:n])
+		if err != nil {
+			return m, err
+		}
+		m.body = append(m.body, v)
+		sig = sig[n:]
+	}
+	return m, nil
+}
+
+// dbusEncoder encodes basic values in little endian
+type dbusEncoder struct {
+	b []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *dbusEncoder) basic(sig byte, v any) {
+	switch sig {
+	case 'u':
+		e.align(4)
+		e.b = binary.LittleEndian.AppendUint32(e.b, v.(uint32))
+	case 's', 'o':
+		s := v.(string)
+		e.align(4)
+		e.b = binary.LittleEndian.AppendUint32(e.b, uint32(len(s)))
+		e.b = append(append(e.b, s...), 0)
+	case 'g':
+		s := v.(string)
+		e.b = append(append(append(e.b, byte(len(s))), s...), 0)
+	default:
+		panic("unsupported D-Bus argument type " + string(sig))
+	}
+}
+
+// dbusTypeLen returns the length of the first complete type of a signature
+func dbusTypeLen(sig string) int {
+	switch sig[0] {
+	case 'a':
+		return 1 + dbusTypeLen(sig[1:])
+	case '(', '{':
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(sig)
+	}
+	return 1
+}
+
+// dbusAlignment returns the alignment of a type
+func dbusAlignment(sig byte) int {
+	switch sig {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 'a', 's', 'o':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// dbusDecoder decodes values. Arrays become []any, dictionaries map[any]any,
+// structs []any, and variants their value.
+type dbusDecoder struct {
+	b     []byte
+	order binary.ByteOrder
+	pos   int
+}
+
+func (d *dbusDecoder) take(n, align int) ([]byte, error) {
+	d.pos = (d.pos + align - 1) &^ (align - 1)
+	if d.pos+n > len(d.b) {
+		return nil, fmt.Errorf("truncated D-Bus message")
+	}
+	b := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *dbusDecoder) value(sig string) (any, error) {
+	switch sig[0] {
+	case 'y':
+		b, err := d.take(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b', 'u', 'i':
+		b, err := d.take(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint32(b)
+		switch sig[0] {
+		case 'b':
+			return v != 0, nil
+		case 'i':
+			return int32(v), nil
+		}
+		return v, nil
+	case 'n', 'q':
+		b, err := d.take(2, 2)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'x', 't', 'd':
+		b, err := d.take(8, 8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(b)
+		switch sig[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 'h':
+		b, err := d.take(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b), nil
+	case 's', 'o':
+		b, err := d.take(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(d.order.Uint32(b))+1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return dbusObjectPath(s[:len(s)-1]), nil
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		b, err := d.take(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(b[0])+1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		s, err := d.value("g")
+		if err != nil {
+			return nil, err
+		}
+		inner := s.(string)
+		if inner == "" || dbusTypeLen(inner) != len(inner) {
+			return nil, fmt.Errorf("invalid variant signature %q", inner)
+		}
+		return d.value(inner)
+	case '(':
+		if _, err := d.take(0, 8); err != nil {
+			return nil, err
+		}
+		var fields []any
+		for inner := sig[1 : len(sig)-1]; inner != ""; {
+			n := dbusTypeLen(inner)
+			v, err := d.value(inner[:n])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+			inner = inner[n:]
+		}
+		return fields, nil
+	case 'a':
+		b, err := d.take(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		n := int(d.order.Uint32(b))
+		elem := sig[1:]
+		if _, err := d.take(0, dbusAlignment(elem[0])); err != nil {
+			return nil, err
+		}
+		end := d.pos + n
+		if end > len(d.b) {
+			return nil, fmt.Errorf("truncated D-Bus message")
+		}
+		if elem[0] == '{' {
+			keySig := elem[1:2]
+			valueSig := elem[2 : len(elem)-1]
+			dict := make(map[any]any)
+			for d.pos < end {
+				if _, err := d.take(0, 8); err != nil {
+					return nil, err
+				}
+				k, err := d.value(keySig)
+				if err != nil {
+					return nil, err
+				}
+				v, err := d.value(valueSig)
+				if err != nil {
+					return nil, err
+				}
+				dict[k] = v
+			}
+			return dict, nil
+		}
+		items := []any{}
+		for d.pos < end {
+			v, err := d.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unsupported D-Bus type %q", sig)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Half-life of the usual packet rate small-packet floods are detected
+// against; it is not updated during a flood, so a long flood doesn't become
+// the usual rate
+const ddosBaselineHalfLife = 5 * time.Minute
+
+var (
+	ddosIndicators      = flag.Bool("ddos.indicators", false, "Export packets per second, the average packet size and a small-packet flood flag per interface")
+	ddosFloodPacketSize = flag.Float64("ddos.flood-packet-size", 128, "Average packet size in bytes below which a packet rate spike counts as a small-packet flood")
+	ddosFloodMinPPS     = flag.Float64("ddos.flood-min-pps", 10000, "Packets per second below which no small-packet flood is flagged, whatever the spike")
+	ddosFloodFactor     = flag.Float64("ddos.flood-factor", 4, "How many times the usual packet rate of the last minutes the packet rate has to reach for a small-packet flood")
+
+	networkPacketRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_packets_per_second",
+			Help: "Packets per second of the network interface",
+		},
+		[]string{"interface", "direction"},
+	)
+	networkPacketSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_average_packet_size_bytes",
+			Help: "Average size of the packets of the network interface in the last collection cycle in bytes",
+		},
+		[]string{"interface", "direction"},
+	)
+	networkSmallPacketFlood = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_small_packet_flood",
+			Help: "Whether the packet rate spiked above --ddos.flood-factor times the usual rate while the average packet size fell below --ddos.flood-packet-size (1) or not (0)",
+		},
+		[]string{"interface", "direction"},
+	)
+	networkSmallPacketFloods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "network_interface_small_packet_floods_total",
+			Help: "Number of small-packet floods that started on the network interface",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	// Previous counters and usual packet rates per interface; index 0 is
+	// receive and index 1 transmit
+	ddosStates = struct {
+		sync.Mutex
+		byIface map[string]*ddosState
+	}{
+		byIface: make(map[string]*ddosState),
+	}
+)
+
+func init() {
+	registerMetrics("ddos", networkPacketRate)
+	registerMetrics("ddos", networkPacketSize)
+	registerMetrics("ddos", networkSmallPacketFlood)
+	registerMetrics("ddos", networkSmallPacketFloods)
+}
+
+type ddosState struct {
+	packets, bytes [2]uint64
+	usualPPS       [2]float64
+	flood          [2]bool
+	time           time.Time
+}
+
+// validateDDoSFlags checks the small-packet flood flags
+func validateDDoSFlags() error {
+	if *ddosFloodPacketSize <= 0 {
+		return fmt.Errorf("invalid --ddos.flood-packet-size %v", *ddosFloodPacketSize)
+	}
+	if *ddosFloodMinPPS < 0 {
+		return fmt.Errorf("invalid --ddos.flood-min-pps %v", *ddosFloodMinPPS)
+	}
+	if *ddosFloodFactor < 1 {
+		return fmt.Errorf("invalid --ddos.flood-factor %v, expected at least 1", *ddosFloodFactor)
+	}
+	return nil
+}
+
+// updateDDoSIndicators computes the packet rates and sizes of a collection
+// cycle and flags small-packet floods
+func updateDDoSIndicators(stats []interfaceStats) {
+	if !*ddosIndicators {
+		return
+	}
+	ddosStates.Lock()
+	defer ddosStates.Unlock()
+
+	for _, s := range stats {
+		packets := [2]uint64{s.RxPackets, s.TxPackets}
+		bytes := [2]uint64{s.RxBytes, s.TxBytes}
+		st, ok := ddosStates.byIface[s.Name]
+		if !ok {
+			ddosStates.byIface[s.Name] = &ddosState{packets: packets, bytes: bytes, usualPPS: [2]float64{-1, -1}, time: s.Time}
+			continue
+		}
+		elapsed := s.Time.Sub(st.time)
+		st.time = s.Time
+		prevPackets, prevBytes := st.packets, st.bytes
+		st.packets, st.bytes = packets, bytes
+		// Rates over a gap are averages of the whole gap
+		if !s.HasSpeed || elapsed <= 0 {
+			continue
+		}
+		alpha := 1 - math.Exp(-math.Ln2*elapsed.Seconds()/ddosBaselineHalfLife.Seconds())
+		for i, direction := range []string{"receive", "transmit"} {
+			labels := prometheus.Labels{"interface": s.Name, "direction": direction}
+			deltaPackets := counterDelta(packets[i], prevPackets[i])
+			pps := float64(deltaPackets) / elapsed.Seconds()
+			networkPacketRate.With(labels).Set(pps)
+			if deltaPackets == 0 {
+				st.flood[i] = false
+				networkSmallPacketFlood.With(labels).Set(0)
+				st.usualPPS[i] += alpha * (pps - st.usualPPS[i])
+				continue
+			}
+			size := float64(counterDelta(bytes[i], prevBytes[i])) / float64(deltaPackets)
+			networkPacketSize.With(labels).Set(size)
+
+			// Seed with the first rate rather than rising up from zero
+			if st.usualPPS[i] < 0 {
+				st.usualPPS[i] = pps
+			}
+			flood := pps >= *ddosFloodMinPPS && size < *ddosFloodPacketSize && pps >= *ddosFloodFactor*st.usualPPS[i]
+			if flood && !st.flood[i] {
+				networkSmallPacketFloods.With(labels).Inc()
+			}
+			st.flood[i] = flood
+			networkSmallPacketFlood.With(labels).Set(boolToFloat(flood))
+			if !flood {
+				st.usualPPS[i] += alpha * (pps - st.usualPPS[i])
+			}
+		}
+	}
+}
+
+// forgetDDoSIndicators drops the state and series of a removed interface
+func forgetDDoSIndicators(name string) {
+	ddosStates.Lock()
+	defer ddosStates.Unlock()
+	delete(ddosStates.byIface, name)
+	labels := prometheus.Labels{"interface": name}
+	for _, vec := range []*prometheus.GaugeVec{networkPacketRate, networkPacketSize, networkSmallPacketFlood} {
+		vec.DeletePartialMatch(labels)
+	}
+	networkSmallPacketFloods.DeletePartialMatch(labels)
+}
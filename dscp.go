@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	dscpInterval   = flag.Duration("dscp.interval", 5*time.Second, "How often to read the per-DSCP counters and compute the per-DSCP speeds")
+	dscpInterfaces = flag.String("dscp.interfaces", ".*", "Regular expression of interfaces to attach the DSCP classifier to")
+)
+
+// Map slots: 64 code points times direction times bytes and packets
+const dscpMapEntries = 64 * 4
+
+// Names of the standard DSCP code points, others are exported by number
+var dscpNames = map[int]string{
+	0: "be", 1: "le", 8: "cs1", 10: "af11", 12: "af12", 14: "af13",
+	16: "cs2", 18: "af21", 20: "af22", 22: "af23", 24: "cs3", 26: "af31", 28: "af32", 30: "af33",
+	32: "cs4", 34: "af41", 36: "af42", 38: "af43", 40: "cs5", 44: "va", 46: "ef", 48: "cs6", 56: "cs7",
+}
+
+var (
+	dscpSpeedDesc = prometheus.NewDesc("network_interface_dscp_speed_bits",
+		"Speed of the IP traffic of the interface by DSCP code point in bits per second", []string{"interface", "dscp", "class", "direction"}, nil)
+	dscpBytesDesc = prometheus.NewDesc("network_interface_dscp_bytes_total",
+		"Bytes of IP traffic of the interface by DSCP code point since the classifier was attached", []string{"interface", "dscp", "class", "direction"}, nil)
+	dscpPacketsDesc = prometheus.NewDesc("network_interface_dscp_packets_total",
+		"Packets of IP traffic of the interface by DSCP code point since the classifier was attached", []string{"interface", "dscp", "class", "direction"}, nil)
+
+	// Classifier counters and speeds of the last read by interface
+	dscpSnapshot struct {
+		sync.Mutex
+		byIface map[string][]dscpCounter
+	}
+)
+
+func init() {
+	registerCollector("dscp", "per-DSCP class speeds via eBPF socket filters", false, startDSCPCollector).
+		requires(capBPF, capNetRaw).
+		checks(checkDSCPFlags)
+}
+
+type dscpCounter struct {
+	dscp, class, direction string
+	bytes, packets         uint64
+	speed                  float64
+}
+
+// dscpLabels returns the code point name and its class, e.g. af21 and af2.
+// The AF drop precedences share a class, the others are their own class.
+func dscpLabels(dscp int) (string, string) {
+	name, ok := dscpNames[dscp]
+	if !ok {
+		return strconv.Itoa(dscp), "other"
+	}
+	if strings.HasPrefix(name, "af") {
+		return name, name[:3]
+	}
+	return name, name
+}
+
+// dscpProgram adds the length and a packet of each IPv4 and IPv6 packet to
+// the map at dscp * 4 + direction * 2 + {0 bytes, 1 packets}
+func dscpProgram(mapFd int) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(
+		insn(bpfMov64Reg, bpfR6, bpfR1, 0, 0),
+		insn(bpfLdxMemW, bpfR7, bpfR6, 0, 0), // r7 = skb->len
+		insn(bpfMov64Imm, bpfR8, 0, 0, 0),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 4, 0), // r2 = skb->pkt_type
+		insn(bpfJneImm, bpfR2, 0, 1, unix.PACKET_OUTGOING),
+		insn(bpfMov64Imm, bpfR8, 0, 0, 2),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 16, 0), // r2 = skb->protocol
+	)
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IP)), "ipv4")
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IPV6)), "ipv6")
+	a.jump(bpfJa, 0, 0, "exit")
+
+	// The DSCP is the upper 6 bits of the IPv4 TOS byte and of the IPv6
+	// traffic class, bits 4 to 9 of the header
+	a.label("ipv4")
+	a.emit(
+		insn(bpfLdAbsB, 0, 0, 0, 1),
+		insn(bpfRsh64Imm, bpfR0, 0, 0, 2),
+	)
+	a.jump(bpfJa, 0, 0, "count")
+	a.label("ipv6")
+	a.emit(
+		insn(bpfLdAbsH, 0, 0, 0, 0),
+		insn(bpfRsh64Imm, bpfR0, 0, 0, 6),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0x3f),
+	)
+
+	a.label("count")
+	a.emit(
+		insn(bpfMov64Reg, bpfR9, bpfR0, 0, 0),
+		insn(bpfLsh64Imm, bpfR9, 0, 0, 2),
+		insn(bpfAdd64Reg, bpfR9, bpfR8, 0, 0),
+	)
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.emit(
+		insn(bpfAdd64Imm, bpfR9, 0, 0, 1),
+		insn(bpfMov64Imm, bpfR7, 0, 0, 1),
+	)
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.label("exit")
+	a.emit(
+		insn(bpfMov64Imm, bpfR0, 0, 0, 0),
+		insn(bpfExit, 0, 0, 0, 0),
+	)
+	return a.program()
+}
+
+// dscpCounters labels the counters of a classifier read, leaving out the
+// code points without any traffic
+func dscpCounters(counters, previous []uint64, elapsed float64) []dscpCounter {
+	var result []dscpCounter
+	for dscp := 0; dscp < 64; dscp++ {
+		if counters[dscp*4] == 0 && counters[dscp*4+2] == 0 {
+			continue
+		}
+		name, class := dscpLabels(dscp)
+		for dir, direction := range []string{"receive", "transmit"} {
+			key := dscp*4 + dir*2
+			result = append(result, dscpCounter{
+				dscp:      name,
+				class:     class,
+				direction: direction,
+				bytes:     counters[key],
+				packets:   counters[key+1],
+				speed:     counterRate(counters, previous, key, elapsed) * 8,
+			})
+		}
+	}
+	return result
+}
+
+// checkDSCPFlags validates --dscp.interfaces
+func checkDSCPFlags() error {
+	if _, err := regexp.Compile(*dscpInterfaces); err != nil {
+		return fmt.Errorf("invalid --dscp.interfaces: %w", err)
+	}
+	return nil
+}
+
+// startDSCPCollector starts attaching the classifier to the selected
+// interfaces
+func startDSCPCollector() error {
+	registerMetrics("dscp", dscpCollector{})
+	go collectDSCP(regexp.MustCompile(*dscpInterfaces))
+	return nil
+}
+
+// collectDSCP periodically refreshes the DSCP snapshot
+func collectDSCP(selected *regexp.Regexp) {
+	classifiers := &packetClassifiers{
+		name:     "DSCP",
+		selected: selected,
+		entries:  dscpMapEntries,
+		program:  dscpProgram,
+	}
+	for {
+		byIface := make(map[string][]dscpCounter)
+		for name, c := range classifiers.refresh() {
+			counters, previous, elapsed, err := c.read()
+			if err != nil {
+				log.Printf("Error reading the DSCP counters of %s: %v", name, err)
+				continue
+			}
+			byIface[name] = dscpCounters(counters, previous, elapsed)
+		}
+		dscpSnapshot.Lock()
+		dscpSnapshot.byIface = byIface
+		dscpSnapshot.Unlock()
+		time.Sleep(*dscpInterval)
+	}
+}
+
+// dscpCollector exports the last DSCP snapshot
+type dscpCollector struct{}
+
+func (dscpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dscpSpeedDesc
+	ch <- dscpBytesDesc
+	ch <- dscpPacketsDesc
+}
+
+func (dscpCollector) Collect(ch chan<- prometheus.Metric) {
+	dscpSnapshot.Lock()
+	defer dscpSnapshot.Unlock()
+	for name, counters := range dscpSnapshot.byIface {
+		for _, c := range counters {
+			ch <- prometheus.MustNewConstMetric(dscpSpeedDesc, prometheus.GaugeValue, c.speed, name, c.dscp, c.class, c.direction)
+			ch <- prometheus.MustNewConstMetric(dscpBytesDesc, prometheus.CounterValue, float64(c.bytes), name, c.dscp, c.class, c.direction)
+			ch <- prometheus.MustNewConstMetric(dscpPacketsDesc, prometheus.CounterValue, float64(c.packets), name, c.dscp, c.class, c.direction)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ethtoolIfreq is struct ifreq with the ethtool command buffer as ifr_data
+type ethtoolIfreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte // rest of the ifreq union
+}
+
+// ethtool runs an ethtool ioctl on an interface. buf holds the command
+// structure, starting with the ETHTOOL_* command number, and receives the reply.
+func ethtool(ifaceName string, buf []byte) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifr ethtoolIfreq
+	copy(ifr.name[:unix.IFNAMSIZ-1], ifaceName)
+	ifr.data = unsafe.Pointer(&buf[0])
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ethtoolCommand returns a zeroed command buffer of size bytes for cmd
+func ethtoolCommand(cmd uint32, size int) []byte {
+	buf := make([]byte, size)
+	binary.NativeEndian.PutUint32(buf, cmd)
+	return buf
+}
+
+// ethtoolDump dumps an ethtool netlink message type, e.g.
+// ETHTOOL_MSG_PAUSE_GET, for all interfaces and returns the attributes of the
+// replies by interface name. headerType is the type of the request header
+// attribute, flags the ETHTOOL_FLAG_* of the request.
+func ethtoolDump(c *genlConn, cmd uint8, headerType uint16, flags uint32) (map[string]map[uint16][]byte, error) {
+	replies, err := c.execute(cmd, unix.NLM_F_DUMP, nlAttrNested(headerType, nlAttrU32(unix.ETHTOOL_A_HEADER_FLAGS, flags)))
+	if err != nil {
+		return nil, err
+	}
+	byIface := make(map[string]map[uint16][]byte, len(replies))
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		name := nlString(nlAttrMap(attrs[headerType])[unix.ETHTOOL_A_HEADER_DEV_NAME])
+		if name != "" {
+			byIface[name] = attrs
+		}
+	}
+	return byIface, nil
+}
+
+// ethtoolBitset decodes a verbose (non-compact) ethtool bitset into the
+// names of its bits and whether they are set
+func ethtoolBitset(b []byte) map[string]bool {
+	set := nlAttrMap(b)
+	// A bitset without mask only lists the bits that are set
+	_, noMask := set[unix.ETHTOOL_A_BITSET_NOMASK]
+	bits := make(map[string]bool)
+	for _, bit := range nlAttrs(set[unix.ETHTOOL_A_BITSET_BITS]) {
+		if bit.typ != unix.ETHTOOL_A_BITSET_BITS_BIT {
+			continue
+		}
+		attrs := nlAttrMap(bit.value)
+		if name := nlString(attrs[unix.ETHTOOL_A_BITSET_BIT_NAME]); name != "" {
+			_, value := attrs[unix.ETHTOOL_A_BITSET_BIT_VALUE]
+			bits[name] = value || noMask
+		}
+	}
+	return bits
+}
+
+// String set of the driver statistics and the length of their names, from
+// linux/ethtool.h
+const (
+	ethSSStats      = 1
+	ethGStringLen   = 32
+	sizeofSsetInfo  = 16
+	sizeofGStrings  = 12
+	sizeofEthStats  = 8
+	ethtoolMaxStats = 1 << 16
+)
+
+// ethtoolStats reads the driver statistics of an interface as ethtool -S
+// shows them, by name
+func ethtoolStats(ifaceName string) (map[string]uint64, error) {
+	// struct ethtool_sset_info: cmd, reserved, sset_mask, then the count of
+	// each set in the mask
+	info := ethtoolCommand(unix.ETHTOOL_GSSET_INFO, sizeofSsetInfo+4)
+	binary.NativeEndian.PutUint64(info[8:], 1<<ethSSStats)
+	if err := ethtool(ifaceName, info); err != nil {
+		return nil, err
+	}
+	if binary.NativeEndian.Uint64(info[8:])&(1<<ethSSStats) == 0 {
+		return nil, nil
+	}
+	n := int(binary.NativeEndian.Uint32(info[sizeofSsetInfo:]))
+	if n == 0 || n > ethtoolMaxStats {
+		return nil, nil
+	}
+
+	// struct ethtool_gstrings: cmd, string_set, len, then the names
+	names := ethtoolCommand(unix.ETHTOOL_GSTRINGS, sizeofGStrings+n*ethGStringLen)
+	binary.NativeEndian.PutUint32(names[4:], ethSSStats)
+	binary.NativeEndian.PutUint32(names[8:], uint32(n))
+	if err := ethtool(ifaceName, names); err != nil {
+		return nil, err
+	}
+	// struct ethtool_stats: cmd, n_stats, then the values
+	values := ethtoolCommand(unix.ETHTOOL_GSTATS, sizeofEthStats+n*8)
+	binary.NativeEndian.PutUint32(values[4:], uint32(n))
+	if err := ethtool(ifaceName, values); err != nil {
+		return nil, err
+	}
+	// The driver may have returned fewer statistics than it announced
+	n = min(n, int(binary.NativeEndian.Uint32(values[4:])))
+	stats := make(map[string]uint64, n)
+	for i := 0; i < n; i++ {
+		name := nlString(names[sizeofGStrings+i*ethGStringLen : sizeofGStrings+(i+1)*ethGStringLen])
+		stats[name] = binary.NativeEndian.Uint64(values[sizeofEthStats+i*8:])
+	}
+	return stats, nil
+}
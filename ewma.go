@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ewmaHalfLife = flag.Duration("speed.ewma-half-life", 0, "Half-life of the exponentially weighted moving average speed, e.g. 30s; 0 disables unless --speed.ewma-alpha is set")
+	ewmaAlpha    = flag.Float64("speed.ewma-alpha", 0, "Fixed smoothing factor (0 < alpha <= 1) applied per collection cycle, instead of --speed.ewma-half-life")
+
+	networkSpeedEWMA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_ewma_bits",
+			Help: "Exponentially weighted moving average of the network interface speed in bits per second",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	// Smoothed speeds per interface; index 0 is receive and index 1 transmit
+	ewmaSpeeds = struct {
+		sync.Mutex
+		byIface map[string]*ewmaState
+	}{
+		byIface: make(map[string]*ewmaState),
+	}
+)
+
+func init() {
+	registerMetrics("ewma", networkSpeedEWMA)
+}
+
+type ewmaState struct {
+	value [2]float64
+	time  time.Time
+}
+
+// validateEWMAFlags checks the smoothing flags
+func validateEWMAFlags() error {
+	if *ewmaAlpha != 0 && *ewmaHalfLife != 0 {
+		return fmt.Errorf("--speed.ewma-alpha and --speed.ewma-half-life are mutually exclusive")
+	}
+	if *ewmaAlpha < 0 || *ewmaAlpha > 1 {
+		return fmt.Errorf("invalid --speed.ewma-alpha %v, expected 0 < alpha <= 1", *ewmaAlpha)
+	}
+	if *ewmaHalfLife < 0 {
+		return fmt.Errorf("invalid --speed.ewma-half-life %s", *ewmaHalfLife)
+	}
+	return nil
+}
+
+// smoothingFactor returns the weight of a new sample taken elapsed after the
+// previous one. With a half-life the weight depends on the elapsed time, so
+// late or skipped cycles don't change how fast the average decays.
+func smoothingFactor(elapsed time.Duration) float64 {
+	if *ewmaAlpha != 0 {
+		return *ewmaAlpha
+	}
+	return 1 - math.Exp(-math.Ln2*elapsed.Seconds()/ewmaHalfLife.Seconds())
+}
+
+// updateEWMA folds the speeds of a collection cycle into the moving averages
+func updateEWMA(stats []interfaceStats) {
+	if *ewmaAlpha == 0 && *ewmaHalfLife == 0 {
+		return
+	}
+	ewmaSpeeds.Lock()
+	defer ewmaSpeeds.Unlock()
+
+	for _, s := range stats {
+		if !s.HasSpeed {
+			continue
+		}
+		speeds := [2]float64{s.RxSpeed, s.TxSpeed}
+		st, ok := ewmaSpeeds.byIface[s.Name]
+		if !ok {
+			// Seed with the first speed rather than decaying up from zero
+			st = &ewmaState{value: speeds}
+			ewmaSpeeds.byIface[s.Name] = st
+		} else {
+			alpha := smoothingFactor(s.Time.Sub(st.time))
+			for i := range speeds {
+				st.value[i] += alpha * (speeds[i] - st.value[i])
+			}
+		}
+		st.time = s.Time
+
+		networkSpeedEWMA.With(prometheus.Labels{"interface": s.Name, "direction": "receive"}).Set(st.value[0])
+		networkSpeedEWMA.With(prometheus.Labels{"interface": s.Name, "direction": "transmit"}).Set(st.value[1])
+	}
+}
+
+// forgetEWMA drops the moving averages of a removed interface
+func forgetEWMA(name string) {
+	ewmaSpeeds.Lock()
+	defer ewmaSpeeds.Unlock()
+	delete(ewmaSpeeds.byIface, name)
+	networkSpeedEWMA.DeletePartialMatch(prometheus.Labels{"interface": name})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	flapWindow    = flag.Duration("flap.window", 5*time.Minute, "Window in which operstate transitions are counted for flap detection")
+	flapThreshold = flag.Int("flap.threshold", 3, "An interface is flapping when it has more than this many operstate transitions within --flap.window")
+
+	networkStateChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "network_interface_state_changes_total",
+			Help: "Number of operstate transitions of the network interface",
+		},
+		[]string{"interface"},
+	)
+
+	networkFlapping = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_flapping",
+			Help: "Whether the network interface changed operstate more than --flap.threshold times within --flap.window (1) or not (0)",
+		},
+		[]string{"interface"},
+	)
+
+	// Last operstate and recent transition times per interface
+	operStates = struct {
+		sync.Mutex
+		byIface map[string]*operStateHistory
+	}{
+		byIface: make(map[string]*operStateHistory),
+	}
+)
+
+func init() {
+	registerMetrics("flap", networkStateChanges)
+	registerMetrics("flap", networkFlapping)
+}
+
+type operStateHistory struct {
+	state       string
+	transitions []time.Time
+}
+
+// validateFlapFlags checks the flap detection flags
+func validateFlapFlags() error {
+	if *flapWindow <= 0 {
+		return fmt.Errorf("invalid --flap.window %s", *flapWindow)
+	}
+	if *flapThreshold < 0 {
+		return fmt.Errorf("invalid --flap.threshold %d", *flapThreshold)
+	}
+	return nil
+}
+
+// recordOperState notes the operstate of an interface as seen in sysfs or a
+// link notification, counting a transition if it changed
+func recordOperState(name, state string, now time.Time) {
+	if state == "" {
+		return
+	}
+	operStates.Lock()
+	defer operStates.Unlock()
+
+	h, ok := operStates.byIface[name]
+	if !ok {
+		operStates.byIface[name] = &operStateHistory{state: state}
+		networkStateChanges.WithLabelValues(name)
+		networkFlapping.WithLabelValues(name).Set(0)
+		return
+	}
+	if h.state == state {
+		return
+	}
+	h.state = state
+	h.transitions = append(h.transitions, now)
+	networkStateChanges.WithLabelValues(name).Inc()
+	if len(h.transitions) > *flapThreshold {
+		networkFlapping.WithLabelValues(name).Set(1)
+	}
+}
+
+// updateFlapping expires transitions older than --flap.window, so an
+// interface stops flapping once it has been stable long enough
+func updateFlapping(now time.Time) {
+	operStates.Lock()
+	defer operStates.Unlock()
+	for name, h := range operStates.byIface {
+		i := 0
+		for i < len(h.transitions) && now.Sub(h.transitions[i]) > *flapWindow {
+			i++
+		}
+		h.transitions = h.transitions[i:]
+		flapping := 0.0
+		if len(h.transitions) > *flapThreshold {
+			flapping = 1
+		}
+		networkFlapping.WithLabelValues(name).Set(flapping)
+	}
+}
+
+// forgetFlaps drops the state history of a removed interface
+func forgetFlaps(name string) {
+	operStates.Lock()
+	delete(operStates.byIface, name)
+	operStates.Unlock()
+	networkStateChanges.DeleteLabelValues(name)
+	networkFlapping.DeleteLabelValues(name)
+}
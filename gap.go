@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	speedMaxGap = flag.Duration("speed.max-gap", 10*time.Second, "Skip the speeds of a collection cycle that comes this long after the previous one, e.g. after a stall or suspend, instead of exporting the average over the gap; 0 disables")
+
+	collectionGaps = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "network_interface_collection_gaps_total",
+			Help: "Number of collection cycles whose speeds were skipped because they came longer than --speed.max-gap after the previous one",
+		},
+	)
+
+	sampleAgeDesc = prometheus.NewDesc("network_interface_sample_age_seconds",
+		"Seconds since the speed of the interface was last computed", []string{"interface"}, nil)
+
+	// When the speed of each interface was last computed, with the monotonic
+	// clock reading of time.Now
+	sampleTimes = struct {
+		sync.Mutex
+		byIface map[string]time.Time
+	}{byIface: make(map[string]time.Time)}
+)
+
+func init() {
+	registerMetrics("exporter", collectionGaps)
+	registerMetrics("exporter", sampleAgeCollector{})
+}
+
+// recordSampleTimes notes the interfaces that got a speed in a collection cycle
+func recordSampleTimes(stats []interfaceStats) {
+	sampleTimes.Lock()
+	defer sampleTimes.Unlock()
+	for _, s := range stats {
+		if s.HasSpeed {
+			sampleTimes.byIface[s.Name] = s.Time
+		}
+	}
+}
+
+// forgetSampleTime drops the sample time of a removed interface
+func forgetSampleTime(name string) {
+	sampleTimes.Lock()
+	defer sampleTimes.Unlock()
+	delete(sampleTimes.byIface, name)
+}
+
+// sampleAgeCollector exports the age of the speeds at scrape time. The age
+// is measured on the monotonic clock, so NTP steps don't change it.
+type sampleAgeCollector struct{}
+
+func (sampleAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sampleAgeDesc
+}
+
+func (sampleAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	sampleTimes.Lock()
+	defer sampleTimes.Unlock()
+	for name, t := range sampleTimes.byIface {
+		ch <- prometheus.MustNewConstMetric(sampleAgeDesc, prometheus.GaugeValue, time.Since(t).Seconds(), name)
+	}
+}
+
+// countGaps counts a collection cycle in which speeds were skipped for a gap
+func countGaps(stats []interfaceStats) {
+	for _, s := range stats {
+		if s.Gap {
+			collectionGaps.Inc()
+			return
+		}
+	}
+}
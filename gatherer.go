@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// labelsFlag collects key=value pairs from repeated or comma-separated --labels flags
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	return formatPairs(l)
+}
+
+func (l labelsFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label %q is reserved for the exporter's series", name)
+		}
+		l[name] = val
+	}
+	return nil
+}
+
+// Labels the exporter adds to its series or that identify the interface and
+// the host of a series; the collectors' own labels are checked by
+// validateStaticLabels
+var reservedLabels = map[string]bool{
+	"interface":     true,
+	"device":        true,
+	"direction":     true,
+	"host":          true,
+	"alias":         true,
+	"vrf":           true,
+	"tunnel_type":   true,
+	"tunnel_local":  true,
+	"tunnel_remote": true,
+	"tunnel_id":     true,
+}
+
+// formatPairs formats a map as sorted, comma-separated key=value pairs
+func formatPairs(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + m[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// aliasesFlag collects interface=alias pairs from repeated or comma-separated --interface.aliases flags
+type aliasesFlag map[string]string
+
+func (a aliasesFlag) String() string {
+	return formatPairs(a)
+}
+
+func (a aliasesFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, alias, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || alias == "" {
+			return fmt.Errorf("invalid interface alias %q, expected interface=alias", pair)
+		}
+		a[name] = alias
+	}
+	return nil
+}
+
+var (
+	staticLabels     = labelsFlag{}
+	interfaceAliases = aliasesFlag{}
+
+	hostnameLabel  = flag.Bool("labels.hostname", false, "Add the hostname as a hostname label to every series, for pushed metrics that get no instance label from a scrape")
+	machineIDLabel = flag.Bool("labels.machine-id", false, "Add the contents of /etc/machine-id as a machine_id label to every series")
+)
+
+// Where the machine ID is kept, the second on systems without systemd
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+func init() {
+	flag.Var(staticLabels, "labels", "Constant labels added to every series as name=value, e.g. site=ams1,role=edge; repeatable or comma-separated")
+
+	flag.Var(interfaceAliases, "interface.aliases", "Interface aliases as interface=alias, e.g. eth0=uplink-core1; replace the ifalias description and add an alias label to the interface's series")
+
+	// The environment is the base the flags add to
+	for env, value := range map[string]flag.Value{"LABELS": staticLabels, "INTERFACE_ALIASES": interfaceAliases} {
+		if v := os.Getenv(env); v != "" {
+			if err := value.Set(v); err != nil {
+				log.Fatalf("Invalid %s: %v", env, err)
+			}
+		}
+	}
+}
+
+// addHostLabels adds the labels of --labels.hostname and --labels.machine-id
+// to the --labels
+func addHostLabels() error {
+	if *hostnameLabel {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		staticLabels["hostname"] = hostname
+	}
+	if *machineIDLabel {
+		var err error
+		for _, file := range machineIDFiles {
+			var data []byte
+			if data, err = os.ReadFile(file); err == nil {
+				if id := strings.TrimSpace(string(data)); id != "" {
+					staticLabels["machine_id"] = id
+					return nil
+				}
+				err = fmt.Errorf("%s is empty", file)
+			}
+		}
+		return fmt.Errorf("reading the machine ID: %w", err)
+	}
+	return nil
+}
+
+// validateStaticLabels checks that no series of the collectors registered so
+// far has a label of --labels; registerMetrics checks those registered later
+func validateStaticLabels() error {
+	return checkStaticLabels(registeredCollectors...)
+}
+
+// checkStaticLabels returns an error if a series of the collectors has a
+// label of --labels, which would fail every scrape
+func checkStaticLabels(cs ...prometheus.Collector) error {
+	if len(staticLabels) == 0 {
+		return nil
+	}
+	for _, c := range cs {
+		// Wrapping checks the labels against those of every Desc
+		r := prometheus.WrapRegistererWith(prometheus.Labels(staticLabels), prometheus.NewRegistry())
+		if err := r.Register(c); err != nil {
+			return fmt.Errorf("--labels collide with the labels of a series: %w", err)
+		}
+	}
+	return nil
+}
+
+// aliasLabel returns the alias label to add to a series, if the series
+// belongs to an interface with a configured alias; the node_exporter
+// compatible series name it device
+func aliasLabel(m *dto.Metric) (*dto.LabelPair, bool) {
+	for _, lp := range m.Label {
+		if name := lp.GetName(); name == "interface" || name == "device" {
+			if alias, ok := interfaceAliases[lp.GetValue()]; ok {
+				return &dto.LabelPair{Name: stringPtr("alias"), Value: stringPtr(alias)}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// defaultMetricsPrefix is the prefix of the per-interface metric names
+const defaultMetricsPrefix = "network_interface"
+
+var metricsPrefix = flag.String("metrics.prefix", defaultMetricsPrefix, "Prefix replacing "+defaultMetricsPrefix+" in the names of the per-interface metrics")
+
+// validateMetricsPrefix checks that --metrics.prefix yields valid metric names
+func validateMetricsPrefix() error {
+	if !model.IsValidMetricName(model.LabelValue(*metricsPrefix)) {
+		return fmt.Errorf("invalid --metrics.prefix %q", *metricsPrefix)
+	}
+	return nil
+}
+
+var speedUnit = flag.String("speed.unit", "bits", "Unit of the speed metrics: bits, bytes (network_interface_speed_bytes etc. in bytes per second) or both")
+
+// validateSpeedUnit checks --speed.unit
+func validateSpeedUnit() error {
+	switch *speedUnit {
+	case "bits", "bytes", "both":
+		return nil
+	}
+	return fmt.Errorf("invalid --speed.unit %q, expected bits, bytes or both", *speedUnit)
+}
+
+// Traffic speeds in bits per second besides the speed and its derivatives,
+// whose dashboards compare them with the speed. Link speeds, bitrates and
+// configured rates are capacities and stay in bits.
+var otherSpeedFamilies = map[string]bool{
+	"network_vrf_speed_bits":                               true,
+	defaultMetricsPrefix + "_traffic_baseline_bits":        true,
+	defaultMetricsPrefix + "_traffic_baseline_stddev_bits": true,
+	defaultMetricsPrefix + "_dscp_speed_bits":              true,
+	defaultMetricsPrefix + "_protocol_speed_bits":          true,
+	defaultMetricsPrefix + "_gtpu_speed_bits":              true,
+}
+
+// isSpeedFamily reports whether a family, before renaming to --metrics.prefix,
+// is one of the speeds in bits per second --speed.unit applies to: the speed
+// and its windows, moving average, groups and aggregates, and the traffic
+// speeds of otherSpeedFamilies
+func isSpeedFamily(name string) bool {
+	return strings.HasPrefix(name, defaultMetricsPrefix+"_speed_") && strings.HasSuffix(name, "_bits") || otherSpeedFamilies[name]
+}
+
+// speedBytesFamily returns a copy of a speed family in bytes per second
+func speedBytesFamily(mf *dto.MetricFamily) *dto.MetricFamily {
+	bytes := &dto.MetricFamily{
+		Name: stringPtr(strings.TrimSuffix(mf.GetName(), "_bits") + "_bytes"),
+		Help: stringPtr(strings.ReplaceAll(mf.GetHelp(), "bits per second", "bytes per second")),
+		Type: mf.Type,
+	}
+	for _, m := range mf.Metric {
+		if m.Gauge == nil {
+			continue
+		}
+		value := m.Gauge.GetValue() / 8
+		labels := make([]*dto.LabelPair, len(m.Label))
+		copy(labels, m.Label)
+		bytes.Metric = append(bytes.Metric, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: &value}, TimestampMs: m.TimestampMs})
+	}
+	return bytes
+}
+
+// metricsGatherer wraps g, converting the speeds to --speed.unit, renaming the
+// per-interface metrics to --metrics.prefix, adding alias, vrf and tunnel
+// labels and the --labels to every series
+func metricsGatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return relabelGatherer(g, true)
+}
+
+// relabelGatherer is metricsGatherer, adding the alias, vrf and tunnel labels
+// only if the interfaces of g are the exporter's own
+func relabelGatherer(g prometheus.Gatherer, local bool) prometheus.Gatherer {
+	interfaceLabels := local && (len(interfaceAliases) > 0 || vrfEnabled.Load() || tunnelsEnabled.Load())
+	if len(staticLabels) == 0 && !interfaceLabels && *metricsPrefix == defaultMetricsPrefix && *speedUnit == "bits" {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if *speedUnit != "bits" {
+			converted := families[:0:0]
+			for _, mf := range families {
+				if !isSpeedFamily(mf.GetName()) {
+					converted = append(converted, mf)
+					continue
+				}
+				if *speedUnit == "both" {
+					converted = append(converted, mf)
+				}
+				converted = append(converted, speedBytesFamily(mf))
+			}
+			families = converted
+		}
+		for _, mf := range families {
+			if rest, ok := strings.CutPrefix(mf.GetName(), defaultMetricsPrefix+"_"); ok {
+				mf.Name = stringPtr(*metricsPrefix + "_" + rest)
+			}
+			for _, m := range mf.Metric {
+				// Aliases, VRFs and tunnels are those of local interfaces
+				if interfaceLabels && !isRemoteSeries(m) {
+					if lp, ok := aliasLabel(m); ok {
+						m.Label = append(m.Label, lp)
+					}
+					if lp, ok := vrfLabel(m); ok {
+						m.Label = append(m.Label, lp)
+					}
+					m.Label = append(m.Label, tunnelLabels(m)...)
+				}
+				for name, value := range staticLabels {
+					for _, lp := range m.Label {
+						if lp.GetName() == name {
+							return nil, fmt.Errorf("label %q of --labels collides with a label of %s", name, mf.GetName())
+						}
+					}
+					m.Label = append(m.Label, &dto.LabelPair{Name: stringPtr(name), Value: stringPtr(value)})
+				}
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+		// Renaming can reorder the families
+		sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+		return families, err
+	})
+}
+
+// stringPtr returns a pointer to s, as the protobuf structs expect
+func stringPtr(s string) *string {
+	return &s
+}
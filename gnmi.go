@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	gnmiTargets            = flag.String("gnmi.targets", "", "Comma-separated gNMI targets to subscribe to the OpenConfig interface counters of as host[:port], port 9339 by default")
+	gnmiInterval           = flag.Duration("gnmi.interval", 10*time.Second, "Sample interval requested from the gNMI targets")
+	gnmiUsername           = flag.String("gnmi.username", "", "gNMI username")
+	gnmiPassword           = flag.String("gnmi.password", "", "gNMI password; needs --gnmi.username")
+	gnmiPasswordFile       = flag.String("gnmi.password-file", "", "File containing the gNMI password; mutually exclusive with --gnmi.password")
+	gnmiEncoding           = flag.String("gnmi.encoding", "proto", "Encoding requested from the gNMI targets: proto, json or json_ietf")
+	gnmiCAFile             = flag.String("gnmi.ca-file", "", "PEM file with the CA certificates to verify the gNMI targets with, the system ones when empty")
+	gnmiInsecureSkipVerify = flag.Bool("gnmi.insecure-skip-verify", false, "Don't verify the certificates of the gNMI targets")
+)
+
+// gNMI Encoding values
+var gnmiEncodings = map[string]uint64{"json": 0, "proto": 2, "json_ietf": 4}
+
+// SubscriptionMode SAMPLE of gNMI
+const gnmiModeSample = 2
+
+// Leaves of an OpenConfig interface, relative to /interfaces/interface
+const (
+	gnmiInOctets = "state/counters/in-octets"
+	gnmiPrefix   = "state/"
+)
+
+func init() {
+	registerCollector("gnmi", "OpenConfig interface counters of routers and switches streamed over gNMI, with a host label", false, startGNMICollector).
+		checks(checkGNMIFlags)
+}
+
+// pbField is a decoded protobuf field, bytes for length-delimited ones
+type pbField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// pbDecode splits a protobuf message into its fields
+func pbDecode(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := pbField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.varint, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.varint = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// gnmiPath encodes a Path of element names without keys, matching all
+// list entries
+func gnmiPath(names ...string) []byte {
+	var path []byte
+	for _, name := range names {
+		elem := protowire.AppendTag(nil, 1, protowire.BytesType)
+		elem = protowire.AppendString(elem, name)
+		path = protowire.AppendTag(path, 3, protowire.BytesType)
+		path = protowire.AppendBytes(path, elem)
+	}
+	return path
+}
+
+// gnmiSubscribeRequest encodes a SubscribeRequest for a stream of samples of
+// the state of all interfaces
+func gnmiSubscribeRequest(encoding uint64, interval time.Duration) []byte {
+	var sub []byte
+	sub = protowire.AppendTag(sub, 1, protowire.BytesType)
+	sub = protowire.AppendBytes(sub, gnmiPath("interfaces", "interface", "state"))
+	sub = protowire.AppendTag(sub, 2, protowire.VarintType)
+	sub = protowire.AppendVarint(sub, gnmiModeSample)
+	sub = protowire.AppendTag(sub, 3, protowire.VarintType)
+	sub = protowire.AppendVarint(sub, uint64(interval.Nanoseconds()))
+
+	// Mode STREAM is the default
+	var list []byte
+	list = protowire.AppendTag(list, 2, protowire.BytesType)
+	list = protowire.AppendBytes(list, sub)
+	list = protowire.AppendTag(list, 8, protowire.VarintType)
+	list = protowire.AppendVarint(list, encoding)
+
+	req := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, list)
+}
+
+// gnmiElem is an element of a gNMI path
+type gnmiElem struct {
+	name string
+	keys map[string]string
+}
+
+// gnmiDecodePath decodes the elements of a Path
+func gnmiDecodePath(b []byte) ([]gnmiElem, error) {
+	fields, err := pbDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	var elems []gnmiElem
+	for _, f := range fields {
+		if f.num != 3 || f.typ != protowire.BytesType {
+			continue
+		}
+		elemFields, err := pbDecode(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		elem := gnmiElem{keys: make(map[string]string)}
+		for _, ef := range elemFields {
+			switch {
+			case ef.num == 1 && ef.typ == protowire.BytesType:
+				elem.name = string(ef.bytes)
+			case ef.num == 2 && ef.typ == protowire.BytesType:
+				entry, err := pbDecode(ef.bytes)
+				if err != nil {
+					return nil, err
+				}
+				var key, value string
+				for _, kv := range entry {
+					if kv.num == 1 {
+						key = string(kv.bytes)
+					} else if kv.num == 2 {
+						value = string(kv.bytes)
+					}
+				}
+				elem.keys[key] = value
+			}
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// gnmiDecodeValue decodes a TypedValue into leaves by their path relative to
+// the update. Scalars are a single leaf with an empty path, JSON objects are
+// flattened.
+func gnmiDecodeValue(b []byte) (map[string]string, error) {
+	fields, err := pbDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make(map[string]string)
+	for _, f := range fields {
+		switch f.num {
+		case 1, 12: // string_val, ascii_val
+			leaves[""] = string(f.bytes)
+		case 2: // int_val
+			leaves[""] = strconv.FormatInt(int64(f.varint), 10)
+		case 3: // uint_val
+			leaves[""] = strconv.FormatUint(f.varint, 10)
+		case 4: // bool_val
+			leaves[""] = strconv.FormatBool(f.varint != 0)
+		case 6: // float_val
+			leaves[""] = strconv.FormatFloat(float64(math.Float32frombits(uint32(f.varint))), 'g', -1, 32)
+		case 14: // double_val
+			leaves[""] = strconv.FormatFloat(math.Float64frombits(f.varint), 'g', -1, 64)
+		case 10, 11: // json_val, json_ietf_val
+			d := json.NewDecoder(bytes.NewReader(f.bytes))
+			d.UseNumber()
+			var v any
+			if err := d.Decode(&v); err != nil {
+				return nil, err
+			}
+			flattenJSON(leaves, "", v)
+		}
+	}
+	return leaves, nil
+}
+
+// flattenJSON adds the scalars of a JSON value to leaves by their path,
+// without the module prefixes of JSON_IETF member names
+func flattenJSON(leaves map[string]string, path string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for name, member := range v {
+			if i := strings.LastIndex(name, ":"); i >= 0 {
+				name = name[i+1:]
+			}
+			if path != "" {
+				name = path + "/" + name
+			}
+			flattenJSON(leaves, name, member)
+		}
+	case []any:
+	case nil:
+	default:
+		leaves[path] = fmt.Sprint(v)
+	}
+}
+
+// gnmiClient keeps the leaves streamed by a target
+type gnmiClient struct {
+	host   *remoteHost
+	client *http.Client
+	url    string
+	// Sent with the username of --gnmi.username
+	password string
+	// Leaves by interface and path relative to /interfaces/interface
+	leaves map[string]map[string]string
+	// Timestamps of the octet counters by interface
+	times map[string]time.Time
+}
+
+// notification applies the updates of a Notification
+func (c *gnmiClient) notification(b []byte) error {
+	fields, err := pbDecode(b)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now()
+	var prefix []gnmiElem
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType && f.varint != 0:
+			timestamp = time.Unix(0, int64(f.varint))
+		case f.num == 2 && f.typ == protowire.BytesType:
+			if prefix, err = gnmiDecodePath(f.bytes); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range fields {
+		if f.num != 4 || f.typ != protowire.BytesType {
+			continue
+		}
+		update, err := pbDecode(f.bytes)
+		if err != nil {
+			return err
+		}
+		path := prefix
+		var values map[string]string
+		for _, uf := range update {
+			switch uf.num {
+			case 1:
+				elems, err := gnmiDecodePath(uf.bytes)
+				if err != nil {
+					return err
+				}
+				path = append(append([]gnmiElem(nil), prefix...), elems...)
+			case 3:
+				if values, err = gnmiDecodeValue(uf.bytes); err != nil {
+					return err
+				}
+			}
+		}
+		c.apply(path, values, timestamp)
+	}
+	return nil
+}
+
+// apply stores the leaves of an update below /interfaces/interface[name]
+func (c *gnmiClient) apply(path []gnmiElem, values map[string]string, timestamp time.Time) {
+	for i, elem := range path {
+		name, ok := elem.keys["name"]
+		if elem.name != "interface" || !ok {
+			continue
+		}
+		var names []string
+		for _, e := range path[i+1:] {
+			names = append(names, e.name)
+		}
+		base := strings.Join(names, "/")
+		leaves := c.leaves[name]
+		if leaves == nil {
+			leaves = make(map[string]string)
+			c.leaves[name] = leaves
+		}
+		for leaf, value := range values {
+			if leaf = strings.Trim(base+"/"+leaf, "/"); leaf == gnmiInOctets {
+				c.times[name] = timestamp
+			}
+			leaves[leaf] = value
+		}
+		return
+	}
+}
+
+// sample returns the interfaces with counters as a sample, timestamped by
+// the target
+func (c *gnmiClient) sample() remoteSample {
+	s := remoteSample{
+		counters: make(map[string]netspeed.Counters),
+		links:    make(map[string]remoteLink),
+		times:    make(map[string]time.Time),
+	}
+	for name, leaves := range c.leaves {
+		t, ok := c.times[name]
+		if !ok {
+			continue
+		}
+		counter := func(leaf string) uint64 {
+			v, _ := strconv.ParseUint(leaves[gnmiPrefix+"counters/"+leaf], 10, 64)
+			return v
+		}
+		s.counters[name] = netspeed.Counters{
+			RxBytes:   counter("in-octets"),
+			TxBytes:   counter("out-octets"),
+			RxPackets: counter("in-unicast-pkts") + counter("in-multicast-pkts") + counter("in-broadcast-pkts"),
+			TxPackets: counter("out-unicast-pkts") + counter("out-multicast-pkts") + counter("out-broadcast-pkts"),
+			RxErrors:  counter("in-errors"),
+			TxErrors:  counter("out-errors"),
+			RxDrops:   counter("in-discards"),
+			TxDrops:   counter("out-discards"),
+		}
+		admin := leaves[gnmiPrefix+"admin-status"]
+		s.links[name] = remoteLink{
+			up:          admin == "" || admin == "UP",
+			loopback:    strings.HasSuffix(leaves[gnmiPrefix+"type"], "softwareLoopback"),
+			description: leaves[gnmiPrefix+"description"],
+			mtu:         leaves[gnmiPrefix+"mtu"],
+			// LOWER_LAYER_DOWN as lowerlayerdown, like the operstate of
+			// local interfaces
+			operstate: strings.ToLower(strings.ReplaceAll(leaves[gnmiPrefix+"oper-status"], "_", "")),
+		}
+		s.times[name] = t
+	}
+	return s
+}
+
+// session subscribes to the target and updates the host every
+// --gnmi.interval until the stream fails
+func (c *gnmiClient) session(request []byte) error {
+	body, w := io.Pipe()
+	defer w.Close()
+	req, err := http.NewRequest(http.MethodPost, c.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if *gnmiUsername != "" {
+		req.Header.Set("username", *gnmiUsername)
+		req.Header.Set("password", c.password)
+	}
+	// The request stream stays open for the lifetime of the subscription
+	go func() {
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(request)))
+		w.Write(append(frame, request...))
+	}()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("target answered with %s instead of HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	// Errors before the first message come in the headers
+	if err := grpcStatus(resp.Header); err != nil {
+		return err
+	}
+
+	// Targets send a sample every interval, a silent stream is a dead one
+	timeout := 3**gnmiInterval + 30*time.Second
+	watchdog := time.AfterFunc(timeout, func() { resp.Body.Close() })
+	defer watchdog.Stop()
+	c.leaves, c.times = make(map[string]map[string]string), make(map[string]time.Time)
+	synced := false
+	var last time.Time
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				if err := grpcStatus(resp.Trailer); err != nil {
+					return err
+				}
+				return errors.New("subscription ended")
+			}
+			return err
+		}
+		if header[0] != 0 {
+			return errors.New("compressed gRPC message")
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > 64<<20 {
+			return fmt.Errorf("gRPC message of %d bytes", size)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return err
+		}
+		watchdog.Reset(timeout)
+
+		fields, err := pbDecode(msg)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			switch {
+			case f.num == 1 && f.typ == protowire.BytesType:
+				if err := c.notification(f.bytes); err != nil {
+					return err
+				}
+			case f.num == 3 && f.typ == protowire.VarintType:
+				synced = f.varint != 0
+			}
+		}
+		// The first sample once the initial state is complete
+		if synced && time.Since(last) >= *gnmiInterval {
+			c.host.update(c.sample())
+			last = time.Now()
+		}
+	}
+}
+
+// grpcStatus returns the error of a gRPC status, nil for OK or no status
+func grpcStatus(h http.Header) error {
+	code := h.Get("Grpc-Status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	return fmt.Errorf("gRPC status %s: %s", code, h.Get("Grpc-Message"))
+}
+
+// run keeps a subscription to the target, resubscribing after failures
+func (c *gnmiClient) run(request []byte) {
+	for {
+		err := c.session(request)
+		log.Printf("Error streaming from gNMI target %s: %v", c.host.destination, err)
+		c.host.down()
+		time.Sleep(max(*gnmiInterval, 10*time.Second))
+	}
+}
+
+// checkGNMIFlags validates --gnmi.encoding, --gnmi.targets and the password
+func checkGNMIFlags() error {
+	if _, ok := gnmiEncodings[*gnmiEncoding]; !ok {
+		return fmt.Errorf("unsupported --gnmi.encoding %q", *gnmiEncoding)
+	}
+	if strings.Trim(*gnmiTargets, ", ") == "" {
+		return errors.New("--gnmi.targets is required")
+	}
+	password, err := secretValue("gnmi.password", *gnmiPassword, *gnmiPasswordFile)
+	if err != nil {
+		return err
+	}
+	if password != "" && *gnmiUsername == "" {
+		return errors.New("--gnmi.password needs --gnmi.username")
+	}
+	return nil
+}
+
+// startGNMICollector subscribes to the gNMI targets
+func startGNMICollector() error {
+	encoding := gnmiEncodings[*gnmiEncoding]
+	tlsConfig := &tls.Config{InsecureSkipVerify: *gnmiInsecureSkipVerify}
+	if *gnmiCAFile != "" {
+		pem, err := os.ReadFile(*gnmiCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", *gnmiCAFile)
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+	password, err := secretValue("gnmi.password", *gnmiPassword, *gnmiPasswordFile)
+	if err != nil {
+		return err
+	}
+
+	var clients []*gnmiClient
+	for _, target := range strings.Split(*gnmiTargets, ",") {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+		address := target
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			address = net.JoinHostPort(strings.Trim(target, "[]"), "9339")
+		}
+		clients = append(clients, &gnmiClient{
+			host:     &remoteHost{destination: target, source: "gnmi"},
+			client:   client,
+			url:      "https://" + address + "/gnmi.gNMI/Subscribe",
+			password: password,
+		})
+	}
+	hosts := make([]*remoteHost, len(clients))
+	for i, c := range clients {
+		hosts[i] = c.host
+	}
+	addRemoteHosts(hosts)
+	request := gnmiSubscribeRequest(encoding, *gnmiInterval)
+	for _, c := range clients {
+		go c.run(request)
+	}
+	return nil
+}
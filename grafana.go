@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// grafanaPanel is a time series panel of the generated dashboard. In the
+// queries {prefix} stands for --metrics.prefix and {speed} for the unit
+// suffix of the speed families; the unit "speed" follows --speed.unit.
+type grafanaPanel struct {
+	title, expr, legend, unit string
+}
+
+// Per-interface panels every dashboard starts with
+var grafanaInterfacePanels = []grafanaPanel{
+	{"Speed", `{prefix}_speed_{speed}{interface=~"$interface"}`, "{{interface}} {{direction}}", "speed"},
+	{"Packets", `rate({prefix}_packets_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{direction}}", "pps"},
+	{"Errors", `rate({prefix}_errors_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{direction}}", "pps"},
+	{"Drops", `rate({prefix}_drops_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{direction}}", "pps"},
+}
+
+// Panels of the derived metrics, added when their flags enable them
+var grafanaFeaturePanels = []struct {
+	title   string
+	enabled func() bool
+	panels  []grafanaPanel
+}{
+	{"Smoothed Speed", func() bool { return *ewmaHalfLife != 0 || *ewmaAlpha != 0 }, []grafanaPanel{
+		{"Smoothed speed", `{prefix}_speed_ewma_{speed}{interface=~"$interface"}`, "{{interface}} {{direction}}", "speed"},
+	}},
+	{"DDoS Indicators", func() bool { return *ddosIndicators }, []grafanaPanel{
+		{"Packets per second", `{prefix}_packets_per_second{interface=~"$interface"}`, "{{interface}} {{direction}}", "pps"},
+		{"Average packet size", `{prefix}_average_packet_size_bytes{interface=~"$interface"}`, "{{interface}} {{direction}}", "decbytes"},
+		{"Small-packet floods", `{prefix}_small_packet_flood{interface=~"$interface"}`, "{{interface}} {{direction}}", "short"},
+	}},
+	{"Anomaly Detection", func() bool { return *anomalySeason != "" }, []grafanaPanel{
+		{"Anomaly score", `{prefix}_traffic_anomaly_score{interface=~"$interface"}`, "{{interface}} {{direction}}", "short"},
+		{"Baseline", `{prefix}_traffic_baseline_{speed}{interface=~"$interface"}`, "{{interface}} {{direction}}", "speed"},
+	}},
+	{"Alerts", func() bool { return len(alertRules) > 0 }, []grafanaPanel{
+		{"Firing alerts", `exporter_alert_firing{interface=~"$interface"} == 1`, "{{rule}} {{interface}}", "short"},
+	}},
+}
+
+// Panels of the collectors, added when the collector runs; collectors without
+// an entry get none
+var grafanaCollectorPanels = map[string][]grafanaPanel{
+	"microburst": {
+		{"Microburst peak speed", `{prefix}_microburst_max_bits{interface=~"$interface"}`, "{{interface}} {{direction}}", "bps"},
+		{"Microbursts", `increase({prefix}_microbursts_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{direction}}", "short"},
+	},
+	"cgroup": {
+		{"Traffic by cgroup", `rate(network_cgroup_bytes_total[$__rate_interval]) * 8`, "{{unit}} {{direction}}", "bps"},
+	},
+	"dscp": {
+		{"Speed by DSCP", `{prefix}_dscp_speed_{speed}{interface=~"$interface"}`, "{{interface}} {{dscp}} {{direction}}", "speed"},
+	},
+	"gtp": {
+		{"GTP-U speed", `{prefix}_gtpu_speed_{speed}{interface=~"$interface"}`, "{{interface}} {{type}} {{direction}}", "speed"},
+		{"PDP contexts", `network_gtp_pdp_contexts`, "{{interface}} {{peer}}", "short"},
+	},
+	"interrupts": {
+		{"Interrupts by CPU", `sum by (interface, cpu) (rate({prefix}_interrupts_total{interface=~"$interface"}[$__rate_interval]))`, "{{interface}} CPU {{cpu}}", "short"},
+	},
+	"ipv6": {
+		{"IPv6 speed", `rate({prefix}_ipv6_bytes_total{interface=~"$interface"}[$__rate_interval]) * 8`, "{{interface}} {{direction}}", "bps"},
+	},
+	"listen": {
+		{"Listen queue overflows", `rate(network_tcp_listen_overflows_total[$__rate_interval])`, "overflows", "short"},
+	},
+	"modem": {
+		{"Modem signal quality", `network_modem_signal_quality_percent{interface=~"$interface"}`, "{{interface}}", "percent"},
+	},
+	"multicast": {
+		{"Multicast packets", `rate({prefix}_multicast_packets_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}}", "pps"},
+	},
+	"pause": {
+		{"Pause frames", `rate({prefix}_pause_frames_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{direction}}", "short"},
+	},
+	"probe": {
+		{"Probe round-trip time", `network_probe_rtt_seconds`, "{{target}} {{protocol}}", "s"},
+		{"Probe loss", `network_probe_loss_ratio`, "{{target}} {{protocol}}", "percentunit"},
+	},
+	"protocol": {
+		{"Speed by protocol", `{prefix}_protocol_speed_{speed}{interface=~"$interface"}`, "{{interface}} {{protocol}} {{port}} {{direction}}", "speed"},
+	},
+	"qdisc": {
+		{"Queueing discipline drops", `rate(network_qdisc_drops_total{interface=~"$interface"}[$__rate_interval])`, "{{interface}} {{kind}} {{handle}}", "pps"},
+		{"Queueing discipline backlog", `network_qdisc_backlog_bytes{interface=~"$interface"}`, "{{interface}} {{kind}} {{handle}}", "decbytes"},
+	},
+	"route": {
+		{"Routes", `network_routes`, "{{family}} {{table}} {{protocol}}", "short"},
+	},
+	"sctp": {
+		{"SCTP associations", `network_sctp_associations`, "{{state}}", "short"},
+		{"SCTP retransmits", `rate(network_sctp_retransmits_total[$__rate_interval])`, "{{reason}}", "short"},
+	},
+	"speedtest": {
+		{"Speed test", `network_speedtest_speed_bits`, "{{server}} {{direction}}", "bps"},
+	},
+	"sriov": {
+		{"Virtual function speed", `rate({prefix}_vf_bytes_total{interface=~"$interface"}[$__rate_interval]) * 8`, "{{interface}} VF {{vf}} {{direction}}", "bps"},
+	},
+	"tcp": {
+		{"TCP round-trip time", `network_tcp_rtt_average_seconds{interface=~"$interface"}`, "{{interface}} {{destination}}", "s"},
+		{"TCP retransmits", `network_tcp_retransmit_ratio{interface=~"$interface"}`, "{{interface}} {{destination}}", "percentunit"},
+	},
+	"transceiver": {
+		{"Transceiver receive power", `network_transceiver_rx_power_watts{interface=~"$interface"}`, "{{interface}} lane {{lane}}", "watt"},
+	},
+	"vrf": {
+		{"Speed by VRF", `network_vrf_speed_{speed}`, "{{vrf}} {{direction}}", "speed"},
+	},
+	"wireless": {
+		{"Station signal", `network_wireless_station_signal_dbm{interface=~"$interface"}`, "{{interface}} {{station}}", "dBm"},
+	},
+	"xfrm": {
+		{"IPsec errors", `rate(network_xfrm_errors_total[$__rate_interval])`, "{{error}}", "short"},
+	},
+}
+
+// grafanaDashboard lays out the panels two per row, each group under a row
+// panel of its own
+type grafanaDashboard struct {
+	panels []map[string]any
+	x, y   int
+}
+
+var grafanaDatasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+func (d *grafanaDashboard) row(title string) {
+	if d.x != 0 {
+		d.x, d.y = 0, d.y+8
+	}
+	d.panels = append(d.panels, map[string]any{
+		"type":      "row",
+		"title":     title,
+		"id":        len(d.panels) + 1,
+		"collapsed": false,
+		"panels":    []any{},
+		"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": d.y},
+	})
+	d.y++
+}
+
+func (d *grafanaDashboard) add(p grafanaPanel, r *strings.Replacer, speedUnit string) {
+	unit := p.unit
+	if unit == "speed" {
+		unit = speedUnit
+	}
+	d.panels = append(d.panels, map[string]any{
+		"type":       "timeseries",
+		"title":      p.title,
+		"id":         len(d.panels) + 1,
+		"datasource": grafanaDatasource,
+		"gridPos":    map[string]int{"h": 8, "w": 12, "x": d.x, "y": d.y},
+		"fieldConfig": map[string]any{
+			"defaults":  map[string]any{"unit": unit},
+			"overrides": []any{},
+		},
+		"options": map[string]any{
+			"legend":  map[string]any{"displayMode": "table", "placement": "bottom", "showLegend": true, "calcs": []string{"mean", "max"}},
+			"tooltip": map[string]any{"mode": "multi", "sort": "desc"},
+		},
+		"targets": []map[string]any{{
+			"datasource":   grafanaDatasource,
+			"expr":         r.Replace(p.expr),
+			"legendFormat": p.legend,
+			"refId":        "A",
+		}},
+	})
+	if d.x == 0 {
+		d.x = 12
+	} else {
+		d.x, d.y = 0, d.y+8
+	}
+}
+
+// generateGrafanaDashboard builds a dashboard for the metric names and the
+// collectors of this instance
+func generateGrafanaDashboard() map[string]any {
+	// With --speed.unit=both the bits keep their names
+	speed, unit := "bits", "bps"
+	if *speedUnit == "bytes" {
+		speed, unit = "bytes", "Bps"
+	}
+	r := strings.NewReplacer("{prefix}", *metricsPrefix, "{speed}", speed)
+
+	d := &grafanaDashboard{}
+	d.row("Interfaces")
+	for _, p := range grafanaInterfacePanels {
+		d.add(p, r, unit)
+	}
+	for _, f := range grafanaFeaturePanels {
+		if !f.enabled() {
+			continue
+		}
+		d.row(f.title)
+		for _, p := range f.panels {
+			d.add(p, r, unit)
+		}
+	}
+	names := make([]string, 0, len(startedCollectors))
+	for name := range startedCollectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, c := range names {
+		panels, ok := grafanaCollectorPanels[c]
+		if !ok {
+			continue
+		}
+		d.row("Collector " + c)
+		for _, p := range panels {
+			d.add(p, r, unit)
+		}
+	}
+
+	return map[string]any{
+		"title":         "Network Interfaces",
+		"uid":           "vyosexporter",
+		"tags":          []string{"network", "vyosexporter"},
+		"schemaVersion": 38,
+		"editable":      true,
+		"graphTooltip":  1,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-1h", "to": "now"},
+		"panels":        d.panels,
+		"templating": map[string]any{"list": []map[string]any{
+			{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			{
+				"name":       "interface",
+				"label":      "Interface",
+				"type":       "query",
+				"datasource": grafanaDatasource,
+				"definition": "label_values(" + *metricsPrefix + "_info, interface)",
+				"query":      map[string]string{"query": "label_values(" + *metricsPrefix + "_info, interface)", "refId": "StandardVariableQuery"},
+				"refresh":    2,
+				"sort":       1,
+				"multi":      true,
+				"includeAll": true,
+				"allValue":   ".*",
+				"current":    map[string]any{"text": []string{"All"}, "value": []string{"$__all"}},
+			},
+		}},
+	}
+}
+
+// handleGrafanaDashboard serves a Grafana dashboard matching the metric names
+// and the enabled collectors at /dashboard.json
+func handleGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, generateGrafanaDashboard())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	graphiteAddress  = flag.String("graphite.address", "", "Address (host:port) of a Graphite/Carbon plaintext receiver; empty disables")
+	graphitePrefix   = flag.String("graphite.prefix", "network", "Prefix prepended to all Graphite metric paths")
+	graphiteInterval = flag.Duration("graphite.interval", 10*time.Second, "How often to push metrics to Graphite")
+
+	// Dots separate path components and whitespace separates fields, so
+	// neither may appear inside a component
+	graphiteEscaper = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+)
+
+// graphitePlaintext encodes the stats as "<path> <value> <timestamp>" lines
+func graphitePlaintext(stats []interfaceStats) []byte {
+	var buf bytes.Buffer
+	for _, s := range stats {
+		path := *graphitePrefix + "." + graphiteEscaper.Replace(s.Name) + "."
+		ts := s.Time.Unix()
+		if s.HasSpeed {
+			fmt.Fprintf(&buf, "%srx_bits_per_second %s %d\n", path, strconv.FormatFloat(s.RxSpeed, 'f', -1, 64), ts)
+			fmt.Fprintf(&buf, "%stx_bits_per_second %s %d\n", path, strconv.FormatFloat(s.TxSpeed, 'f', -1, 64), ts)
+		}
+		for _, m := range []struct {
+			name  string
+			value string
+		}{
+			{"rx_bytes", strconv.FormatUint(s.RxBytes, 10)},
+			{"tx_bytes", strconv.FormatUint(s.TxBytes, 10)},
+			{"rx_packets", strconv.FormatUint(s.RxPackets, 10)},
+			{"tx_packets", strconv.FormatUint(s.TxPackets, 10)},
+			{"rx_errors", strconv.FormatUint(s.RxErrors, 10)},
+			{"tx_errors", strconv.FormatUint(s.TxErrors, 10)},
+			{"rx_drops", strconv.FormatUint(s.RxDrops, 10)},
+			{"tx_drops", strconv.FormatUint(s.TxDrops, 10)},
+		} {
+			fmt.Fprintf(&buf, "%s%s %s %d\n", path, m.name, m.value, ts)
+		}
+	}
+	return buf.Bytes()
+}
+
+// graphiteSink keeps a TCP connection to Carbon open across pushes
+type graphiteSink struct {
+	conn net.Conn
+}
+
+// push writes the stats, reconnecting if the previous connection broke
+func (g *graphiteSink) push(stats []interfaceStats) error {
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", *graphiteAddress, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := g.conn.Write(graphitePlaintext(stats)); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// groupsFlag collects name=interface,interface groups from repeated or
+// semicolon-separated --interface.group flags
+type groupsFlag map[string][]string
+
+func (g groupsFlag) String() string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strings.Join(g[name], ",")
+	}
+	return strings.Join(parts, ";")
+}
+
+func (g groupsFlag) Set(value string) error {
+	for _, group := range strings.Split(value, ";") {
+		name, members, ok := strings.Cut(strings.TrimSpace(group), "=")
+		if !ok || name == "" || members == "" || !model.LabelValue(name).IsValid() {
+			return fmt.Errorf("invalid interface group %q, expected name=interface,interface", group)
+		}
+		var ifaces []string
+		for _, iface := range strings.Split(members, ",") {
+			if iface = strings.TrimSpace(iface); iface != "" {
+				ifaces = append(ifaces, iface)
+			}
+		}
+		g[name] = ifaces
+	}
+	return nil
+}
+
+var (
+	interfaceGroups = groupsFlag{}
+
+	networkGroupSpeed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_group_bits",
+			Help: "Summed speed of the interfaces of a group in bits per second",
+		},
+		[]string{"group", "direction"},
+	)
+	networkGroupErrors = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_group_errors_total",
+			Help: "Summed errors of the interfaces of a group",
+		},
+		[]string{"group", "direction"},
+	)
+	networkGroupDrops = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_group_drops_total",
+			Help: "Summed drops of the interfaces of a group",
+		},
+		[]string{"group", "direction"},
+	)
+	networkGroupInterfaces = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_group_interfaces",
+			Help: "Number of interfaces of a group that are present",
+		},
+		[]string{"group"},
+	)
+)
+
+func init() {
+	flag.Var(interfaceGroups, "interface.group", "Named group of interfaces whose speeds, errors and drops are summed, as name=interface,interface, e.g. uplinks=eth0,eth1; repeatable or semicolon-separated")
+
+	if v := os.Getenv("INTERFACE_GROUPS"); v != "" {
+		if err := interfaceGroups.Set(v); err != nil {
+			log.Fatalf("Invalid INTERFACE_GROUPS: %v", err)
+		}
+	}
+
+	registerMetrics("groups", networkGroupSpeed)
+	registerMetrics("groups", networkGroupErrors)
+	registerMetrics("groups", networkGroupDrops)
+	registerMetrics("groups", networkGroupInterfaces)
+}
+
+// updateGroups sums the members of each interface group for a collection
+// cycle. Members that are missing, e.g. down, are left out of the sums.
+func updateGroups(stats []interfaceStats) {
+	if len(interfaceGroups) == 0 {
+		return
+	}
+	byName := make(map[string]interfaceStats, len(stats))
+	for _, s := range stats {
+		byName[s.Name] = s
+	}
+	for group, members := range interfaceGroups {
+		var speed, errors, drops [2]float64
+		var present int
+		for _, member := range members {
+			s, ok := byName[member]
+			if !ok || !s.HasSpeed {
+				continue
+			}
+			speed[0], speed[1] = speed[0]+s.RxSpeed, speed[1]+s.TxSpeed
+			errors[0], errors[1] = errors[0]+float64(s.RxErrors), errors[1]+float64(s.TxErrors)
+			drops[0], drops[1] = drops[0]+float64(s.RxDrops), drops[1]+float64(s.TxDrops)
+			present++
+		}
+		for i, direction := range []string{"receive", "transmit"} {
+			labels := prometheus.Labels{"group": group, "direction": direction}
+			networkGroupSpeed.With(labels).Set(speed[i])
+			networkGroupErrors.With(labels).Set(errors[i])
+			networkGroupDrops.With(labels).Set(drops[i])
+		}
+		networkGroupInterfaces.With(prometheus.Labels{"group": group}).Set(float64(present))
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	gtpInterval   = flag.Duration("gtp.interval", 15*time.Second, "How often to read the PDP contexts of the gtp devices and the GTP-U counters")
+	gtpInterfaces = flag.String("gtp.interfaces", "", "Regular expression of interfaces carrying GTP-U, e.g. the N3 interface of a UPF, to attach the GTP-U classifier to; none by default")
+	gtpTunnels    = flag.Bool("gtp.tunnels", false, "Export a series per PDP context with its TEIDs and addresses; one per subscriber session")
+)
+
+// Generic netlink family, command and attributes, from linux/gtp.h
+const (
+	gtpFamily          = "gtp"
+	gtpCmdGetPDP       = 3
+	gtpAttrLink        = 1
+	gtpAttrVersion     = 2
+	gtpAttrTID         = 3
+	gtpAttrPeerAddress = 4
+	gtpAttrMSAddress   = 5
+	gtpAttrITEI        = 8
+	gtpAttrOTEI        = 9
+	gtpAttrPeerAddr6   = 11
+	gtpAttrMSAddr6     = 12
+)
+
+// UDP port of GTP-U, 3GPP TS 29.281
+const gtpuPort = 2152
+
+// Message classes of the classifier, in map key order
+const (
+	gtpuGPDU = iota
+	gtpuEchoRequest
+	gtpuEchoResponse
+	gtpuErrorIndication
+	gtpuEndMarker
+	gtpuOther
+	gtpuMalformed
+	gtpuClasses
+)
+
+var gtpuTypeNames = []string{"g_pdu", "echo_request", "echo_response", "error_indication", "end_marker", "other"}
+
+// Classes of the GTP-U message types, the others count as other
+var gtpuMessageTypes = map[int32]int32{
+	1:   gtpuEchoRequest,
+	2:   gtpuEchoResponse,
+	26:  gtpuErrorIndication,
+	254: gtpuEndMarker,
+	255: gtpuGPDU,
+}
+
+var (
+	gtpPDPContextsDesc = prometheus.NewDesc("network_gtp_pdp_contexts",
+		"Number of PDP contexts, tunnels, of the gtp device by GTP version and peer", []string{"interface", "version", "peer"}, nil)
+	gtpTunnelDesc = prometheus.NewDesc("network_gtp_tunnel_info",
+		"PDP context of the gtp device with its TEIDs, the TID for GTPv0, and the address of the mobile station, with --gtp.tunnels", []string{"interface", "version", "peer", "ms_address", "local_teid", "remote_teid"}, nil)
+	gtpuSpeedDesc = prometheus.NewDesc("network_interface_gtpu_speed_bits",
+		"Speed of the GTP-U traffic of the interface by message type in bits per second, outer headers included", []string{"interface", "type", "direction"}, nil)
+	gtpuBytesDesc = prometheus.NewDesc("network_interface_gtpu_bytes_total",
+		"Bytes of GTP-U traffic of the interface by message type since the classifier was attached, outer headers included", []string{"interface", "type", "direction"}, nil)
+	gtpuPacketsDesc = prometheus.NewDesc("network_interface_gtpu_packets_total",
+		"GTP-U packets of the interface by message type since the classifier was attached", []string{"interface", "type", "direction"}, nil)
+	gtpuMalformedDesc = prometheus.NewDesc("network_interface_gtpu_malformed_packets_total",
+		"Packets to or from the GTP-U port of the interface that are not GTPv1-U or whose length doesn't match the UDP length", []string{"interface", "direction"}, nil)
+
+	// Result of the last PDP context dump and classifier read
+	gtpSnapshot struct {
+		sync.Mutex
+		metrics []prometheus.Metric
+	}
+)
+
+func init() {
+	registerCollector("gtp", "PDP contexts of gtp devices via generic netlink and GTP-U traffic via eBPF socket filters", false, startGTPCollector).
+		requires(capNetAdmin, capBPF, capNetRaw).
+		checks(checkGTPFlags)
+}
+
+// gtpPDPKey groups the PDP contexts of a gtp device
+type gtpPDPKey struct{ iface, version, peer string }
+
+// readGTPContexts dumps the PDP contexts of all gtp devices
+func readGTPContexts(rt *netlinkConn, c *genlConn, metrics []prometheus.Metric) ([]prometheus.Metric, error) {
+	names, err := linkNames(rt)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.execute(gtpCmdGetPDP, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	contexts := make(map[gtpPDPKey]int)
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		index, _ := nlUint(attrs[gtpAttrLink])
+		name, ok := names[uint32(index)]
+		if !ok {
+			continue
+		}
+		version, _ := nlUint(attrs[gtpAttrVersion])
+		peer, ms := gtpAddress(attrs[gtpAttrPeerAddress], attrs[gtpAttrPeerAddr6]), gtpAddress(attrs[gtpAttrMSAddress], attrs[gtpAttrMSAddr6])
+		labels := []string{name, strconv.FormatUint(version, 10), peer}
+		contexts[gtpPDPKey{labels[0], labels[1], labels[2]}]++
+		if !*gtpTunnels {
+			continue
+		}
+		var local, remote string
+		if version == 0 {
+			if tid, ok := nlUint(attrs[gtpAttrTID]); ok {
+				local = strconv.FormatUint(tid, 10)
+			}
+		} else {
+			if tei, ok := nlUint(attrs[gtpAttrITEI]); ok {
+				local = strconv.FormatUint(tei, 10)
+			}
+			if tei, ok := nlUint(attrs[gtpAttrOTEI]); ok {
+				remote = strconv.FormatUint(tei, 10)
+			}
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(gtpTunnelDesc, prometheus.GaugeValue, 1, append(labels, ms, local, remote)...))
+	}
+	for k, n := range contexts {
+		metrics = append(metrics, prometheus.MustNewConstMetric(gtpPDPContextsDesc, prometheus.GaugeValue, float64(n), k.iface, k.version, k.peer))
+	}
+	return metrics, nil
+}
+
+// gtpAddress formats the IPv4 or, on kernels with IPv6 support, the IPv6
+// address of a PDP context
+func gtpAddress(v4, v6 []byte) string {
+	for _, b := range [][]byte{v4, v6} {
+		if addr, ok := netip.AddrFromSlice(b); ok {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// gtpuProgram classifies the unfragmented or first fragments of UDP packets
+// to or from the GTP-U port by message type, or as malformed when they are
+// not GTPv1 with the protocol type bit set or the GTP length doesn't match
+// the UDP length. It adds the length and a packet to the map at
+//
+//	class * 4 + direction * 2 + {0 bytes, 1 packets}
+//
+// and returns 0 so no packet is ever queued to the socket.
+func gtpuProgram(mapFd int) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(
+		insn(bpfMov64Reg, bpfR6, bpfR1, 0, 0),
+		insn(bpfLdxMemW, bpfR7, bpfR6, 0, 0), // r7 = skb->len
+		insn(bpfMov64Imm, bpfR8, 0, 0, 0),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 4, 0), // r2 = skb->pkt_type
+		insn(bpfJneImm, bpfR2, 0, 1, unix.PACKET_OUTGOING),
+		insn(bpfMov64Imm, bpfR8, 0, 0, 2),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 16, 0), // r2 = skb->protocol
+	)
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IP)), "ipv4")
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IPV6)), "ipv6")
+	a.jump(bpfJa, 0, 0, "exit")
+
+	// The UDP header offset goes to r10-12, as in protocolProgram
+	a.label("ipv4")
+	a.emit(
+		insn(bpfLdAbsH, 0, 0, 0, 6),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0x1fff),
+	)
+	a.jump(bpfJneImm, bpfR0, 0, "exit")
+	a.emit(insn(bpfLdAbsB, 0, 0, 0, 9))
+	a.jump(bpfJneImm, bpfR0, unix.IPPROTO_UDP, "exit")
+	a.emit(
+		insn(bpfLdAbsB, 0, 0, 0, 0),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0xf),
+		insn(bpfLsh64Imm, bpfR0, 0, 0, 2),
+		insn(bpfStxMemW, bpfR10, bpfR0, -12, 0),
+	)
+	a.jump(bpfJa, 0, 0, "udp")
+	// Extension headers are not followed
+	a.label("ipv6")
+	a.emit(insn(bpfLdAbsB, 0, 0, 0, 6))
+	a.jump(bpfJneImm, bpfR0, unix.IPPROTO_UDP, "exit")
+	a.emit(insn(bpfStMemW, bpfR10, 0, -12, 40))
+
+	// Destination port first, then the source port
+	a.label("udp")
+	a.emit(
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndH, 0, bpfR1, 0, 2),
+	)
+	a.jump(bpfJeqImm, bpfR0, gtpuPort, "gtp")
+	a.emit(
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndH, 0, bpfR1, 0, 0),
+	)
+	a.jump(bpfJneImm, bpfR0, gtpuPort, "exit")
+
+	// The flags byte starts with version 1 and the protocol type bit, and
+	// the GTP length counts what follows the 8 bytes of mandatory header
+	a.label("gtp")
+	a.emit(
+		insn(bpfMov64Imm, bpfR9, 0, 0, gtpuMalformed*4),
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndB, 0, bpfR1, 0, 8),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0xf0),
+	)
+	a.jump(bpfJneImm, bpfR0, 0x30, "count")
+	a.emit(
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndH, 0, bpfR1, 0, 4),
+		insn(bpfStxMemW, bpfR10, bpfR0, -16, 0),
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndH, 0, bpfR1, 0, 10),
+		insn(bpfAdd64Imm, bpfR0, 0, 0, 16),
+		insn(bpfLdxMemW, bpfR1, bpfR10, -16, 0),
+		insn(bpfSub64Reg, bpfR1, bpfR0, 0, 0),
+	)
+	a.jump(bpfJneImm, bpfR1, 0, "count")
+	a.emit(
+		insn(bpfMov64Imm, bpfR9, 0, 0, gtpuOther*4),
+		insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+		insn(bpfLdIndB, 0, bpfR1, 0, 9),
+	)
+	for typ := range gtpuMessageTypes {
+		a.jump(bpfJeqImm, bpfR0, typ, "type"+strconv.Itoa(int(typ)))
+	}
+	a.jump(bpfJa, 0, 0, "count")
+	for typ, class := range gtpuMessageTypes {
+		a.label("type" + strconv.Itoa(int(typ)))
+		a.emit(insn(bpfMov64Imm, bpfR9, 0, 0, class*4))
+		a.jump(bpfJa, 0, 0, "count")
+	}
+
+	a.label("count")
+	a.emit(insn(bpfAdd64Reg, bpfR9, bpfR8, 0, 0))
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.emit(
+		insn(bpfAdd64Imm, bpfR9, 0, 0, 1),
+		insn(bpfMov64Imm, bpfR7, 0, 0, 1),
+	)
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.label("exit")
+	a.emit(
+		insn(bpfMov64Imm, bpfR0, 0, 0, 0),
+		insn(bpfExit, 0, 0, 0, 0),
+	)
+	return a.program()
+}
+
+// gtpuMetrics appends the metrics of a classifier read
+func gtpuMetrics(metrics []prometheus.Metric, name string, counters, previous []uint64, elapsed float64) []prometheus.Metric {
+	for dir, direction := range []string{"receive", "transmit"} {
+		for class, typ := range gtpuTypeNames {
+			key := class*4 + dir*2
+			metrics = append(metrics,
+				prometheus.MustNewConstMetric(gtpuSpeedDesc, prometheus.GaugeValue, counterRate(counters, previous, key, elapsed)*8, name, typ, direction),
+				prometheus.MustNewConstMetric(gtpuBytesDesc, prometheus.CounterValue, float64(counters[key]), name, typ, direction),
+				prometheus.MustNewConstMetric(gtpuPacketsDesc, prometheus.CounterValue, float64(counters[key+1]), name, typ, direction))
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(gtpuMalformedDesc, prometheus.CounterValue,
+			float64(counters[gtpuMalformed*4+dir*2+1]), name, direction))
+	}
+	return metrics
+}
+
+// checkGTPFlags validates --gtp.interfaces
+func checkGTPFlags() error {
+	if _, err := regexp.Compile(*gtpInterfaces); err != nil {
+		return fmt.Errorf("invalid --gtp.interfaces: %w", err)
+	}
+	return nil
+}
+
+// startGTPCollector opens the netlink socket for the link dumps
+func startGTPCollector() error {
+	var selected *regexp.Regexp
+	if *gtpInterfaces != "" {
+		selected = regexp.MustCompile(*gtpInterfaces)
+	}
+	rt, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("gtp", gtpCollector{})
+	go collectGTP(rt, selected)
+	return nil
+}
+
+// collectGTP periodically refreshes the GTP snapshot. The family appears
+// once the gtp module is loaded, with the first gtp device.
+func collectGTP(rt *netlinkConn, selected *regexp.Regexp) {
+	var c *genlConn
+	var classifiers *packetClassifiers
+	if selected != nil {
+		classifiers = &packetClassifiers{
+			name:     "GTP-U",
+			selected: selected,
+			entries:  gtpuClasses * 4,
+			program:  gtpuProgram,
+		}
+	}
+	for {
+		var metrics []prometheus.Metric
+		if c == nil {
+			c, _ = dialGenetlink(gtpFamily)
+		}
+		if c != nil {
+			withContexts, err := readGTPContexts(rt, c, metrics)
+			if err != nil {
+				log.Printf("Error reading GTP PDP contexts: %v", err)
+				c.Close()
+				c = nil
+			} else {
+				metrics = withContexts
+			}
+		}
+		if classifiers != nil {
+			for name, cl := range classifiers.refresh() {
+				counters, previous, elapsed, err := cl.read()
+				if err != nil {
+					log.Printf("Error reading the GTP-U counters of %s: %v", name, err)
+					continue
+				}
+				metrics = gtpuMetrics(metrics, name, counters, previous, elapsed)
+			}
+		}
+		gtpSnapshot.Lock()
+		gtpSnapshot.metrics = metrics
+		gtpSnapshot.Unlock()
+		time.Sleep(*gtpInterval)
+	}
+}
+
+// gtpCollector exports the metrics of the last GTP read
+type gtpCollector struct{}
+
+func (gtpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gtpPDPContextsDesc
+	ch <- gtpTunnelDesc
+	ch <- gtpuSpeedDesc
+	ch <- gtpuBytesDesc
+	ch <- gtpuPacketsDesc
+	ch <- gtpuMalformedDesc
+}
+
+func (gtpCollector) Collect(ch chan<- prometheus.Metric) {
+	gtpSnapshot.Lock()
+	defer gtpSnapshot.Unlock()
+	for _, m := range gtpSnapshot.metrics {
+		ch <- m
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	historyDuration = flag.Duration("history.duration", 15*time.Minute, "How much per-second speed history to keep in memory per interface; 0 disables")
+
+	// Per-interface speed history keyed by interface name
+	speedHistory = struct {
+		sync.RWMutex
+		rings map[string]*historyRing
+	}{
+		rings: make(map[string]*historyRing),
+	}
+)
+
+// historySample is a single speed reading; float32 halves the memory footprint
+// and is precise enough for plotting
+type historySample struct {
+	time   int64 // unix seconds
+	rx, tx float32
+}
+
+// historyRing is a fixed-size ring buffer of samples, oldest overwritten first
+type historyRing struct {
+	samples []historySample
+	next    int
+	full    bool
+}
+
+func (r *historyRing) add(s historySample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns the samples newer than cutoff in chronological order
+func (r *historyRing) since(cutoff int64) []historySample {
+	var ordered []historySample
+	if r.full {
+		ordered = append(ordered, r.samples[r.next:]...)
+	}
+	ordered = append(ordered, r.samples[:r.next]...)
+	for i, s := range ordered {
+		if s.time > cutoff {
+			return ordered[i:]
+		}
+	}
+	return nil
+}
+
+// last returns the most recent sample
+func (r *historyRing) last() historySample {
+	return r.samples[(r.next-1+len(r.samples))%len(r.samples)]
+}
+
+// historyCapacity is the number of samples needed to cover the configured duration
+func historyCapacity() int {
+	if n := int(*historyDuration / time.Second); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// recordHistory appends the speeds of a collection cycle to the history
+func recordHistory(stats []interfaceStats) {
+	if *historyDuration <= 0 {
+		return
+	}
+	speedHistory.Lock()
+	defer speedHistory.Unlock()
+
+	var now int64
+	for _, s := range stats {
+		now = s.Time.Unix()
+		// No sample for the first cycle of an interface and gap cycles,
+		// rather than a dip to zero
+		if !s.HasSpeed {
+			continue
+		}
+		ring, ok := speedHistory.rings[s.Name]
+		if !ok {
+			ring = &historyRing{samples: make([]historySample, historyCapacity())}
+			speedHistory.rings[s.Name] = ring
+		}
+		ring.add(historySample{time: now, rx: float32(s.RxSpeed), tx: float32(s.TxSpeed)})
+	}
+
+	// Forget interfaces whose whole history has aged out
+	cutoff := now - int64(historyDuration.Seconds())
+	for name, ring := range speedHistory.rings {
+		if ring.last().time <= cutoff {
+			delete(speedHistory.rings, name)
+		}
+	}
+}
+
+// historyResponse is the document returned by /api/v1/history
+type historyResponse struct {
+	Interface string              `json:"interface"`
+	Samples   []historySampleJSON `json:"samples"`
+}
+
+type historySampleJSON struct {
+	Timestamp       int64   `json:"timestamp"`
+	RxBitsPerSecond float32 `json:"rx_bits_per_second"`
+	TxBitsPerSecond float32 `json:"tx_bits_per_second"`
+}
+
+// handleHistory serves the speed history of one interface:
+// /api/v1/history?iface=eth0&range=15m
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if *historyDuration <= 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history is disabled"})
+		return
+	}
+	name := r.URL.Query().Get("iface")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "iface parameter is required"})
+		return
+	}
+	window := *historyDuration
+	if v := r.URL.Query().Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid range"})
+			return
+		}
+		window = d
+	}
+
+	speedHistory.RLock()
+	ring, ok := speedHistory.rings[name]
+	var samples []historySample
+	if ok {
+		samples = ring.since(time.Now().Add(-window).Unix())
+	}
+	speedHistory.RUnlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "interface not found"})
+		return
+	}
+
+	resp := historyResponse{Interface: name, Samples: make([]historySampleJSON, len(samples))}
+	for i, s := range samples {
+		resp.Samples[i] = historySampleJSON{Timestamp: s.time, RxBitsPerSecond: s.rx, TxBitsPerSecond: s.tx}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
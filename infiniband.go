@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var infinibandInterval = flag.Duration("infiniband.interval", 15*time.Second, "How often to read the InfiniBand/RDMA port counters")
+
+// Error counters of the standard port counter set, exported by file name
+var infinibandErrorCounters = []string{
+	"port_rcv_errors",
+	"port_rcv_remote_physical_errors",
+	"port_rcv_switch_relay_errors",
+	"port_rcv_constraint_errors",
+	"port_xmit_discards",
+	"port_xmit_constraint_errors",
+	"symbol_error",
+	"link_downed",
+	"link_error_recovery",
+	"local_link_integrity_errors",
+	"excessive_buffer_overrun_errors",
+	"VL15_dropped",
+}
+
+var (
+	infinibandInfoDesc = prometheus.NewDesc("network_infiniband_port_info",
+		"State, physical state and link layer of the InfiniBand/RDMA port and its network device, if any",
+		[]string{"device", "port", "state", "phys_state", "link_layer", "netdev"}, nil)
+	infinibandRateDesc = prometheus.NewDesc("network_infiniband_port_rate_bits",
+		"Signaling rate of the InfiniBand/RDMA port", []string{"device", "port"}, nil)
+	infinibandDataDesc = prometheus.NewDesc("network_infiniband_port_data_bytes_total",
+		"Data received or transmitted by the InfiniBand/RDMA port", []string{"device", "port", "direction"}, nil)
+	infinibandPacketsDesc = prometheus.NewDesc("network_infiniband_port_packets_total",
+		"Packets received or transmitted by the InfiniBand/RDMA port", []string{"device", "port", "direction"}, nil)
+	infinibandErrorsDesc = prometheus.NewDesc("network_infiniband_port_errors_total",
+		"Errors of the InfiniBand/RDMA port by counter", []string{"device", "port", "counter"}, nil)
+	infinibandWaitDesc = prometheus.NewDesc("network_infiniband_port_transmit_wait_total",
+		"Ticks the InfiniBand/RDMA port had data to transmit but no flow control credits", []string{"device", "port"}, nil)
+
+	// Result of the last sysfs read
+	infinibandSnapshot struct {
+		sync.Mutex
+		ports []infinibandPort
+	}
+)
+
+func init() {
+	registerCollector("infiniband", "InfiniBand/RoCE port data, packet and error counters from sysfs", false, startInfinibandCollector)
+}
+
+type infinibandPort struct {
+	device, port                      string
+	state, physState, linkLayer, ndev string
+	rate                              float64 // bits per second
+	// Counter values by file name
+	counters map[string]float64
+}
+
+// sysfsState strips the number of a state attribute like "4: ACTIVE"
+func sysfsState(s string) string {
+	if _, name, ok := strings.Cut(s, ": "); ok {
+		s = name
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// parseInfinibandRate parses a rate attribute like "100 Gb/sec (4X EDR)"
+func parseInfinibandRate(s string) float64 {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || fields[1] != "Gb/sec" {
+		return 0
+	}
+	gbps, _ := strconv.ParseFloat(fields[0], 64)
+	return gbps * 1e9
+}
+
+// readInfinibandPorts reads the ports of all RDMA devices
+func readInfinibandPorts() ([]infinibandPort, error) {
+	portDirs, err := filepath.Glob(sysFilePath("class/infiniband/*/ports/*"))
+	if err != nil {
+		return nil, err
+	}
+	var ports []infinibandPort
+	for _, dir := range portDirs {
+		attr := func(name string) string {
+			data, _ := os.ReadFile(filepath.Join(dir, name))
+			return strings.TrimSpace(string(data))
+		}
+		p := infinibandPort{
+			device:    filepath.Base(filepath.Dir(filepath.Dir(dir))),
+			port:      filepath.Base(dir),
+			state:     sysfsState(attr("state")),
+			physState: sysfsState(attr("phys_state")),
+			linkLayer: strings.ToLower(attr("link_layer")),
+			// The network device of a RoCE port, or an IPoIB interface
+			ndev:     attr("gid_attrs/ndevs/0"),
+			rate:     parseInfinibandRate(attr("rate")),
+			counters: make(map[string]float64),
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, "counters"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			// Some counters are not readable, e.g. unsupported ones return EINVAL
+			if v, err := strconv.ParseUint(attr("counters/"+e.Name()), 10, 64); err == nil {
+				p.counters[e.Name()] = float64(v)
+			}
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// startInfinibandCollector starts reading the RDMA port counters
+func startInfinibandCollector() error {
+	registerMetrics("infiniband", infinibandCollector{})
+	go collectInfiniband()
+	return nil
+}
+
+// collectInfiniband periodically refreshes the InfiniBand snapshot
+func collectInfiniband() {
+	for {
+		ports, err := readInfinibandPorts()
+		if err != nil {
+			log.Printf("Error reading InfiniBand ports: %v", err)
+		} else {
+			infinibandSnapshot.Lock()
+			infinibandSnapshot.ports = ports
+			infinibandSnapshot.Unlock()
+		}
+		time.Sleep(*infinibandInterval)
+	}
+}
+
+// infinibandCollector exports the last InfiniBand snapshot
+type infinibandCollector struct{}
+
+func (infinibandCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- infinibandInfoDesc
+	ch <- infinibandRateDesc
+	ch <- infinibandDataDesc
+	ch <- infinibandPacketsDesc
+	ch <- infinibandErrorsDesc
+	ch <- infinibandWaitDesc
+}
+
+func (infinibandCollector) Collect(ch chan<- prometheus.Metric) {
+	infinibandSnapshot.Lock()
+	defer infinibandSnapshot.Unlock()
+	for _, p := range infinibandSnapshot.ports {
+		ch <- prometheus.MustNewConstMetric(infinibandInfoDesc, prometheus.GaugeValue, 1, p.device, p.port, p.state, p.physState, p.linkLayer, p.ndev)
+		if p.rate > 0 {
+			ch <- prometheus.MustNewConstMetric(infinibandRateDesc, prometheus.GaugeValue, p.rate, p.device, p.port)
+		}
+		counter := func(desc *prometheus.Desc, name string, scale float64, labels ...string) {
+			if v, ok := p.counters[name]; ok {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v*scale, append([]string{p.device, p.port}, labels...)...)
+			}
+		}
+		// The data counters count 32 bit words
+		counter(infinibandDataDesc, "port_rcv_data", 4, "receive")
+		counter(infinibandDataDesc, "port_xmit_data", 4, "transmit")
+		counter(infinibandPacketsDesc, "port_rcv_packets", 1, "receive")
+		counter(infinibandPacketsDesc, "port_xmit_packets", 1, "transmit")
+		counter(infinibandWaitDesc, "port_xmit_wait", 1)
+		for _, name := range infinibandErrorCounters {
+			counter(infinibandErrorsDesc, name, 1, name)
+		}
+	}
+}
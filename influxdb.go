@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxURL       = flag.String("influxdb.url", "", "Base URL of an InfluxDB v2 server to write metrics to, e.g. http://localhost:8086; empty disables")
+	influxToken     = flag.String("influxdb.token", "", "InfluxDB API token")
+	influxTokenFile = flag.String("influxdb.token-file", "", "File containing the InfluxDB API token; mutually exclusive with --influxdb.token")
+	influxOrg       = flag.String("influxdb.org", "", "InfluxDB organization")
+	influxBucket    = flag.String("influxdb.bucket", "", "InfluxDB bucket")
+	influxInterval  = flag.Duration("influxdb.interval", 10*time.Second, "How often to write metrics to InfluxDB")
+
+	// Escapes for measurement names and tag keys/values in line protocol
+	influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLineProtocol encodes the stats as one network_interface point per interface
+func influxLineProtocol(stats []interfaceStats) []byte {
+	var buf bytes.Buffer
+	for _, s := range stats {
+		buf.WriteString("network_interface,interface=")
+		buf.WriteString(influxTagEscaper.Replace(s.Name))
+		// Empty tag values are not allowed in line protocol
+		if s.Description != "" {
+			buf.WriteString(",description=")
+			buf.WriteString(influxTagEscaper.Replace(s.Description))
+		}
+		// The speed fields are left out of points without a speed
+		if s.HasSpeed {
+			fmt.Fprintf(&buf, " rx_bits_per_second=%s,tx_bits_per_second=%s,",
+				strconv.FormatFloat(s.RxSpeed, 'f', -1, 64), strconv.FormatFloat(s.TxSpeed, 'f', -1, 64))
+		} else {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "rx_bytes=%du,tx_bytes=%du,rx_packets=%du,tx_packets=%du",
+			s.RxBytes, s.TxBytes, s.RxPackets, s.TxPackets)
+		fmt.Fprintf(&buf, ",rx_errors=%du,tx_errors=%du,rx_drops=%du,tx_drops=%du",
+			s.RxErrors, s.TxErrors, s.RxDrops, s.TxDrops)
+		fmt.Fprintf(&buf, " %d\n", s.Time.Unix())
+	}
+	return buf.Bytes()
+}
+
+// influxWriteURL builds the v2 write endpoint URL
+func influxWriteURL() (string, error) {
+	u, err := url.Parse(*influxURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	q := url.Values{}
+	q.Set("org", *influxOrg)
+	q.Set("bucket", *influxBucket)
+	q.Set("precision", "s")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// validateInfluxFlags checks the flags of the InfluxDB output
+func validateInfluxFlags() error {
+	if _, err := secretValue("influxdb.token", *influxToken, *influxTokenFile); err != nil {
+		return err
+	}
+	if *influxURL == "" {
+		return nil
+	}
+	if *influxOrg == "" || *influxBucket == "" {
+		return fmt.Errorf("--influxdb.org and --influxdb.bucket are required with --influxdb.url")
+	}
+	if _, err := influxWriteURL(); err != nil {
+		return fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	return nil
+}
+
+// newInfluxWriter validates the flags and returns a push function for runPushSink
+func newInfluxWriter() (func([]interfaceStats) error, error) {
+	if err := validateInfluxFlags(); err != nil {
+		return nil, err
+	}
+	writeURL, err := influxWriteURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	token, err := secretValue("influxdb.token", *influxToken, *influxTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return func(stats []interfaceStats) error {
+		req, err := http.NewRequest(http.MethodPost, writeURL, bytes.NewReader(influxLineProtocol(stats)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var interruptsInterval = flag.Duration("interrupts.interval", 15*time.Second, "How often to read the interrupt counters of the network devices")
+
+var (
+	interruptsDesc = prometheus.NewDesc("network_interface_interrupts_total",
+		"Interrupts of the queue of the interface handled by the CPU", []string{"interface", "irq", "queue", "cpu"}, nil)
+
+	// Result of the last /proc/interrupts read
+	interruptsSnapshot struct {
+		sync.Mutex
+		irqs []nicInterrupt
+	}
+)
+
+func init() {
+	registerCollector("interrupts", "per-queue, per-CPU interrupt counters of network devices from /proc/interrupts", false, startInterruptsCollector)
+}
+
+// nicInterrupt is an interrupt line of an interface
+type nicInterrupt struct {
+	iface, irq, queue string
+	// Count by CPU name, e.g. "CPU0"
+	counts map[string]uint64
+}
+
+// procInterrupt is a numbered line of /proc/interrupts
+type procInterrupt struct {
+	irq    string
+	action string
+	counts map[string]uint64
+}
+
+// parseInterrupts parses the numbered lines of /proc/interrupts. The header
+// names the columns, as offline CPUs are left out.
+func parseInterrupts(r *bufio.Scanner) ([]procInterrupt, error) {
+	if !r.Scan() {
+		return nil, fmt.Errorf("missing header")
+	}
+	cpus := strings.Fields(r.Text())
+	var irqs []procInterrupt
+	for r.Scan() {
+		fields := strings.Fields(r.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		irq := strings.TrimSuffix(fields[0], ":")
+		// Architecture specific counters like NMI or LOC
+		if _, err := strconv.Atoi(irq); err != nil {
+			continue
+		}
+		fields = fields[1:]
+		p := procInterrupt{irq: irq, counts: make(map[string]uint64, len(cpus))}
+		for i, cpu := range cpus {
+			if i >= len(fields) {
+				break
+			}
+			n, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("IRQ %s: %w", irq, err)
+			}
+			p.counts[cpu] = n
+		}
+		// The columns after the counts vary by architecture, the action
+		// names come last
+		if len(fields) > len(cpus) {
+			p.action = fields[len(fields)-1]
+		}
+		irqs = append(irqs, p)
+	}
+	return irqs, r.Err()
+}
+
+// irqAction returns the action names of an IRQ, e.g. "eth0-TxRx-3". sysfs
+// has them unmangled, /proc/interrupts joins shared IRQs with spaces.
+func irqAction(p procInterrupt) string {
+	if data, err := os.ReadFile(sysFilePath("kernel/irq/" + p.irq + "/actions")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return p.action
+}
+
+// deviceIRQs maps the MSI interrupts of the PCI devices of the interfaces
+// to the interface names
+func deviceIRQs(ifaces []net.Interface) map[string]string {
+	owners := make(map[string]string)
+	for _, iface := range ifaces {
+		dir, ok := pciDeviceDir(iface.Name)
+		if !ok {
+			continue
+		}
+		entries, _ := os.ReadDir(filepath.Join(dir, "msi_irqs"))
+		for _, e := range entries {
+			owners[e.Name()] = iface.Name
+		}
+	}
+	return owners
+}
+
+// actionInterface finds the interface named in an action, for drivers
+// naming their queues like "eth0-rx-0" or "i40e-eth0-TxRx-3"
+func actionInterface(action string, ifaces []net.Interface) string {
+	for _, iface := range ifaces {
+		for _, a := range strings.Split(action, ",") {
+			a = strings.TrimSpace(a)
+			if a == iface.Name || strings.HasPrefix(a, iface.Name+"-") ||
+				strings.Contains(a, "-"+iface.Name+"-") || strings.HasSuffix(a, "-"+iface.Name) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// readInterrupts reads the interrupt counters of all network devices
+func readInterrupts() ([]nicInterrupt, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(procFilePath("interrupts"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	irqs, err := parseInterrupts(bufio.NewScanner(file))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file.Name(), err)
+	}
+
+	owners := deviceIRQs(ifaces)
+	var nics []nicInterrupt
+	for _, p := range irqs {
+		action := irqAction(p)
+		iface, ok := owners[p.irq]
+		if !ok {
+			iface = actionInterface(action, ifaces)
+		}
+		if iface == "" {
+			continue
+		}
+		nics = append(nics, nicInterrupt{iface: iface, irq: p.irq, queue: action, counts: p.counts})
+	}
+	return nics, nil
+}
+
+// startInterruptsCollector starts reading the interrupt counters
+func startInterruptsCollector() error {
+	registerMetrics("interrupts", interruptsCollector{})
+	go collectInterrupts()
+	return nil
+}
+
+// collectInterrupts periodically refreshes the interrupts snapshot
+func collectInterrupts() {
+	for {
+		irqs, err := readInterrupts()
+		if err != nil {
+			log.Printf("Error reading interrupts: %v", err)
+		} else {
+			interruptsSnapshot.Lock()
+			interruptsSnapshot.irqs = irqs
+			interruptsSnapshot.Unlock()
+		}
+		time.Sleep(*interruptsInterval)
+	}
+}
+
+// interruptsCollector exports the last interrupt counters
+type interruptsCollector struct{}
+
+func (interruptsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- interruptsDesc
+}
+
+func (interruptsCollector) Collect(ch chan<- prometheus.Metric) {
+	interruptsSnapshot.Lock()
+	defer interruptsSnapshot.Unlock()
+	for _, irq := range interruptsSnapshot.irqs {
+		for cpu, n := range irq.counts {
+			ch <- prometheus.MustNewConstMetric(interruptsDesc, prometheus.CounterValue, float64(n), irq.iface, irq.irq, irq.queue, strings.TrimPrefix(cpu, "CPU"))
+		}
+	}
+}
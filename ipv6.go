@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ipv6Interval = flag.Duration("ipv6.interval", 15*time.Second, "How often to read the per-interface IPv6 counters from /proc/net/dev_snmp6")
+
+var (
+	ipv6BytesDesc = prometheus.NewDesc("network_interface_ipv6_bytes_total",
+		"IPv6 bytes received or sent on the interface, counted from the IPv6 header on", []string{"interface", "direction"}, nil)
+	ipv6PacketsDesc = prometheus.NewDesc("network_interface_ipv6_packets_total",
+		"IPv6 packets received or sent on the interface", []string{"interface", "direction"}, nil)
+	ipv6MulticastPacketsDesc = prometheus.NewDesc("network_interface_ipv6_multicast_packets_total",
+		"IPv6 multicast packets received or sent on the interface", []string{"interface", "direction"}, nil)
+	ipv6ErrorsDesc = prometheus.NewDesc("network_interface_ipv6_errors_total",
+		"IPv6 packets of the interface that were dropped or failed, by reason", []string{"interface", "direction", "reason"}, nil)
+
+	// Counters of the dev_snmp6 files making up the traffic series, with the
+	// direction; the rest are errors
+	ipv6Traffic = map[string]struct {
+		desc      *prometheus.Desc
+		direction string
+	}{
+		"Ip6InOctets":     {ipv6BytesDesc, "receive"},
+		"Ip6OutOctets":    {ipv6BytesDesc, "transmit"},
+		"Ip6InReceives":   {ipv6PacketsDesc, "receive"},
+		"Ip6OutRequests":  {ipv6PacketsDesc, "transmit"},
+		"Ip6InMcastPkts":  {ipv6MulticastPacketsDesc, "receive"},
+		"Ip6OutMcastPkts": {ipv6MulticastPacketsDesc, "transmit"},
+	}
+	ipv6Errors = map[string]struct{ direction, reason string }{
+		"Ip6InHdrErrors":     {"receive", "header"},
+		"Ip6InAddrErrors":    {"receive", "address"},
+		"Ip6InNoRoutes":      {"receive", "no_route"},
+		"Ip6InTooBigErrors":  {"receive", "too_big"},
+		"Ip6InTruncatedPkts": {"receive", "truncated"},
+		"Ip6InUnknownProtos": {"receive", "unknown_protocol"},
+		"Ip6InDiscards":      {"receive", "discard"},
+		"Ip6OutDiscards":     {"transmit", "discard"},
+		"Ip6OutNoRoutes":     {"transmit", "no_route"},
+		"Ip6FragFails":       {"transmit", "fragmentation"},
+		"Ip6ReasmFails":      {"receive", "reassembly"},
+		"Icmp6InErrors":      {"receive", "icmp"},
+		"Icmp6OutErrors":     {"transmit", "icmp"},
+		"Icmp6InCsumErrors":  {"receive", "icmp_checksum"},
+	}
+
+	// Result of the last read of the dev_snmp6 files by interface
+	ipv6Snapshot struct {
+		sync.Mutex
+		byIface map[string]map[string]uint64
+	}
+)
+
+func init() {
+	registerCollector("ipv6", "per-interface IPv6 traffic and error counters from /proc/net/dev_snmp6", false, startIPv6Collector)
+}
+
+// readIPv6Counters reads /proc/net/dev_snmp6/<interface>, lines of a counter
+// name and its value
+func readIPv6Counters(iface string) (map[string]uint64, error) {
+	file, err := os.Open(procFilePath("net/dev_snmp6/" + iface))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	counters := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			counters[fields[0]] = v
+		}
+	}
+	return counters, scanner.Err()
+}
+
+// readAllIPv6Counters reads the counters of every interface with IPv6
+// enabled, except the loopback interface
+func readAllIPv6Counters() (map[string]map[string]uint64, error) {
+	entries, err := os.ReadDir(procFilePath("net/dev_snmp6"))
+	if err != nil {
+		return nil, err
+	}
+	byIface := make(map[string]map[string]uint64, len(entries))
+	for _, e := range entries {
+		if e.Name() == "lo" {
+			continue
+		}
+		// Interfaces removed since the directory was listed
+		if counters, err := readIPv6Counters(e.Name()); err == nil {
+			byIface[e.Name()] = counters
+		}
+	}
+	return byIface, nil
+}
+
+// startIPv6Collector starts reading the IPv6 counters
+func startIPv6Collector() error {
+	if _, err := os.Stat(procFilePath("net/dev_snmp6")); err != nil {
+		return err
+	}
+	registerMetrics("ipv6", ipv6Collector{})
+	go collectIPv6()
+	return nil
+}
+
+// collectIPv6 periodically refreshes the IPv6 snapshot
+func collectIPv6() {
+	for {
+		byIface, err := readAllIPv6Counters()
+		if err != nil {
+			log.Printf("Error reading IPv6 counters: %v", err)
+		} else {
+			ipv6Snapshot.Lock()
+			ipv6Snapshot.byIface = byIface
+			ipv6Snapshot.Unlock()
+		}
+		time.Sleep(*ipv6Interval)
+	}
+}
+
+// ipv6Collector exports the last IPv6 counters
+type ipv6Collector struct{}
+
+func (ipv6Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ipv6BytesDesc
+	ch <- ipv6PacketsDesc
+	ch <- ipv6MulticastPacketsDesc
+	ch <- ipv6ErrorsDesc
+}
+
+func (ipv6Collector) Collect(ch chan<- prometheus.Metric) {
+	ipv6Snapshot.Lock()
+	defer ipv6Snapshot.Unlock()
+	for iface, counters := range ipv6Snapshot.byIface {
+		for name, value := range counters {
+			if t, ok := ipv6Traffic[name]; ok {
+				ch <- prometheus.MustNewConstMetric(t.desc, prometheus.CounterValue, float64(value), iface, t.direction)
+			} else if e, ok := ipv6Errors[name]; ok {
+				ch <- prometheus.MustNewConstMetric(ipv6ErrorsDesc, prometheus.CounterValue, float64(value), iface, e.direction, e.reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	kafkaBrokers  = flag.String("kafka.brokers", "", "Comma-separated Kafka bootstrap brokers (host:port) to produce interface stats to; empty disables")
+	kafkaTopic    = flag.String("kafka.topic", "network-interface-stats", "Kafka topic to produce the interface stats to")
+	kafkaFormat   = flag.String("kafka.format", "json", "Message format: json, or avro for Avro single-object encoding")
+	kafkaInterval = flag.Duration("kafka.interval", 10*time.Second, "How often to produce the interface stats to Kafka")
+)
+
+// Kafka API keys and versions. Produce v3 and Metadata v4 are the oldest
+// versions Kafka 4 still accepts, and are understood since Kafka 0.11.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaAvroSchema is the Parsing Canonical Form of the Avro schema of the
+// messages, whose fingerprint identifies them in the single-object encoding
+const kafkaAvroSchema = `{"name":"vyosexporter.InterfaceStats","type":"record","fields":[` +
+	`{"name":"host","type":"string"},{"name":"interface","type":"string"},{"name":"description","type":"string"},{"name":"index","type":"int"},` +
+	`{"name":"rx_bits_per_second","type":["null","double"]},{"name":"tx_bits_per_second","type":["null","double"]},` +
+	`{"name":"rx_bytes","type":"long"},{"name":"tx_bytes","type":"long"},{"name":"rx_packets","type":"long"},{"name":"tx_packets","type":"long"},` +
+	`{"name":"rx_errors","type":"long"},{"name":"tx_errors","type":"long"},{"name":"rx_drops","type":"long"},{"name":"tx_drops","type":"long"},` +
+	`{"name":"timestamp","type":"long"}]}`
+
+// CRC-32C of record batches
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// avroFingerprint returns the CRC-64-AVRO fingerprint of a schema
+func avroFingerprint(schema string) uint64 {
+	const empty = 0xc15d213aa4d7a795
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = fp>>1 ^ empty&-(fp&1)
+		}
+		table[i] = fp
+	}
+	fp := uint64(empty)
+	for i := 0; i < len(schema); i++ {
+		fp = fp>>8 ^ table[byte(fp)^schema[i]]
+	}
+	return fp
+}
+
+// kafkaMessage is the JSON message of an interface
+type kafkaMessage struct {
+	Host string `json:"host"`
+	interfaceJSON
+}
+
+// encodeAvro encodes a message in the Avro single-object encoding
+func encodeAvro(m kafkaMessage, fingerprint uint64) []byte {
+	b := binary.LittleEndian.AppendUint64([]byte{0xc3, 0x01}, fingerprint)
+	for _, s := range []string{m.Host, m.Interface, m.Description} {
+		b = binary.AppendVarint(b, int64(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.AppendVarint(b, int64(m.Index))
+	// The speeds are null without a speed: union branch 0 is null, 1 double
+	for _, speed := range []*float64{m.RxBitsPerSecond, m.TxBitsPerSecond} {
+		if speed == nil {
+			b = binary.AppendVarint(b, 0)
+			continue
+		}
+		b = binary.AppendVarint(b, 1)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(*speed))
+	}
+	for _, v := range []uint64{m.RxBytes, m.TxBytes, m.RxPackets, m.TxPackets, m.RxErrors, m.TxErrors, m.RxDrops, m.TxDrops} {
+		b = binary.AppendVarint(b, int64(v))
+	}
+	return binary.AppendVarint(b, m.Timestamp)
+}
+
+// kafkaProducer is a minimal Kafka producer without compression, producing
+// with acks=1 to the partition leaders
+type kafkaProducer struct {
+	brokers     []string
+	hostname    string
+	fingerprint uint64
+	correlation int32
+
+	// Leaders of the partitions of the topic, refreshed after errors
+	leaders map[int32]string
+	conns   map[string]*kafkaConn
+}
+
+// kafkaConn is a connection to a broker
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// validateKafkaFlags checks --kafka.format and --kafka.topic
+func validateKafkaFlags() error {
+	if *kafkaFormat != "json" && *kafkaFormat != "avro" {
+		return fmt.Errorf("unsupported --kafka.format %q", *kafkaFormat)
+	}
+	if *kafkaBrokers != "" && *kafkaTopic == "" {
+		return errors.New("--kafka.topic is empty")
+	}
+	return nil
+}
+
+// newKafkaProducer validates the flags
+func newKafkaProducer() (*kafkaProducer, error) {
+	if err := validateKafkaFlags(); err != nil {
+		return nil, err
+	}
+	var brokers []string
+	for _, b := range strings.Split(*kafkaBrokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	hostname, _ := os.Hostname()
+	return &kafkaProducer{
+		brokers:     brokers,
+		hostname:    hostname,
+		fingerprint: avroFingerprint(kafkaAvroSchema),
+		conns:       make(map[string]*kafkaConn),
+	}, nil
+}
+
+// kafkaString appends a Kafka STRING
+func kafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// request sends a request to a broker and returns the response body after
+// the correlation ID
+func (p *kafkaProducer) request(address string, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	c, ok := p.conns[address]
+	if !ok {
+		conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		c = &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+		p.conns[address] = c
+	}
+	p.correlation++
+	header := binary.BigEndian.AppendUint16(nil, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(version))
+	header = binary.BigEndian.AppendUint32(header, uint32(p.correlation))
+	header = kafkaString(header, "vyosexporter")
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(header)+len(body)))
+	msg = append(append(msg, header...), body...)
+
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{b: resp}
+	if id := r.int32(); id != p.correlation {
+		return nil, fmt.Errorf("response to request %d instead of %d", id, p.correlation)
+	}
+	return r, r.err
+}
+
+// close closes the connections and forgets the leaders after an error
+func (p *kafkaProducer) close() {
+	for address, c := range p.conns {
+		c.conn.Close()
+		delete(p.conns, address)
+	}
+	p.leaders = nil
+}
+
+// kafkaReader decodes a response, remembering the first error
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n || n < 0 {
+		r.err = errors.New("truncated Kafka response")
+		return make([]byte, max(n, 0))
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// metadata looks up the partition leaders of the topic on the first
+// reachable bootstrap broker
+func (p *kafkaProducer) metadata() error {
+	body := binary.BigEndian.AppendUint32(nil, 1)
+	body = kafkaString(body, *kafkaTopic)
+	// allow_auto_topic_creation
+	body = append(body, 1)
+	var err error
+	for _, address := range p.brokers {
+		var r *kafkaReader
+		if r, err = p.request(address, kafkaMetadata, kafkaMetadataVersion, body); err != nil {
+			p.close()
+			continue
+		}
+		r.int32() // throttle_time_ms
+		brokers := make(map[int32]string)
+		for i := r.int32(); i > 0 && r.err == nil; i-- {
+			node, host, port := r.int32(), r.string(), r.int32()
+			r.string() // rack
+			brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		r.string() // cluster_id
+		r.int32()  // controller_id
+		leaders := make(map[int32]string)
+		for i := r.int32(); i > 0 && r.err == nil; i-- {
+			code, name := r.int16(), r.string()
+			r.next(1) // is_internal
+			if code != 0 {
+				return fmt.Errorf("topic %s: Kafka error %d", name, code)
+			}
+			for j := r.int32(); j > 0 && r.err == nil; j-- {
+				code, partition, leader := r.int16(), r.int32(), r.int32()
+				// replica_nodes, isr_nodes
+				r.next(4 * int(r.int32()))
+				r.next(4 * int(r.int32()))
+				// Empty while the partition has no leader
+				leaders[partition] = ""
+				if code == 0 {
+					leaders[partition] = brokers[leader]
+				}
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if len(leaders) == 0 {
+			return fmt.Errorf("no partitions of topic %s", *kafkaTopic)
+		}
+		p.leaders = leaders
+		return nil
+	}
+	return err
+}
+
+// recordBatch encodes records with the given keys and values as a v2
+// RecordBatch
+func recordBatch(keys, values [][]byte, now time.Time) []byte {
+	var records []byte
+	for i := range values {
+		var record []byte
+		record = append(record, 0)                     // attributes
+		record = binary.AppendVarint(record, 0)        // timestampDelta
+		record = binary.AppendVarint(record, int64(i)) // offsetDelta
+		record = binary.AppendVarint(record, int64(len(keys[i])))
+		record = append(record, keys[i]...)
+		record = binary.AppendVarint(record, int64(len(values[i])))
+		record = append(record, values[i]...)
+		record = binary.AppendVarint(record, 0) // headers
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+	// From attributes on, covered by the CRC
+	var tail []byte
+	tail = binary.BigEndian.AppendUint16(tail, 0)
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)-1))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(now.UnixMilli()))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(now.UnixMilli()))
+	tail = binary.BigEndian.AppendUint64(tail, math.MaxUint64) // producerId -1
+	tail = binary.BigEndian.AppendUint16(tail, math.MaxUint16) // producerEpoch -1
+	tail = binary.BigEndian.AppendUint32(tail, math.MaxUint32) // baseSequence -1
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)))
+	tail = append(tail, records...)
+
+	batch := binary.BigEndian.AppendUint64(nil, 0) // baseOffset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail)))
+	batch = binary.BigEndian.AppendUint32(batch, math.MaxUint32) // partitionLeaderEpoch -1
+	batch = append(batch, 2)                                     // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, castagnoli))
+	return append(batch, tail...)
+}
+
+// push produces a message per interface, keyed by host and interface so the
+// messages of an interface stay in order on one partition
+func (p *kafkaProducer) push(stats []interfaceStats) error {
+	if p.leaders == nil {
+		if err := p.metadata(); err != nil {
+			return err
+		}
+	}
+	partitions := int32(len(p.leaders))
+	type batch struct{ keys, values [][]byte }
+	batches := make(map[int32]*batch)
+	for _, s := range stats {
+		m := kafkaMessage{Host: p.hostname, interfaceJSON: interfaceToJSON(s)}
+		key := []byte(p.hostname + "/" + s.Name)
+		var value []byte
+		if *kafkaFormat == "avro" {
+			value = encodeAvro(m, p.fingerprint)
+		} else {
+			value, _ = json.Marshal(m)
+		}
+		partition := int32(crc32.ChecksumIEEE(key) % uint32(partitions))
+		b := batches[partition]
+		if b == nil {
+			b = &batch{}
+			batches[partition] = b
+		}
+		b.keys, b.values = append(b.keys, key), append(b.values, value)
+	}
+
+	// One request per leader
+	byLeader := make(map[string][]int32)
+	for partition := range batches {
+		address := p.leaders[partition]
+		if address == "" {
+			p.close()
+			return fmt.Errorf("no leader of partition %d", partition)
+		}
+		byLeader[address] = append(byLeader[address], partition)
+	}
+	now := time.Now()
+	for address, parts := range byLeader {
+		body := binary.BigEndian.AppendUint16(nil, math.MaxUint16) // transactional_id null
+		body = binary.BigEndian.AppendUint16(body, 1)              // acks
+		body = binary.BigEndian.AppendUint32(body, 10000)          // timeout_ms
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = kafkaString(body, *kafkaTopic)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(parts)))
+		for _, partition := range parts {
+			records := recordBatch(batches[partition].keys, batches[partition].values, now)
+			body = binary.BigEndian.AppendUint32(body, uint32(partition))
+			body = binary.BigEndian.AppendUint32(body, uint32(len(records)))
+			body = append(body, records...)
+		}
+		r, err := p.request(address, kafkaProduce, kafkaProduceVersion, body)
+		if err != nil {
+			p.close()
+			return err
+		}
+		for i := r.int32(); i > 0 && r.err == nil; i-- {
+			r.string()
+			for j := r.int32(); j > 0 && r.err == nil; j-- {
+				partition, code := r.int32(), r.int16()
+				r.int64() // base_offset
+				r.int64() // log_append_time
+				if code != 0 && r.err == nil {
+					// Leadership moves, look it up again next time
+					p.close()
+					return fmt.Errorf("partition %d: Kafka error %d", partition, code)
+				}
+			}
+		}
+		if r.err != nil {
+			p.close()
+			return r.err
+		}
+	}
+	return nil
+}
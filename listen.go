@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var listenInterval = flag.Duration("listen.interval", 15*time.Second, "How often to read the accept queues of the listening TCP sockets and the listen drop counters")
+
+// TCP_LISTEN state bit of an inet_diag request
+const tcpDiagListen = 1 << 10
+
+// TcpExt counters of /proc/net/netstat by metric
+var listenNetstatCounters = []struct {
+	field string
+	desc  *prometheus.Desc
+}{
+	{"ListenOverflows", prometheus.NewDesc("network_tcp_listen_overflows_total",
+		"Connections dropped because the accept queue of the listening socket was full", nil, nil)},
+	{"ListenDrops", prometheus.NewDesc("network_tcp_listen_drops_total",
+		"Connection requests dropped by listening sockets for any reason, including overflows", nil, nil)},
+	{"TCPReqQFullDrop", prometheus.NewDesc("network_tcp_syn_backlog_drops_total",
+		"SYNs dropped because the SYN backlog was full and SYN cookies are disabled", nil, nil)},
+	{"SyncookiesSent", prometheus.NewDesc("network_tcp_syncookies_sent_total",
+		"SYN cookies sent because the SYN backlog was full", nil, nil)},
+}
+
+var (
+	listenQueueLengthDesc = prometheus.NewDesc("network_tcp_listen_queue_length",
+		"Established connections waiting in the accept queue of the listening sockets of the address and port", []string{"address", "port"}, nil)
+	listenQueueLimitDesc = prometheus.NewDesc("network_tcp_listen_queue_limit",
+		"Size of the accept queue of the listening sockets of the address and port, the listen() backlog capped by net.core.somaxconn", []string{"address", "port"}, nil)
+
+	// Result of the last read
+	listenSnapshot struct {
+		sync.Mutex
+		netstat map[string]uint64
+		queues  map[[2]string]listenQueue
+	}
+)
+
+func init() {
+	registerCollector("listen", "TCP accept queue depths and listen overflow counters", false, startListenCollector)
+}
+
+type listenQueue struct {
+	length, limit uint64
+}
+
+// readTCPExt reads the TcpExt counters of /proc/net/netstat, a line of
+// names followed by a line of values
+func readTCPExt() (map[string]uint64, error) {
+	f, err := os.Open(procFilePath("net/netstat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var names []string
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "TcpExt:" {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		counters := make(map[string]uint64, len(names))
+		for i, value := range fields[1:] {
+			if i < len(names) {
+				counters[names[i]], _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+		return counters, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no TcpExt counters")
+}
+
+// dumpListenQueues dumps the listening TCP sockets. The receive queue of a
+// listening socket is its accept queue, the send queue its limit. Sockets
+// sharing an address and port with SO_REUSEPORT are summed up.
+func dumpListenQueues(c *netlinkConn) (map[[2]string]listenQueue, error) {
+	queues := make(map[[2]string]listenQueue)
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		req := make([]byte, sizeofInetDiagReqV2)
+		req[0], req[1] = family, unix.IPPROTO_TCP
+		binary.NativeEndian.PutUint32(req[4:], tcpDiagListen)
+		replies, err := c.execute(sockDiagByFamily, unix.NLM_F_DUMP, req)
+		if err != nil {
+			if family == unix.AF_INET6 && errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, err
+		}
+		for _, reply := range replies {
+			if len(reply) < sizeofInetDiagMsg {
+				continue
+			}
+			addr := net.IP(reply[8:24])
+			if family == unix.AF_INET {
+				addr = net.IP(reply[8:12])
+			}
+			port := binary.BigEndian.Uint16(reply[4:6])
+			key := [2]string{addr.String(), fmt.Sprint(port)}
+			q := queues[key]
+			q.length += uint64(binary.NativeEndian.Uint32(reply[56:60]))
+			q.limit += uint64(binary.NativeEndian.Uint32(reply[60:64]))
+			queues[key] = q
+		}
+	}
+	return queues, nil
+}
+
+// startListenCollector starts reading the accept queues
+func startListenCollector() error {
+	c, err := dialNetlink(unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return err
+	}
+	registerMetrics("listen", listenCollector{})
+	go collectListen(c)
+	return nil
+}
+
+// collectListen periodically refreshes the listen snapshot
+func collectListen(c *netlinkConn) {
+	for {
+		netstat, err := readTCPExt()
+		if err != nil {
+			log.Printf("Error reading TCP listen counters: %v", err)
+		}
+		queues, err := dumpListenQueues(c)
+		if err != nil {
+			log.Printf("Error dumping listening sockets: %v", err)
+		}
+		listenSnapshot.Lock()
+		listenSnapshot.netstat, listenSnapshot.queues = netstat, queues
+		listenSnapshot.Unlock()
+		time.Sleep(*listenInterval)
+	}
+}
+
+// listenCollector exports the last listen snapshot
+type listenCollector struct{}
+
+func (listenCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range listenNetstatCounters {
+		ch <- counter.desc
+	}
+	ch <- listenQueueLengthDesc
+	ch <- listenQueueLimitDesc
+}
+
+func (listenCollector) Collect(ch chan<- prometheus.Metric) {
+	listenSnapshot.Lock()
+	defer listenSnapshot.Unlock()
+	for _, counter := range listenNetstatCounters {
+		if v, ok := listenSnapshot.netstat[counter.field]; ok {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(v))
+		}
+	}
+	for key, q := range listenSnapshot.queues {
+		ch <- prometheus.MustNewConstMetric(listenQueueLengthDesc, prometheus.GaugeValue, float64(q.length), key[:]...)
+		ch <- prometheus.MustNewConstMetric(listenQueueLimitDesc, prometheus.GaugeValue, float64(q.limit), key[:]...)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var lldpInterfaces = flag.String("lldp.interfaces", ".*", "Regular expression of physical interfaces to listen for LLDP frames on")
+
+// How often the interfaces are checked for new ones to listen on
+const lldpRefreshInterval = time.Minute
+
+// Nearest bridge group address LLDP frames are sent to, never forwarded by
+// bridges
+var lldpMulticastAddr = []byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+var (
+	lldpNeighborDesc = prometheus.NewDesc("network_interface_lldp_neighbor_info",
+		"Neighbor announced by LLDP on the network interface", []string{"interface", "chassis_id", "port_id", "port_description", "system_name", "management_address"}, nil)
+	lldpNeighborAgeDesc = prometheus.NewDesc("network_interface_lldp_neighbor_age_seconds",
+		"Seconds since the last LLDP frame of the neighbor", []string{"interface", "chassis_id", "port_id"}, nil)
+
+	// Neighbors seen and not yet expired, by interface and MSAP identifier
+	lldpSnapshot = struct {
+		sync.Mutex
+		neighbors map[lldpKey]*lldpNeighbor
+	}{neighbors: make(map[lldpKey]*lldpNeighbor)}
+)
+
+func init() {
+	registerCollector("lldp", "LLDP neighbors (switch, port, system name) of the physical interfaces from a passive listener", false, startLLDPCollector).
+		requires(capNetRaw).
+		checks(checkLLDPFlags)
+}
+
+// lldpKey identifies a neighbor of an interface, as the chassis and port IDs
+// do in LLDP
+type lldpKey struct{ iface, chassisID, portID string }
+
+// lldpNeighbor is the content of the last LLDPDU of a neighbor
+type lldpNeighbor struct {
+	portDescription, systemName, managementAddress string
+	seen, expires                                  time.Time
+}
+
+// LLDP TLV types, IEEE 802.1AB 8.4
+const (
+	lldpTLVEnd             = 0
+	lldpTLVChassisID       = 1
+	lldpTLVPortID          = 2
+	lldpTLVTTL             = 3
+	lldpTLVPortDescription = 4
+	lldpTLVSystemName      = 5
+	lldpTLVManagementAddr  = 8
+)
+
+// lldpDU is a parsed LLDPDU
+type lldpDU struct {
+	chassisID, portID                              string
+	ttl                                            time.Duration
+	portDescription, systemName, managementAddress string
+}
+
+// parseLLDPDU parses the TLVs of an LLDPDU, the payload of an ethernet frame
+// of type 0x88cc
+func parseLLDPDU(b []byte) (lldpDU, error) {
+	var du lldpDU
+	var hasTTL bool
+	for len(b) >= 2 {
+		header := binary.BigEndian.Uint16(b)
+		typ, length := int(header>>9), int(header&0x1ff)
+		if len(b) < 2+length {
+			return du, fmt.Errorf("TLV %d truncated", typ)
+		}
+		value := b[2 : 2+length]
+		b = b[2+length:]
+		switch typ {
+		case lldpTLVEnd:
+			b = nil
+		case lldpTLVChassisID:
+			if length >= 2 {
+				du.chassisID = lldpID(value[0], 4, 5, value[1:])
+			}
+		case lldpTLVPortID:
+			if length >= 2 {
+				du.portID = lldpID(value[0], 3, 4, value[1:])
+			}
+		case lldpTLVTTL:
+			if length >= 2 {
+				du.ttl = time.Duration(binary.BigEndian.Uint16(value)) * time.Second
+				hasTTL = true
+			}
+		case lldpTLVPortDescription:
+			du.portDescription = lldpString(value)
+		case lldpTLVSystemName:
+			du.systemName = lldpString(value)
+		case lldpTLVManagementAddr:
+			// Length of the address string, address subtype, address; only
+			// the first address is kept
+			if du.managementAddress == "" && length >= 2 && int(value[0]) <= length-1 {
+				du.managementAddress = lldpAddress(value[1 : 1+int(value[0])])
+			}
+		}
+	}
+	if du.chassisID == "" || du.portID == "" || !hasTTL {
+		return du, fmt.Errorf("mandatory TLV missing")
+	}
+	return du, nil
+}
+
+// lldpID formats a chassis or port ID by its subtype, MAC addresses and
+// network addresses are binary, the others text
+func lldpID(subtype, macSubtype, addrSubtype byte, value []byte) string {
+	switch subtype {
+	case macSubtype:
+		if len(value) == 6 {
+			return net.HardwareAddr(value).String()
+		}
+	case addrSubtype:
+		return lldpAddress(value)
+	}
+	return lldpString(value)
+}
+
+// lldpAddress formats an IANA address family number and an address
+func lldpAddress(value []byte) string {
+	if len(value) < 2 {
+		return ""
+	}
+	if addr, ok := netip.AddrFromSlice(value[1:]); ok && (value[0] == 1 || value[0] == 2) {
+		return addr.String()
+	}
+	return fmt.Sprintf("%x", value[1:])
+}
+
+// lldpString returns printable text of a TLV, as switches pad some with NULs
+func lldpString(value []byte) string {
+	return strings.TrimRight(strings.ToValidUTF8(string(value), ""), "\x00 ")
+}
+
+// isPhysicalInterface reports whether the interface has a device in sysfs,
+// unlike bridges, VLANs and tunnels
+func isPhysicalInterface(name string) bool {
+	_, err := os.Stat(sysFilePath("class/net/" + name + "/device"))
+	return err == nil
+}
+
+// checkLLDPFlags validates --lldp.interfaces
+func checkLLDPFlags() error {
+	if _, err := regexp.Compile(*lldpInterfaces); err != nil {
+		return fmt.Errorf("invalid --lldp.interfaces: %w", err)
+	}
+	return nil
+}
+
+// startLLDPCollector opens the packet socket for the LLDP frames of all
+// interfaces
+func startLLDPCollector() error {
+	selected := regexp.MustCompile(*lldpInterfaces)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_LLDP)))
+	if err != nil {
+		return fmt.Errorf("opening packet socket: %w", err)
+	}
+	registerMetrics("lldp", lldpCollector{})
+	names := &lldpInterfaceNames{byIndex: make(map[int]string)}
+	go names.refresh(fd, selected)
+	go readLLDPFrames(fd, names)
+	return nil
+}
+
+// lldpInterfaceNames are the selected interfaces the socket joined the LLDP
+// group on, by index
+type lldpInterfaceNames struct {
+	sync.Mutex
+	byIndex map[int]string
+}
+
+// refresh periodically joins the LLDP group on new physical interfaces, so
+// the NIC passes the frames up; the frames of the other interfaces are
+// dropped by their index
+func (n *lldpInterfaceNames) refresh(fd int, selected *regexp.Regexp) {
+	for {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			log.Printf("Error listing interfaces for LLDP: %v", err)
+		}
+		current := make(map[int]string)
+		for _, iface := range ifaces {
+			if selected.MatchString(iface.Name) && isPhysicalInterface(iface.Name) {
+				current[iface.Index] = iface.Name
+			}
+		}
+		n.Lock()
+		for index, name := range current {
+			if _, ok := n.byIndex[index]; ok {
+				continue
+			}
+			mreq := &unix.PacketMreq{Ifindex: int32(index), Type: unix.PACKET_MR_MULTICAST, Alen: 6}
+			copy(mreq.Address[:], lldpMulticastAddr)
+			if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+				log.Printf("Error joining the LLDP group on %s: %v", name, err)
+			}
+		}
+		// Memberships of removed interfaces go away with them
+		n.byIndex = current
+		n.Unlock()
+		time.Sleep(lldpRefreshInterval)
+	}
+}
+
+// name returns the name of a selected interface
+func (n *lldpInterfaceNames) name(index int) (string, bool) {
+	n.Lock()
+	defer n.Unlock()
+	name, ok := n.byIndex[index]
+	return name, ok
+}
+
+// readLLDPFrames records the neighbors of the received LLDPDUs until the
+// socket fails
+func readLLDPFrames(fd int, names *lldpInterfaceNames) {
+	defer unix.Close(fd)
+	buf := make([]byte, 9216)
+	for {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			log.Printf("Error receiving LLDP frames: %v", err)
+			return
+		}
+		ll, ok := from.(*unix.SockaddrLinklayer)
+		// Frames the host sent itself, e.g. from lldpd
+		if !ok || ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		iface, ok := names.name(ll.Ifindex)
+		if !ok {
+			continue
+		}
+		du, err := parseLLDPDU(buf[:n])
+		if err != nil {
+			continue
+		}
+		recordLLDPNeighbor(iface, du, time.Now())
+	}
+}
+
+// recordLLDPNeighbor adds or updates a neighbor; a TTL of 0 announces its
+// shutdown
+func recordLLDPNeighbor(iface string, du lldpDU, now time.Time) {
+	lldpSnapshot.Lock()
+	defer lldpSnapshot.Unlock()
+	key := lldpKey{iface, du.chassisID, du.portID}
+	if du.ttl == 0 {
+		delete(lldpSnapshot.neighbors, key)
+		return
+	}
+	lldpSnapshot.neighbors[key] = &lldpNeighbor{
+		portDescription:   du.portDescription,
+		systemName:        du.systemName,
+		managementAddress: du.managementAddress,
+		seen:              now,
+		expires:           now.Add(du.ttl),
+	}
+}
+
+// lldpCollector exports the neighbors, dropping the expired ones
+type lldpCollector struct{}
+
+func (lldpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lldpNeighborDesc
+	ch <- lldpNeighborAgeDesc
+}
+
+func (lldpCollector) Collect(ch chan<- prometheus.Metric) {
+	lldpSnapshot.Lock()
+	defer lldpSnapshot.Unlock()
+	now := time.Now()
+	for k, n := range lldpSnapshot.neighbors {
+		if now.After(n.expires) {
+			delete(lldpSnapshot.neighbors, k)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(lldpNeighborDesc, prometheus.GaugeValue, 1,
+			k.iface, k.chassisID, k.portID, n.portDescription, n.systemName, n.managementAddress)
+		ch <- prometheus.MustNewConstMetric(lldpNeighborAgeDesc, prometheus.GaugeValue, now.Sub(n.seen).Seconds(), k.iface, k.chassisID, k.portID)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var macsecInterval = flag.Duration("macsec.interval", 15*time.Second, "How often to read the MACsec SecY, channel and SA statistics")
+
+// Generic netlink family and attributes, from linux/if_macsec.h
+const (
+	macsecFamily         = "macsec"
+	macsecCmdGetTxSC     = 0
+	macsecAttrIfindex    = 1
+	macsecAttrSecY       = 4
+	macsecAttrTxSAList   = 5
+	macsecAttrRxSCList   = 6
+	macsecAttrTxSCStats  = 7
+	macsecAttrSecYStats  = 8
+	macsecSecYAttrSCI    = 1
+	macsecRxSCAttrSCI    = 1
+	macsecRxSCAttrActive = 2
+	macsecRxSCAttrSAList = 3
+	macsecRxSCAttrStats  = 4
+	macsecSAAttrAN       = 1
+	macsecSAAttrActive   = 2
+	macsecSAAttrPN       = 3
+	macsecSAAttrStats    = 6
+)
+
+// Names of the MACSEC_*_STATS_ATTR_* counters by attribute
+var (
+	macsecTxSCStats = map[uint16]string{1: "protected_packets", 2: "encrypted_packets", 3: "protected_bytes", 4: "encrypted_bytes"}
+	macsecSecYStats = map[uint16]string{1: "out_untagged", 2: "in_untagged", 3: "out_too_long", 4: "in_no_tag",
+		5: "in_bad_tag", 6: "in_unknown_sci", 7: "in_no_sci", 8: "in_overrun"}
+	macsecRxSCStats = map[uint16]string{1: "validated_bytes", 2: "decrypted_bytes", 3: "unchecked", 4: "delayed", 5: "ok",
+		6: "invalid", 7: "late", 8: "not_valid", 9: "not_using_sa", 10: "unused_sa"}
+	macsecTxSAStats = map[uint16]string{1: "protected", 2: "encrypted"}
+	macsecRxSAStats = map[uint16]string{1: "ok", 2: "invalid", 3: "not_valid", 4: "not_using_sa", 5: "unused_sa"}
+)
+
+var (
+	macsecTransmitPacketsDesc = prometheus.NewDesc("network_macsec_transmit_packets_total",
+		"Packets sent on the MACsec transmit channel, integrity protected only or also encrypted", []string{"interface", "sci", "protection"}, nil)
+	macsecTransmitBytesDesc = prometheus.NewDesc("network_macsec_transmit_bytes_total",
+		"Bytes sent on the MACsec transmit channel, integrity protected only or also encrypted", []string{"interface", "sci", "protection"}, nil)
+	macsecReceivePacketsDesc = prometheus.NewDesc("network_macsec_receive_packets_total",
+		"Packets received on the MACsec receive channel of a peer by validation result", []string{"interface", "sci", "result"}, nil)
+	macsecReceiveBytesDesc = prometheus.NewDesc("network_macsec_receive_bytes_total",
+		"Bytes received on the MACsec receive channel of a peer, validated only or also decrypted", []string{"interface", "sci", "protection"}, nil)
+	macsecSecYPacketsDesc = prometheus.NewDesc("network_macsec_secy_packets_total",
+		"Packets of the MACsec interface not belonging to a channel, e.g. untagged or with a bad tag", []string{"interface", "counter"}, nil)
+	macsecSAPacketsDesc = prometheus.NewDesc("network_macsec_sa_packets_total",
+		"Packets of the MACsec secure association by result", []string{"interface", "sci", "an", "direction", "result"}, nil)
+	macsecSAActiveDesc = prometheus.NewDesc("network_macsec_sa_active",
+		"1 if the MACsec secure association is in use, 0 otherwise", []string{"interface", "sci", "an", "direction"}, nil)
+	macsecSANextPNDesc = prometheus.NewDesc("network_macsec_sa_next_pn",
+		"Next packet number of the MACsec secure association; the key must be rotated before it is exhausted", []string{"interface", "sci", "an", "direction"}, nil)
+
+	// Result of the last MACsec dump
+	macsecSnapshot struct {
+		sync.Mutex
+		devices []macsecDevice
+	}
+)
+
+func init() {
+	registerCollector("macsec", "MACsec SecY, channel and secure association statistics via generic netlink", false, startMACsecCollector)
+}
+
+type macsecDevice struct {
+	iface, sci string
+	txSC, secY map[string]uint64
+	txSAs      []macsecSA
+	rxSCs      []macsecRxSC
+}
+
+type macsecRxSC struct {
+	sci   string
+	stats map[string]uint64
+	sas   []macsecSA
+}
+
+type macsecSA struct {
+	an     string
+	active bool
+	nextPN uint64
+	stats  map[string]uint64
+}
+
+// macsecStats decodes a nested statistics attribute by counter name
+func macsecStats(b []byte, names map[uint16]string) map[string]uint64 {
+	stats := make(map[string]uint64)
+	for _, a := range nlAttrs(b) {
+		if name, ok := names[a.typ]; ok {
+			if v, ok := nlUint(a.value); ok {
+				stats[name] = v
+			}
+		}
+	}
+	return stats
+}
+
+// parseMACsecSAs decodes a list of secure associations
+func parseMACsecSAs(b []byte, names map[uint16]string) []macsecSA {
+	var sas []macsecSA
+	for _, a := range nlAttrs(b) {
+		attrs := nlAttrMap(a.value)
+		an, ok := nlUint(attrs[macsecSAAttrAN])
+		if !ok {
+			continue
+		}
+		active, _ := nlUint(attrs[macsecSAAttrActive])
+		// 32 bits, or 64 bits with extended packet numbering
+		pn, _ := nlUint(attrs[macsecSAAttrPN])
+		sas = append(sas, macsecSA{
+			an:     strconv.FormatUint(an, 10),
+			active: active != 0,
+			nextPN: pn,
+			stats:  macsecStats(attrs[macsecSAAttrStats], names),
+		})
+	}
+	return sas
+}
+
+// parseMACsecDevice decodes the reply for one MACsec interface. SCIs are
+// in network byte order and printed like ip macsec does.
+func parseMACsecDevice(b []byte) (macsecDevice, bool) {
+	attrs := nlAttrMap(b)
+	index, ok := nlUint(attrs[macsecAttrIfindex])
+	if !ok {
+		return macsecDevice{}, false
+	}
+	d := macsecDevice{
+		sci:   hex.EncodeToString(nlAttrMap(attrs[macsecAttrSecY])[macsecSecYAttrSCI]),
+		txSC:  macsecStats(attrs[macsecAttrTxSCStats], macsecTxSCStats),
+		secY:  macsecStats(attrs[macsecAttrSecYStats], macsecSecYStats),
+		txSAs: parseMACsecSAs(attrs[macsecAttrTxSAList], macsecTxSAStats),
+	}
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		d.iface = iface.Name
+	} else {
+		d.iface = strconv.FormatUint(index, 10)
+	}
+	for _, a := range nlAttrs(attrs[macsecAttrRxSCList]) {
+		sc := nlAttrMap(a.value)
+		d.rxSCs = append(d.rxSCs, macsecRxSC{
+			sci:   hex.EncodeToString(sc[macsecRxSCAttrSCI]),
+			stats: macsecStats(sc[macsecRxSCAttrStats], macsecRxSCStats),
+			sas:   parseMACsecSAs(sc[macsecRxSCAttrSAList], macsecRxSAStats),
+		})
+	}
+	return d, true
+}
+
+// readMACsecDevices dumps the MACsec interfaces
+func readMACsecDevices(c *genlConn) ([]macsecDevice, error) {
+	replies, err := c.execute(macsecCmdGetTxSC, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	var devices []macsecDevice
+	for _, reply := range replies {
+		if d, ok := parseMACsecDevice(reply); ok {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// startMACsecCollector starts reading the MACsec statistics
+func startMACsecCollector() error {
+	registerMetrics("macsec", macsecCollector{})
+	go collectMACsec()
+	return nil
+}
+
+// collectMACsec periodically refreshes the MACsec snapshot. The family
+// appears once the macsec module is loaded, with the first MACsec interface.
+func collectMACsec() {
+	var c *genlConn
+	for {
+		var devices []macsecDevice
+		if c == nil {
+			c, _ = dialGenetlink(macsecFamily)
+		}
+		if c != nil {
+			var err error
+			if devices, err = readMACsecDevices(c); err != nil {
+				log.Printf("Error reading MACsec interfaces: %v", err)
+				c.Close()
+				c = nil
+			}
+		}
+		macsecSnapshot.Lock()
+		macsecSnapshot.devices = devices
+		macsecSnapshot.Unlock()
+		time.Sleep(*macsecInterval)
+	}
+}
+
+// macsecCollector exports the last MACsec snapshot
+type macsecCollector struct{}
+
+func (macsecCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- macsecTransmitPacketsDesc
+	ch <- macsecTransmitBytesDesc
+	ch <- macsecReceivePacketsDesc
+	ch <- macsecReceiveBytesDesc
+	ch <- macsecSecYPacketsDesc
+	ch <- macsecSAPacketsDesc
+	ch <- macsecSAActiveDesc
+	ch <- macsecSANextPNDesc
+}
+
+func (macsecCollector) Collect(ch chan<- prometheus.Metric) {
+	macsecSnapshot.Lock()
+	defer macsecSnapshot.Unlock()
+	for _, d := range macsecSnapshot.devices {
+		for _, protection := range []string{"protected", "encrypted"} {
+			if v, ok := d.txSC[protection+"_packets"]; ok {
+				ch <- prometheus.MustNewConstMetric(macsecTransmitPacketsDesc, prometheus.CounterValue, float64(v), d.iface, d.sci, protection)
+			}
+			if v, ok := d.txSC[protection+"_bytes"]; ok {
+				ch <- prometheus.MustNewConstMetric(macsecTransmitBytesDesc, prometheus.CounterValue, float64(v), d.iface, d.sci, protection)
+			}
+		}
+		for counter, v := range d.secY {
+			ch <- prometheus.MustNewConstMetric(macsecSecYPacketsDesc, prometheus.CounterValue, float64(v), d.iface, counter)
+		}
+		collectMACsecSAs(ch, d.iface, d.sci, "transmit", d.txSAs)
+		for _, sc := range d.rxSCs {
+			for name, v := range sc.stats {
+				switch name {
+				case "validated_bytes", "decrypted_bytes":
+					ch <- prometheus.MustNewConstMetric(macsecReceiveBytesDesc, prometheus.CounterValue, float64(v), d.iface, sc.sci, name[:len(name)-len("_bytes")])
+				default:
+					ch <- prometheus.MustNewConstMetric(macsecReceivePacketsDesc, prometheus.CounterValue, float64(v), d.iface, sc.sci, name)
+				}
+			}
+			collectMACsecSAs(ch, d.iface, sc.sci, "receive", sc.sas)
+		}
+	}
+}
+
+// collectMACsecSAs exports the secure associations of a channel
+func collectMACsecSAs(ch chan<- prometheus.Metric, iface, sci, direction string, sas []macsecSA) {
+	for _, sa := range sas {
+		ch <- prometheus.MustNewConstMetric(macsecSAActiveDesc, prometheus.GaugeValue, boolToFloat(sa.active), iface, sci, sa.an, direction)
+		ch <- prometheus.MustNewConstMetric(macsecSANextPNDesc, prometheus.GaugeValue, float64(sa.nextPN), iface, sci, sa.an, direction)
+		for result, v := range sa.stats {
+			ch <- prometheus.MustNewConstMetric(macsecSAPacketsDesc, prometheus.CounterValue, float64(v), iface, sci, sa.an, direction, result)
+		}
+	}
+}
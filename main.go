@@ -1,36 +1,40 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"sort"
-	"strings"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
 )
 
-const (
-	bytesToBits = 8
-	// Maximum number of interfaces to track
-	maxInterfaces = 1000
-	// Cleanup interval for old interfaces
-	cleanupInterval = 5 * time.Minute
-)
+const bytesToBits = 8
 
 var (
-	allowedIPs = flag.String("allowed-ips", os.Getenv("ALLOWED_IPS"), "Comma-separated list of allowed IP addresses")
+	// BNG/BRAS hosts run thousands of PPPoE session interfaces
+	maxInterfaces     = flag.Int("interface.max", 20000, "Maximum number of interfaces whose previous reading is kept for the speed calculation")
+	cleanupInterval   = flag.Duration("interface.cleanup-interval", 5*time.Minute, "Forget the previous reading of interfaces not seen for this long")
+	interfaceEviction = flag.String("interface.eviction", "lru", "Which interfaces to forget beyond --interface.max: lru for the least recently seen, absent for only those missing from /proc/net/dev")
+
+	allowedIPs = flag.String("allowed-ips", os.Getenv("ALLOWED_IPS"), "Comma-separated list of allowed IP addresses, CIDRs or hostnames")
 	port       = flag.String("port", os.Getenv("PORT"), "Port to listen on")
 
+	enableRuntimeMetrics = flag.Bool("web.enable-runtime-metrics", false, "Export Go runtime (go_*) and process (process_*) metrics of the exporter itself")
+
 	// Create a custom Prometheus registry
 	customRegistry = prometheus.NewRegistry()
+	// Metrics of the exporter itself, kept out of the textfile output where
+	// they would collide with node_exporter's own
+	runtimeRegistry = prometheus.NewRegistry()
 
 	networkSpeedBits = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -64,265 +68,437 @@ var (
 		[]string{"interface", "direction"},
 	)
 
+	networkLinkSpeed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_link_speed_bits",
+			Help: "Negotiated link speed of the interface in bits per second",
+		},
+		[]string{"interface"},
+	)
+
 	networkInterfaceInfo = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "network_interface_info",
 			Help: "Information about network interfaces",
 		},
-		[]string{"interface", "description"},
+		[]string{"interface", "description", "mtu", "operstate"},
 	)
 
-	// Store previous values for speed calculation with mutex for thread safety
-	prevStats = struct {
+	// Computes the speeds; created when the dev collector starts, after the
+	// path flags are parsed
+	speedCollector *netspeed.Collector
+
+	// Latest per-interface view, published after every collection cycle
+	latestStats = struct {
 		sync.RWMutex
-		stats map[string]struct {
-			rxBytes, txBytes     uint64
-			rxPackets, txPackets uint64
-			rxErrors, txErrors   uint64
-			rxDrops, txDrops     uint64
-			time                 time.Time
-			lastSeen             time.Time
-		}
-	}{
-		stats: make(map[string]struct {
-			rxBytes, txBytes     uint64
-			rxPackets, txPackets uint64
-			rxErrors, txErrors   uint64
-			rxDrops, txDrops     uint64
-			time                 time.Time
-			lastSeen             time.Time
-		}),
-	}
+		stats []interfaceStats
+	}{}
 )
 
+// interfaceStats is the latest state of an interface shared with the output sinks
+type interfaceStats = netspeed.InterfaceStats
+
+// currentStats returns a copy of the interface stats of the last collection cycle
+func currentStats() []interfaceStats {
+	latestStats.RLock()
+	defer latestStats.RUnlock()
+	return append([]interfaceStats(nil), latestStats.stats...)
+}
+
 func init() {
 	// Register only custom metrics to the custom registry
-	customRegistry.MustRegister(networkSpeedBits)
-	customRegistry.MustRegister(networkErrors)
-	customRegistry.MustRegister(networkDrops)
-	customRegistry.MustRegister(networkPackets)
-	customRegistry.MustRegister(networkInterfaceInfo)
+	registerMetrics("speed", networkSpeedBits)
+	registerMetrics("errors", networkErrors)
+	registerMetrics("drops", networkDrops)
+	registerMetrics("packets", networkPackets)
+	registerMetrics("info", networkInterfaceInfo)
+	registerMetrics("info", networkLinkSpeed)
+
+	registerCollector("dev", "interface speeds, errors, drops and packets from /proc/net/dev", true, startDevCollector)
+}
+
+// startDevCollector starts the per-second collection loop
+func startDevCollector() error {
+	speedCollector = newCollector(netspeed.WithMaxGap(*speedMaxGap))
+	go watchLinkChanges()
+	go collectNetworkSpeeds()
+	return nil
 }
 
-// cleanupOldInterfaces removes interfaces that haven't been seen for a while
-func cleanupOldInterfaces() {
-	prevStats.Lock()
-	defer prevStats.Unlock()
+// validateInterfaceCleanup checks the --interface.max, --interface.cleanup-interval
+// and --interface.eviction flags
+func validateInterfaceCleanup() error {
+	if *maxInterfaces < 1 {
+		return fmt.Errorf("invalid --interface.max %d, expected at least 1", *maxInterfaces)
+	}
+	if *cleanupInterval <= 0 {
+		return fmt.Errorf("invalid --interface.cleanup-interval %s", *cleanupInterval)
+	}
+	if *interfaceEviction != "lru" && *interfaceEviction != "absent" {
+		return fmt.Errorf("invalid --interface.eviction %q, expected lru or absent", *interfaceEviction)
+	}
+	return nil
+}
 
-	now := time.Now()
-	for iface, stats := range prevStats.stats {
-		if now.Sub(stats.lastSeen) > cleanupInterval {
-			delete(prevStats.stats, iface)
-		}
+// forgetInterface drops the state and series of a removed interface
+func forgetInterface(name string) {
+	if speedCollector != nil {
+		speedCollector.Forget(name)
 	}
 
-	// Enforce maximum number of interfaces
-	if len(prevStats.stats) > maxInterfaces {
-		// Remove oldest interfaces until we're under the limit
-		interfaces := make([]string, 0, len(prevStats.stats))
-		for iface := range prevStats.stats {
-			interfaces = append(interfaces, iface)
-		}
-		sort.Slice(interfaces, func(i, j int) bool {
-			return prevStats.stats[interfaces[i]].lastSeen.Before(prevStats.stats[interfaces[j]].lastSeen)
-		})
-		for i := 0; i < len(interfaces)-maxInterfaces; i++ {
-			delete(prevStats.stats, interfaces[i])
-		}
+	labels := prometheus.Labels{"interface": name}
+	for _, vec := range []*prometheus.GaugeVec{networkSpeedBits, networkErrors, networkDrops, networkPackets, networkInterfaceInfo, networkLinkSpeed} {
+		vec.DeletePartialMatch(labels)
 	}
+	forgetSpeedWindows(name)
+	forgetEWMA(name)
+	forgetDDoSIndicators(name)
+	forgetSampleTime(name)
+	forgetCounterSource(name)
+	forgetAddresses(name)
+	forgetMicrobursts(name)
+	forgetFlaps(name)
+	forgetPPPSession(name)
+	forgetAccounting(name)
+	forgetPercentiles(name)
+	forgetAnomalies(name)
 }
 
-func collectNetworkSpeeds() {
-	// Create a buffer for scanner to prevent memory allocation
-	scannerBuf := make([]byte, 0, 64*1024)
+// publishInterfaceInfo replaces the info and link speed series of an
+// interface, so a changed description, MTU or operstate doesn't leave the
+// old series behind
+func publishInterfaceInfo(name string, m netspeed.Metadata) {
+	networkInterfaceInfo.DeletePartialMatch(prometheus.Labels{"interface": name})
+	networkLinkSpeed.DeletePartialMatch(prometheus.Labels{"interface": name})
+	if m.IsLoopback() || !m.IsUp() {
+		return
+	}
+	if m.LinkSpeed > 0 {
+		networkLinkSpeed.WithLabelValues(name).Set(float64(m.LinkSpeed))
+	}
+	networkInterfaceInfo.With(prometheus.Labels{
+		"interface":   name,
+		"description": m.Description,
+		"mtu":         strconv.Itoa(m.MTU),
+		"operstate":   m.OperState,
+	}).Set(1)
+}
 
+func collectNetworkSpeeds() {
 	for {
-		// Read /proc/net/dev
-		file, err := os.Open("/proc/net/dev")
-		if err != nil {
-			log.Printf("Error opening /proc/net/dev: %v", err)
+		cycleStats, ok := collectCycle()
+		if !ok {
 			time.Sleep(time.Second)
 			continue
 		}
 
-		scanner := bufio.NewScanner(file)
-		scanner.Buffer(scannerBuf, 1024*1024) // Set max token size to 1MB
+		for _, stats := range cycleStats {
+			if !stats.HasSpeed {
+				continue
+			}
+			ifaceName := stats.Name
+
+			networkSpeedBits.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "receive",
+			}).Set(stats.RxSpeed)
+			networkSpeedBits.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "transmit",
+			}).Set(stats.TxSpeed)
+
+			// Set error counters
+			networkErrors.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "receive",
+			}).Set(float64(stats.RxErrors))
+			networkErrors.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "transmit",
+			}).Set(float64(stats.TxErrors))
+
+			// Set drop counters
+			networkDrops.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "receive",
+			}).Set(float64(stats.RxDrops))
+			networkDrops.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "transmit",
+			}).Set(float64(stats.TxDrops))
+
+			// Set packet counters
+			networkPackets.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "receive",
+			}).Set(float64(stats.RxPackets))
+			networkPackets.With(prometheus.Labels{
+				"interface": ifaceName,
+				"direction": "transmit",
+			}).Set(float64(stats.TxPackets))
+		}
 
-		// Skip header lines
-		scanner.Scan()
-		scanner.Scan()
+		// Publish this cycle's view for the output sinks
+		latestStats.Lock()
+		latestStats.stats = cycleStats
+		latestStats.Unlock()
+		notifyStatsSubscribers()
+		recordHistory(cycleStats)
+		accountStats(cycleStats)
+		updateQuotas(time.Now())
+		updatePercentiles(cycleStats)
+		updateAnomalies(cycleStats)
+		updateSpeedWindows(cycleStats)
+		updateEWMA(cycleStats)
+		updateDDoSIndicators(cycleStats)
+		countGaps(cycleStats)
+		updateCounterSources(cycleStats)
+		recordSampleTimes(cycleStats)
+		updateTotals(cycleStats)
+		updateGroups(cycleStats)
+		updateFlapping(time.Now())
+		evaluateAlerts(cycleStats, time.Now())
+		updateVRFs(cycleStats)
+		updateTunnels()
+		writeTextfile()
 
-		// Track current interfaces to clean up old ones
-		currentInterfaces := make(map[string]bool)
+		// Clean up old interfaces
+		if *interfaceEviction == "absent" {
+			speedCollector.PruneAbsent(*cleanupInterval, *maxInterfaces)
+		} else {
+			speedCollector.Prune(*cleanupInterval, *maxInterfaces)
+		}
+		markCycleDone()
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			fields := strings.Fields(line)
-			if len(fields) < 17 {
-				continue
-			}
+		time.Sleep(time.Second)
+	}
+}
 
-			// Get interface name (remove the colon)
-			ifaceName := strings.TrimSuffix(fields[0], ":")
-			currentInterfaces[ifaceName] = true
+func main() {
+	flag.Parse()
 
-			// Skip loopback and down interfaces
-			iface, err := net.InterfaceByName(ifaceName)
-			if err != nil || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
-				continue
-			}
+	// Subcommands take the same flags after their name
+	switch flag.Arg(0) {
+	case "print":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		*once = true
+	case "top":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if err := runTop(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "rules":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if err := runRules(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "check-config":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if !runCheckConfig(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *once {
+		if err := runOnce(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-			// Get interface description from /sys/class/net/<interface>/ifalias
-			description := "Unknown"
-			descFile := fmt.Sprintf("/sys/class/net/%s/ifalias", ifaceName)
-			if descBytes, err := os.ReadFile(descFile); err == nil {
-				description = strings.TrimSpace(string(descBytes))
-			}
+	if err := addHostLabels(); err != nil {
+		log.Fatal(err)
+	}
+	for _, validate := range flagValidators {
+		if err := validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setupAccessControl(); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if windows, err = parseSpeedWindows(*speedWindows); err != nil {
+		log.Fatal(err)
+	}
 
-			// Update interface info metric
-			networkInterfaceInfo.With(prometheus.Labels{
-				"interface":   ifaceName,
-				"description": description,
-			}).Set(1)
-
-			// Parse receive and transmit statistics
-			var rxBytes, rxPackets, rxErrors, rxDrops uint64
-			var txBytes, txPackets, txErrors, txDrops uint64
-
-			fmt.Sscanf(fields[1], "%d", &rxBytes)
-			fmt.Sscanf(fields[2], "%d", &rxPackets)
-			fmt.Sscanf(fields[3], "%d", &rxErrors)
-			fmt.Sscanf(fields[4], "%d", &rxDrops)
-			fmt.Sscanf(fields[9], "%d", &txBytes)
-			fmt.Sscanf(fields[10], "%d", &txPackets)
-			fmt.Sscanf(fields[11], "%d", &txErrors)
-			fmt.Sscanf(fields[12], "%d", &txDrops)
-
-			now := time.Now()
-			prevStats.RLock()
-			prev, exists := prevStats.stats[ifaceName]
-			prevStats.RUnlock()
-
-			if exists {
-				// Calculate speed in bits per second
-				timeDiff := now.Sub(prev.time).Seconds()
-				if timeDiff > 0 {
-					// Calculate receive speed in bits per second
-					rxSpeed := float64(rxBytes-prev.rxBytes) * bytesToBits / timeDiff
-					networkSpeedBits.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "receive",
-					}).Set(rxSpeed)
-
-					// Calculate transmit speed in bits per second
-					txSpeed := float64(txBytes-prev.txBytes) * bytesToBits / timeDiff
-					networkSpeedBits.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "transmit",
-					}).Set(txSpeed)
-
-					// Set error counters
-					networkErrors.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "receive",
-					}).Set(float64(rxErrors))
-					networkErrors.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "transmit",
-					}).Set(float64(txErrors))
-
-					// Set drop counters
-					networkDrops.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "receive",
-					}).Set(float64(rxDrops))
-					networkDrops.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "transmit",
-					}).Set(float64(txDrops))
-
-					// Set packet counters
-					networkPackets.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "receive",
-					}).Set(float64(rxPackets))
-					networkPackets.With(prometheus.Labels{
-						"interface": ifaceName,
-						"direction": "transmit",
-					}).Set(float64(txPackets))
-				}
-			}
+	// The textfile and the Pushgateway are the only outputs unless a port is given explicitly
+	pushOnly := (*textfileDirectory != "" || *pushgatewayURL != "") && *port == "" && len(webListenAddresses) == 0
 
-			// Update previous values
-			prevStats.Lock()
-			prevStats.stats[ifaceName] = struct {
-				rxBytes, txBytes     uint64
-				rxPackets, txPackets uint64
-				rxErrors, txErrors   uint64
-				rxDrops, txDrops     uint64
-				time                 time.Time
-				lastSeen             time.Time
-			}{
-				rxBytes:   rxBytes,
-				txBytes:   txBytes,
-				rxPackets: rxPackets,
-				txPackets: txPackets,
-				rxErrors:  rxErrors,
-				txErrors:  txErrors,
-				rxDrops:   rxDrops,
-				txDrops:   txDrops,
-				time:      now,
-				lastSeen:  now,
+	// Bind the port while still privileged. Sockets passed by systemd replace
+	// --port, as does --web.listen-address unless --port is set too.
+	var listeners []net.Listener
+	var webListeners []policyListener
+	if !pushOnly {
+		if listeners, err = systemdListeners(); err != nil {
+			log.Fatal(err)
+		}
+		if len(listeners) == 0 && (len(webListenAddresses) == 0 || *port != "") {
+			l, err := net.Listen("tcp", ":"+*port)
+			if err != nil {
+				log.Fatal(err)
 			}
-			prevStats.Unlock()
+			listeners = append(listeners, l)
+		}
+		if webListeners, err = bindWebListeners(); err != nil {
+			log.Fatal(err)
 		}
-		file.Close()
+	}
 
-		// Clean up old interfaces
-		cleanupOldInterfaces()
+	// Everything from here on, including file access, runs as --runas.user
+	if *runAsUser != "" {
+		if err := dropPrivileges(requiredCapabilities()); err != nil {
+			log.Fatalf("Error dropping privileges: %v", err)
+		}
+	}
 
-		time.Sleep(time.Second)
+	// Restore traffic totals before the first collection cycle accounts into them
+	if *accountingFile != "" {
+		if err := loadAccounting(); err != nil {
+			log.Fatalf("Error loading accounting file %s: %v", *accountingFile, err)
+		}
+		go saveAccountingPeriodically()
 	}
-}
 
-func isIPAllowed(remoteAddr string) bool {
-	if *allowedIPs == "" {
-		return true // Allow all if no whitelist specified
+	// Start the enabled collectors, each collecting in its own goroutine
+	if err := startCollectors(); err != nil {
+		log.Fatal(err)
 	}
 
-	// Extract IP from remoteAddr (which might include port)
-	ip, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		ip = remoteAddr // If no port, use the whole string
+	if *netflowCollector != "" {
+		e, err := newNetflowExporter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go exportNetflow(e)
 	}
 
-	allowedList := strings.Split(*allowedIPs, ",")
-	for _, allowedIP := range allowedList {
-		allowedIP = strings.TrimSpace(allowedIP)
-		if ip == allowedIP {
-			return true
+	if *sflowCollector != "" {
+		a, err := newSflowAgent()
+		if err != nil {
+			log.Fatal(err)
 		}
+		go runPushSink("sFlow collector "+*sflowCollector, *sflowInterval, a.push)
 	}
-	return false
-}
 
-func main() {
-	flag.Parse()
+	if *influxURL != "" {
+		push, err := newInfluxWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPushSink("InfluxDB "+*influxURL, *influxInterval, push)
+	}
 
-	// Start collecting network speeds in a goroutine
-	go collectNetworkSpeeds()
+	if *graphiteAddress != "" {
+		g := &graphiteSink{}
+		go runPushSink("Graphite "+*graphiteAddress, *graphiteInterval, g.push)
+	}
+
+	if *statsdAddress != "" {
+		e, err := newStatsdEmitter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPushSink("StatsD "+*statsdAddress, *statsdInterval, e.push)
+	}
+
+	if *mqttBroker != "" {
+		p, err := newMQTTPublisher()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPushSink("MQTT broker "+*mqttBroker, *mqttInterval, p.push)
+	}
+
+	if *kafkaBrokers != "" {
+		k, err := newKafkaProducer()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPushSink("Kafka "+*kafkaBrokers, *kafkaInterval, k.push)
+	}
+
+	if len(alertWebhooks) > 0 {
+		go sendAlerts()
+	}
+
+	if *pushgatewayURL != "" {
+		p, err := newPushgatewayPusher()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPushgateway(p)
+	}
+
+	if *compatNodeExporterNames {
+		registerMetrics("node", nodeNetworkCollector{})
+	}
+	if *enableRuntimeMetrics {
+		runtimeRegistry.MustRegister(promcollectors.NewGoCollector())
+		runtimeRegistry.MustRegister(promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{}))
+	}
+
+	// Own mux, as importing net/http/pprof registers unguarded handlers on the default one
+	mux := http.NewServeMux()
 
 	// Expose the registered metrics via HTTP with IP whitelist, using the custom registry
-	http.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !isIPAllowed(r.RemoteAddr) {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
+	mux.Handle("/metrics", withAccessLog(withIPWhitelist(withRateLimit(withBearerToken(handleMetrics(prometheus.Gatherers{customRegistry, remoteRegistry, runtimeRegistry}, prometheus.Gatherers{customRegistry, runtimeRegistry}))))))
+
+	// Prometheus HTTP service discovery of the exporter and the remote hosts
+	mux.Handle("/sd", withIPWhitelist(withBearerToken(http.HandlerFunc(handleSD))))
+
+	// JSON API for scripts and web UIs
+	mux.Handle("/api/v1/interfaces", withIPWhitelist(withBearerToken(http.HandlerFunc(handleInterfaces))))
+	mux.Handle("/api/v1/interfaces/", withIPWhitelist(withBearerToken(http.HandlerFunc(handleInterface))))
+	mux.Handle("/api/v1/stream", withIPWhitelist(withBearerToken(http.HandlerFunc(handleStream))))
+	mux.Handle("/api/v1/history", withIPWhitelist(withBearerToken(http.HandlerFunc(handleHistory))))
+	mux.Handle("/api/v1/accounting", withIPWhitelist(withBearerToken(http.HandlerFunc(handleAccounting))))
+	mux.Handle("/api/v1/admin/reset-speed-windows", withIPWhitelist(withBearerToken(http.HandlerFunc(handleResetSpeedWindows))))
+
+	// Grafana dashboard for the metric names and collectors of this instance
+	mux.Handle("/dashboard.json", withIPWhitelist(withBearerToken(http.HandlerFunc(handleGrafanaDashboard))))
+
+	// Prometheus rules for the metric names of this instance
+	mux.Handle("/rules.yaml", withIPWhitelist(withBearerToken(http.HandlerFunc(handleRules))))
+
+	// Built-in live traffic page
+	mux.Handle("/", withIPWhitelist(http.HandlerFunc(handleDashboard)))
+
+	if *enablePprof {
+		registerPprof(mux)
+	}
+
+	// Metrics of other network namespaces, on demand
+	if *netnsProbe {
+		if missing := missingCapabilities(netnsProbeCapabilities); len(missing) > 0 {
+			log.Printf("Disabling /probe for lack of privileges: missing %s", formatCapabilities(missing))
+		} else {
+			mux.Handle("/probe", withAccessLog(withIPWhitelist(withRateLimit(withBearerToken(http.HandlerFunc(handleNetnsProbe))))))
 		}
-		promhttp.HandlerFor(customRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-	}))
+	}
 
-	log.Printf("Starting server on :%v with IP whitelist: %v", *port, *allowedIPs)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
-		log.Fatal(err)
+	if pushOnly {
+		if *textfileDirectory != "" {
+			log.Printf("Writing metrics to %s", filepath.Join(*textfileDirectory, textfileName))
+		}
+		if *pushgatewayURL != "" {
+			log.Printf("Pushing metrics to %s", *pushgatewayURL)
+		}
+		notifyReady()
+		select {}
+	}
+
+	errs := make(chan error)
+	for _, l := range listeners {
+		log.Printf("Starting server on %v with IP whitelist: %v", l.Addr(), *allowedIPs)
+		go func(l net.Listener) { errs <- http.Serve(l, mux) }(l)
+	}
+	for _, l := range webListeners {
+		log.Printf("Starting server on %v: %s", l.Addr(), l.describe())
+		go func(l policyListener) { errs <- l.serve(mux) }(l)
 	}
+	notifyReady()
+	log.Fatal(<-errs)
 }
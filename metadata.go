@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+	"golang.org/x/sys/unix"
+)
+
+// How often the whole cache is dropped when link notifications are unavailable
+const metadataFallbackRefresh = 30 * time.Second
+
+// Metadata per interface name, read from sysfs when an interface is first
+// seen and dropped again when a link notification reports a change
+var metadataCache = struct {
+	sync.Mutex
+	byName map[string]netspeed.Metadata
+}{
+	byName: make(map[string]netspeed.Metadata),
+}
+
+// readSysfsAttr reads /sys/class/net/<interface>/<attr>
+func readSysfsAttr(ifaceName, attr string) (string, error) {
+	data, err := os.ReadFile(sysFilePath(fmt.Sprintf("class/net/%s/%s", ifaceName, attr)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// interfaceMetadataFor returns the cached metadata, reading it on a miss
+func interfaceMetadataFor(ifaceName string) (netspeed.Metadata, error) {
+	metadataCache.Lock()
+	m, ok := metadataCache.byName[ifaceName]
+	metadataCache.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	m, err := netspeed.ReadMetadata(*sysfsPath, ifaceName)
+	if err != nil {
+		return m, err
+	}
+	if alias, ok := interfaceAliases[ifaceName]; ok {
+		m.Description = alias
+	}
+	metadataCache.Lock()
+	metadataCache.byName[ifaceName] = m
+	metadataCache.Unlock()
+	publishInterfaceInfo(ifaceName, m)
+	if !m.IsLoopback() {
+		recordOperState(ifaceName, m.OperState, time.Now())
+	}
+	return m, nil
+}
+
+// linkSpeedBits returns the negotiated link speed, zero if unknown
+func linkSpeedBits(ifaceName string) uint64 {
+	m, err := interfaceMetadataFor(ifaceName)
+	if err != nil {
+		return 0
+	}
+	return m.LinkSpeed
+}
+
+// invalidateMetadata drops the cached metadata of an interface, matched by
+// name or index so that renamed interfaces are refreshed too. It returns
+// the names the interface was cached under.
+func invalidateMetadata(ifaceName string, index int) []string {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+	var names []string
+	for name, m := range metadataCache.byName {
+		if name == ifaceName || m.Index == index {
+			delete(metadataCache.byName, name)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// flushMetadata drops all cached metadata
+func flushMetadata() {
+	metadataCache.Lock()
+	metadataCache.byName = make(map[string]netspeed.Metadata)
+	metadataCache.Unlock()
+	markVRFsStale()
+	markTunnelsStale()
+}
+
+// watchLinkChanges follows RTNLGRP_LINK notifications: changed interfaces get
+// their metadata and info series refreshed, removed interfaces are forgotten
+// right away instead of by the cleanup sweep. Without notifications, the
+// cache is flushed periodically instead.
+func watchLinkChanges() {
+	if err := readLinkNotifications(); err != nil {
+		log.Printf("Error receiving link notifications, refreshing interface metadata every %s: %v", metadataFallbackRefresh, err)
+	}
+	for {
+		time.Sleep(metadataFallbackRefresh)
+		flushMetadata()
+	}
+}
+
+// readLinkNotifications processes link notifications until the socket fails
+func readLinkNotifications() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.ENOBUFS) {
+			// Notifications were lost, so any entry may be stale
+			flushMetadata()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != unix.RTM_NEWLINK && msg.Header.Type != unix.RTM_DELLINK {
+				continue
+			}
+			name, index, operState, ok := parseLinkMessage(msg)
+			if !ok {
+				continue
+			}
+			// The notification carries the state it was sent for, which
+			// sysfs may no longer show when the link bounces quickly
+			if msg.Header.Type == unix.RTM_NEWLINK && operState != "" {
+				recordOperState(name, operState, time.Now())
+			}
+			handleLinkChange(msg.Header.Type, name, index)
+		}
+	}
+}
+
+// handleLinkChange applies an RTM_NEWLINK or RTM_DELLINK notification
+func handleLinkChange(msgType uint16, name string, index int) {
+	markVRFsStale()
+	markTunnelsStale()
+	for _, old := range invalidateMetadata(name, index) {
+		// Renamed interfaces continue under their new name
+		if old != name || msgType == unix.RTM_DELLINK {
+			forgetInterface(old)
+		}
+	}
+	if msgType == unix.RTM_DELLINK {
+		forgetInterface(name)
+		return
+	}
+	// Re-read now so the info series changes without waiting for the next
+	// cycle. This fails for interfaces being torn down, whose RTM_DELLINK
+	// follows shortly.
+	interfaceMetadataFor(name)
+}
+
+// Names of the IF_OPER_* states as in /sys/class/net/<interface>/operstate
+var operStateNames = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+// parseLinkMessage extracts the interface name, index and operstate of an
+// RTM_*LINK message
+func parseLinkMessage(msg syscall.NetlinkMessage) (name string, index int, operState string, ok bool) {
+	if len(msg.Data) < unix.SizeofIfInfomsg {
+		return "", 0, "", false
+	}
+	// struct ifinfomsg: family, pad, type, then the index at offset 4
+	index = int(int32(binary.NativeEndian.Uint32(msg.Data[4:8])))
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+	if err != nil {
+		return "", 0, "", false
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.IFLA_IFNAME:
+			name = strings.TrimRight(string(attr.Value), "\x00")
+		case unix.IFLA_OPERSTATE:
+			if len(attr.Value) == 1 && int(attr.Value[0]) < len(operStateNames) {
+				operState = operStateNames[attr.Value[0]]
+			}
+		}
+	}
+	return name, index, operState, true
+}
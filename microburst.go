@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	microburstInterval   = flag.Duration("microburst.interval", 100*time.Millisecond, "High-resolution sampling interval for microburst detection")
+	microburstThreshold  = flag.Float64("microburst.threshold", 0.8, "Fraction of the link speed above which a high-resolution sample counts as a burst")
+	microburstInterfaces = flag.String("microburst.interfaces", ".*", "Regular expression of interfaces to sample at high resolution")
+	microburstWindow     = flag.Duration("microburst.window", time.Minute, "Window network_interface_microburst_max_bits reports the peak of; at least the scrape interval")
+
+	networkMicrobursts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "network_interface_microbursts_total",
+			Help: "Number of bursts above the configured fraction of the link speed seen by the high-resolution sampler",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	networkMicroburstMaxDesc = prometheus.NewDesc(
+		"network_interface_microburst_max_bits",
+		"Highest high-resolution speed over the last --microburst.window in bits per second",
+		[]string{"interface", "direction"}, nil,
+	)
+
+	// Highest rate per second of the window, by interface and direction
+	microburstMax = struct {
+		sync.Mutex
+		peaks map[[2]string][]microburstPeak
+	}{
+		peaks: make(map[[2]string][]microburstPeak),
+	}
+)
+
+func init() {
+	registerMetrics("microburst", networkMicrobursts)
+	registerMetrics("microburst", microburstMaxCollector{})
+
+	registerCollector("microburst", "high-resolution sampling for microburst detection", false, startMicroburstSampler).
+		checks(checkMicroburstFlags)
+}
+
+// microburstPeak is the highest rate seen in one second
+type microburstPeak struct {
+	second int64
+	rate   float64
+}
+
+// expireMicroburstPeaks drops the seconds that left the window
+func expireMicroburstPeaks(peaks []microburstPeak, now time.Time) []microburstPeak {
+	oldest := now.Add(-*microburstWindow).Unix()
+	for len(peaks) > 0 && peaks[0].second <= oldest {
+		peaks = peaks[1:]
+	}
+	return peaks
+}
+
+// microburstMaxCollector exports the peak over the window. Reading doesn't
+// reset it, so the textfile, the Pushgateway and several scrapers all see
+// the same peak.
+type microburstMaxCollector struct{}
+
+func (microburstMaxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- networkMicroburstMaxDesc
+}
+
+func (microburstMaxCollector) Collect(ch chan<- prometheus.Metric) {
+	microburstMax.Lock()
+	defer microburstMax.Unlock()
+	now := time.Now()
+	for key, peaks := range microburstMax.peaks {
+		peaks = expireMicroburstPeaks(peaks, now)
+		if len(peaks) == 0 {
+			delete(microburstMax.peaks, key)
+			continue
+		}
+		microburstMax.peaks[key] = peaks
+		max := 0.0
+		for _, p := range peaks {
+			if p.rate > max {
+				max = p.rate
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(networkMicroburstMaxDesc, prometheus.GaugeValue, max, key[0], key[1])
+	}
+}
+
+// readStatisticsCounter reads /sys/class/net/<interface>/statistics/<name>
+func readStatisticsCounter(ifaceName, name string) (uint64, error) {
+	value, err := readSysfsAttr(ifaceName, "statistics/"+name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// microburstState is the high-resolution sampler state of one interface
+type microburstState struct {
+	linkSpeed        float64
+	rxBytes, txBytes uint64
+	time             time.Time
+	inBurst          [2]bool
+}
+
+// sampleMicrobursts samples the selected interfaces every --microburst.interval
+func sampleMicrobursts(selected *regexp.Regexp) {
+	states := make(map[string]*microburstState)
+	var lastRefresh time.Time
+
+	ticker := time.NewTicker(*microburstInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// Follow the interface list and link speeds of the main collection loop
+		if now.Sub(lastRefresh) >= time.Second {
+			current := make(map[string]*microburstState)
+			for _, s := range currentStats() {
+				if !selected.MatchString(s.Name) {
+					continue
+				}
+				speed := float64(linkSpeedBits(s.Name))
+				if speed == 0 {
+					continue
+				}
+				st, ok := states[s.Name]
+				if !ok {
+					st = &microburstState{}
+				}
+				st.linkSpeed = speed
+				current[s.Name] = st
+			}
+			states = current
+			lastRefresh = now
+		}
+
+		for name, st := range states {
+			rx, err := readStatisticsCounter(name, "rx_bytes")
+			if err != nil {
+				continue
+			}
+			tx, err := readStatisticsCounter(name, "tx_bytes")
+			if err != nil {
+				continue
+			}
+			if !st.time.IsZero() {
+				elapsed := now.Sub(st.time).Seconds()
+				rates := [2]float64{
+					float64(counterDelta(rx, st.rxBytes)) * bytesToBits / elapsed,
+					float64(counterDelta(tx, st.txBytes)) * bytesToBits / elapsed,
+				}
+				recordMicroburst(name, st, rates, now)
+			}
+			st.rxBytes, st.txBytes, st.time = rx, tx, now
+		}
+	}
+}
+
+// recordMicroburst updates the peak of the current second and counts bursts
+// on their rising edge
+func recordMicroburst(name string, st *microburstState, rates [2]float64, now time.Time) {
+	microburstMax.Lock()
+	defer microburstMax.Unlock()
+	second := now.Unix()
+	for i, direction := range []string{"receive", "transmit"} {
+		key := [2]string{name, direction}
+		peaks := microburstMax.peaks[key]
+		if n := len(peaks); n > 0 && peaks[n-1].second == second {
+			if rates[i] > peaks[n-1].rate {
+				peaks[n-1].rate = rates[i]
+			}
+		} else {
+			peaks = append(expireMicroburstPeaks(peaks, now), microburstPeak{second, rates[i]})
+		}
+		microburstMax.peaks[key] = peaks
+		bursting := rates[i] > *microburstThreshold*st.linkSpeed
+		if bursting && !st.inBurst[i] {
+			networkMicrobursts.WithLabelValues(name, direction).Inc()
+		}
+		st.inBurst[i] = bursting
+	}
+}
+
+// forgetMicrobursts drops the burst series of a removed interface
+func forgetMicrobursts(name string) {
+	microburstMax.Lock()
+	defer microburstMax.Unlock()
+	delete(microburstMax.peaks, [2]string{name, "receive"})
+	delete(microburstMax.peaks, [2]string{name, "transmit"})
+	networkMicrobursts.DeletePartialMatch(prometheus.Labels{"interface": name})
+}
+
+// checkMicroburstFlags validates the sampler flags
+func checkMicroburstFlags() error {
+	if _, err := regexp.Compile(*microburstInterfaces); err != nil {
+		return fmt.Errorf("invalid --microburst.interfaces: %w", err)
+	}
+	if *microburstInterval <= 0 {
+		return fmt.Errorf("--microburst.interval must be positive")
+	}
+	if *microburstThreshold <= 0 {
+		return fmt.Errorf("--microburst.threshold must be positive")
+	}
+	if *microburstWindow < time.Second {
+		return fmt.Errorf("--microburst.window must be at least 1s")
+	}
+	return nil
+}
+
+// startMicroburstSampler starts the sampler
+func startMicroburstSampler() error {
+	go sampleMicrobursts(regexp.MustCompile(*microburstInterfaces))
+	return nil
+}
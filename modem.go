@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var modemInterval = flag.Duration("modem.interval", 30*time.Second, "How often to read cellular modem state and signal from ModemManager")
+
+// ModemManager D-Bus names
+const (
+	mmService          = "org.freedesktop.ModemManager1"
+	mmPath             = "/org/freedesktop/ModemManager1"
+	mmModemIface       = "org.freedesktop.ModemManager1.Modem"
+	mm3gppIface        = "org.freedesktop.ModemManager1.Modem.Modem3gpp"
+	mmSignalIface      = "org.freedesktop.ModemManager1.Modem.Signal"
+	mmObjectManager    = "org.freedesktop.DBus.ObjectManager"
+	mmModemPortTypeNet = 2
+)
+
+// Names of MMModemState, from -1 (failed)
+var mmModemStates = []string{"failed", "unknown", "initializing", "locked", "disabled", "disabling",
+	"enabling", "enabled", "searching", "registered", "disconnecting", "connecting", "connected"}
+
+// Names of MMModem3gppRegistrationState
+var mmRegistrationStates = []string{"idle", "home", "searching", "denied", "unknown", "roaming",
+	"home-sms-only", "roaming-sms-only", "emergency-only", "home-csfb-not-preferred",
+	"roaming-csfb-not-preferred", "attached-rlos"}
+
+// Names of the MMModemAccessTechnology bits, from bit 0
+var mmAccessTechnologies = []string{"pots", "gsm", "gsm-compact", "gprs", "edge", "umts", "hsdpa",
+	"hsupa", "hspa", "hspa-plus", "1xrtt", "evdo0", "evdoa", "evdob", "lte", "5gnr", "lte-cat-m", "lte-nb-iot"}
+
+// Signal properties with the values of each access technology
+var mmSignalTechnologies = []struct {
+	property, technology string
+}{
+	{"Gsm", "gsm"},
+	{"Umts", "umts"},
+	{"Lte", "lte"},
+	{"Nr5g", "5gnr"},
+}
+
+var (
+	modemInfoDesc = prometheus.NewDesc("network_modem_info",
+		"Manufacturer, model, access technology, operator, registration and state of the cellular modem", []string{"interface", "modem", "manufacturer", "model", "access_technology", "operator", "registration_state", "state"}, nil)
+	modemSignalQualityDesc = prometheus.NewDesc("network_modem_signal_quality_percent",
+		"Signal quality of the cellular modem as reported by ModemManager, from 0 to 100", []string{"interface", "modem"}, nil)
+	modemRSRPDesc = prometheus.NewDesc("network_modem_rsrp_dbm",
+		"Reference signal received power of the cellular modem in dBm", []string{"interface", "modem", "technology"}, nil)
+	modemRSRQDesc = prometheus.NewDesc("network_modem_rsrq_db",
+		"Reference signal received quality of the cellular modem in dB", []string{"interface", "modem", "technology"}, nil)
+	modemSINRDesc = prometheus.NewDesc("network_modem_sinr_db",
+		"Signal to interference plus noise ratio of the cellular modem in dB", []string{"interface", "modem", "technology"}, nil)
+	modemRSSIDesc = prometheus.NewDesc("network_modem_rssi_dbm",
+		"Received signal strength of the cellular modem in dBm", []string{"interface", "modem", "technology"}, nil)
+
+	// Metrics of the signal values. LTE reports the SINR as snr, 5G NR as sinr.
+	mmSignalValues = map[string]*prometheus.Desc{
+		"rsrp": modemRSRPDesc,
+		"rsrq": modemRSRQDesc,
+		"sinr": modemSINRDesc,
+		"snr":  modemSINRDesc,
+		"rssi": modemRSSIDesc,
+	}
+
+	// Result of the last ModemManager read
+	modemSnapshot struct {
+		sync.Mutex
+		modems []modemStatus
+	}
+)
+
+func init() {
+	registerCollector("modem", "cellular modem signal, access technology and registration from ModemManager over D-Bus", false, startModemCollector)
+}
+
+type modemStatus struct {
+	iface, modem, manufacturer, model string
+	accessTechnology, operator        string
+	registration, state               string
+	signalQuality                     float64
+	signals                           []modemSignal
+}
+
+type modemSignal struct {
+	technology string
+	// Values by metric, only those the modem reports
+	values map[*prometheus.Desc]float64
+}
+
+// mmEnumName names an enum value from its list, the number if unknown
+func mmEnumName(names []string, v, offset int64) string {
+	if i := v + offset; i >= 0 && i < int64(len(names)) {
+		return names[i]
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// mmAccessTechnology names the bits of an access technology mask, e.g.
+// lte,5gnr for an NSA 5G connection
+func mmAccessTechnology(mask uint32) string {
+	var names []string
+	for i, name := range mmAccessTechnologies {
+		if mask&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "unknown"
+	}
+	return strings.Join(names, ",")
+}
+
+// parseModem decodes the properties of a modem object by interface
+func parseModem(objectPath string, ifaces map[any]any) (modemStatus, bool) {
+	props, ok := ifaces[mmModemIface].(map[any]any)
+	if !ok {
+		return modemStatus{}, false
+	}
+	m := modemStatus{modem: path.Base(objectPath), registration: "unknown"}
+	m.manufacturer, _ = props["Manufacturer"].(string)
+	m.model, _ = props["Model"].(string)
+	state, _ := props["State"].(int32)
+	m.state = mmEnumName(mmModemStates, int64(state), 1)
+	access, _ := props["AccessTechnologies"].(uint32)
+	m.accessTechnology = mmAccessTechnology(access)
+	if quality, ok := props["SignalQuality"].([]any); ok && len(quality) == 2 {
+		if v, ok := quality[0].(uint32); ok {
+			m.signalQuality = float64(v)
+		}
+	}
+	// The data interface is the first net port, e.g. wwan0
+	ports, _ := props["Ports"].([]any)
+	for _, p := range ports {
+		if port, ok := p.([]any); ok && len(port) == 2 && port[1] == uint32(mmModemPortTypeNet) {
+			m.iface, _ = port[0].(string)
+			break
+		}
+	}
+
+	if props, ok := ifaces[mm3gppIface].(map[any]any); ok {
+		if v, ok := props["RegistrationState"].(uint32); ok {
+			m.registration = mmEnumName(mmRegistrationStates, int64(v), 0)
+		}
+		m.operator, _ = props["OperatorName"].(string)
+	}
+
+	if props, ok := ifaces[mmSignalIface].(map[any]any); ok {
+		for _, t := range mmSignalTechnologies {
+			values, ok := props[t.property].(map[any]any)
+			if !ok || len(values) == 0 {
+				continue
+			}
+			s := modemSignal{technology: t.technology, values: make(map[*prometheus.Desc]float64)}
+			for key, desc := range mmSignalValues {
+				if v, ok := values[key].(float64); ok {
+					s.values[desc] = v
+				}
+			}
+			m.signals = append(m.signals, s)
+		}
+	}
+	return m, true
+}
+
+// readModems reads the modems from the ModemManager object tree, and turns
+// on the extended signal polling of modems that have it off
+func readModems(c *dbusConn, polling map[string]bool) ([]modemStatus, error) {
+	reply, err := c.call(mmService, mmPath, mmObjectManager, "GetManagedObjects", "")
+	if err != nil {
+		return nil, err
+	}
+	var objects map[any]any
+	if len(reply) == 1 {
+		objects, _ = reply[0].(map[any]any)
+	}
+	if objects == nil {
+		return nil, fmt.Errorf("unexpected GetManagedObjects reply")
+	}
+	var modems []modemStatus
+	for p, v := range objects {
+		objectPath, _ := p.(dbusObjectPath)
+		ifaces, _ := v.(map[any]any)
+		m, ok := parseModem(string(objectPath), ifaces)
+		if !ok {
+			continue
+		}
+		modems = append(modems, m)
+
+		// RSRP and the like are only updated at the rate set with Setup
+		signal, ok := ifaces[mmSignalIface].(map[any]any)
+		if !ok || signal["Rate"] != uint32(0) || polling[string(objectPath)] {
+			continue
+		}
+		polling[string(objectPath)] = true
+		rate := uint32(max(modemInterval.Seconds(), 1))
+		if _, err := c.call(mmService, string(objectPath), mmSignalIface, "Setup", "u", rate); err != nil {
+			log.Printf("Error enabling signal polling of modem %s: %v", m.modem, err)
+		}
+	}
+	sort.Slice(modems, func(i, j int) bool { return modems[i].modem < modems[j].modem })
+	return modems, nil
+}
+
+// startModemCollector starts reading the modems from ModemManager
+func startModemCollector() error {
+	registerMetrics("modem", modemCollector{})
+	go collectModems()
+	return nil
+}
+
+// collectModems periodically refreshes the modem snapshot. The system bus
+// connection is kept between reads and redialed after errors, as
+// ModemManager may be started or restarted after the exporter.
+func collectModems() {
+	var c *dbusConn
+	polling := make(map[string]bool)
+	for {
+		var modems []modemStatus
+		var err error
+		if c == nil {
+			c, err = dialSystemBus()
+		}
+		if err == nil {
+			if modems, err = readModems(c, polling); err != nil {
+				c.Close()
+				c = nil
+				// Signal polling resets when ModemManager restarts
+				polling = make(map[string]bool)
+			}
+		}
+		if err != nil {
+			log.Printf("Error reading modems from ModemManager: %v", err)
+		}
+		modemSnapshot.Lock()
+		modemSnapshot.modems = modems
+		modemSnapshot.Unlock()
+		time.Sleep(*modemInterval)
+	}
+}
+
+// modemCollector exports the last modem snapshot
+type modemCollector struct{}
+
+func (modemCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- modemInfoDesc
+	ch <- modemSignalQualityDesc
+	ch <- modemRSRPDesc
+	ch <- modemRSRQDesc
+	ch <- modemSINRDesc
+	ch <- modemRSSIDesc
+}
+
+func (modemCollector) Collect(ch chan<- prometheus.Metric) {
+	modemSnapshot.Lock()
+	defer modemSnapshot.Unlock()
+	for _, m := range modemSnapshot.modems {
+		ch <- prometheus.MustNewConstMetric(modemInfoDesc, prometheus.GaugeValue, 1,
+			m.iface, m.modem, m.manufacturer, m.model, m.accessTechnology, m.operator, m.registration, m.state)
+		ch <- prometheus.MustNewConstMetric(modemSignalQualityDesc, prometheus.GaugeValue, m.signalQuality, m.iface, m.modem)
+		for _, s := range m.signals {
+			for desc, v := range s.values {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, m.iface, m.modem, s.technology)
+			}
+		}
+	}
+}
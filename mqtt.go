@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect = 0x10
+	mqttConnack = 0x20
+	mqttPublish = 0x30
+)
+
+var (
+	mqttBroker       = flag.String("mqtt.broker", "", "MQTT broker URL (tcp://host:1883 or tls://host:8883) to publish interface throughput to; empty disables")
+	mqttTopic        = flag.String("mqtt.topic", "net/{host}/{interface}", "Topic pattern; {host} and {interface} are replaced")
+	mqttClientID     = flag.String("mqtt.client-id", "", "MQTT client ID (default: vyosexporter-<hostname>)")
+	mqttUsername     = flag.String("mqtt.username", "", "MQTT username")
+	mqttPassword     = flag.String("mqtt.password", "", "MQTT password; needs --mqtt.username")
+	mqttPasswordFile = flag.String("mqtt.password-file", "", "File containing the MQTT password; mutually exclusive with --mqtt.password")
+	mqttRetain       = flag.Bool("mqtt.retain", false, "Publish with the retain flag so new subscribers get the latest values")
+	mqttInterval     = flag.Duration("mqtt.interval", 10*time.Second, "How often to publish to MQTT")
+)
+
+// mqttPublisher is a minimal MQTT 3.1.1 client publishing at QoS 0
+type mqttPublisher struct {
+	broker   *url.URL
+	hostname string
+	clientID string
+	password string
+	conn     net.Conn
+}
+
+// validateMQTTFlags checks the broker URL and the credentials of the MQTT
+// output: MQTT 3.1.1 allows no password without a username
+func validateMQTTFlags() error {
+	password, err := secretValue("mqtt.password", *mqttPassword, *mqttPasswordFile)
+	if err != nil {
+		return err
+	}
+	if password != "" && *mqttUsername == "" {
+		return fmt.Errorf("--mqtt.password needs --mqtt.username")
+	}
+	if *mqttBroker == "" {
+		return nil
+	}
+	broker, err := url.Parse(*mqttBroker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker URL: %w", err)
+	}
+	switch broker.Scheme {
+	case "tcp", "mqtt", "tls", "ssl", "mqtts":
+	default:
+		return fmt.Errorf("unsupported MQTT broker scheme %q", broker.Scheme)
+	}
+	return nil
+}
+
+// newMQTTPublisher validates the flags
+func newMQTTPublisher() (*mqttPublisher, error) {
+	if err := validateMQTTFlags(); err != nil {
+		return nil, err
+	}
+	broker, err := url.Parse(*mqttBroker)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secretValue("mqtt.password", *mqttPassword, *mqttPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	clientID := *mqttClientID
+	if clientID == "" {
+		clientID = "vyosexporter-" + hostname
+	}
+	return &mqttPublisher{broker: broker, hostname: hostname, clientID: clientID, password: password}, nil
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// mqttPacket prepends the fixed header to the variable header and payload
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	// Remaining length is encoded 7 bits at a time
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// connect opens the connection and performs the CONNECT/CONNACK handshake
+func (p *mqttPublisher) connect() error {
+	host := p.broker.Host
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch p.broker.Scheme {
+	case "tls", "ssl", "mqtts":
+		if p.broker.Port() == "" {
+			host = net.JoinHostPort(host, "8883")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: p.broker.Hostname()})
+	default:
+		if p.broker.Port() == "" {
+			host = net.JoinHostPort(host, "1883")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep alive has to outlast the publish interval as we don't send pings
+	keepAlive := int(2 * mqttInterval.Seconds())
+	if keepAlive < 60 {
+		keepAlive = 60
+	}
+	flags := byte(0x02) // clean session
+	if *mqttUsername != "" {
+		flags |= 0x80
+	}
+	if p.password != "" {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, p.clientID)
+	if *mqttUsername != "" {
+		body = appendMQTTString(body, *mqttUsername)
+	}
+	if p.password != "" {
+		body = appendMQTTString(body, p.password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(mqttConnect, body)); err != nil {
+		conn.Close()
+		return err
+	}
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if connack[0] != mqttConnack {
+		conn.Close()
+		return errors.New("unexpected response to CONNECT")
+	}
+	if connack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused connection with return code %d", connack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	p.conn = conn
+	return nil
+}
+
+// topic expands the topic pattern for an interface
+func (p *mqttPublisher) topic(ifaceName string) string {
+	return strings.NewReplacer("{host}", p.hostname, "{interface}", ifaceName).Replace(*mqttTopic)
+}
+
+// push publishes one JSON message per interface, reconnecting when needed
+func (p *mqttPublisher) push(stats []interfaceStats) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	header := byte(mqttPublish)
+	if *mqttRetain {
+		header |= 0x01
+	}
+	for _, s := range stats {
+		payload, err := json.Marshal(interfaceToJSON(s))
+		if err != nil {
+			return err
+		}
+		body := append(appendMQTTString(nil, p.topic(s.Name)), payload...)
+		p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := p.conn.Write(mqttPacket(header, body)); err != nil {
+			p.conn.Close()
+			p.conn = nil
+			return err
+		}
+	}
+	return nil
+}
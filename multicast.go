@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var multicastInterval = flag.Duration("multicast.interval", 15*time.Second, "How often to read the IGMP and MLD group memberships from /proc/net/igmp and /proc/net/igmp6")
+
+var (
+	multicastPacketsDesc = prometheus.NewDesc("network_interface_multicast_packets_total",
+		"Multicast packets received on the interface", []string{"interface", "direction"}, nil)
+	multicastGroupsDesc = prometheus.NewDesc("network_interface_multicast_groups",
+		"Number of multicast groups joined on the interface", []string{"interface", "family"}, nil)
+
+	// Groups of the last read by interface, index 0 for IPv4 and 1 for IPv6
+	multicastSnapshot struct {
+		sync.Mutex
+		byIface map[string]*[2]int
+	}
+)
+
+func init() {
+	registerCollector("multicast", "multicast packets received and IGMP/MLD group memberships", false, startMulticastCollector)
+}
+
+// countIGMPGroups counts the groups per interface in /proc/net/igmp. Each
+// interface has a line with its index and name, followed by one tab-indented
+// line per group.
+func countIGMPGroups(groups map[string]*[2]int) error {
+	file, err := os.Open(procFilePath("net/igmp"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	// The header
+	scanner.Scan()
+	var iface string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") {
+			if iface != "" {
+				groupsOf(groups, iface)[0]++
+			}
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			iface = fields[1]
+			groupsOf(groups, iface)
+		}
+	}
+	return scanner.Err()
+}
+
+// countMLDGroups counts the groups per interface in /proc/net/igmp6, one
+// line per group with the index and name of the interface
+func countMLDGroups(groups map[string]*[2]int) error {
+	file, err := os.Open(procFilePath("net/igmp6"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 3 {
+			groupsOf(groups, fields[1])[1]++
+		}
+	}
+	return scanner.Err()
+}
+
+// groupsOf returns the group counts of an interface, adding it if missing
+func groupsOf(groups map[string]*[2]int, iface string) *[2]int {
+	g, ok := groups[iface]
+	if !ok {
+		g = &[2]int{}
+		groups[iface] = g
+	}
+	return g
+}
+
+// startMulticastCollector starts reading the group memberships
+func startMulticastCollector() error {
+	registerMetrics("multicast", multicastCollector{})
+	go collectMulticastGroups()
+	return nil
+}
+
+// collectMulticastGroups periodically refreshes the group counts. Either
+// file is missing when its protocol is disabled, which only leaves out its
+// family.
+func collectMulticastGroups() {
+	reported := false
+	for {
+		groups := make(map[string]*[2]int)
+		errIGMP, errMLD := countIGMPGroups(groups), countMLDGroups(groups)
+		if errIGMP != nil && errMLD != nil && !reported {
+			log.Printf("Error reading multicast groups: %v; %v", errIGMP, errMLD)
+			reported = true
+		}
+		delete(groups, "lo")
+		multicastSnapshot.Lock()
+		multicastSnapshot.byIface = groups
+		multicastSnapshot.Unlock()
+		time.Sleep(*multicastInterval)
+	}
+}
+
+// multicastCollector exports the multicast packets of the last collection
+// cycle and the last group counts
+type multicastCollector struct{}
+
+func (multicastCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- multicastPacketsDesc
+	ch <- multicastGroupsDesc
+}
+
+func (multicastCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range currentStats() {
+		ch <- prometheus.MustNewConstMetric(multicastPacketsDesc, prometheus.CounterValue, float64(s.RxMulticast), s.Name, "receive")
+	}
+	multicastSnapshot.Lock()
+	defer multicastSnapshot.Unlock()
+	for iface, g := range multicastSnapshot.byIface {
+		ch <- prometheus.MustNewConstMetric(multicastGroupsDesc, prometheus.GaugeValue, float64(g[0]), iface, "ipv4")
+		ch <- prometheus.MustNewConstMetric(multicastGroupsDesc, prometheus.GaugeValue, float64(g[1]), iface, "ipv6")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	netflowVersion9 = 9
+	ipfixVersion    = 10
+
+	netflowTemplateIPv4 = 256
+	netflowTemplateIPv6 = 257
+
+	// Keep datagrams below a typical path MTU
+	netflowMaxPacketSize = 1400
+)
+
+var (
+	netflowCollector = flag.String("netflow.collector", "", "Address (host:port) of a NetFlow/IPFIX collector to export conntrack flows to; empty disables")
+	netflowProtocol  = flag.String("netflow.protocol", "v9", "Flow export protocol: v9 or ipfix")
+	netflowInterval  = flag.Duration("netflow.interval", 10*time.Second, "How often to sample conntrack and export flow records")
+	netflowSourceID  = flag.Uint("netflow.source-id", 0, "NetFlow v9 source ID / IPFIX observation domain ID")
+
+	// Reference point for the NetFlow v9 sysUptime fields
+	startTime = time.Now()
+)
+
+// netflowField is an information element of a template
+type netflowField struct {
+	id, length uint16
+}
+
+// netflowRecord is one unidirectional flow record
+type netflowRecord struct {
+	src, dst       net.IP
+	sport, dport   uint16
+	proto          uint8
+	bytes, packets uint64
+	first, last    time.Time
+	ipv6           bool
+}
+
+// netflowTemplate returns the fields of the IPv4 or IPv6 template. Element
+// IDs are shared between NetFlow v9 and IPFIX except for the timestamps.
+func netflowTemplate(ipv6, ipfix bool) []netflowField {
+	fields := []netflowField{{8, 4}, {12, 4}} // sourceIPv4Address, destinationIPv4Address
+	if ipv6 {
+		fields = []netflowField{{27, 16}, {28, 16}} // sourceIPv6Address, destinationIPv6Address
+	}
+	fields = append(fields,
+		netflowField{7, 2},  // sourceTransportPort
+		netflowField{11, 2}, // destinationTransportPort
+		netflowField{4, 1},  // protocolIdentifier
+		netflowField{1, 8},  // octetDeltaCount
+		netflowField{2, 8},  // packetDeltaCount
+	)
+	if ipfix {
+		return append(fields, netflowField{150, 4}, netflowField{151, 4}) // flowStartSeconds, flowEndSeconds
+	}
+	return append(fields, netflowField{22, 4}, netflowField{21, 4}) // FIRST_SWITCHED, LAST_SWITCHED
+}
+
+// netflowExporter encodes flow records and sends them to the collector
+type netflowExporter struct {
+	conn     net.Conn
+	ipfix    bool
+	sequence uint32
+}
+
+// appendTemplateSet appends a set announcing both templates
+func (e *netflowExporter) appendTemplateSet(buf []byte) []byte {
+	setID := uint16(0)
+	if e.ipfix {
+		setID = 2
+	}
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint16(buf, setID)
+	buf = binary.BigEndian.AppendUint16(buf, 0) // length, filled in below
+	for _, tmpl := range []struct {
+		id   uint16
+		ipv6 bool
+	}{{netflowTemplateIPv4, false}, {netflowTemplateIPv6, true}} {
+		fields := netflowTemplate(tmpl.ipv6, e.ipfix)
+		buf = binary.BigEndian.AppendUint16(buf, tmpl.id)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(fields)))
+		for _, f := range fields {
+			buf = binary.BigEndian.AppendUint16(buf, f.id)
+			buf = binary.BigEndian.AppendUint16(buf, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(buf[start+2:], uint16(len(buf)-start))
+	return buf
+}
+
+// appendRecord appends the data fields of a single record
+func (e *netflowExporter) appendRecord(buf []byte, r netflowRecord) []byte {
+	if r.ipv6 {
+		buf = append(buf, r.src.To16()...)
+		buf = append(buf, r.dst.To16()...)
+	} else {
+		buf = append(buf, r.src.To4()...)
+		buf = append(buf, r.dst.To4()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, r.sport)
+	buf = binary.BigEndian.AppendUint16(buf, r.dport)
+	buf = append(buf, r.proto)
+	buf = binary.BigEndian.AppendUint64(buf, r.bytes)
+	buf = binary.BigEndian.AppendUint64(buf, r.packets)
+	if e.ipfix {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(r.first.Unix()))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(r.last.Unix()))
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(r.first.Sub(startTime).Milliseconds()))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(r.last.Sub(startTime).Milliseconds()))
+	}
+	return buf
+}
+
+// appendHeader appends the packet header; the count/length field is patched by export
+func (e *netflowExporter) appendHeader(buf []byte, now time.Time) []byte {
+	if e.ipfix {
+		buf = binary.BigEndian.AppendUint16(buf, ipfixVersion)
+		buf = binary.BigEndian.AppendUint16(buf, 0) // message length
+		buf = binary.BigEndian.AppendUint32(buf, uint32(now.Unix()))
+		buf = binary.BigEndian.AppendUint32(buf, e.sequence)
+		return binary.BigEndian.AppendUint32(buf, uint32(*netflowSourceID))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, netflowVersion9)
+	buf = binary.BigEndian.AppendUint16(buf, 0) // record count
+	buf = binary.BigEndian.AppendUint32(buf, uint32(now.Sub(startTime).Milliseconds()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(now.Unix()))
+	buf = binary.BigEndian.AppendUint32(buf, e.sequence)
+	return binary.BigEndian.AppendUint32(buf, uint32(*netflowSourceID))
+}
+
+// export sends the records, packing as many as fit into each datagram. The
+// templates are repeated in the first packet of every export.
+func (e *netflowExporter) export(records []netflowRecord) error {
+	now := time.Now()
+	withTemplates := true
+	for len(records) > 0 || withTemplates {
+		buf := e.appendHeader(make([]byte, 0, netflowMaxPacketSize+128), now)
+		count := 0
+		if withTemplates {
+			buf = e.appendTemplateSet(buf)
+			count += 2
+			withTemplates = false
+		}
+
+		// One data set per address family, switching sets when the family changes
+		setStart, setFamily := -1, false
+		dataRecords := 0
+		for len(records) > 0 && len(buf) < netflowMaxPacketSize {
+			r := records[0]
+			if setStart < 0 || setFamily != r.ipv6 {
+				buf = closeNetflowSet(buf, setStart)
+				setStart, setFamily = len(buf), r.ipv6
+				templateID := uint16(netflowTemplateIPv4)
+				if r.ipv6 {
+					templateID = netflowTemplateIPv6
+				}
+				buf = binary.BigEndian.AppendUint16(buf, templateID)
+				buf = binary.BigEndian.AppendUint16(buf, 0)
+			}
+			buf = e.appendRecord(buf, r)
+			records = records[1:]
+			count++
+			dataRecords++
+		}
+		buf = closeNetflowSet(buf, setStart)
+
+		if e.ipfix {
+			binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+			// IPFIX sequence numbers count data records
+			e.sequence += uint32(dataRecords)
+		} else {
+			binary.BigEndian.PutUint16(buf[2:], uint16(count))
+			// NetFlow v9 sequence numbers count packets
+			e.sequence++
+		}
+		if _, err := e.conn.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeNetflowSet pads the set starting at start to 4 bytes and fills in its length
+func closeNetflowSet(buf []byte, start int) []byte {
+	if start < 0 {
+		return buf
+	}
+	for (len(buf)-start)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	binary.BigEndian.PutUint16(buf[start+2:], uint16(len(buf)-start))
+	return buf
+}
+
+// conntrackFlowKey identifies a flow across conntrack dumps
+func conntrackFlowKey(f *conntrackFlow) string {
+	return f.zone + "|" + f.protoNum + "|" + f.src + "|" + f.sport + "|" + f.dst + "|" + f.dport
+}
+
+// netflowPrev holds the counters of a flow at the previous dump
+type netflowPrev struct {
+	origBytes, origPackets   uint64
+	replyBytes, replyPackets uint64
+	first                    time.Time
+}
+
+// conntrackDeltaRecords turns a conntrack dump into flow records carrying the
+// traffic seen since the previous dump, one per direction that saw traffic
+func conntrackDeltaRecords(flows []conntrackFlow, prev map[string]netflowPrev, now time.Time) ([]netflowRecord, map[string]netflowPrev) {
+	next := make(map[string]netflowPrev, len(flows))
+	var records []netflowRecord
+	for i := range flows {
+		f := &flows[i]
+		key := conntrackFlowKey(f)
+		p, ok := prev[key]
+		if !ok || f.origBytes < p.origBytes || f.replyBytes < p.replyBytes {
+			// New flow, or the tuple was reused by a new connection
+			p = netflowPrev{first: now}
+		}
+		next[key] = netflowPrev{
+			origBytes: f.origBytes, origPackets: f.origPackets,
+			replyBytes: f.replyBytes, replyPackets: f.replyPackets,
+			first: p.first,
+		}
+
+		proto, _ := strconv.ParseUint(f.protoNum, 10, 8)
+		ipv6 := f.family == "ipv6"
+		if f.origBytes > p.origBytes {
+			records = appendNetflowRecord(records, netflowRecord{
+				src: net.ParseIP(f.src), dst: net.ParseIP(f.dst),
+				sport: parsePort(f.sport), dport: parsePort(f.dport),
+				proto: uint8(proto), ipv6: ipv6,
+				bytes: f.origBytes - p.origBytes, packets: f.origPackets - p.origPackets,
+				first: p.first, last: now,
+			})
+		}
+		if f.replyBytes > p.replyBytes {
+			records = appendNetflowRecord(records, netflowRecord{
+				src: net.ParseIP(f.replySrc), dst: net.ParseIP(f.replyDst),
+				sport: parsePort(f.replySport), dport: parsePort(f.replyDport),
+				proto: uint8(proto), ipv6: ipv6,
+				bytes: f.replyBytes - p.replyBytes, packets: f.replyPackets - p.replyPackets,
+				first: p.first, last: now,
+			})
+		}
+	}
+	return records, next
+}
+
+// appendNetflowRecord skips records whose addresses could not be parsed
+func appendNetflowRecord(records []netflowRecord, r netflowRecord) []netflowRecord {
+	if r.src == nil || r.dst == nil {
+		return records
+	}
+	return append(records, r)
+}
+
+func parsePort(s string) uint16 {
+	port, _ := strconv.ParseUint(s, 10, 16)
+	return uint16(port)
+}
+
+// validateNetflowFlags checks --netflow.protocol
+func validateNetflowFlags() error {
+	switch *netflowProtocol {
+	case "v9", "ipfix":
+		return nil
+	}
+	return fmt.Errorf("unknown --netflow.protocol %q, expected v9 or ipfix", *netflowProtocol)
+}
+
+// newNetflowExporter validates the flags and connects to the collector
+func newNetflowExporter() (*netflowExporter, error) {
+	if err := validateNetflowFlags(); err != nil {
+		return nil, err
+	}
+	e := &netflowExporter{ipfix: *netflowProtocol == "ipfix"}
+	conn, err := net.Dial("udp", *netflowCollector)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return e, nil
+}
+
+// exportNetflow periodically samples conntrack and exports the per-flow deltas
+func exportNetflow(e *netflowExporter) {
+	prev := make(map[string]netflowPrev)
+	for {
+		time.Sleep(*netflowInterval)
+
+		flows, err := readConntrack()
+		if err != nil {
+			log.Printf("Error reading %s: %v", procFilePath(conntrackFile), err)
+			continue
+		}
+		var records []netflowRecord
+		records, prev = conntrackDeltaRecords(flows, prev, time.Now())
+		if err := e.export(records); err != nil {
+			log.Printf("Error exporting flows to %s: %v", *netflowCollector, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkConn is a netlink socket for request/response exchanges with the
+// kernel, as opposed to the notification socket of watchLinkChanges
+type netlinkConn struct {
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+// dialNetlink opens a netlink socket of the given protocol, e.g. NETLINK_GENERIC
+func dialNetlink(protocol int) (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Large enough for the biggest dump messages the kernel sends at once
+	return &netlinkConn{fd: fd, buf: make([]byte, 64*1024)}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// execute sends a request and returns the payloads of the replies; with
+// NLM_F_DUMP it follows a multipart reply until NLMSG_DONE
+func (c *netlinkConn) execute(msgType, flags uint16, payload []byte) ([][]byte, error) {
+	var replies [][]byte
+	err := c.executeFunc(msgType, flags, payload, func(reply []byte) {
+		// Copied, as the receive buffer is reused
+		replies = append(replies, append([]byte(nil), reply...))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// executeFunc is execute passing each reply to f instead of collecting them,
+// for dumps too large to hold, like a full routing table. The reply is only
+// valid until f returns.
+func (c *netlinkConn) executeFunc(msgType, flags uint16, payload []byte, f func(reply []byte)) error {
+	c.seq++
+	msg := make([]byte, unix.SizeofNlMsghdr+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	copy(msg[unix.SizeofNlMsghdr:], payload)
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	for {
+		n, _, err := unix.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(c.buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("truncated netlink error")
+				}
+				// Zero is the acknowledgement of a successful request
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+					return syscall.Errno(errno)
+				}
+				return nil
+			}
+			f(m.Data)
+			if m.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// genlConn is a generic netlink connection to one family, e.g. nl80211
+type genlConn struct {
+	*netlinkConn
+	family uint16
+}
+
+// dialGenetlink opens a generic netlink connection and resolves the family
+func dialGenetlink(family string) (*genlConn, error) {
+	c, err := dialNetlink(unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	g := &genlConn{netlinkConn: c, family: unix.GENL_ID_CTRL}
+	replies, err := g.execute(unix.CTRL_CMD_GETFAMILY, 0, nlAttrString(unix.CTRL_ATTR_FAMILY_NAME, family))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("generic netlink family %s: %w", family, err)
+	}
+	for _, reply := range replies {
+		if id, ok := nlAttrMap(reply)[unix.CTRL_ATTR_FAMILY_ID]; ok && len(id) >= 2 {
+			g.family = binary.NativeEndian.Uint16(id)
+			return g, nil
+		}
+	}
+	c.Close()
+	return nil, fmt.Errorf("generic netlink family %s not found", family)
+}
+
+// execute sends a command with the given attributes and returns the
+// attributes of the replies, without their generic netlink header
+func (g *genlConn) execute(cmd uint8, flags uint16, attrs []byte) ([][]byte, error) {
+	payload := make([]byte, unix.GENL_HDRLEN+len(attrs))
+	payload[0] = cmd
+	payload[1] = 1 // version
+	copy(payload[unix.GENL_HDRLEN:], attrs)
+	replies, err := g.netlinkConn.execute(g.family, flags, payload)
+	if err != nil {
+		return nil, err
+	}
+	for i, reply := range replies {
+		if len(reply) < unix.GENL_HDRLEN {
+			return nil, fmt.Errorf("truncated generic netlink message")
+		}
+		replies[i] = reply[unix.GENL_HDRLEN:]
+	}
+	return replies, nil
+}
+
+// rtLink is a link of an RTM_GETLINK dump, with its IFLA_* attributes
+type rtLink struct {
+	index uint32
+	attrs map[uint16][]byte
+}
+
+// dumpLinks dumps all links of a NETLINK_ROUTE connection, with attrs like
+// IFLA_EXT_MASK added to the request
+func dumpLinks(c *netlinkConn, attrs ...[]byte) ([]rtLink, error) {
+	req := make([]byte, unix.SizeofIfInfomsg)
+	req[0] = unix.AF_UNSPEC
+	for _, a := range attrs {
+		req = append(req, a...)
+	}
+	replies, err := c.execute(unix.RTM_GETLINK, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]rtLink, 0, len(replies))
+	for _, reply := range replies {
+		if len(reply) < unix.SizeofIfInfomsg {
+			continue
+		}
+		// struct ifinfomsg: family, pad, type, then the index at offset 4
+		links = append(links, rtLink{
+			index: binary.NativeEndian.Uint32(reply[4:8]),
+			attrs: nlAttrMap(reply[unix.SizeofIfInfomsg:]),
+		})
+	}
+	return links, nil
+}
+
+// linkNames returns the names of the interfaces by index
+func linkNames(c *netlinkConn) (map[uint32]string, error) {
+	links, err := dumpLinks(c)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[uint32]string, len(links))
+	for _, l := range links {
+		names[l.index] = nlString(l.attrs[unix.IFLA_IFNAME])
+	}
+	return names, nil
+}
+
+// kind returns the IFLA_INFO_KIND of the link, e.g. "vrf" or "vxlan"
+func (l rtLink) kind() string {
+	return nlString(nlAttrMap(l.attrs[unix.IFLA_LINKINFO])[unix.IFLA_INFO_KIND])
+}
+
+// nlAttrAlign rounds an attribute length up to the netlink alignment
+func nlAttrAlign(n int) int {
+	return (n + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+// nlAttr encodes a netlink attribute
+func nlAttr(typ uint16, value []byte) []byte {
+	b := make([]byte, nlAttrAlign(unix.NLA_HDRLEN+len(value)))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(unix.NLA_HDRLEN+len(value)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[unix.NLA_HDRLEN:], value)
+	return b
+}
+
+func nlAttrU32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return nlAttr(typ, b)
+}
+
+// nlAttrNested encodes attributes nested in one of the given type
+func nlAttrNested(typ uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, a := range attrs {
+		value = append(value, a...)
+	}
+	return nlAttr(typ|unix.NLA_F_NESTED, value)
+}
+
+func nlAttrString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+// netlinkAttr is a decoded attribute; nested attributes are decoded again
+// from value
+type netlinkAttr struct {
+	typ   uint16
+	value []byte
+}
+
+// nlAttrs decodes a sequence of attributes, stopping at a malformed one
+func nlAttrs(b []byte) []netlinkAttr {
+	var attrs []netlinkAttr
+	for len(b) >= unix.NLA_HDRLEN {
+		n := int(binary.NativeEndian.Uint16(b[0:2]))
+		if n < unix.NLA_HDRLEN || n > len(b) {
+			break
+		}
+		typ := binary.NativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		attrs = append(attrs, netlinkAttr{typ: typ, value: b[unix.NLA_HDRLEN:n]})
+		b = b[min(nlAttrAlign(n), len(b)):]
+	}
+	return attrs
+}
+
+// nlAttrMap decodes attributes by type, for messages without repeated types
+func nlAttrMap(b []byte) map[uint16][]byte {
+	m := make(map[uint16][]byte)
+	for _, a := range nlAttrs(b) {
+		m[a.typ] = a.value
+	}
+	return m
+}
+
+// nlUint decodes an unsigned attribute of 1, 2, 4 or 8 bytes
+func nlUint(b []byte) (uint64, bool) {
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), true
+	case 2:
+		return uint64(binary.NativeEndian.Uint16(b)), true
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b)), true
+	case 8:
+		return binary.NativeEndian.Uint64(b), true
+	}
+	return 0, false
+}
+
+// nlString decodes a NUL-terminated string attribute
+func nlString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
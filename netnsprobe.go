@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var netnsProbe = flag.Bool("web.enable-netns-probe", false, "Serve /probe?target=<netns|container>, collecting the interfaces of a named network namespace or a container on demand")
+
+var (
+	netnsProbeSpeedDesc    = prometheus.NewDesc("network_interface_speed_bits", "Network interface speed in bits per second", []string{"interface", "direction"}, nil)
+	netnsProbeErrorsDesc   = prometheus.NewDesc("network_interface_errors_total", "Total number of network interface errors", []string{"interface", "direction"}, nil)
+	netnsProbeDropsDesc    = prometheus.NewDesc("network_interface_drops_total", "Total number of network interface drops", []string{"interface", "direction"}, nil)
+	netnsProbePacketsDesc  = prometheus.NewDesc("network_interface_packets_total", "Total number of network interface packets", []string{"interface", "direction"}, nil)
+	netnsProbeSuccessDesc  = prometheus.NewDesc("network_netns_probe_success", "Whether the network namespace of the target could be read", nil, nil)
+	netnsProbeDurationDesc = prometheus.NewDesc("network_netns_probe_duration_seconds", "How long the probe took", nil, nil)
+
+	// Entering a namespace needs CAP_SYS_ADMIN, opening that of a process
+	// of another user CAP_SYS_PTRACE
+	netnsProbeCapabilities = []capability{capSysAdmin, capSysPtrace}
+
+	// Container IDs as they appear in cgroup paths, e.g.
+	// /system.slice/docker-<id>.scope
+	containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	netnsTargets = struct {
+		sync.Mutex
+		byName map[string]*netnsTarget
+	}{byName: make(map[string]*netnsTarget)}
+)
+
+const (
+	// Where ip netns keeps the named network namespaces
+	netnsDir = "/run/netns"
+	// Targets not probed for this long are forgotten, and the next probe
+	// starts over
+	netnsProbeIdle = 10 * time.Minute
+	// Time between the two readings of the first probe of a target
+	netnsProbeFirstInterval = time.Second
+)
+
+// netnsTarget is a probed namespace or container; its speeds are relative
+// to the previous probe
+type netnsTarget struct {
+	// Serializes the probes of the target
+	mu        sync.Mutex
+	collector *netspeed.Collector
+	// Interfaces of the namespace, read from netlink inside it, as sysfs
+	// shows those of the exporter's
+	interfaces map[string]net.Interface
+	// For containers: a process of the container, looked up again once it
+	// is gone
+	pid       int
+	probed    bool
+	lastProbe time.Time
+}
+
+// metadata returns the metadata the collector filters the interfaces by
+func (t *netnsTarget) metadata(name string) (netspeed.Metadata, error) {
+	iface, ok := t.interfaces[name]
+	if !ok {
+		return netspeed.Metadata{}, fmt.Errorf("no interface %s", name)
+	}
+	m := netspeed.Metadata{Index: iface.Index, MTU: iface.MTU}
+	if iface.Flags&net.FlagUp != 0 {
+		m.Flags |= unix.IFF_UP
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		m.Flags |= unix.IFF_LOOPBACK
+	}
+	return m, nil
+}
+
+// lookupNetnsTarget returns the state of a target, forgetting those that
+// haven't been probed for netnsProbeIdle
+func lookupNetnsTarget(name string) *netnsTarget {
+	netnsTargets.Lock()
+	defer netnsTargets.Unlock()
+	now := time.Now()
+	for n, t := range netnsTargets.byName {
+		if now.Sub(t.lastProbe) > netnsProbeIdle {
+			delete(netnsTargets.byName, n)
+		}
+	}
+	t, ok := netnsTargets.byName[name]
+	if !ok {
+		t = &netnsTarget{}
+		t.reset()
+		netnsTargets.byName[name] = t
+	}
+	t.lastProbe = now
+	return t
+}
+
+// reset starts the target over, with no previous probe to compute the speeds
+// from
+func (t *netnsTarget) reset() {
+	t.collector = netspeed.New(
+		netspeed.WithProcfs(filepath.Join(*procfsPath, "thread-self")),
+		netspeed.WithMetadataFunc(t.metadata),
+	)
+	t.probed = false
+}
+
+// forgetNetnsTarget drops the state of a target that doesn't exist
+func forgetNetnsTarget(name string) {
+	netnsTargets.Lock()
+	defer netnsTargets.Unlock()
+	delete(netnsTargets.byName, name)
+}
+
+// namespacePath returns the file of the network namespace of a target: the
+// name of a namespace in /run/netns, or the ID of a container or a unique
+// prefix of at least 12 characters
+func (t *netnsTarget) namespacePath(target string) (string, error) {
+	if target != "." && target != ".." && !strings.Contains(target, "/") {
+		path := filepath.Join(netnsDir, target)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	if len(target) < 12 || len(target) > 64 || strings.Trim(target, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("no network namespace or container %q", target)
+	}
+	if t.pid == 0 || !inContainer(t.pid, target) {
+		pid, err := findContainer(target)
+		if err != nil {
+			return "", err
+		}
+		// The process may be of a new namespace, after a restart of the
+		// container
+		if t.pid != 0 {
+			t.reset()
+		}
+		t.pid = pid
+	}
+	return filepath.Join(*procfsPath, strconv.Itoa(t.pid), "ns/net"), nil
+}
+
+// containerIDs returns the container IDs in the cgroup paths of a process
+func containerIDs(pid int) []string {
+	file, err := os.Open(filepath.Join(*procfsPath, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ids = append(ids, containerIDPattern.FindAllString(scanner.Text(), -1)...)
+	}
+	return ids
+}
+
+// inContainer reports whether a process belongs to the container with the
+// ID prefix
+func inContainer(pid int, prefix string) bool {
+	for _, id := range containerIDs(pid) {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// findContainer returns a process of the container with the ID prefix
+func findContainer(prefix string) (int, error) {
+	entries, err := os.ReadDir(*procfsPath)
+	if err != nil {
+		return 0, err
+	}
+	var found string
+	var pid int
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		for _, id := range containerIDs(p) {
+			if !strings.HasPrefix(id, prefix) {
+				continue
+			}
+			if found != "" && id != found {
+				return 0, fmt.Errorf("container ID %s is ambiguous", prefix)
+			}
+			if found == "" {
+				found, pid = id, p
+			}
+		}
+	}
+	if found == "" {
+		return 0, fmt.Errorf("no network namespace or container %q", prefix)
+	}
+	return pid, nil
+}
+
+// probe reads the interfaces of the network namespace at path. The first
+// probe of a target takes two readings for the speeds.
+func (t *netnsTarget) probe(ctx context.Context, path string) ([]interfaceStats, error) {
+	type result struct {
+		stats []interfaceStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// The namespace is a property of the thread. A thread that can't
+		// return to the exporter's namespace stays locked and ends with
+		// the goroutine.
+		runtime.LockOSThread()
+		own, err := os.Open(filepath.Join(*procfsPath, "thread-self/ns/net"))
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: err}
+			return
+		}
+		defer own.Close()
+		ns, err := os.Open(path)
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: err}
+			return
+		}
+		defer ns.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: fmt.Errorf("entering the network namespace: %w", err)}
+			return
+		}
+		stats, err := t.collect(ctx)
+		if restoreErr := unix.Setns(int(own.Fd()), unix.CLONE_NEWNET); restoreErr != nil {
+			log.Printf("Error leaving the network namespace %s: %v", path, restoreErr)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		done <- result{stats, err}
+	}()
+	r := <-done
+	return r.stats, r.err
+}
+
+// collect reads the interfaces on a thread in the target's namespace
+func (t *netnsTarget) collect(ctx context.Context) ([]interfaceStats, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	t.interfaces = make(map[string]net.Interface, len(ifaces))
+	for _, iface := range ifaces {
+		t.interfaces[iface.Name] = iface
+	}
+	if !t.probed {
+		if _, err := t.collector.CollectContext(ctx); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(netnsProbeFirstInterval):
+		}
+	}
+	stats, err := t.collector.CollectContext(ctx)
+	if err == nil {
+		t.probed = true
+	}
+	return stats, err
+}
+
+// netnsProbeCollector exports the result of a probe
+type netnsProbeCollector struct {
+	stats    []interfaceStats
+	success  bool
+	duration time.Duration
+}
+
+func (c netnsProbeCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c netnsProbeCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(netnsProbeSuccessDesc, prometheus.GaugeValue, boolToFloat(c.success))
+	ch <- prometheus.MustNewConstMetric(netnsProbeDurationDesc, prometheus.GaugeValue, c.duration.Seconds())
+	for _, s := range c.stats {
+		// Gauges like the per-interface series of /metrics
+		for _, d := range []struct {
+			desc   *prometheus.Desc
+			rx, tx float64
+		}{
+			{netnsProbeErrorsDesc, float64(s.RxErrors), float64(s.TxErrors)},
+			{netnsProbeDropsDesc, float64(s.RxDrops), float64(s.TxDrops)},
+			{netnsProbePacketsDesc, float64(s.RxPackets), float64(s.TxPackets)},
+		} {
+			ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, d.rx, s.Name, "receive")
+			ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, d.tx, s.Name, "transmit")
+		}
+		if s.HasSpeed {
+			ch <- prometheus.MustNewConstMetric(netnsProbeSpeedDesc, prometheus.GaugeValue, s.RxSpeed, s.Name, "receive")
+			ch <- prometheus.MustNewConstMetric(netnsProbeSpeedDesc, prometheus.GaugeValue, s.TxSpeed, s.Name, "transmit")
+		}
+	}
+}
+
+// handleNetnsProbe serves /probe?target=, the interfaces of one network
+// namespace or container, blackbox_exporter style
+func handleNetnsProbe(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	t := lookupNetnsTarget(target)
+	t.mu.Lock()
+	path, err := t.namespacePath(target)
+	var stats []interfaceStats
+	if err == nil {
+		stats, err = t.probe(r.Context(), path)
+	} else {
+		forgetNetnsTarget(target)
+	}
+	t.mu.Unlock()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Probe of %s failed: %v", target, err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(netnsProbeCollector{stats: stats, success: err == nil, duration: time.Since(start)})
+	// Aliases, VRFs and tunnels are those of the exporter's interfaces
+	metricsHTTPHandler(relabelGatherer(registry, false)).ServeHTTP(w, r)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	nftablesInterval     = flag.Duration("nftables.interval", 15*time.Second, "How often to read the nftables counters")
+	nftablesRuleComments = flag.String("nftables.rule-comments", "", "Regular expression of rule comments to export the counters of, for rules of nft and iptables-nft, e.g. ^prom:")
+)
+
+const (
+	// NFT_OBJECT_COUNTER, the type of named counters
+	nftObjectCounter = 1
+	// NFTNL_UDATA_RULE_COMMENT, the comment in the rule user data
+	nftUdataRuleComment = 0
+	// sizeof(struct nfgenmsg)
+	sizeofNfgenmsg = 4
+)
+
+// Names of the nftables address families, as in nft list ruleset
+var nftFamilies = map[uint8]string{
+	unix.NFPROTO_INET:   "inet",
+	unix.NFPROTO_IPV4:   "ip",
+	unix.NFPROTO_ARP:    "arp",
+	unix.NFPROTO_NETDEV: "netdev",
+	unix.NFPROTO_BRIDGE: "bridge",
+	unix.NFPROTO_IPV6:   "ip6",
+}
+
+var (
+	nftCounterBytesDesc = prometheus.NewDesc("network_nftables_counter_bytes_total",
+		"Bytes counted by the named nftables counter", []string{"family", "table", "name"}, nil)
+	nftCounterPacketsDesc = prometheus.NewDesc("network_nftables_counter_packets_total",
+		"Packets counted by the named nftables counter", []string{"family", "table", "name"}, nil)
+	nftRuleBytesDesc = prometheus.NewDesc("network_nftables_rule_bytes_total",
+		"Bytes counted by the nftables rules with the comment, summed over the rules of the chain", []string{"family", "table", "chain", "comment"}, nil)
+	nftRulePacketsDesc = prometheus.NewDesc("network_nftables_rule_packets_total",
+		"Packets counted by the nftables rules with the comment, summed over the rules of the chain", []string{"family", "table", "chain", "comment"}, nil)
+
+	// Result of the last nftables dumps
+	nftablesSnapshot struct {
+		sync.Mutex
+		counters map[[3]string]nftCounter
+		rules    map[[4]string]nftCounter
+	}
+)
+
+func init() {
+	registerCollector("nftables", "named nftables counters and counters of rules with matching comments", false, startNftablesCollector).
+		requires(capNetAdmin).
+		checks(checkNftablesFlags)
+}
+
+type nftCounter struct {
+	bytes, packets uint64
+}
+
+// nftFamily names the family of a reply from its struct nfgenmsg
+func nftFamily(reply []byte) string {
+	if name, ok := nftFamilies[reply[0]]; ok {
+		return name
+	}
+	return fmt.Sprint(reply[0])
+}
+
+// parseNftCounter decodes the nested NFTA_COUNTER_* attributes, which are
+// in network byte order
+func parseNftCounter(b []byte) (nftCounter, bool) {
+	attrs := nlAttrMap(b)
+	bytes, packets := attrs[unix.NFTA_COUNTER_BYTES], attrs[unix.NFTA_COUNTER_PACKETS]
+	if len(bytes) != 8 || len(packets) != 8 {
+		return nftCounter{}, false
+	}
+	return nftCounter{binary.BigEndian.Uint64(bytes), binary.BigEndian.Uint64(packets)}, true
+}
+
+// nftRuleComment returns the comment of the rule user data, a list of
+// type, length, value entries
+func nftRuleComment(udata []byte) string {
+	for len(udata) >= 2 {
+		typ, n := udata[0], int(udata[1])
+		if 2+n > len(udata) {
+			break
+		}
+		if typ == nftUdataRuleComment {
+			return nlString(udata[2 : 2+n])
+		}
+		udata = udata[2+n:]
+	}
+	return ""
+}
+
+// nftDump dumps the objects of a NFT_MSG_GET* message of all families
+func nftDump(c *netlinkConn, msg uint16) ([][]byte, error) {
+	req := make([]byte, sizeofNfgenmsg)
+	req[0] = unix.NFPROTO_UNSPEC
+	replies, err := c.execute(unix.NFNL_SUBSYS_NFTABLES<<8|msg, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	valid := replies[:0]
+	for _, reply := range replies {
+		if len(reply) >= sizeofNfgenmsg {
+			valid = append(valid, reply)
+		}
+	}
+	return valid, nil
+}
+
+// readNftCounters dumps the named counters
+func readNftCounters(c *netlinkConn) (map[[3]string]nftCounter, error) {
+	replies, err := nftDump(c, unix.NFT_MSG_GETOBJ)
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[[3]string]nftCounter)
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply[sizeofNfgenmsg:])
+		if typ := attrs[unix.NFTA_OBJ_TYPE]; len(typ) != 4 || binary.BigEndian.Uint32(typ) != nftObjectCounter {
+			continue
+		}
+		if counter, ok := parseNftCounter(attrs[unix.NFTA_OBJ_DATA]); ok {
+			key := [3]string{nftFamily(reply), nlString(attrs[unix.NFTA_OBJ_TABLE]), nlString(attrs[unix.NFTA_OBJ_NAME])}
+			counters[key] = counter
+		}
+	}
+	return counters, nil
+}
+
+// readNftRules dumps the rules and sums up the counters of those with a
+// matching comment by chain and comment
+func readNftRules(c *netlinkConn, comments *regexp.Regexp) (map[[4]string]nftCounter, error) {
+	replies, err := nftDump(c, unix.NFT_MSG_GETRULE)
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[[4]string]nftCounter)
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply[sizeofNfgenmsg:])
+		comment := nftRuleComment(attrs[unix.NFTA_RULE_USERDATA])
+		if comment == "" || !comments.MatchString(comment) {
+			continue
+		}
+		for _, expr := range nlAttrs(attrs[unix.NFTA_RULE_EXPRESSIONS]) {
+			e := nlAttrMap(expr.value)
+			if nlString(e[unix.NFTA_EXPR_NAME]) != "counter" {
+				continue
+			}
+			if counter, ok := parseNftCounter(e[unix.NFTA_EXPR_DATA]); ok {
+				key := [4]string{nftFamily(reply), nlString(attrs[unix.NFTA_RULE_TABLE]), nlString(attrs[unix.NFTA_RULE_CHAIN]), comment}
+				sum := rules[key]
+				sum.bytes += counter.bytes
+				sum.packets += counter.packets
+				rules[key] = sum
+			}
+			break
+		}
+	}
+	return rules, nil
+}
+
+// checkNftablesFlags validates --nftables.rule-comments
+func checkNftablesFlags() error {
+	if _, err := regexp.Compile(*nftablesRuleComments); err != nil {
+		return fmt.Errorf("invalid --nftables.rule-comments: %w", err)
+	}
+	return nil
+}
+
+// startNftablesCollector starts reading the nftables counters
+func startNftablesCollector() error {
+	var comments *regexp.Regexp
+	if *nftablesRuleComments != "" {
+		comments = regexp.MustCompile(*nftablesRuleComments)
+	}
+	c, err := dialNetlink(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	registerMetrics("nftables", nftablesCollector{})
+	go collectNftables(c, comments)
+	return nil
+}
+
+// collectNftables periodically refreshes the nftables snapshot
+func collectNftables(c *netlinkConn, comments *regexp.Regexp) {
+	for {
+		counters, err := readNftCounters(c)
+		if err != nil {
+			log.Printf("Error reading nftables counters: %v", err)
+		}
+		var rules map[[4]string]nftCounter
+		if comments != nil {
+			if rules, err = readNftRules(c, comments); err != nil {
+				log.Printf("Error reading nftables rules: %v", err)
+			}
+		}
+		nftablesSnapshot.Lock()
+		nftablesSnapshot.counters, nftablesSnapshot.rules = counters, rules
+		nftablesSnapshot.Unlock()
+		time.Sleep(*nftablesInterval)
+	}
+}
+
+// nftablesCollector exports the last nftables snapshot
+type nftablesCollector struct{}
+
+func (nftablesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nftCounterBytesDesc
+	ch <- nftCounterPacketsDesc
+	ch <- nftRuleBytesDesc
+	ch <- nftRulePacketsDesc
+}
+
+func (nftablesCollector) Collect(ch chan<- prometheus.Metric) {
+	nftablesSnapshot.Lock()
+	defer nftablesSnapshot.Unlock()
+	for key, c := range nftablesSnapshot.counters {
+		ch <- prometheus.MustNewConstMetric(nftCounterBytesDesc, prometheus.CounterValue, float64(c.bytes), key[:]...)
+		ch <- prometheus.MustNewConstMetric(nftCounterPacketsDesc, prometheus.CounterValue, float64(c.packets), key[:]...)
+	}
+	for key, c := range nftablesSnapshot.rules {
+		ch <- prometheus.MustNewConstMetric(nftRuleBytesDesc, prometheus.CounterValue, float64(c.bytes), key[:]...)
+		ch <- prometheus.MustNewConstMetric(nftRulePacketsDesc, prometheus.CounterValue, float64(c.packets), key[:]...)
+	}
+}
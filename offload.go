@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var offloadInterval = flag.Duration("offload.interval", time.Minute, "How often to read the offload features of the interfaces")
+
+// Offloads of the info metric and the netdev features they are made of; an
+// offload is on if any of its features is active
+var offloads = []struct {
+	label    string
+	features []string
+}{
+	{"gro", []string{"rx-gro"}},
+	{"gso", []string{"tx-generic-segmentation"}},
+	{"tso", []string{"tx-tcp-segmentation", "tx-tcp6-segmentation"}},
+	{"lro", []string{"rx-lro"}},
+	{"rx_checksum", []string{"rx-checksum"}},
+	{"tx_checksum", []string{"tx-checksum-ipv4", "tx-checksum-ip-generic", "tx-checksum-ipv6"}},
+}
+
+var (
+	offloadInfoDesc = prometheus.NewDesc("network_interface_offload_info",
+		"Offload features of the network interface, each label on or off",
+		append([]string{"interface"}, offloadLabels()...), nil)
+
+	// Label values of the last features dump by interface
+	offloadSnapshot struct {
+		sync.Mutex
+		byIface map[string][]string
+	}
+)
+
+func init() {
+	registerCollector("offload", "GRO, GSO, TSO, LRO and checksum offload settings via ethtool netlink", false, startOffloadCollector)
+}
+
+func offloadLabels() []string {
+	labels := make([]string, len(offloads))
+	for i, o := range offloads {
+		labels[i] = o.label
+	}
+	return labels
+}
+
+// readOffloads dumps the active features of all interfaces
+func readOffloads(c *genlConn) (map[string][]string, error) {
+	replies, err := ethtoolDump(c, unix.ETHTOOL_MSG_FEATURES_GET, unix.ETHTOOL_A_FEATURES_HEADER, 0)
+	if err != nil {
+		return nil, err
+	}
+	byIface := make(map[string][]string, len(replies))
+	for name, attrs := range replies {
+		active := ethtoolBitset(attrs[unix.ETHTOOL_A_FEATURES_ACTIVE])
+		values := make([]string, len(offloads))
+		for i, o := range offloads {
+			values[i] = "off"
+			for _, feature := range o.features {
+				if active[feature] {
+					values[i] = "on"
+				}
+			}
+		}
+		byIface[name] = values
+	}
+	return byIface, nil
+}
+
+// startOffloadCollector starts reading the offload features
+func startOffloadCollector() error {
+	c, err := dialGenetlink(unix.ETHTOOL_GENL_NAME)
+	if err != nil {
+		return err
+	}
+	registerMetrics("offload", offloadCollector{})
+	go collectOffloads(c)
+	return nil
+}
+
+// collectOffloads periodically refreshes the offload snapshot
+func collectOffloads(c *genlConn) {
+	for {
+		byIface, err := readOffloads(c)
+		if err != nil {
+			log.Printf("Error reading offload features: %v", err)
+		} else {
+			offloadSnapshot.Lock()
+			offloadSnapshot.byIface = byIface
+			offloadSnapshot.Unlock()
+		}
+		time.Sleep(*offloadInterval)
+	}
+}
+
+// offloadCollector exports the last offload snapshot
+type offloadCollector struct{}
+
+func (offloadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- offloadInfoDesc
+}
+
+func (offloadCollector) Collect(ch chan<- prometheus.Metric) {
+	offloadSnapshot.Lock()
+	defer offloadSnapshot.Unlock()
+	for name, values := range offloadSnapshot.byIface {
+		ch <- prometheus.MustNewConstMetric(offloadInfoDesc, prometheus.GaugeValue, 1, append([]string{name}, values...)...)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	once         = flag.Bool("once", false, "Sample twice over --once.interval, print the interface speeds to stdout and exit; same as the print subcommand")
+	onceInterval = flag.Duration("once.interval", time.Second, "Time between the two samples of --once")
+	onceFormat   = flag.String("once.format", "text", "Output format of --once: text or json")
+)
+
+// sampleSpeeds measures the speeds of all up, non-loopback interfaces
+// between two readings of /proc/net/dev taken interval apart
+func sampleSpeeds(interval time.Duration) ([]interfaceStats, error) {
+	c := newCollector()
+	if _, err := c.Collect(); err != nil {
+		return nil, err
+	}
+	time.Sleep(interval)
+	stats, err := c.Collect()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, nil
+}
+
+// formatBitRate formats a speed in bits per second with a decimal prefix
+func formatBitRate(bps float64) string {
+	units := []string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s", "Tbit/s"}
+	i := 0
+	for bps >= 1000 && i < len(units)-1 {
+		bps /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", bps, units[i])
+}
+
+// printSpeeds writes the stats as a table or as an /api/v1/interfaces document
+func printSpeeds(w io.Writer, stats []interfaceStats, format string) error {
+	if format == "json" {
+		resp := interfacesResponse{
+			Timestamp:  time.Now().Unix(),
+			Interfaces: make([]interfaceJSON, 0, len(stats)),
+		}
+		for _, s := range stats {
+			resp.Interfaces = append(resp.Interfaces, apiInterfaceJSON(s))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tRECEIVE\tTRANSMIT\tRX ERRORS\tTX ERRORS\tRX DROPS\tTX DROPS")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", s.Name, formatBitRate(s.RxSpeed), formatBitRate(s.TxSpeed),
+			s.RxErrors, s.TxErrors, s.RxDrops, s.TxDrops)
+	}
+	return tw.Flush()
+}
+
+// runOnce implements --once and the print subcommand
+func runOnce() error {
+	if *onceFormat != "text" && *onceFormat != "json" {
+		return fmt.Errorf("invalid --once.format %q, expected text or json", *onceFormat)
+	}
+	stats, err := sampleSpeeds(*onceInterval)
+	if err != nil {
+		return err
+	}
+	return printSpeeds(os.Stdout, stats, *onceFormat)
+}
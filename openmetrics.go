@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var sampleTimestamps = flag.Bool("web.sample-timestamps", false, "Attach the time of the last collection cycle to the per-interface speed, error, drop, packet and info samples on /metrics")
+
+// Families of the dev collector, whose samples get the time of the
+// collection cycle with --web.sample-timestamps
+var devFamilies = []string{"speed_bits", "speed_bytes", "errors_total", "drops_total", "packets_total", "info"}
+
+// Created timestamps of the counters read from the kernel and other sources
+// that don't know when they started counting
+var counterCreated = struct {
+	sync.Mutex
+	series map[string]*counterSeries
+	boot   time.Time
+}{series: make(map[string]*counterSeries)}
+
+// counterSeries is the last value and the created timestamp of a counter
+type counterSeries struct {
+	value   float64
+	created time.Time
+	seen    time.Time
+}
+
+// readBootTime returns the boot time from /proc/stat, or the start of the
+// exporter if it can't be read
+func readBootTime() time.Time {
+	f, err := os.Open(procFilePath("stat"))
+	if err != nil {
+		return time.Now()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			if btime, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return time.Unix(btime, 0)
+			}
+		}
+	}
+	return time.Now()
+}
+
+// seriesKey identifies a series of a family
+func seriesKey(name string, m *dto.Metric) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, lp := range m.Label {
+		b.WriteByte(0xff)
+		b.WriteString(lp.GetName())
+		b.WriteByte('=')
+		b.WriteString(lp.GetValue())
+	}
+	return b.String()
+}
+
+// openMetricsGatherer wraps g, giving counters without a created timestamp
+// the boot time, or the time just after the last sample before a reset, and
+// adding the sample timestamps of --web.sample-timestamps
+func openMetricsGatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		now := time.Now()
+
+		counterCreated.Lock()
+		if counterCreated.boot.IsZero() {
+			counterCreated.boot = readBootTime()
+		}
+		for _, mf := range families {
+			if mf.GetType() != dto.MetricType_COUNTER {
+				continue
+			}
+			for _, m := range mf.Metric {
+				if m.Counter == nil || m.Counter.CreatedTimestamp != nil {
+					continue
+				}
+				key := seriesKey(mf.GetName(), m)
+				s := counterCreated.series[key]
+				if s == nil {
+					s = &counterSeries{created: counterCreated.boot}
+					counterCreated.series[key] = s
+				} else if m.Counter.GetValue() < s.value {
+					s.created = s.seen.Add(time.Millisecond)
+				}
+				s.value, s.seen = m.Counter.GetValue(), now
+				m.Counter.CreatedTimestamp = timestamppb.New(s.created)
+			}
+		}
+		// Forget the series that are gone
+		for key, s := range counterCreated.series {
+			if now.Sub(s.seen) > time.Hour {
+				delete(counterCreated.series, key)
+			}
+		}
+		counterCreated.Unlock()
+
+		if *sampleTimestamps {
+			var cycle time.Time
+			for _, s := range currentStats() {
+				if s.Time.After(cycle) {
+					cycle = s.Time
+				}
+			}
+			if !cycle.IsZero() {
+				timestamp := cycle.UnixMilli()
+				for _, mf := range families {
+					if !isDevFamily(mf.GetName()) {
+						continue
+					}
+					for _, m := range mf.Metric {
+						if !isRemoteSeries(m) {
+							m.TimestampMs = &timestamp
+						}
+					}
+				}
+			}
+		}
+		return families, err
+	})
+}
+
+// isDevFamily reports whether a family, named with --metrics.prefix, is one
+// of the dev collector
+func isDevFamily(name string) bool {
+	for _, family := range devFamilies {
+		if name == *metricsPrefix+"_"+family {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOpenMetricsFamily writes a family in the OpenMetrics format, adding a
+// _created sample after each counter sample with a created timestamp, which
+// expfmt leaves out
+func writeOpenMetricsFamily(w io.Writer, mf *dto.MetricFamily) error {
+	if mf.GetType() != dto.MetricType_COUNTER || !strings.HasSuffix(mf.GetName(), "_total") || len(mf.Metric) == 0 {
+		_, err := expfmt.MetricFamilyToOpenMetrics(w, mf)
+		return err
+	}
+	createdName := strings.TrimSuffix(mf.GetName(), "_total") + "_created"
+	var buf bytes.Buffer
+	for i, m := range mf.Metric {
+		buf.Reset()
+		single := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: []*dto.Metric{m}}
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, single); err != nil {
+			return err
+		}
+		// The HELP and TYPE lines once per family
+		lines := buf.Bytes()
+		if i > 0 {
+			lines = withoutComments(lines)
+		}
+		if _, err := w.Write(lines); err != nil {
+			return err
+		}
+		ct := m.GetCounter().GetCreatedTimestamp()
+		if ct == nil {
+			continue
+		}
+		// A gauge sample line has the form of a _created one
+		buf.Reset()
+		created := float64(ct.AsTime().UnixNano()) / 1e9
+		sample := &dto.MetricFamily{
+			Name:   &createdName,
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: m.Label, Gauge: &dto.Gauge{Value: &created}}},
+		}
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, sample); err != nil {
+			return err
+		}
+		if _, err := w.Write(withoutComments(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutComments drops the comment lines of the OpenMetrics output of a
+// family, keeping the samples
+func withoutComments(b []byte) []byte {
+	var out []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 && line[0] != '#' {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// gzipAccepted reports whether the client accepts gzip responses
+func gzipAccepted(h http.Header) bool {
+	for _, part := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		if part = strings.TrimSpace(part); part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHTTPHandler serves g in the format the scraper negotiates. The
+// OpenMetrics format is written here, with the _created samples of the
+// counters; the others are promhttp's.
+func metricsHTTPHandler(g prometheus.Gatherer) http.Handler {
+	g = openMetricsGatherer(g)
+	handler := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if !strings.HasPrefix(string(format), expfmt.OpenMetricsType) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		families, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		if gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		for _, mf := range families {
+			if err := writeOpenMetricsFamily(out, mf); err != nil {
+				log.Printf("Error writing metrics: %v", err)
+				return
+			}
+		}
+		expfmt.FinalizeOpenMetrics(out)
+	})
+}
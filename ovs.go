@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ovsSocket   = flag.String("ovs.socket", "unix:/var/run/openvswitch/db.sock", "OVSDB server to read Open vSwitch port statistics from, unix:<path> or tcp:<host>:<port>")
+	ovsInterval = flag.Duration("ovs.interval", 15*time.Second, "How often to read Open vSwitch port and datapath statistics")
+)
+
+// Kernel datapath generic netlink family, from linux/openvswitch.h
+const (
+	ovsDatapathFamily = "ovs_datapath"
+	ovsDPCmdGet       = 3
+	ovsDPAttrName     = 1
+	ovsDPAttrStats    = 3
+	// struct ovs_header: the datapath ifindex after the genl header
+	ovsHeaderLen = 4
+)
+
+var (
+	ovsInterfaceInfoDesc = prometheus.NewDesc("network_ovs_interface_info",
+		"Bridge, port, type and link state of the Open vSwitch interface", []string{"bridge", "port", "interface", "type", "link_state"}, nil)
+	ovsInterfaceBytesDesc = prometheus.NewDesc("network_ovs_interface_bytes_total",
+		"Bytes received or transmitted by the Open vSwitch interface", []string{"bridge", "port", "interface", "direction"}, nil)
+	ovsInterfacePacketsDesc = prometheus.NewDesc("network_ovs_interface_packets_total",
+		"Packets received or transmitted by the Open vSwitch interface", []string{"bridge", "port", "interface", "direction"}, nil)
+	ovsInterfaceErrorsDesc = prometheus.NewDesc("network_ovs_interface_errors_total",
+		"Receive or transmit errors of the Open vSwitch interface", []string{"bridge", "port", "interface", "direction"}, nil)
+	ovsInterfaceDroppedDesc = prometheus.NewDesc("network_ovs_interface_dropped_total",
+		"Packets dropped on receive or transmit by the Open vSwitch interface", []string{"bridge", "port", "interface", "direction"}, nil)
+	ovsDatapathLookupsDesc = prometheus.NewDesc("network_ovs_datapath_lookups_total",
+		"Flow table lookups of the kernel datapath that hit a flow, missed and went to userspace, or were lost on the way", []string{"datapath", "result"}, nil)
+	ovsDatapathFlowsDesc = prometheus.NewDesc("network_ovs_datapath_flows",
+		"Flows installed in the kernel datapath", []string{"datapath"}, nil)
+
+	// Result of the last OVSDB and datapath reads
+	ovsSnapshot struct {
+		sync.Mutex
+		interfaces []ovsInterface
+		datapaths  []ovsDatapath
+	}
+)
+
+func init() {
+	registerCollector("ovs", "Open vSwitch port statistics from OVSDB and kernel datapath flow lookups", false, startOVSCollector)
+}
+
+type ovsInterface struct {
+	bridge, port, name, ifaceType, linkState string
+	// statistics column, e.g. rx_bytes
+	stats map[string]float64
+}
+
+type ovsDatapath struct {
+	name              string
+	hit, missed, lost uint64
+	flows             uint64
+}
+
+// ovsdbRow is a row of an OVSDB select result by column
+type ovsdbRow map[string]json.RawMessage
+
+// ovsdbAtoms decodes a column of the OVSDB JSON notation: a single atom,
+// ["set", [atoms]], or ["uuid", "..."] for a reference
+func ovsdbAtoms(raw json.RawMessage) []json.RawMessage {
+	var tagged []json.RawMessage
+	if json.Unmarshal(raw, &tagged) != nil || len(tagged) != 2 {
+		return []json.RawMessage{raw}
+	}
+	var tag string
+	json.Unmarshal(tagged[0], &tag)
+	if tag == "set" {
+		var atoms []json.RawMessage
+		json.Unmarshal(tagged[1], &atoms)
+		return atoms
+	}
+	return []json.RawMessage{raw}
+}
+
+// ovsdbUUID decodes a ["uuid", "..."] atom
+func ovsdbUUID(raw json.RawMessage) string {
+	var pair []string
+	if json.Unmarshal(raw, &pair) != nil || len(pair) != 2 || pair[0] != "uuid" {
+		return ""
+	}
+	return pair[1]
+}
+
+// ovsdbString decodes a string column, empty for an empty optional one
+func ovsdbString(raw json.RawMessage) string {
+	var s string
+	json.Unmarshal(raw, &s)
+	return s
+}
+
+// ovsdbIntMap decodes a ["map", [[key, value], ...]] column of integers
+func ovsdbIntMap(raw json.RawMessage) map[string]float64 {
+	var tagged []json.RawMessage
+	if json.Unmarshal(raw, &tagged) != nil || len(tagged) != 2 {
+		return nil
+	}
+	var tag string
+	var pairs [][2]json.RawMessage
+	json.Unmarshal(tagged[0], &tag)
+	if tag != "map" || json.Unmarshal(tagged[1], &pairs) != nil {
+		return nil
+	}
+	values := make(map[string]float64, len(pairs))
+	for _, p := range pairs {
+		var key string
+		var value float64
+		if json.Unmarshal(p[0], &key) == nil && json.Unmarshal(p[1], &value) == nil {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// dialOVSDB connects to the OVSDB server given in the ovs-vsctl --db form
+func dialOVSDB(target string) (net.Conn, error) {
+	network, address, ok := strings.Cut(target, ":")
+	if !ok {
+		network, address = "unix", target
+	}
+	if network != "unix" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported OVSDB connection method %q", network)
+	}
+	return net.DialTimeout(network, address, 10*time.Second)
+}
+
+// ovsdbSelect selects the given columns of all rows of the tables in one
+// transaction, returning the rows by table
+func ovsdbSelect(conn net.Conn, tables map[string][]string) (map[string][]ovsdbRow, error) {
+	params := []any{"Open_vSwitch"}
+	var names []string
+	for table, columns := range tables {
+		names = append(names, table)
+		params = append(params, map[string]any{"op": "select", "table": table, "where": []any{}, "columns": columns})
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := json.NewEncoder(conn).Encode(map[string]any{"method": "transact", "params": params, "id": 0}); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result []struct {
+			Rows  []ovsdbRow `json:"rows"`
+			Error string     `json:"error"`
+		} `json:"result"`
+		Error any `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("transact: %v", resp.Error)
+	}
+	if len(resp.Result) != len(names) {
+		return nil, fmt.Errorf("transact: %d results for %d operations", len(resp.Result), len(names))
+	}
+	rows := make(map[string][]ovsdbRow, len(names))
+	for i, table := range names {
+		if resp.Result[i].Error != "" {
+			return nil, fmt.Errorf("select %s: %s", table, resp.Result[i].Error)
+		}
+		rows[table] = resp.Result[i].Rows
+	}
+	return rows, nil
+}
+
+// readOVSInterfaces reads the interfaces with their statistics, which
+// ovs-vswitchd writes to OVSDB every few seconds, and their bridge and port
+func readOVSInterfaces() ([]ovsInterface, error) {
+	conn, err := dialOVSDB(*ovsSocket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rows, err := ovsdbSelect(conn, map[string][]string{
+		"Bridge":    {"name", "ports"},
+		"Port":      {"_uuid", "name", "interfaces"},
+		"Interface": {"_uuid", "name", "type", "link_state", "statistics"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bridgeOfPort := make(map[string]string)
+	for _, b := range rows["Bridge"] {
+		for _, p := range ovsdbAtoms(b["ports"]) {
+			bridgeOfPort[ovsdbUUID(p)] = ovsdbString(b["name"])
+		}
+	}
+	type portRef struct{ bridge, port string }
+	portOfInterface := make(map[string]portRef)
+	for _, p := range rows["Port"] {
+		ref := portRef{bridgeOfPort[ovsdbUUID(p["_uuid"])], ovsdbString(p["name"])}
+		for _, i := range ovsdbAtoms(p["interfaces"]) {
+			portOfInterface[ovsdbUUID(i)] = ref
+		}
+	}
+	var ifaces []ovsInterface
+	for _, i := range rows["Interface"] {
+		ref := portOfInterface[ovsdbUUID(i["_uuid"])]
+		var linkState string
+		if atoms := ovsdbAtoms(i["link_state"]); len(atoms) == 1 {
+			linkState = ovsdbString(atoms[0])
+		}
+		// An empty type is a regular network device
+		ifaceType := ovsdbString(i["type"])
+		if ifaceType == "" {
+			ifaceType = "system"
+		}
+		ifaces = append(ifaces, ovsInterface{
+			bridge:    ref.bridge,
+			port:      ref.port,
+			name:      ovsdbString(i["name"]),
+			ifaceType: ifaceType,
+			linkState: linkState,
+			stats:     ovsdbIntMap(i["statistics"]),
+		})
+	}
+	return ifaces, nil
+}
+
+// readOVSDatapaths dumps the kernel datapaths with their flow lookup stats
+func readOVSDatapaths(c *genlConn) ([]ovsDatapath, error) {
+	replies, err := c.execute(ovsDPCmdGet, unix.NLM_F_DUMP, make([]byte, ovsHeaderLen))
+	if err != nil {
+		return nil, err
+	}
+	var dps []ovsDatapath
+	for _, reply := range replies {
+		if len(reply) < ovsHeaderLen {
+			continue
+		}
+		attrs := nlAttrMap(reply[ovsHeaderLen:])
+		dp := ovsDatapath{name: nlString(attrs[ovsDPAttrName])}
+		// struct ovs_dp_stats: n_hit, n_missed, n_lost, n_flows
+		if stats := attrs[ovsDPAttrStats]; len(stats) >= 32 {
+			dp.hit = binary.NativeEndian.Uint64(stats[0:8])
+			dp.missed = binary.NativeEndian.Uint64(stats[8:16])
+			dp.lost = binary.NativeEndian.Uint64(stats[16:24])
+			dp.flows = binary.NativeEndian.Uint64(stats[24:32])
+		}
+		dps = append(dps, dp)
+	}
+	return dps, nil
+}
+
+// startOVSCollector starts reading Open vSwitch statistics
+func startOVSCollector() error {
+	registerMetrics("ovs", ovsCollector{})
+	go collectOVS()
+	return nil
+}
+
+// collectOVS periodically refreshes the Open vSwitch snapshot. The kernel
+// datapath is optional, ovs-vswitchd may run a userspace (DPDK) datapath.
+func collectOVS() {
+	var dp *genlConn
+	for {
+		ifaces, err := readOVSInterfaces()
+		if err != nil {
+			log.Printf("Error reading Open vSwitch interfaces from %s: %v", *ovsSocket, err)
+		}
+		if dp == nil {
+			// The family appears once the openvswitch module is loaded
+			dp, _ = dialGenetlink(ovsDatapathFamily)
+		}
+		var dps []ovsDatapath
+		if dp != nil {
+			if dps, err = readOVSDatapaths(dp); err != nil {
+				log.Printf("Error reading Open vSwitch datapaths: %v", err)
+				dp.Close()
+				dp = nil
+			}
+		}
+		ovsSnapshot.Lock()
+		ovsSnapshot.interfaces, ovsSnapshot.datapaths = ifaces, dps
+		ovsSnapshot.Unlock()
+		time.Sleep(*ovsInterval)
+	}
+}
+
+// ovsCollector exports the last Open vSwitch snapshot
+type ovsCollector struct{}
+
+func (ovsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ovsInterfaceInfoDesc
+	ch <- ovsInterfaceBytesDesc
+	ch <- ovsInterfacePacketsDesc
+	ch <- ovsInterfaceErrorsDesc
+	ch <- ovsInterfaceDroppedDesc
+	ch <- ovsDatapathLookupsDesc
+	ch <- ovsDatapathFlowsDesc
+}
+
+func (ovsCollector) Collect(ch chan<- prometheus.Metric) {
+	ovsSnapshot.Lock()
+	defer ovsSnapshot.Unlock()
+	for _, i := range ovsSnapshot.interfaces {
+		ch <- prometheus.MustNewConstMetric(ovsInterfaceInfoDesc, prometheus.GaugeValue, 1, i.bridge, i.port, i.name, i.ifaceType, i.linkState)
+		for _, c := range []struct {
+			desc *prometheus.Desc
+			stat string
+		}{
+			{ovsInterfaceBytesDesc, "bytes"},
+			{ovsInterfacePacketsDesc, "packets"},
+			{ovsInterfaceErrorsDesc, "errors"},
+			{ovsInterfaceDroppedDesc, "dropped"},
+		} {
+			// Statistics the interface type does not support are left out
+			if v, ok := i.stats["rx_"+c.stat]; ok {
+				ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, v, i.bridge, i.port, i.name, "receive")
+			}
+			if v, ok := i.stats["tx_"+c.stat]; ok {
+				ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, v, i.bridge, i.port, i.name, "transmit")
+			}
+		}
+	}
+	for _, dp := range ovsSnapshot.datapaths {
+		ch <- prometheus.MustNewConstMetric(ovsDatapathLookupsDesc, prometheus.CounterValue, float64(dp.hit), dp.name, "hit")
+		ch <- prometheus.MustNewConstMetric(ovsDatapathLookupsDesc, prometheus.CounterValue, float64(dp.missed), dp.name, "missed")
+		ch <- prometheus.MustNewConstMetric(ovsDatapathLookupsDesc, prometheus.CounterValue, float64(dp.lost), dp.name, "lost")
+		ch <- prometheus.MustNewConstMetric(ovsDatapathFlowsDesc, prometheus.GaugeValue, float64(dp.flows), dp.name)
+	}
+}
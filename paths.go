@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+)
+
+var (
+	procfsPath = flag.String("path.procfs", "/proc", "procfs mountpoint, e.g. /host/proc when running in a container")
+	sysfsPath  = flag.String("path.sysfs", "/sys", "sysfs mountpoint, e.g. /host/sys when running in a container")
+)
+
+// procFilePath returns the path of a file below the procfs mountpoint
+func procFilePath(name string) string {
+	return filepath.Join(*procfsPath, name)
+}
+
+// sysFilePath returns the path of a file below the sysfs mountpoint
+func sysFilePath(name string) string {
+	return filepath.Join(*sysfsPath, name)
+}
+
+// newCollector returns a collector reading the configured procfs, with the
+// cached interface metadata and the sysfs statistics for counters that wrap,
+// read by --collection.workers
+func newCollector(opts ...netspeed.Option) *netspeed.Collector {
+	opts = append([]netspeed.Option{
+		netspeed.WithProcfs(*procfsPath),
+		netspeed.WithSysfs(*sysfsPath),
+		netspeed.WithMetadataFunc(interfaceMetadataFor),
+		netspeed.WithSysfsFallback(),
+		netspeed.WithWorkers(*collectionWorkers),
+	}, opts...)
+	return netspeed.New(opts...)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var pauseInterval = flag.Duration("pause.interval", 15*time.Second, "How often to read pause frame counters and flow control settings")
+
+var (
+	pauseFramesDesc = prometheus.NewDesc("network_interface_pause_frames_total",
+		"Number of 802.3x pause frames received or transmitted", []string{"interface", "direction"}, nil)
+	flowControlDesc = prometheus.NewDesc("network_interface_flow_control_enabled",
+		"Whether the interface honors received (receive) or sends (transmit) pause frames", []string{"interface", "direction"}, nil)
+	flowControlAutonegDesc = prometheus.NewDesc("network_interface_flow_control_autoneg",
+		"Whether flow control is autonegotiated", []string{"interface"}, nil)
+
+	// Result of the last ethtool pause dump by interface
+	pauseSnapshot struct {
+		sync.Mutex
+		byIface map[string]pauseState
+	}
+)
+
+func init() {
+	registerCollector("pause", "pause frame counters and flow control settings via ethtool netlink", false, startPauseCollector)
+}
+
+type pauseState struct {
+	autoneg, rx, tx    bool
+	hasStats           bool
+	rxFrames, txFrames uint64
+}
+
+// readPause dumps the pause settings and, where the driver reports them,
+// the standard pause frame counters of all interfaces
+func readPause(c *genlConn) (map[string]pauseState, error) {
+	replies, err := ethtoolDump(c, unix.ETHTOOL_MSG_PAUSE_GET, unix.ETHTOOL_A_PAUSE_HEADER, unix.ETHTOOL_FLAG_STATS)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]pauseState, len(replies))
+	for name, attrs := range replies {
+		var st pauseState
+		if v, ok := nlUint(attrs[unix.ETHTOOL_A_PAUSE_AUTONEG]); ok {
+			st.autoneg = v != 0
+		}
+		if v, ok := nlUint(attrs[unix.ETHTOOL_A_PAUSE_RX]); ok {
+			st.rx = v != 0
+		}
+		if v, ok := nlUint(attrs[unix.ETHTOOL_A_PAUSE_TX]); ok {
+			st.tx = v != 0
+		}
+		if stats, ok := attrs[unix.ETHTOOL_A_PAUSE_STATS]; ok {
+			stat := nlAttrMap(stats)
+			rx, rxOK := nlUint(stat[unix.ETHTOOL_A_PAUSE_STAT_RX_FRAMES])
+			tx, txOK := nlUint(stat[unix.ETHTOOL_A_PAUSE_STAT_TX_FRAMES])
+			st.rxFrames, st.txFrames, st.hasStats = rx, tx, rxOK || txOK
+		}
+		states[name] = st
+	}
+	return states, nil
+}
+
+// startPauseCollector starts reading the pause settings and counters
+func startPauseCollector() error {
+	c, err := dialGenetlink(unix.ETHTOOL_GENL_NAME)
+	if err != nil {
+		return err
+	}
+	registerMetrics("pause", pauseCollector{})
+	go collectPause(c)
+	return nil
+}
+
+// collectPause periodically refreshes the pause snapshot
+func collectPause(c *genlConn) {
+	for {
+		states, err := readPause(c)
+		if err != nil {
+			log.Printf("Error reading pause parameters: %v", err)
+		} else {
+			pauseSnapshot.Lock()
+			pauseSnapshot.byIface = states
+			pauseSnapshot.Unlock()
+		}
+		time.Sleep(*pauseInterval)
+	}
+}
+
+// pauseCollector exports the last pause snapshot
+type pauseCollector struct{}
+
+func (pauseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pauseFramesDesc
+	ch <- flowControlDesc
+	ch <- flowControlAutonegDesc
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (pauseCollector) Collect(ch chan<- prometheus.Metric) {
+	pauseSnapshot.Lock()
+	defer pauseSnapshot.Unlock()
+	for name, st := range pauseSnapshot.byIface {
+		ch <- prometheus.MustNewConstMetric(flowControlDesc, prometheus.GaugeValue, boolToFloat(st.rx), name, "receive")
+		ch <- prometheus.MustNewConstMetric(flowControlDesc, prometheus.GaugeValue, boolToFloat(st.tx), name, "transmit")
+		ch <- prometheus.MustNewConstMetric(flowControlAutonegDesc, prometheus.GaugeValue, boolToFloat(st.autoneg), name)
+		if st.hasStats {
+			ch <- prometheus.MustNewConstMetric(pauseFramesDesc, prometheus.CounterValue, float64(st.rxFrames), name, "receive")
+			ch <- prometheus.MustNewConstMetric(pauseFramesDesc, prometheus.CounterValue, float64(st.txFrames), name, "transmit")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pcieInterval = flag.Duration("pcie.interval", time.Minute, "How often to read the PCIe link and NUMA node of the network devices")
+
+var (
+	pcieInfoDesc = prometheus.NewDesc("network_interface_pcie_info",
+		"PCI address of the device of the interface", []string{"interface", "address"}, nil)
+	pcieLinkSpeedDesc = prometheus.NewDesc("network_interface_pcie_link_speed_transfers_per_second",
+		"Negotiated (current) and maximum (max) PCIe link speed per lane", []string{"interface", "type"}, nil)
+	pcieLinkWidthDesc = prometheus.NewDesc("network_interface_pcie_link_width",
+		"Negotiated (current) and maximum (max) number of PCIe lanes", []string{"interface", "type"}, nil)
+	pcieLinkDegradedDesc = prometheus.NewDesc("network_interface_pcie_link_degraded",
+		"Whether the PCIe link trained below the speed or width the device is capable of", []string{"interface"}, nil)
+	numaNodeDesc = prometheus.NewDesc("network_interface_numa_node",
+		"NUMA node the device of the interface is attached to", []string{"interface"}, nil)
+
+	// Result of the last sysfs read by interface
+	pcieSnapshot struct {
+		sync.Mutex
+		byIface map[string]pcieDevice
+	}
+)
+
+func init() {
+	registerCollector("pcie", "PCIe link speed and width and NUMA node of network devices from sysfs", false, startPCIeCollector)
+}
+
+// pcieDevice is the PCI device of an interface. Conventional PCI devices,
+// e.g. most virtual machine NICs, have no link attributes.
+type pcieDevice struct {
+	address                string
+	hasLink                bool
+	currentSpeed, maxSpeed float64 // transfers per second
+	currentWidth, maxWidth float64
+	numaNode               int
+}
+
+// degraded reports whether the link trained below the device's capability
+func (d pcieDevice) degraded() bool {
+	return d.currentSpeed < d.maxSpeed || d.currentWidth < d.maxWidth
+}
+
+// parseLinkSpeed parses a link speed attribute like "8.0 GT/s PCIe"
+func parseLinkSpeed(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || fields[1] != "GT/s" {
+		return 0, false // "Unknown"
+	}
+	gts, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return gts * 1e9, true
+}
+
+// pciDeviceDir returns the sysfs directory of the PCI device of an
+// interface, walking up from devices like virtio that sit below it
+func pciDeviceDir(ifaceName string) (string, bool) {
+	dir, err := filepath.EvalSymlinks(sysFilePath("class/net/" + ifaceName + "/device"))
+	if err != nil {
+		return "", false // virtual interface
+	}
+	devices := sysFilePath("devices")
+	for strings.HasPrefix(dir, devices+"/") {
+		if subsystem, err := os.Readlink(filepath.Join(dir, "subsystem")); err == nil && filepath.Base(subsystem) == "pci" {
+			return dir, true
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", false
+}
+
+// readPCIeDevice reads the PCI device of an interface
+func readPCIeDevice(ifaceName string) (pcieDevice, bool) {
+	dir, ok := pciDeviceDir(ifaceName)
+	if !ok {
+		return pcieDevice{}, false
+	}
+	attr := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return strings.TrimSpace(string(data))
+	}
+	dev := pcieDevice{address: filepath.Base(dir), numaNode: -1}
+	if node, err := strconv.Atoi(attr("numa_node")); err == nil {
+		dev.numaNode = node
+	}
+
+	currentSpeed, ok1 := parseLinkSpeed(attr("current_link_speed"))
+	maxSpeed, ok2 := parseLinkSpeed(attr("max_link_speed"))
+	currentWidth, err1 := strconv.Atoi(attr("current_link_width"))
+	maxWidth, err2 := strconv.Atoi(attr("max_link_width"))
+	if ok1 && ok2 && err1 == nil && err2 == nil {
+		dev.hasLink = true
+		dev.currentSpeed, dev.maxSpeed = currentSpeed, maxSpeed
+		dev.currentWidth, dev.maxWidth = float64(currentWidth), float64(maxWidth)
+	}
+	return dev, true
+}
+
+// startPCIeCollector starts reading the PCI devices
+func startPCIeCollector() error {
+	registerMetrics("pcie", pcieCollector{})
+	go collectPCIe()
+	return nil
+}
+
+// collectPCIe periodically reads the PCI devices of all interfaces
+func collectPCIe() {
+	for {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			log.Printf("Error listing interfaces: %v", err)
+		}
+		devices := make(map[string]pcieDevice)
+		for _, iface := range ifaces {
+			if dev, ok := readPCIeDevice(iface.Name); ok {
+				devices[iface.Name] = dev
+			}
+		}
+		pcieSnapshot.Lock()
+		pcieSnapshot.byIface = devices
+		pcieSnapshot.Unlock()
+		time.Sleep(*pcieInterval)
+	}
+}
+
+// pcieCollector exports the last PCI device reads
+type pcieCollector struct{}
+
+func (pcieCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pcieInfoDesc
+	ch <- pcieLinkSpeedDesc
+	ch <- pcieLinkWidthDesc
+	ch <- pcieLinkDegradedDesc
+	ch <- numaNodeDesc
+}
+
+func (pcieCollector) Collect(ch chan<- prometheus.Metric) {
+	pcieSnapshot.Lock()
+	defer pcieSnapshot.Unlock()
+	for name, dev := range pcieSnapshot.byIface {
+		ch <- prometheus.MustNewConstMetric(pcieInfoDesc, prometheus.GaugeValue, 1, name, dev.address)
+		// -1 on machines without NUMA
+		if dev.numaNode >= 0 {
+			ch <- prometheus.MustNewConstMetric(numaNodeDesc, prometheus.GaugeValue, float64(dev.numaNode), name)
+		}
+		if !dev.hasLink {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(pcieLinkSpeedDesc, prometheus.GaugeValue, dev.currentSpeed, name, "current")
+		ch <- prometheus.MustNewConstMetric(pcieLinkSpeedDesc, prometheus.GaugeValue, dev.maxSpeed, name, "max")
+		ch <- prometheus.MustNewConstMetric(pcieLinkWidthDesc, prometheus.GaugeValue, dev.currentWidth, name, "current")
+		ch <- prometheus.MustNewConstMetric(pcieLinkWidthDesc, prometheus.GaugeValue, dev.maxWidth, name, "max")
+		ch <- prometheus.MustNewConstMetric(pcieLinkDegradedDesc, prometheus.GaugeValue, boolToFloat(dev.degraded()), name)
+	}
+}
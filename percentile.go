@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Billing samples are the average rate over 5 minute intervals
+const percentileSampleInterval = 5 * time.Minute
+
+var (
+	percentileWindow = flag.String("percentile.window", "", "Window for 95th percentile billing: day, month (calendar, local time) or a duration such as 720h for a rolling window; empty disables")
+
+	network95thPercentile = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_95th_percentile_bits",
+			Help: "95th percentile of the 5-minute average speed over the billing window in bits per second",
+		},
+		[]string{"interface", "direction"},
+	)
+
+	// Billing samples per interface
+	percentiles = struct {
+		sync.Mutex
+		byIface map[string]*percentileState
+	}{
+		byIface: make(map[string]*percentileState),
+	}
+)
+
+func init() {
+	registerMetrics("percentile", network95thPercentile)
+}
+
+// percentileSample is the average speed of one 5 minute interval
+type percentileSample struct {
+	Time int64   `json:"t"` // unix seconds at the start of the interval
+	Rx   float64 `json:"rx"`
+	Tx   float64 `json:"tx"`
+}
+
+// percentileState tracks the open interval and the closed samples of an interface
+type percentileState struct {
+	start            time.Time
+	startRx, startTx uint64
+	samples          []percentileSample
+}
+
+// validatePercentileWindow checks the --percentile.window flag
+func validatePercentileWindow() error {
+	switch *percentileWindow {
+	case "", "day", "month":
+		return nil
+	}
+	if d, err := time.ParseDuration(*percentileWindow); err != nil || d < percentileSampleInterval {
+		return fmt.Errorf("invalid --percentile.window %q, expected day, month or a duration of at least %s", *percentileWindow, percentileSampleInterval)
+	}
+	return nil
+}
+
+// percentileWindowStart returns the oldest sample time still in the window
+func percentileWindowStart(now time.Time) time.Time {
+	now = now.Local()
+	switch *percentileWindow {
+	case "day":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	case "month":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	d, _ := time.ParseDuration(*percentileWindow)
+	return now.Add(-d)
+}
+
+// percentile95 returns the value below which 95% of the values fall, which is
+// how burstable billing discards the top 5% of samples
+func percentile95(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+}
+
+// updatePercentiles closes finished 5 minute intervals and recomputes the
+// 95th percentile of interfaces that got a new sample
+func updatePercentiles(stats []interfaceStats) {
+	if *percentileWindow == "" {
+		return
+	}
+	percentiles.Lock()
+	defer percentiles.Unlock()
+
+	for _, s := range stats {
+		interval := s.Time.Truncate(percentileSampleInterval)
+		st, ok := percentiles.byIface[s.Name]
+		if !ok {
+			st = &percentileState{}
+			percentiles.byIface[s.Name] = st
+		}
+		if st.start.IsZero() {
+			st.start, st.startRx, st.startTx = s.Time, s.RxBytes, s.TxBytes
+			continue
+		}
+		if !interval.After(st.start) {
+			continue
+		}
+
+		// The previous interval is complete: average rate between its first
+		// and this observation
+		elapsed := s.Time.Sub(st.start).Seconds()
+		st.samples = append(st.samples, percentileSample{
+			Time: st.start.Truncate(percentileSampleInterval).Unix(),
+			Rx:   float64(counterDelta(s.RxBytes, st.startRx)) * bytesToBits / elapsed,
+			Tx:   float64(counterDelta(s.TxBytes, st.startTx)) * bytesToBits / elapsed,
+		})
+		st.start, st.startRx, st.startTx = s.Time, s.RxBytes, s.TxBytes
+
+		cutoff := percentileWindowStart(s.Time).Unix()
+		for len(st.samples) > 0 && st.samples[0].Time < cutoff {
+			st.samples = st.samples[1:]
+		}
+		rx := make([]float64, len(st.samples))
+		tx := make([]float64, len(st.samples))
+		for i, sample := range st.samples {
+			rx[i], tx[i] = sample.Rx, sample.Tx
+		}
+		network95thPercentile.With(prometheus.Labels{"interface": s.Name, "direction": "receive"}).Set(percentile95(rx))
+		network95thPercentile.With(prometheus.Labels{"interface": s.Name, "direction": "transmit"}).Set(percentile95(tx))
+	}
+}
+
+// forgetPercentiles drops the billing samples of a removed interface
+func forgetPercentiles(name string) {
+	percentiles.Lock()
+	defer percentiles.Unlock()
+	delete(percentiles.byIface, name)
+	network95thPercentile.DeletePartialMatch(prometheus.Labels{"interface": name})
+}
+
+// percentileSnapshot returns a copy of the closed samples for persisting
+func percentileSnapshot() map[string][]percentileSample {
+	percentiles.Lock()
+	defer percentiles.Unlock()
+	snapshot := make(map[string][]percentileSample, len(percentiles.byIface))
+	for name, st := range percentiles.byIface {
+		if len(st.samples) > 0 {
+			snapshot[name] = append([]percentileSample(nil), st.samples...)
+		}
+	}
+	return snapshot
+}
+
+// restorePercentiles loads persisted samples; the open interval starts fresh
+func restorePercentiles(samples map[string][]percentileSample) {
+	percentiles.Lock()
+	defer percentiles.Unlock()
+	for name, s := range samples {
+		percentiles.byIface[name] = &percentileState{samples: s}
+	}
+}
@@ -0,0 +1,380 @@
+// Package netspeed measures the throughput of Linux network interfaces from
+// /proc/net/dev, the collection code behind the exporter, for embedding in
+// other programs.
+//
+//	c := netspeed.New()
+//	for {
+//		stats, err := c.Collect()
+//		...
+//		time.Sleep(time.Second)
+//	}
+package netspeed
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bytesToBits converts byte counters to the bit rates reported in InterfaceStats
+const bytesToBits = 8
+
+// Sources of the counters of an interface
+const (
+	SourceProcfs = "procfs"
+	SourceSysfs  = "sysfs"
+)
+
+// Counters are the counters of an interface from /proc/net/dev
+type Counters struct {
+	RxBytes, TxBytes     uint64
+	RxPackets, TxPackets uint64
+	RxErrors, TxErrors   uint64
+	RxDrops, TxDrops     uint64
+	// Multicast packets received; the kernel counts no transmitted ones
+	RxMulticast uint64
+}
+
+// InterfaceStats is the state of an interface at one collection
+type InterfaceStats struct {
+	Counters
+	Name        string
+	Description string
+	Index       int
+	// Speeds in bits per second, zero until two samples have been taken
+	RxSpeed, TxSpeed float64
+	HasSpeed         bool
+	// Set when the speed was left out because the collection came longer
+	// than the maximum gap after the previous one. An interface back after
+	// being absent or down for longer gets no speed either, but no Gap.
+	Gap bool
+	// When the counters were read; includes a monotonic clock reading
+	Time time.Time
+	// Where the counters were read from, SourceProcfs or SourceSysfs
+	Source string
+}
+
+// sample is the previous reading of an interface used for speed calculation
+type sample struct {
+	Counters
+	source   string
+	time     time.Time
+	lastSeen time.Time
+}
+
+// Collector computes interface speeds from successive readings of
+// /proc/net/dev. It is safe for concurrent use.
+type Collector struct {
+	procfs          string
+	sysfs           string
+	metadata        func(name string) (Metadata, error)
+	includeLoopback bool
+	includeDown     bool
+	maxGap          time.Duration
+	sysfsFallback   bool
+	workers         int
+
+	mu   sync.Mutex
+	prev map[string]sample
+	// Time of the last complete Collect, the lastSeen of the interfaces
+	// that are present
+	lastCollect time.Time
+	// Interfaces whose counters are read from sysfs
+	fallback   map[string]bool
+	scannerBuf []byte
+}
+
+// Option configures a Collector
+type Option func(*Collector)
+
+// WithProcfs sets the procfs mountpoint, /proc by default
+func WithProcfs(path string) Option {
+	return func(c *Collector) { c.procfs = path }
+}
+
+// WithSysfs sets the sysfs mountpoint used for interface metadata, /sys by default
+func WithSysfs(path string) Option {
+	return func(c *Collector) { c.sysfs = path }
+}
+
+// WithMetadataFunc replaces reading the metadata from sysfs on every
+// collection, e.g. with a cache
+func WithMetadataFunc(f func(name string) (Metadata, error)) Option {
+	return func(c *Collector) { c.metadata = f }
+}
+
+// WithLoopback includes loopback interfaces, which are skipped by default
+func WithLoopback() Option {
+	return func(c *Collector) { c.includeLoopback = true }
+}
+
+// WithDown includes interfaces that are administratively down, which are
+// skipped by default
+func WithDown() Option {
+	return func(c *Collector) { c.includeDown = true }
+}
+
+// WithMaxGap leaves out the speed of an interval longer than d, e.g. after
+// a stalled collection or a suspend, when it would be an average over the
+// whole gap rather than the current speed; InterfaceStats.Gap is set instead.
+// Zero, the default, keeps every speed.
+func WithMaxGap(d time.Duration) Option {
+	return func(c *Collector) { c.maxGap = d }
+}
+
+// WithSysfsFallback switches an interface to the counters of
+// <sysfs>/class/net/<interface>/statistics when its /proc/net/dev counters
+// look like they wrapped at 32 bits, as with drivers that keep 32-bit
+// counters in their legacy statistics
+func WithSysfsFallback() Option {
+	return func(c *Collector) { c.sysfsFallback = true }
+}
+
+// WithWorkers reads the metadata and sysfs statistics of up to n interfaces
+// at a time, so hosts with thousands of interfaces aren't slowed down by
+// one sysfs read after the other when the metadata has to be read again.
+// /proc/net/dev is still read in one pass. The default is 1.
+func WithWorkers(n int) Option {
+	return func(c *Collector) { c.workers = n }
+}
+
+// New returns a Collector
+func New(opts ...Option) *Collector {
+	c := &Collector{
+		procfs:     "/proc",
+		sysfs:      "/sys",
+		prev:       make(map[string]sample),
+		fallback:   make(map[string]bool),
+		scannerBuf: make([]byte, 0, 64*1024),
+		workers:    1,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.metadata == nil {
+		c.metadata = func(name string) (Metadata, error) { return ReadMetadata(c.sysfs, name) }
+	}
+	return c
+}
+
+// counterDelta returns how much a counter grew, treating a decrease as a
+// reset after which cur bytes were counted
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// looksWrapped reports whether a counter went down from a value in the upper
+// half of the 32-bit range, the sign of a 32-bit counter that wrapped rather
+// than of a reset
+func looksWrapped(cur, prev Counters) bool {
+	pairs := [][2]uint64{
+		{cur.RxBytes, prev.RxBytes}, {cur.TxBytes, prev.TxBytes},
+		{cur.RxPackets, prev.RxPackets}, {cur.TxPackets, prev.TxPackets},
+	}
+	for _, p := range pairs {
+		if p[0] < p[1] && p[1] > math.MaxUint32/2 && p[1] <= math.MaxUint32 {
+			return true
+		}
+	}
+	return false
+}
+
+// parallel calls f for 0 to n-1 on up to workers goroutines
+func parallel(n, workers int, f func(i int)) {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// Collect reads the counters of all interfaces and returns their stats, with
+// speeds relative to the previous Collect
+func (c *Collector) Collect() ([]InterfaceStats, error) {
+	return c.CollectContext(context.Background())
+}
+
+// CollectContext is Collect, giving up with the error of ctx when it is done
+// before all interfaces were read. Reads already under way are finished
+// first. An abandoned collection leaves no trace, the next one computes the
+// speeds relative to the last complete one.
+func (c *Collector) CollectContext(ctx context.Context) ([]InterfaceStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := readNetDev(c.procfs, c.scannerBuf)
+	if err != nil {
+		return nil, err
+	}
+	// The monotonic clock reading of now is what Sub compares, so NTP
+	// steps of the wall clock don't change the elapsed time
+	now := time.Now()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Which interfaces are read from sysfs is decided before the reads
+	wrapped := make(map[string]bool)
+	for _, e := range entries {
+		if prev, ok := c.prev[e.Name]; ok && c.sysfsFallback && !c.fallback[e.Name] && prev.source == SourceProcfs && looksWrapped(e.Counters, prev.Counters) {
+			wrapped[e.Name] = true
+		}
+	}
+
+	type reading struct {
+		meta     Metadata
+		err      error
+		counters Counters
+		source   string
+	}
+	readings := make([]reading, len(entries))
+	parallel(len(entries), c.workers, func(i int) {
+		e, r := entries[i], &readings[i]
+		r.counters, r.source = e.Counters, SourceProcfs
+		if r.err = ctx.Err(); r.err != nil {
+			return
+		}
+		if r.meta, r.err = c.metadata(e.Name); r.err != nil {
+			return
+		}
+		if c.fallback[e.Name] || wrapped[e.Name] {
+			if counters, err := ReadStatistics(c.sysfs, e.Name); err == nil {
+				r.counters, r.source = counters, SourceSysfs
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for name := range wrapped {
+		c.fallback[name] = true
+	}
+
+	// A gap of the collection itself, rather than of an interface that was
+	// absent in between
+	cycleGap := !c.lastCollect.IsZero() && IsGap(now, c.lastCollect, c.maxGap)
+	stats := make([]InterfaceStats, 0, len(entries))
+	for i, e := range entries {
+		r := readings[i]
+		if r.err != nil || (!c.includeLoopback && r.meta.IsLoopback()) || (!c.includeDown && !r.meta.IsUp()) {
+			continue
+		}
+		s := InterfaceStats{
+			Counters:    r.counters,
+			Name:        e.Name,
+			Description: r.meta.Description,
+			Index:       r.meta.Index,
+			Time:        now,
+			Source:      r.source,
+		}
+		// Speeds need both readings from the same source
+		if prev, ok := c.prev[e.Name]; ok && prev.source == s.Source {
+			if IsGap(now, prev.time, c.maxGap) {
+				s.Gap = cycleGap
+			} else {
+				s.RxSpeed, s.TxSpeed, s.HasSpeed = Speeds(s.Counters, prev.Counters, now.Sub(prev.time))
+			}
+		}
+		stats = append(stats, s)
+		c.prev[e.Name] = sample{Counters: s.Counters, source: s.Source, time: now, lastSeen: now}
+	}
+	c.lastCollect = now
+	return stats, nil
+}
+
+// IsGap reports whether the interval between two readings, taken at prev
+// and now, exceeds maxGap; zero disables the check. The monotonic clock
+// stops during a suspend, so the wall clock is checked too.
+func IsGap(now, prev time.Time, maxGap time.Duration) bool {
+	if maxGap <= 0 {
+		return false
+	}
+	return now.Sub(prev) > maxGap || now.Round(0).Sub(prev.Round(0)) > maxGap
+}
+
+// Speeds returns the receive and transmit speeds in bits per second between
+// two readings of an interface taken elapsed apart, treating a decrease of
+// the counters as a reset. It returns false if no time passed between them.
+func Speeds(cur, prev Counters, elapsed time.Duration) (rx, tx float64, ok bool) {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return 0, 0, false
+	}
+	rx = float64(counterDelta(cur.RxBytes, prev.RxBytes)) * bytesToBits / seconds
+	tx = float64(counterDelta(cur.TxBytes, prev.TxBytes)) * bytesToBits / seconds
+	return rx, tx, true
+}
+
+// Forget drops the previous reading of an interface, e.g. after it was removed
+func (c *Collector) Forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.prev, name)
+	delete(c.fallback, name)
+}
+
+// Prune drops the previous readings of interfaces not seen within maxAge and,
+// beyond max interfaces, of the least recently seen ones
+func (c *Collector) Prune(maxAge time.Duration, max int) {
+	c.prune(maxAge, max, false)
+}
+
+// PruneAbsent is Prune, except that beyond max interfaces only the ones
+// missing from the last Collect are dropped, so interfaces that are present
+// keep their speeds however many there are
+func (c *Collector) PruneAbsent(maxAge time.Duration, max int) {
+	c.prune(maxAge, max, true)
+}
+
+// prune drops the readings for Prune and PruneAbsent
+func (c *Collector) prune(maxAge time.Duration, max int, keepPresent bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for name, s := range c.prev {
+		if now.Sub(s.lastSeen) > maxAge {
+			delete(c.prev, name)
+			delete(c.fallback, name)
+		}
+	}
+
+	if len(c.prev) > max {
+		names := make([]string, 0, len(c.prev))
+		for name, s := range c.prev {
+			if !keepPresent || !s.lastSeen.Equal(c.lastCollect) {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return c.prev[names[i]].lastSeen.Before(c.prev[names[j]].lastSeen)
+		})
+		for _, name := range names[:min(len(names), len(c.prev)-max)] {
+			delete(c.prev, name)
+			delete(c.fallback, name)
+		}
+	}
+}
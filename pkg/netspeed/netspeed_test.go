@@ -0,0 +1,94 @@
+package netspeed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Interfaces of the BNG/BRAS-sized fixture
+const benchInterfaces = 10000
+
+// writeBenchFixture writes a procfs and a sysfs with n interfaces that are
+// up, and returns their mountpoints
+func writeBenchFixture(b *testing.B, n int) (procfs, sysfs string) {
+	b.Helper()
+	dir := b.TempDir()
+	procfs, sysfs = filepath.Join(dir, "proc"), filepath.Join(dir, "sys")
+	if err := os.MkdirAll(filepath.Join(procfs, "net"), 0o755); err != nil {
+		b.Fatal(err)
+	}
+
+	var netDev strings.Builder
+	netDev.WriteString("Inter-|   Receive                                                |  Transmit\n")
+	netDev.WriteString(" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n")
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("ppp%d", i)
+		fmt.Fprintf(&netDev, "%7s: %d %d 0 0 0 0 0 0 %d %d 0 0 0 0 0 0\n", name, 1000000+i, 1000+i, 2000000+i, 2000+i)
+
+		iface := filepath.Join(sysfs, "class/net", name)
+		if err := os.MkdirAll(iface, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for attr, value := range map[string]string{
+			"ifindex":   fmt.Sprint(i + 2),
+			"flags":     "0x1091", // IFF_UP|IFF_POINTOPOINT|IFF_RUNNING|IFF_MULTICAST
+			"mtu":       "1492",
+			"operstate": "unknown",
+		} {
+			if err := os.WriteFile(filepath.Join(iface, attr), []byte(value+"\n"), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(procfs, "net/dev"), []byte(netDev.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return procfs, sysfs
+}
+
+// BenchmarkCollect10kInterfaces collects 10k interfaces, with the metadata
+// cached as the exporter does and read from sysfs on every collection. The
+// cached collection has to stay well below 100ms.
+func BenchmarkCollect10kInterfaces(b *testing.B) {
+	procfs, sysfs := writeBenchFixture(b, benchInterfaces)
+
+	cache := make(map[string]Metadata, benchInterfaces)
+	for i := 0; i < benchInterfaces; i++ {
+		name := fmt.Sprintf("ppp%d", i)
+		m, err := ReadMetadata(sysfs, name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		cache[name] = m
+	}
+	cached := func(name string) (Metadata, error) { return cache[name], nil }
+
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"cached", []Option{WithMetadataFunc(cached)}},
+		{"sysfs", []Option{WithWorkers(8)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			c := New(append([]Option{WithProcfs(procfs), WithSysfs(sysfs)}, bench.opts...)...)
+			stats, err := c.Collect()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(stats) != benchInterfaces {
+				b.Fatalf("collected %d interfaces, want %d", len(stats), benchInterfaces)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Collect(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
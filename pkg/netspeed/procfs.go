@@ -0,0 +1,90 @@
+package netspeed
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Number of counter columns per interface in /proc/net/dev
+const netDevColumns = 16
+
+// netDevEntry is an interface line of /proc/net/dev
+type netDevEntry struct {
+	Name string
+	Counters
+}
+
+// ParseNetDevLine parses an interface line of /proc/net/dev. The fields are
+// sliced out of line in place and parsed with strconv, so apart from the
+// line itself nothing is allocated. Long interface names aren't followed by
+// a space, so the name is split off at the colon rather than by whitespace.
+func ParseNetDevLine(line string) (string, Counters, bool) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", Counters{}, false
+	}
+	name = strings.TrimSpace(name)
+
+	var fields [netDevColumns]uint64
+	n := 0
+	for i := 0; i < len(rest) && n < netDevColumns; {
+		if rest[i] == ' ' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(rest) && rest[i] != ' ' {
+			i++
+		}
+		v, err := strconv.ParseUint(rest[start:i], 10, 64)
+		if err != nil {
+			return "", Counters{}, false
+		}
+		fields[n] = v
+		n++
+	}
+	if n < netDevColumns {
+		return "", Counters{}, false
+	}
+
+	return name, Counters{
+		RxBytes:     fields[0],
+		RxPackets:   fields[1],
+		RxErrors:    fields[2],
+		RxDrops:     fields[3],
+		RxMulticast: fields[7],
+		TxBytes:     fields[8],
+		TxPackets:   fields[9],
+		TxErrors:    fields[10],
+		TxDrops:     fields[11],
+	}, true
+}
+
+// readNetDev reads the counters of all interfaces from <procfs>/net/dev,
+// using scannerBuf as the line buffer
+func readNetDev(procfs string, scannerBuf []byte) ([]netDevEntry, error) {
+	file, err := os.Open(filepath.Join(procfs, "net/dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(scannerBuf, 1024*1024) // Set max token size to 1MB
+
+	// Skip header lines
+	scanner.Scan()
+	scanner.Scan()
+
+	var entries []netDevEntry
+	for scanner.Scan() {
+		name, counters, ok := ParseNetDevLine(scanner.Text())
+		if ok {
+			entries = append(entries, netDevEntry{Name: name, Counters: counters})
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,53 @@
+package netspeed
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A /proc/net/dev line of a busy interface, every counter in use
+const benchNetDevLine = "  eth0: 98765432101234 87654321012 12345 6789 0 0 0 4321 123456789012345 98765432109 54321 9876 0 0 0 0"
+
+// sscanfNetDevLine is the fmt.Sscanf parser ParseNetDevLine replaced, kept as
+// the baseline of the benchmarks
+func sscanfNetDevLine(line string) (string, Counters, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < netDevColumns+1 {
+		return "", Counters{}, false
+	}
+	var c Counters
+	fmt.Sscanf(fields[1], "%d", &c.RxBytes)
+	fmt.Sscanf(fields[2], "%d", &c.RxPackets)
+	fmt.Sscanf(fields[3], "%d", &c.RxErrors)
+	fmt.Sscanf(fields[4], "%d", &c.RxDrops)
+	fmt.Sscanf(fields[8], "%d", &c.RxMulticast)
+	fmt.Sscanf(fields[9], "%d", &c.TxBytes)
+	fmt.Sscanf(fields[10], "%d", &c.TxPackets)
+	fmt.Sscanf(fields[11], "%d", &c.TxErrors)
+	fmt.Sscanf(fields[12], "%d", &c.TxDrops)
+	return strings.TrimSuffix(fields[0], ":"), c, true
+}
+
+func BenchmarkParseNetDevLine(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		parse func(string) (string, Counters, bool)
+	}{
+		{"strconv", ParseNetDevLine},
+		{"sscanf", sscanfNetDevLine},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			name, counters, ok := bench.parse(benchNetDevLine)
+			wantName, wantCounters, _ := ParseNetDevLine(benchNetDevLine)
+			if !ok || name != wantName || counters != wantCounters {
+				b.Fatalf("parsed %q %+v, want %q %+v", name, counters, wantName, wantCounters)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bench.parse(benchNetDevLine)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package netspeed
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Metadata is the slowly changing sysfs state of an interface
+type Metadata struct {
+	Index       int
+	Flags       uint32 // IFF_* flags
+	Description string // ifalias, "Unknown" if unreadable
+	MTU         int
+	OperState   string
+	// Negotiated link speed in bits per second, zero when unknown
+	LinkSpeed uint64
+}
+
+// IsUp reports whether the interface is administratively up
+func (m Metadata) IsUp() bool { return m.Flags&unix.IFF_UP != 0 }
+
+// IsLoopback reports whether the interface is a loopback interface
+func (m Metadata) IsLoopback() bool { return m.Flags&unix.IFF_LOOPBACK != 0 }
+
+// readAttr reads <sysfs>/class/net/<interface>/<attr>
+func readAttr(sysfs, ifaceName, attr string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysfs, "class/net", ifaceName, attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ReadMetadata reads the metadata of an interface from the sysfs mounted at sysfs
+func ReadMetadata(sysfs, ifaceName string) (Metadata, error) {
+	var m Metadata
+	index, err := readAttr(sysfs, ifaceName, "ifindex")
+	if err != nil {
+		return m, err
+	}
+	if m.Index, err = strconv.Atoi(index); err != nil {
+		return m, err
+	}
+	flags, err := readAttr(sysfs, ifaceName, "flags")
+	if err != nil {
+		return m, err
+	}
+	f, err := strconv.ParseUint(flags, 0, 32)
+	if err != nil {
+		return m, err
+	}
+	m.Flags = uint32(f)
+
+	if mtu, err := readAttr(sysfs, ifaceName, "mtu"); err == nil {
+		m.MTU, _ = strconv.Atoi(mtu)
+	}
+	m.OperState = "unknown"
+	if state, err := readAttr(sysfs, ifaceName, "operstate"); err == nil {
+		m.OperState = state
+	}
+
+	m.Description = "Unknown"
+	if alias, err := readAttr(sysfs, ifaceName, "ifalias"); err == nil {
+		m.Description = alias
+	}
+	// Reading speed fails on interfaces without a carrier or a fixed speed
+	if speed, err := readAttr(sysfs, ifaceName, "speed"); err == nil {
+		if mbps, err := strconv.ParseInt(speed, 10, 64); err == nil && mbps > 0 {
+			m.LinkSpeed = uint64(mbps) * 1000000
+		}
+	}
+	return m, nil
+}
+
+// ReadStatistics reads the counters of an interface from
+// <sysfs>/class/net/<interface>/statistics
+func ReadStatistics(sysfs, ifaceName string) (Counters, error) {
+	var c Counters
+	for _, f := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"rx_bytes", &c.RxBytes}, {"tx_bytes", &c.TxBytes},
+		{"rx_packets", &c.RxPackets}, {"tx_packets", &c.TxPackets},
+		{"rx_errors", &c.RxErrors}, {"tx_errors", &c.TxErrors},
+		{"rx_dropped", &c.RxDrops}, {"tx_dropped", &c.TxDrops},
+		{"multicast", &c.RxMulticast},
+	} {
+		value, err := readAttr(sysfs, ifaceName, "statistics/"+f.name)
+		if err != nil {
+			return c, err
+		}
+		if *f.value, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	pppInterval = flag.Duration("ppp.interval", 15*time.Second, "How often to refresh the PPP session metadata")
+	pppAccelCLI = flag.String("ppp.accel-cli", "", "Address (host:port) of the accel-ppp TCP CLI to read session usernames and calling station IDs from, e.g. 127.0.0.1:2001")
+
+	networkPPPSessionInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_ppp_session_info",
+			Help: "Peer address and, with accel-ppp, username, calling station ID and type of the PPP session of the interface",
+		},
+		[]string{"interface", "peer", "username", "calling_station", "type"},
+	)
+
+	// Sessions by interface name as of the last refresh
+	pppSessions = struct {
+		sync.Mutex
+		byIface map[string]pppSession
+	}{
+		byIface: make(map[string]pppSession),
+	}
+)
+
+// ARPHRD_PPP, the type of PPP interfaces in sysfs
+const arphrdPPP = "512"
+
+func init() {
+	registerCollector("ppp", "PPP/PPPoE session metadata from the interfaces and accel-ppp", false, startPPPCollector)
+}
+
+type pppSession struct {
+	peer, username, callingStation, sessionType string
+}
+
+// readPeerAddresses dumps the addresses and returns the peer address of
+// each point-to-point interface by index
+func readPeerAddresses(c *netlinkConn) (map[uint32]string, error) {
+	// struct ifaddrmsg: family, prefixlen, flags, scope, index
+	req := make([]byte, unix.SizeofIfAddrmsg)
+	req[0] = unix.AF_UNSPEC
+	replies, err := c.execute(unix.RTM_GETADDR, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[uint32]string)
+	for _, reply := range replies {
+		if len(reply) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		index := binary.NativeEndian.Uint32(reply[4:8])
+		attrs := nlAttrMap(reply[unix.SizeofIfAddrmsg:])
+		// On point-to-point links IFA_ADDRESS is the peer, IFA_LOCAL our end
+		local, lok := netip.AddrFromSlice(attrs[unix.IFA_LOCAL])
+		peer, pok := netip.AddrFromSlice(attrs[unix.IFA_ADDRESS])
+		if lok && pok && local != peer {
+			if _, ok := peers[index]; !ok || peer.Is4() {
+				peers[index] = peer.String()
+			}
+		}
+	}
+	return peers, nil
+}
+
+// readAccelSessions asks the accel-ppp CLI for the sessions by interface name
+func readAccelSessions(address string) (map[string]pppSession, error) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := fmt.Fprint(conn, "show sessions ifname,username,calling-sid,type\r\nexit\r\n"); err != nil {
+		return nil, err
+	}
+	return parseAccelSessions(bufio.NewScanner(conn))
+}
+
+// parseAccelSessions parses the table printed by show sessions:
+//
+//	 ifname | username | calling-sid       | type
+//	--------+----------+-------------------+-------
+//	 ppp0   | alice    | 00:11:22:33:44:55 | pppoe
+func parseAccelSessions(scanner *bufio.Scanner) (map[string]pppSession, error) {
+	sessions := make(map[string]pppSession)
+	var columns []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "|") || strings.HasPrefix(strings.TrimSpace(line), "-") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if columns == nil {
+			columns = fields
+			continue
+		}
+		row := make(map[string]string, len(columns))
+		for i, c := range columns {
+			if i < len(fields) {
+				row[c] = fields[i]
+			}
+		}
+		if row["ifname"] != "" {
+			sessions[row["ifname"]] = pppSession{
+				username:       row["username"],
+				callingStation: row["calling-sid"],
+				sessionType:    row["type"],
+			}
+		}
+	}
+	return sessions, scanner.Err()
+}
+
+// readPPPSessions finds the PPP interfaces and their session metadata
+func readPPPSessions(c *netlinkConn) (map[string]pppSession, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := readPeerAddresses(c)
+	if err != nil {
+		return nil, err
+	}
+	var accel map[string]pppSession
+	if *pppAccelCLI != "" {
+		if accel, err = readAccelSessions(*pppAccelCLI); err != nil {
+			log.Printf("Error reading sessions from accel-ppp at %s: %v", *pppAccelCLI, err)
+		}
+	}
+	sessions := make(map[string]pppSession)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagPointToPoint == 0 {
+			continue
+		}
+		if t, err := readSysfsAttr(iface.Name, "type"); err != nil || t != arphrdPPP {
+			continue
+		}
+		s := accel[iface.Name]
+		s.peer = peers[uint32(iface.Index)]
+		sessions[iface.Name] = s
+	}
+	return sessions, nil
+}
+
+// startPPPCollector starts refreshing the PPP session metadata
+func startPPPCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("ppp", networkPPPSessionInfo)
+	go collectPPPSessions(c)
+	return nil
+}
+
+// collectPPPSessions periodically refreshes the session info series. Ended
+// sessions are removed right away by forgetPPPSession on the link removal.
+func collectPPPSessions(c *netlinkConn) {
+	for {
+		sessions, err := readPPPSessions(c)
+		if err != nil {
+			log.Printf("Error reading PPP sessions: %v", err)
+		} else {
+			pppSessions.Lock()
+			for name, old := range pppSessions.byIface {
+				if s, ok := sessions[name]; !ok || s != old {
+					networkPPPSessionInfo.DeletePartialMatch(prometheus.Labels{"interface": name})
+				}
+			}
+			for name, s := range sessions {
+				networkPPPSessionInfo.WithLabelValues(name, s.peer, s.username, s.callingStation, s.sessionType).Set(1)
+			}
+			pppSessions.byIface = sessions
+			pppSessions.Unlock()
+		}
+		time.Sleep(*pppInterval)
+	}
+}
+
+// forgetPPPSession drops the session info of a removed interface
+func forgetPPPSession(name string) {
+	pppSessions.Lock()
+	defer pppSessions.Unlock()
+	if _, ok := pppSessions.byIface[name]; ok {
+		delete(pppSessions.byIface, name)
+		networkPPPSessionInfo.DeletePartialMatch(prometheus.Labels{"interface": name})
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/pprof"
+)
+
+var enablePprof = flag.Bool("web.enable-pprof", false, "Serve Go profiling data on /debug/pprof/, subject to the IP whitelist")
+
+// registerPprof serves the profiles of net/http/pprof behind the IP whitelist
+func registerPprof(mux *http.ServeMux) {
+	mux.Handle("/debug/pprof/", withIPWhitelist(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", withIPWhitelist(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", withIPWhitelist(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", withIPWhitelist(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", withIPWhitelist(http.HandlerFunc(pprof.Trace)))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	runAsUser  = flag.String("runas.user", "", "User to switch to after binding the port, keeping only the capabilities of the enabled collectors")
+	runAsGroup = flag.String("runas.group", "", "Group to switch to with --runas.user, the user's primary group by default")
+)
+
+// capability is a Linux capability needed by a collector
+type capability struct {
+	name string
+	bit  uint
+}
+
+var (
+	capNetAdmin = capability{"CAP_NET_ADMIN", unix.CAP_NET_ADMIN}
+	capBPF      = capability{"CAP_BPF", unix.CAP_BPF}
+	capNetRaw   = capability{"CAP_NET_RAW", unix.CAP_NET_RAW}
+	// Files such as /proc/net/nf_conntrack are only readable by root
+	capDACReadSearch = capability{"CAP_DAC_READ_SEARCH", unix.CAP_DAC_READ_SEARCH}
+	// Entering the network namespaces of other processes
+	capSysAdmin  = capability{"CAP_SYS_ADMIN", unix.CAP_SYS_ADMIN}
+	capSysPtrace = capability{"CAP_SYS_PTRACE", unix.CAP_SYS_PTRACE}
+)
+
+func formatCapabilities(caps []capability) string {
+	names := make([]string, len(caps))
+	for i, c := range caps {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// capabilitySets returns the effective and permitted capabilities of the process
+func capabilitySets() (effective, permitted uint64, err error) {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return 0, 0, err
+	}
+	effective = uint64(data[1].Effective)<<32 | uint64(data[0].Effective)
+	permitted = uint64(data[1].Permitted)<<32 | uint64(data[0].Permitted)
+	return effective, permitted, nil
+}
+
+// missingCapabilities returns the capabilities of caps the process doesn't have
+func missingCapabilities(caps []capability) []capability {
+	effective, _, err := capabilitySets()
+	if err != nil {
+		return caps
+	}
+	var missing []capability
+	for _, c := range caps {
+		if effective&(1<<c.bit) == 0 {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// requiredCapabilities returns the capabilities needed by the enabled collectors
+func requiredCapabilities() []capability {
+	seen := make(map[uint]bool)
+	var caps []capability
+	add := func(c capability) {
+		if !seen[c.bit] {
+			seen[c.bit] = true
+			caps = append(caps, c)
+		}
+	}
+	for _, c := range enabledCollectors() {
+		for _, cap := range c.capabilities {
+			add(cap)
+		}
+	}
+	// NetFlow export reads the conntrack table too
+	if *netflowCollector != "" {
+		add(capNetAdmin)
+		add(capDACReadSearch)
+	}
+	if *netnsProbe {
+		for _, c := range netnsProbeCapabilities {
+			add(c)
+		}
+	}
+	return caps
+}
+
+// lookupRunAs resolves --runas.user and --runas.group to ids
+func lookupRunAs() (uid, gid int, err error) {
+	u, err := user.Lookup(*runAsUser)
+	if err != nil {
+		if u, err = user.LookupId(*runAsUser); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %s", *runAsUser)
+		}
+	}
+	group := u.Gid
+	if *runAsGroup != "" {
+		g, err := user.LookupGroup(*runAsGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(*runAsGroup); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %s", *runAsGroup)
+			}
+		}
+		group = g.Gid
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(group); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// allThreads runs a syscall on every thread of the process, since
+// capabilities and the keep-capabilities flag are per thread
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("keeping capabilities requires a build with CGO_ENABLED=0")
+		}
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges switches to --runas.user and --runas.group, keeping only
+// the given capabilities of those the process has, and verifies the result
+func dropPrivileges(keep []capability) error {
+	uid, gid, err := lookupRunAs()
+	if err != nil {
+		return err
+	}
+
+	_, permitted, err := capabilitySets()
+	if err != nil {
+		return err
+	}
+	var mask uint64
+	var kept []capability
+	for _, c := range keep {
+		if permitted&(1<<c.bit) != 0 {
+			mask |= 1 << c.bit
+			kept = append(kept, c)
+		}
+	}
+
+	if mask != 0 {
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+
+	// The switch away from root cleared the effective set; raise the kept
+	// capabilities again and drop the rest of the permitted set
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{
+		{Effective: uint32(mask), Permitted: uint32(mask)},
+		{Effective: uint32(mask >> 32), Permitted: uint32(mask >> 32)},
+	}
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+
+	// Verify nothing more than the kept capabilities survived
+	effective, permitted, err := capabilitySets()
+	if err != nil {
+		return err
+	}
+	if effective != mask || permitted != mask {
+		return fmt.Errorf("capabilities %#x remain after dropping privileges, expected %#x", permitted, mask)
+	}
+	if syscall.Getuid() != uid || syscall.Geteuid() != uid || syscall.Getgid() != gid {
+		return fmt.Errorf("still running as uid %d gid %d", syscall.Geteuid(), syscall.Getegid())
+	}
+
+	if len(kept) == 0 {
+		log.Printf("Running as uid %d gid %d without capabilities", uid, gid)
+	} else {
+		log.Printf("Running as uid %d gid %d with %s", uid, gid, formatCapabilities(kept))
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	probeTargets  = flag.String("probe.targets", "", "Comma-separated probe targets as [icmp:|udp:]host[:port][@interface], e.g. gateway@eth0,udp:1.1.1.1:53@eth0; gateway is the IPv4 default gateway")
+	probeInterval = flag.Duration("probe.interval", time.Second, "How often to probe each target")
+	probeTimeout  = flag.Duration("probe.timeout", time.Second, "How long to wait for a reply before counting a probe as lost, at most --probe.interval")
+	probeWindow   = flag.Int("probe.window", 100, "Number of most recent probes the loss ratio is computed over")
+)
+
+// How often host names are resolved again
+const probeResolveInterval = 5 * time.Minute
+
+// Upper bounds of the RTT histogram buckets in seconds
+var probeBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+var (
+	probeRTTDesc = prometheus.NewDesc("network_probe_rtt_seconds",
+		"Round-trip time of the answered probes of the target", []string{"target", "protocol", "interface"}, nil)
+	probeSentDesc = prometheus.NewDesc("network_probe_sent_total",
+		"Probes sent to the target", []string{"target", "protocol", "interface"}, nil)
+	probeReceivedDesc = prometheus.NewDesc("network_probe_received_total",
+		"Probes of the target answered within --probe.timeout", []string{"target", "protocol", "interface"}, nil)
+	probeLossDesc = prometheus.NewDesc("network_probe_loss_ratio",
+		"Share of the last --probe.window probes of the target that were not answered", []string{"target", "protocol", "interface"}, nil)
+
+	// State of the probers, in --probe.targets order
+	probeSnapshot struct {
+		sync.Mutex
+		probers []*prober
+	}
+)
+
+func init() {
+	registerCollector("probe", "ICMP and UDP latency and packet loss probes to a list of targets", false, startProbeCollector).
+		requires(capNetRaw).
+		checks(checkProbeFlags)
+}
+
+// probeTarget is one entry of --probe.targets
+type probeTarget struct {
+	spec, protocol, host, iface string
+	port                        int
+}
+
+// parseProbeTargets parses --probe.targets
+func parseProbeTargets(value string) ([]probeTarget, error) {
+	var targets []probeTarget
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		t := probeTarget{protocol: "icmp"}
+		rest := field
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			rest, t.iface = rest[:i], rest[i+1:]
+		}
+		if p, host, ok := strings.Cut(rest, ":"); ok && (p == "icmp" || p == "udp") {
+			t.protocol, rest = p, host
+		}
+		t.spec = rest
+		switch t.protocol {
+		case "udp":
+			t.host, t.port = rest, 53
+			if host, port, err := net.SplitHostPort(rest); err == nil {
+				n, err := strconv.Atoi(port)
+				if err != nil || n <= 0 || n > 65535 {
+					return nil, fmt.Errorf("invalid port in %q", field)
+				}
+				t.host, t.port = host, n
+			} else {
+				t.spec = net.JoinHostPort(rest, "53")
+			}
+		default:
+			t.host = strings.TrimSuffix(strings.TrimPrefix(rest, "["), "]")
+		}
+		if t.host == "" {
+			return nil, fmt.Errorf("missing host in %q", field)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	return targets, nil
+}
+
+// defaultGateway returns the IPv4 default gateway, of the interface if given
+func defaultGateway(iface string) (net.IP, error) {
+	f, err := os.Open(procFilePath("net/route"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses as little-endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		if iface != "" && fields[0] != iface {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		return binary.LittleEndian.AppendUint32(nil, uint32(gw)), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway")
+}
+
+// resolve returns the address of the target
+func (t probeTarget) resolve() (net.IP, error) {
+	if t.host == "gateway" {
+		return defaultGateway(t.iface)
+	}
+	addr, err := net.ResolveIPAddr("ip", t.host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// prober probes one target and keeps its statistics, guarded by the
+// snapshot lock
+type prober struct {
+	target         probeTarget
+	sent, received uint64
+	buckets        []uint64
+	rttSum         float64
+	// Whether each of the last --probe.window probes was answered
+	recent []bool
+	next   int
+}
+
+// record adds the result of a probe
+func (p *prober) record(rtt time.Duration, answered bool) {
+	probeSnapshot.Lock()
+	defer probeSnapshot.Unlock()
+	p.sent++
+	if answered {
+		p.received++
+		p.rttSum += rtt.Seconds()
+		for i, bound := range probeBuckets {
+			if rtt.Seconds() <= bound {
+				p.buckets[i]++
+			}
+		}
+	}
+	if len(p.recent) < *probeWindow {
+		p.recent = append(p.recent, answered)
+	} else {
+		p.recent[p.next] = answered
+		p.next = (p.next + 1) % len(p.recent)
+	}
+}
+
+// lossRatio returns the share of recent probes that were lost
+func (p *prober) lossRatio() float64 {
+	if len(p.recent) == 0 {
+		return 0
+	}
+	lost := 0
+	for _, answered := range p.recent {
+		if !answered {
+			lost++
+		}
+	}
+	return float64(lost) / float64(len(p.recent))
+}
+
+// probeSocket opens the socket for probes to addr, bound to the interface
+// of the target if any
+func probeSocket(t probeTarget, addr net.IP) (int, error) {
+	family, typ, proto := unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP
+	if addr.To4() == nil {
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+	if t.protocol == "udp" {
+		typ, proto = unix.SOCK_DGRAM, unix.IPPROTO_UDP
+	}
+	fd, err := unix.Socket(family, typ|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return -1, err
+	}
+	if t.iface != "" {
+		if err := unix.BindToDevice(fd, t.iface); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("binding to %s: %w", t.iface, err)
+		}
+	}
+	if err := unix.Connect(fd, probeSockaddr(addr, t.port)); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func probeSockaddr(addr net.IP, port int) unix.Sockaddr {
+	if ip4 := addr.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], addr.To16())
+	return sa
+}
+
+// icmpChecksum computes the internet checksum of an ICMPv4 message
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// probeRequest builds the probe with the identifier and sequence number: an
+// ICMP echo request, or for UDP a DNS query for the root name servers, which
+// DNS servers answer and other services at least refuse.
+func probeRequest(t probeTarget, ipv4 bool, id, seq uint16) []byte {
+	if t.protocol == "udp" {
+		b := binary.BigEndian.AppendUint16(nil, seq)
+		// Flags, one question, no other records, the root name, type NS, class IN
+		return append(b, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1)
+	}
+	typ := byte(128)
+	if ipv4 {
+		typ = 8
+	}
+	b := []byte{typ, 0, 0, 0}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, seq)
+	b = append(b, "networkspeed"...)
+	if ipv4 {
+		// The kernel computes the checksum of ICMPv6 itself
+		binary.BigEndian.PutUint16(b[2:], icmpChecksum(b))
+	}
+	return b
+}
+
+// isProbeReply reports whether a received packet answers the probe. Raw
+// ICMPv4 sockets receive the IP header too, and every ICMP message to the
+// host, not only those of the connected peer.
+func isProbeReply(t probeTarget, ipv4 bool, b []byte, id, seq uint16) bool {
+	if t.protocol == "udp" {
+		return len(b) >= 2 && binary.BigEndian.Uint16(b) == seq
+	}
+	typ := byte(129)
+	if ipv4 {
+		if len(b) < 20 {
+			return false
+		}
+		b, typ = b[int(b[0]&0xf)*4:], 0
+	}
+	return len(b) >= 8 && b[0] == typ && binary.BigEndian.Uint16(b[4:]) == id && binary.BigEndian.Uint16(b[6:]) == seq
+}
+
+// probe sends one probe and waits for the reply until the timeout
+func probe(fd int, t probeTarget, ipv4 bool, id, seq uint16) (time.Duration, bool, error) {
+	start := time.Now()
+	if _, err := unix.Write(fd, probeRequest(t, ipv4, id, seq)); err != nil {
+		return 0, false, err
+	}
+	buf := make([]byte, 1500)
+	deadline := start.Add(*probeTimeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, false, nil
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return 0, false, err
+		}
+		n, err := unix.Read(fd, buf)
+		switch {
+		case err == unix.EAGAIN || err == unix.EINTR:
+			continue
+		case err == unix.ECONNREFUSED:
+			// An ICMP port unreachable answers a UDP probe as well
+			return time.Since(start), true, nil
+		case err != nil:
+			return 0, false, err
+		}
+		if isProbeReply(t, ipv4, buf[:n], id, seq) {
+			return time.Since(start), true, nil
+		}
+	}
+}
+
+// run probes the target every --probe.interval, whether or not the last
+// probe was answered
+func (p *prober) run(id uint16) {
+	var (
+		fd       = -1
+		addr     net.IP
+		resolved time.Time
+		seq      uint16
+	)
+	ticker := time.NewTicker(*probeInterval)
+	for ; ; <-ticker.C {
+		if fd < 0 || time.Since(resolved) > probeResolveInterval {
+			current, err := p.target.resolve()
+			if err != nil {
+				log.Printf("Error resolving probe target %s: %v", p.target.spec, err)
+				p.record(0, false)
+				continue
+			}
+			if fd >= 0 && !current.Equal(addr) {
+				unix.Close(fd)
+				fd = -1
+			}
+			addr, resolved = current, time.Now()
+		}
+		if fd < 0 {
+			var err error
+			if fd, err = probeSocket(p.target, addr); err != nil {
+				log.Printf("Error opening probe socket for %s: %v", p.target.spec, err)
+				p.record(0, false)
+				continue
+			}
+		}
+		seq++
+		rtt, answered, err := probe(fd, p.target, addr.To4() != nil, id, seq)
+		if err != nil {
+			// e.g. the interface is down or there is no route, a lost probe
+			log.Printf("Error probing %s: %v", p.target.spec, err)
+			unix.Close(fd)
+			fd = -1
+		}
+		p.record(rtt, answered)
+	}
+}
+
+// checkProbeFlags validates the targets and timing of the probes
+func checkProbeFlags() error {
+	if _, err := parseProbeTargets(*probeTargets); err != nil {
+		return fmt.Errorf("invalid --probe.targets: %w", err)
+	}
+	if *probeInterval <= 0 || *probeTimeout <= 0 || *probeTimeout > *probeInterval {
+		return errors.New("--probe.timeout must be positive and at most --probe.interval")
+	}
+	if *probeWindow <= 0 {
+		return errors.New("--probe.window must be positive")
+	}
+	return nil
+}
+
+// startProbeCollector starts probing the targets
+func startProbeCollector() error {
+	targets, err := parseProbeTargets(*probeTargets)
+	if err != nil {
+		return fmt.Errorf("invalid --probe.targets: %w", err)
+	}
+	// Raw ICMP sockets see the replies of all probers, told apart by identifier
+	base := uint16(os.Getpid())
+	for i, t := range targets {
+		p := &prober{target: t, buckets: make([]uint64, len(probeBuckets))}
+		probeSnapshot.probers = append(probeSnapshot.probers, p)
+		go p.run(base + uint16(i))
+	}
+	registerMetrics("probe", probeCollector{})
+	return nil
+}
+
+// probeCollector exports the prober statistics
+type probeCollector struct{}
+
+func (probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeRTTDesc
+	ch <- probeSentDesc
+	ch <- probeReceivedDesc
+	ch <- probeLossDesc
+}
+
+func (probeCollector) Collect(ch chan<- prometheus.Metric) {
+	probeSnapshot.Lock()
+	defer probeSnapshot.Unlock()
+	for _, p := range probeSnapshot.probers {
+		labels := []string{p.target.spec, p.target.protocol, p.target.iface}
+		buckets := make(map[float64]uint64, len(probeBuckets))
+		for i, bound := range probeBuckets {
+			buckets[bound] = p.buckets[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(probeRTTDesc, p.received, p.rttSum, buckets, labels...)
+		ch <- prometheus.MustNewConstMetric(probeSentDesc, prometheus.CounterValue, float64(p.sent), labels...)
+		ch <- prometheus.MustNewConstMetric(probeReceivedDesc, prometheus.CounterValue, float64(p.received), labels...)
+		ch <- prometheus.MustNewConstMetric(probeLossDesc, prometheus.GaugeValue, p.lossRatio(), labels...)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	protocolInterval   = flag.Duration("protocol.interval", 5*time.Second, "How often to read the per-protocol counters and compute the per-protocol speeds")
+	protocolInterfaces = flag.String("protocol.interfaces", ".*", "Regular expression of interfaces to attach the per-protocol classifier to")
+	protocolPorts      = flag.String("protocol.ports", "", "Comma-separated TCP/UDP ports to break the TCP and UDP traffic down by, e.g. 22,53,443; at most 16")
+)
+
+// Traffic classes of the classifier, in map key order
+const (
+	protocolTCP = iota
+	protocolUDP
+	protocolICMP
+	protocolOther
+	protocolClasses
+)
+
+var protocolNames = []string{"tcp", "udp", "icmp", "other"}
+
+// Limit of --protocol.ports, bounding the label cardinality and program size
+const protocolMaxPorts = 16
+
+var (
+	protocolSpeedDesc = prometheus.NewDesc("network_interface_protocol_speed_bits",
+		"Speed of the traffic of the interface by IP protocol and, with --protocol.ports, TCP/UDP port in bits per second", []string{"interface", "protocol", "port", "direction"}, nil)
+	protocolBytesDesc = prometheus.NewDesc("network_interface_protocol_bytes_total",
+		"Bytes of the interface by IP protocol and TCP/UDP port since the classifier was attached", []string{"interface", "protocol", "port", "direction"}, nil)
+	protocolPacketsDesc = prometheus.NewDesc("network_interface_protocol_packets_total",
+		"Packets of the interface by IP protocol and TCP/UDP port since the classifier was attached", []string{"interface", "protocol", "port", "direction"}, nil)
+
+	// Classifier counters and speeds of the last read by interface
+	protocolSnapshot struct {
+		sync.Mutex
+		byIface map[string][]protocolCounter
+	}
+)
+
+func init() {
+	registerCollector("protocol", "per-protocol and per-port speeds via eBPF socket filters", false, startProtocolCollector).
+		requires(capBPF, capNetRaw).
+		checks(checkProtocolFlags)
+}
+
+type protocolCounter struct {
+	protocol, port, direction string
+	bytes, packets            uint64
+	speed                     float64
+}
+
+// parseProtocolPorts parses --protocol.ports
+func parseProtocolPorts(value string) ([]uint16, error) {
+	var ports []uint16
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		ports = append(ports, uint16(port))
+	}
+	if len(ports) > protocolMaxPorts {
+		return nil, fmt.Errorf("at most %d ports are supported", protocolMaxPorts)
+	}
+	return ports, nil
+}
+
+// protocolProgram classifies each packet the packet socket sees by
+// direction, IP protocol and, for unfragmented TCP and UDP, the first port
+// in the list that matches the destination or else the source port. It adds
+// the length and a packet to the map at
+//
+//	(class * (len(ports)+1) + port index) * 4 + direction * 2 + {0 bytes, 1 packets}
+//
+// with the port index len(ports) for no match, and returns 0 so no packet
+// is ever queued to the socket.
+func protocolProgram(mapFd int, ports []uint16) []bpfInsn {
+	stride := int32(len(ports)+1) * 4
+	a := &bpfAsm{}
+	a.emit(
+		insn(bpfMov64Reg, bpfR6, bpfR1, 0, 0),
+		insn(bpfLdxMemW, bpfR7, bpfR6, 0, 0), // r7 = skb->len
+		insn(bpfMov64Imm, bpfR8, 0, 0, 0),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 4, 0), // r2 = skb->pkt_type
+		insn(bpfJneImm, bpfR2, 0, 1, unix.PACKET_OUTGOING),
+		insn(bpfMov64Imm, bpfR8, 0, 0, 2),
+		insn(bpfMov64Imm, bpfR9, 0, 0, protocolOther*stride),
+		insn(bpfLdxMemW, bpfR2, bpfR6, 16, 0), // r2 = skb->protocol
+	)
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IP)), "ipv4")
+	a.jump(bpfJeqImm, bpfR2, int32(htons(unix.ETH_P_IPV6)), "ipv6")
+	a.jump(bpfJa, 0, 0, "noport")
+
+	// Packet sockets of type SOCK_DGRAM see the packet from the network
+	// header on. The fragment offset goes to r10-8, the transport header
+	// offset to r10-12 and the protocol to r0.
+	a.label("ipv4")
+	a.emit(
+		insn(bpfLdAbsH, 0, 0, 0, 6),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0x1fff),
+		insn(bpfStxMemW, bpfR10, bpfR0, -8, 0),
+		insn(bpfLdAbsB, 0, 0, 0, 0),
+		insn(bpfAnd64Imm, bpfR0, 0, 0, 0xf),
+		insn(bpfLsh64Imm, bpfR0, 0, 0, 2),
+		insn(bpfStxMemW, bpfR10, bpfR0, -12, 0),
+		insn(bpfLdAbsB, 0, 0, 0, 9),
+	)
+	a.jump(bpfJa, 0, 0, "protocol")
+	// Extension headers are not followed, such packets count as other
+	a.label("ipv6")
+	a.emit(
+		insn(bpfStMemW, bpfR10, 0, -8, 0),
+		insn(bpfStMemW, bpfR10, 0, -12, 40),
+		insn(bpfLdAbsB, 0, 0, 0, 6),
+	)
+
+	a.label("protocol")
+	a.jump(bpfJeqImm, bpfR0, unix.IPPROTO_TCP, "tcp")
+	a.jump(bpfJeqImm, bpfR0, unix.IPPROTO_UDP, "udp")
+	a.jump(bpfJeqImm, bpfR0, unix.IPPROTO_ICMP, "icmp")
+	a.jump(bpfJeqImm, bpfR0, unix.IPPROTO_ICMPV6, "icmp")
+	a.jump(bpfJa, 0, 0, "noport")
+	a.label("tcp")
+	a.emit(insn(bpfMov64Imm, bpfR9, 0, 0, protocolTCP*stride))
+	a.jump(bpfJa, 0, 0, "ports")
+	a.label("udp")
+	a.emit(insn(bpfMov64Imm, bpfR9, 0, 0, protocolUDP*stride))
+	a.jump(bpfJa, 0, 0, "ports")
+	a.label("icmp")
+	a.emit(insn(bpfMov64Imm, bpfR9, 0, 0, protocolICMP*stride))
+	a.jump(bpfJa, 0, 0, "noport")
+
+	a.label("ports")
+	if len(ports) > 0 {
+		a.emit(insn(bpfLdxMemW, bpfR1, bpfR10, -8, 0))
+		a.jump(bpfJneImm, bpfR1, 0, "noport")
+		// Destination port first, then the source port
+		for _, off := range []int32{2, 0} {
+			a.emit(
+				insn(bpfLdxMemW, bpfR1, bpfR10, -12, 0),
+				insn(bpfLdIndH, 0, bpfR1, 0, off),
+			)
+			for i, port := range ports {
+				a.jump(bpfJeqImm, bpfR0, int32(port), "port"+strconv.Itoa(i))
+			}
+		}
+		a.jump(bpfJa, 0, 0, "noport")
+		for i := range ports {
+			a.label("port" + strconv.Itoa(i))
+			a.emit(insn(bpfAdd64Imm, bpfR9, 0, 0, int32(i)*4))
+			a.jump(bpfJa, 0, 0, "count")
+		}
+	}
+	a.label("noport")
+	a.emit(insn(bpfAdd64Imm, bpfR9, 0, 0, int32(len(ports))*4))
+
+	a.label("count")
+	a.emit(insn(bpfAdd64Reg, bpfR9, bpfR8, 0, 0))
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.emit(
+		insn(bpfAdd64Imm, bpfR9, 0, 0, 1),
+		insn(bpfMov64Imm, bpfR7, 0, 0, 1),
+	)
+	a.emit(mapAddReg(mapFd, bpfR9, bpfR7)...)
+	a.emit(
+		insn(bpfMov64Imm, bpfR0, 0, 0, 0),
+		insn(bpfExit, 0, 0, 0, 0),
+	)
+	return a.program()
+}
+
+// protocolCounters labels the counters of a classifier read
+func protocolCounters(counters, previous []uint64, elapsed float64, ports []uint16) []protocolCounter {
+	var result []protocolCounter
+	for class := 0; class < protocolClasses; class++ {
+		for port := 0; port <= len(ports); port++ {
+			// Only TCP and UDP are broken down by port
+			if port < len(ports) && class != protocolTCP && class != protocolUDP {
+				continue
+			}
+			c := protocolCounter{protocol: protocolNames[class]}
+			if port < len(ports) {
+				c.port = strconv.Itoa(int(ports[port]))
+			}
+			for dir, direction := range []string{"receive", "transmit"} {
+				key := (class*(len(ports)+1)+port)*4 + dir*2
+				c.direction = direction
+				c.bytes, c.packets = counters[key], counters[key+1]
+				c.speed = counterRate(counters, previous, key, elapsed) * 8
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
+
+// checkProtocolFlags validates --protocol.interfaces and --protocol.ports
+func checkProtocolFlags() error {
+	if _, err := regexp.Compile(*protocolInterfaces); err != nil {
+		return fmt.Errorf("invalid --protocol.interfaces: %w", err)
+	}
+	if _, err := parseProtocolPorts(*protocolPorts); err != nil {
+		return fmt.Errorf("invalid --protocol.ports: %w", err)
+	}
+	return nil
+}
+
+// startProtocolCollector starts attaching the classifier to the selected
+// interfaces
+func startProtocolCollector() error {
+	selected := regexp.MustCompile(*protocolInterfaces)
+	ports, err := parseProtocolPorts(*protocolPorts)
+	if err != nil {
+		return fmt.Errorf("invalid --protocol.ports: %w", err)
+	}
+	registerMetrics("protocol", protocolCollector{})
+	go collectProtocols(selected, ports)
+	return nil
+}
+
+// collectProtocols periodically refreshes the protocol snapshot
+func collectProtocols(selected *regexp.Regexp, ports []uint16) {
+	classifiers := &packetClassifiers{
+		name:     "protocol",
+		selected: selected,
+		entries:  protocolClasses * (len(ports) + 1) * 4,
+		program:  func(mapFd int) []bpfInsn { return protocolProgram(mapFd, ports) },
+	}
+	for {
+		byIface := make(map[string][]protocolCounter)
+		for name, c := range classifiers.refresh() {
+			counters, previous, elapsed, err := c.read()
+			if err != nil {
+				log.Printf("Error reading the protocol counters of %s: %v", name, err)
+				continue
+			}
+			byIface[name] = protocolCounters(counters, previous, elapsed, ports)
+		}
+		protocolSnapshot.Lock()
+		protocolSnapshot.byIface = byIface
+		protocolSnapshot.Unlock()
+		time.Sleep(*protocolInterval)
+	}
+}
+
+// protocolCollector exports the last protocol snapshot
+type protocolCollector struct{}
+
+func (protocolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- protocolSpeedDesc
+	ch <- protocolBytesDesc
+	ch <- protocolPacketsDesc
+}
+
+func (protocolCollector) Collect(ch chan<- prometheus.Metric) {
+	protocolSnapshot.Lock()
+	defer protocolSnapshot.Unlock()
+	for name, counters := range protocolSnapshot.byIface {
+		for _, c := range counters {
+			ch <- prometheus.MustNewConstMetric(protocolSpeedDesc, prometheus.GaugeValue, c.speed, name, c.protocol, c.port, c.direction)
+			ch <- prometheus.MustNewConstMetric(protocolBytesDesc, prometheus.CounterValue, float64(c.bytes), name, c.protocol, c.port, c.direction)
+			ch <- prometheus.MustNewConstMetric(protocolPacketsDesc, prometheus.CounterValue, float64(c.packets), name, c.protocol, c.port, c.direction)
+		}
+	}
+}
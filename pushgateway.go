@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	pushgatewayURL      = flag.String("pushgateway.url", "", "URL of a Prometheus Pushgateway to push the metrics to, e.g. http://pushgateway:9091; empty disables")
+	pushgatewayJob      = flag.String("pushgateway.job", "vyosexporter", "job label of the metrics pushed to the Pushgateway")
+	pushgatewayInstance = flag.String("pushgateway.instance", "", "instance label of the metrics pushed to the Pushgateway (default: the hostname)")
+	pushgatewayInterval = flag.Duration("pushgateway.interval", 30*time.Second, "How often to push the metrics to the Pushgateway")
+)
+
+// newPushgatewayPusher validates the flags. The metrics are those of the
+// textfile output, replacing the group of the job and instance on each push.
+func newPushgatewayPusher() (*push.Pusher, error) {
+	if *pushgatewayJob == "" {
+		return nil, errors.New("--pushgateway.job is empty")
+	}
+	instance := *pushgatewayInstance
+	if instance == "" {
+		var err error
+		if instance, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return metricsGatherer(prometheus.Gatherers{customRegistry, remoteRegistry}).Gather()
+	})
+	return push.New(*pushgatewayURL, *pushgatewayJob).Grouping("instance", instance).Gatherer(g), nil
+}
+
+// runPushgateway pushes as soon as the first collection cycle is done, then
+// every --pushgateway.interval, and a last time when the exporter is stopped,
+// so hosts that are only up briefly leave their latest values behind
+func runPushgateway(p *push.Pusher) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	wait := time.Second
+	for {
+		select {
+		case <-time.After(wait):
+		case <-signals:
+			if err := p.Push(); err != nil {
+				log.Printf("Error pushing metrics to Pushgateway %s: %v", *pushgatewayURL, err)
+			}
+			os.Exit(0)
+		}
+		if len(currentStats()) == 0 {
+			continue
+		}
+		if err := p.Push(); err != nil {
+			log.Printf("Error pushing metrics to Pushgateway %s: %v", *pushgatewayURL, err)
+		}
+		wait = *pushgatewayInterval
+	}
+}
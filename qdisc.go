@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var qdiscInterval = flag.Duration("qdisc.interval", 15*time.Second, "How often to dump the queueing disciplines and their statistics")
+
+// Traffic control attributes, from linux/rtnetlink.h, linux/gen_stats.h and
+// linux/pkt_sched.h
+const (
+	sizeofTcMsg          = 20
+	tcaKind              = 1
+	tcaStats2            = 7
+	tcaStatsBasic        = 1
+	tcaStatsQueue        = 3
+	tcaStatsApp          = 4
+	tcaStatsPkt64        = 8
+	tcHRoot              = 0xffffffff
+	tcHIngress           = 0xfffffff1
+	tcHClsactIngress     = 0xfffffff2
+	tcHClsactEgress      = 0xfffffff3
+	fqCodelXstatsQdisc   = 0
+	cakeStatsCapacity    = 2
+	cakeStatsMemoryLimit = 3
+	cakeStatsMemoryUsed  = 4
+	cakeStatsTinStats    = 10
+)
+
+var (
+	qdiscLabels = []string{"interface", "kind", "handle", "parent"}
+
+	qdiscBytesDesc = prometheus.NewDesc("network_qdisc_bytes_total",
+		"Bytes sent by the queueing discipline", qdiscLabels, nil)
+	qdiscPacketsDesc = prometheus.NewDesc("network_qdisc_packets_total",
+		"Packets sent by the queueing discipline", qdiscLabels, nil)
+	qdiscDropsDesc = prometheus.NewDesc("network_qdisc_drops_total",
+		"Packets dropped by the queueing discipline", qdiscLabels, nil)
+	qdiscOverlimitsDesc = prometheus.NewDesc("network_qdisc_overlimits_total",
+		"Times the queueing discipline held back a packet because of a rate limit", qdiscLabels, nil)
+	qdiscRequeuesDesc = prometheus.NewDesc("network_qdisc_requeues_total",
+		"Packets the driver handed back to the queueing discipline", qdiscLabels, nil)
+	qdiscBacklogBytesDesc = prometheus.NewDesc("network_qdisc_backlog_bytes",
+		"Bytes queued in the queueing discipline", qdiscLabels, nil)
+	qdiscBacklogPacketsDesc = prometheus.NewDesc("network_qdisc_backlog_packets",
+		"Packets queued in the queueing discipline", qdiscLabels, nil)
+
+	fqCodelECNMarksDesc = prometheus.NewDesc("network_qdisc_fq_codel_ecn_marks_total",
+		"Packets fq_codel marked with ECN instead of dropping them", qdiscLabels, nil)
+	fqCodelCEMarksDesc = prometheus.NewDesc("network_qdisc_fq_codel_ce_marks_total",
+		"Packets fq_codel marked above the ce_threshold", qdiscLabels, nil)
+	fqCodelDropsDesc = prometheus.NewDesc("network_qdisc_fq_codel_drops_total",
+		"Packets fq_codel dropped because the queue was full, by reason", append(qdiscLabels, "reason"), nil)
+	fqCodelNewFlowsDesc = prometheus.NewDesc("network_qdisc_fq_codel_new_flows_total",
+		"Flows fq_codel started to track as new", qdiscLabels, nil)
+	fqCodelFlowsDesc = prometheus.NewDesc("network_qdisc_fq_codel_flows",
+		"Flows in the new and old lists of fq_codel", append(qdiscLabels, "list"), nil)
+	fqCodelMemoryDesc = prometheus.NewDesc("network_qdisc_fq_codel_memory_bytes",
+		"Memory used by the packets queued in fq_codel", qdiscLabels, nil)
+	fqCodelMaxPacketDesc = prometheus.NewDesc("network_qdisc_fq_codel_max_packet_bytes",
+		"Largest packet fq_codel has seen", qdiscLabels, nil)
+
+	cakeCapacityDesc = prometheus.NewDesc("network_qdisc_cake_capacity_estimate_bits",
+		"Capacity CAKE shapes to, estimated with autorate-ingress, in bits per second", qdiscLabels, nil)
+	cakeMemoryDesc = prometheus.NewDesc("network_qdisc_cake_memory_bytes",
+		"Memory used by the packets queued in CAKE", qdiscLabels, nil)
+	cakeMemoryLimitDesc = prometheus.NewDesc("network_qdisc_cake_memory_limit_bytes",
+		"Memory CAKE may use for queued packets", qdiscLabels, nil)
+
+	cakeTinLabels = append(qdiscLabels, "tin")
+	// Counters of the TCA_CAKE_TIN_STATS_* attributes by attribute
+	cakeTinStats = map[uint16]struct {
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+		scale     float64
+	}{
+		2: {prometheus.NewDesc("network_qdisc_cake_tin_sent_packets_total",
+			"Packets sent by the CAKE tin", cakeTinLabels, nil), prometheus.CounterValue, 1},
+		3: {prometheus.NewDesc("network_qdisc_cake_tin_sent_bytes_total",
+			"Bytes sent by the CAKE tin", cakeTinLabels, nil), prometheus.CounterValue, 1},
+		4: {prometheus.NewDesc("network_qdisc_cake_tin_dropped_packets_total",
+			"Packets dropped by the CAKE tin", cakeTinLabels, nil), prometheus.CounterValue, 1},
+		6: {prometheus.NewDesc("network_qdisc_cake_tin_ack_dropped_packets_total",
+			"Redundant TCP ACKs dropped by the ack-filter of the CAKE tin", cakeTinLabels, nil), prometheus.CounterValue, 1},
+		8: {prometheus.NewDesc("network_qdisc_cake_tin_ecn_marked_packets_total",
+			"Packets marked with ECN by the CAKE tin", cakeTinLabels, nil), prometheus.CounterValue, 1},
+		11: {prometheus.NewDesc("network_qdisc_cake_tin_backlog_bytes",
+			"Bytes queued in the CAKE tin", cakeTinLabels, nil), prometheus.GaugeValue, 1},
+		12: {prometheus.NewDesc("network_qdisc_cake_tin_threshold_rate_bits",
+			"Rate the CAKE tin is guaranteed in bits per second", cakeTinLabels, nil), prometheus.GaugeValue, 8},
+		13: {prometheus.NewDesc("network_qdisc_cake_tin_target_seconds",
+			"Queueing delay target of the CAKE tin", cakeTinLabels, nil), prometheus.GaugeValue, 1e-6},
+		18: {prometheus.NewDesc("network_qdisc_cake_tin_peak_delay_seconds",
+			"Peak queueing (sojourn) delay of the CAKE tin", cakeTinLabels, nil), prometheus.GaugeValue, 1e-6},
+		19: {prometheus.NewDesc("network_qdisc_cake_tin_average_delay_seconds",
+			"Average queueing (sojourn) delay of the CAKE tin", cakeTinLabels, nil), prometheus.GaugeValue, 1e-6},
+		20: {prometheus.NewDesc("network_qdisc_cake_tin_base_delay_seconds",
+			"Minimum queueing (sojourn) delay of the CAKE tin", cakeTinLabels, nil), prometheus.GaugeValue, 1e-6},
+	}
+	// Flow counts of the TCA_CAKE_TIN_STATS_* attributes by attribute
+	cakeTinFlows     = map[uint16]string{21: "sparse", 22: "bulk", 23: "unresponsive"}
+	cakeTinFlowsDesc = prometheus.NewDesc("network_qdisc_cake_tin_flows",
+		"Flows of the CAKE tin by type", append(cakeTinLabels, "type"), nil)
+
+	// Result of the last qdisc dump
+	qdiscSnapshot struct {
+		sync.Mutex
+		metrics []prometheus.Metric
+	}
+)
+
+func init() {
+	registerCollector("qdisc", "queueing discipline statistics, with fq_codel and CAKE details, via rtnetlink", false, startQdiscCollector)
+}
+
+// tcHandle formats a traffic control handle like tc does, e.g. 1: or 1:10
+func tcHandle(h uint32) string {
+	switch h {
+	case tcHRoot:
+		return "root"
+	case tcHIngress, tcHClsactIngress:
+		return "ingress"
+	case tcHClsactEgress:
+		return "egress"
+	}
+	if h&0xffff == 0 {
+		return fmt.Sprintf("%x:", h>>16)
+	}
+	return fmt.Sprintf("%x:%x", h>>16, h&0xffff)
+}
+
+// tcObject is a qdisc, class or filter of an RTM_GETQDISC-like dump
+type tcObject struct {
+	ifindex        uint32
+	handle, parent uint32
+	// Priority and protocol of filters
+	info  uint32
+	kind  string
+	attrs map[uint16][]byte
+}
+
+// dumpTC dumps the traffic control objects of a message type, of all
+// interfaces for qdiscs and classes, or of an interface and parent for
+// filters
+func dumpTC(c *netlinkConn, msgType uint16, ifindex, parent uint32) ([]tcObject, error) {
+	req := make([]byte, sizeofTcMsg)
+	req[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(req[4:8], ifindex)
+	binary.NativeEndian.PutUint32(req[12:16], parent)
+	replies, err := c.execute(msgType, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	var objects []tcObject
+	for _, reply := range replies {
+		if len(reply) < sizeofTcMsg {
+			continue
+		}
+		// struct tcmsg: family, padding, ifindex, handle, parent, info
+		o := tcObject{
+			ifindex: binary.NativeEndian.Uint32(reply[4:8]),
+			handle:  binary.NativeEndian.Uint32(reply[8:12]),
+			parent:  binary.NativeEndian.Uint32(reply[12:16]),
+			info:    binary.NativeEndian.Uint32(reply[16:20]),
+			attrs:   nlAttrMap(reply[sizeofTcMsg:]),
+		}
+		o.kind = nlString(o.attrs[tcaKind])
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+// tcStats are the generic statistics of a qdisc, class or action
+type tcStats struct {
+	hasBasic, hasQueue                         bool
+	bytes, packets                             uint64
+	qlen, backlog, drops, requeues, overlimits uint32
+}
+
+// parseTCStats decodes the TCA_STATS_* attributes of a TCA_STATS2 attribute
+func parseTCStats(stats map[uint16][]byte) tcStats {
+	var st tcStats
+	// struct gnet_stats_basic: bytes (u64), packets (u32); the 64-bit
+	// packet count follows separately
+	if basic := stats[tcaStatsBasic]; len(basic) >= 12 {
+		st.hasBasic = true
+		st.bytes = binary.NativeEndian.Uint64(basic[0:8])
+		st.packets = uint64(binary.NativeEndian.Uint32(basic[8:12]))
+		if v, ok := nlUint(stats[tcaStatsPkt64]); ok {
+			st.packets = v
+		}
+	}
+	// struct gnet_stats_queue: qlen, backlog, drops, requeues, overlimits
+	if queue := stats[tcaStatsQueue]; len(queue) >= 20 {
+		st.hasQueue = true
+		st.qlen = binary.NativeEndian.Uint32(queue[0:4])
+		st.backlog = binary.NativeEndian.Uint32(queue[4:8])
+		st.drops = binary.NativeEndian.Uint32(queue[8:12])
+		st.requeues = binary.NativeEndian.Uint32(queue[12:16])
+		st.overlimits = binary.NativeEndian.Uint32(queue[16:20])
+	}
+	return st
+}
+
+// readQdiscs dumps the qdiscs of all interfaces into metrics. The noqueue
+// qdiscs of virtual interfaces have nothing to show and are left out.
+func readQdiscs(c *netlinkConn) ([]prometheus.Metric, error) {
+	names, err := linkNames(c)
+	if err != nil {
+		return nil, err
+	}
+	qdiscs, err := dumpTC(c, unix.RTM_GETQDISC, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []prometheus.Metric
+	for _, q := range qdiscs {
+		name, ok := names[q.ifindex]
+		if !ok || q.kind == "noqueue" {
+			continue
+		}
+		labels := []string{name, q.kind, tcHandle(q.handle), tcHandle(q.parent)}
+		metric := func(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, extra ...string) {
+			metrics = append(metrics, prometheus.MustNewConstMetric(desc, valueType, value, append(labels, extra...)...))
+		}
+		stats := nlAttrMap(q.attrs[tcaStats2])
+		st := parseTCStats(stats)
+		if st.hasBasic {
+			metric(qdiscBytesDesc, prometheus.CounterValue, float64(st.bytes))
+			metric(qdiscPacketsDesc, prometheus.CounterValue, float64(st.packets))
+		}
+		if st.hasQueue {
+			metric(qdiscBacklogPacketsDesc, prometheus.GaugeValue, float64(st.qlen))
+			metric(qdiscBacklogBytesDesc, prometheus.GaugeValue, float64(st.backlog))
+			metric(qdiscDropsDesc, prometheus.CounterValue, float64(st.drops))
+			metric(qdiscRequeuesDesc, prometheus.CounterValue, float64(st.requeues))
+			metric(qdiscOverlimitsDesc, prometheus.CounterValue, float64(st.overlimits))
+		}
+		switch q.kind {
+		case "fq_codel":
+			fqCodelMetrics(stats[tcaStatsApp], metric)
+		case "cake":
+			cakeMetrics(stats[tcaStatsApp], metric)
+		}
+	}
+	return metrics, nil
+}
+
+// fqCodelMetrics decodes struct tc_fq_codel_xstats of a qdisc. The fields
+// after old_flows_len came with later kernels.
+func fqCodelMetrics(b []byte, metric func(*prometheus.Desc, prometheus.ValueType, float64, ...string)) {
+	if len(b) < 28 || binary.NativeEndian.Uint32(b) != fqCodelXstatsQdisc {
+		return
+	}
+	// type, then maxpacket, drop_overlimit, ecn_mark, new_flow_count,
+	// new_flows_len, old_flows_len, ce_mark, memory_usage, drop_overmemory
+	u32 := func(i int) float64 { return float64(binary.NativeEndian.Uint32(b[4+4*i:])) }
+	metric(fqCodelMaxPacketDesc, prometheus.GaugeValue, u32(0))
+	metric(fqCodelDropsDesc, prometheus.CounterValue, u32(1), "overlimit")
+	metric(fqCodelECNMarksDesc, prometheus.CounterValue, u32(2))
+	metric(fqCodelNewFlowsDesc, prometheus.CounterValue, u32(3))
+	metric(fqCodelFlowsDesc, prometheus.GaugeValue, u32(4), "new")
+	metric(fqCodelFlowsDesc, prometheus.GaugeValue, u32(5), "old")
+	if len(b) >= 40 {
+		metric(fqCodelCEMarksDesc, prometheus.CounterValue, u32(6))
+		metric(fqCodelMemoryDesc, prometheus.GaugeValue, u32(7))
+		metric(fqCodelDropsDesc, prometheus.CounterValue, u32(8), "overmemory")
+	}
+}
+
+// cakeMetrics decodes the TCA_CAKE_STATS_* attributes of a qdisc, with the
+// statistics of each tin nested in TCA_CAKE_STATS_TIN_STATS by tin number
+// starting at 1
+func cakeMetrics(b []byte, metric func(*prometheus.Desc, prometheus.ValueType, float64, ...string)) {
+	attrs := nlAttrMap(b)
+	if v, ok := nlUint(attrs[cakeStatsCapacity]); ok {
+		metric(cakeCapacityDesc, prometheus.GaugeValue, float64(v)*8)
+	}
+	if v, ok := nlUint(attrs[cakeStatsMemoryUsed]); ok {
+		metric(cakeMemoryDesc, prometheus.GaugeValue, float64(v))
+	}
+	if v, ok := nlUint(attrs[cakeStatsMemoryLimit]); ok {
+		metric(cakeMemoryLimitDesc, prometheus.GaugeValue, float64(v))
+	}
+	for _, tin := range nlAttrs(attrs[cakeStatsTinStats]) {
+		number := strconv.Itoa(int(tin.typ) - 1)
+		for _, a := range nlAttrs(tin.value) {
+			v, ok := nlUint(a.value)
+			if !ok {
+				continue
+			}
+			if s, ok := cakeTinStats[a.typ]; ok {
+				metric(s.desc, s.valueType, float64(v)*s.scale, number)
+			} else if flows, ok := cakeTinFlows[a.typ]; ok {
+				metric(cakeTinFlowsDesc, prometheus.GaugeValue, float64(v), number, flows)
+			}
+		}
+	}
+}
+
+// startQdiscCollector opens the netlink socket for the qdisc dumps
+func startQdiscCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("qdisc", qdiscCollector{})
+	go collectQdiscs(c)
+	return nil
+}
+
+// collectQdiscs periodically refreshes the qdisc snapshot
+func collectQdiscs(c *netlinkConn) {
+	for {
+		metrics, err := readQdiscs(c)
+		if err != nil {
+			log.Printf("Error reading qdiscs: %v", err)
+		} else {
+			qdiscSnapshot.Lock()
+			qdiscSnapshot.metrics = metrics
+			qdiscSnapshot.Unlock()
+		}
+		time.Sleep(*qdiscInterval)
+	}
+}
+
+// qdiscCollector exports the metrics of the last qdisc dump
+type qdiscCollector struct{}
+
+func (qdiscCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{qdiscBytesDesc, qdiscPacketsDesc, qdiscDropsDesc, qdiscOverlimitsDesc,
+		qdiscRequeuesDesc, qdiscBacklogBytesDesc, qdiscBacklogPacketsDesc, fqCodelECNMarksDesc, fqCodelCEMarksDesc,
+		fqCodelDropsDesc, fqCodelNewFlowsDesc, fqCodelFlowsDesc, fqCodelMemoryDesc, fqCodelMaxPacketDesc,
+		cakeCapacityDesc, cakeMemoryDesc, cakeMemoryLimitDesc, cakeTinFlowsDesc} {
+		ch <- desc
+	}
+	for _, s := range cakeTinStats {
+		ch <- s.desc
+	}
+}
+
+func (qdiscCollector) Collect(ch chan<- prometheus.Metric) {
+	qdiscSnapshot.Lock()
+	defer qdiscSnapshot.Unlock()
+	for _, m := range qdiscSnapshot.metrics {
+		ch <- m
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quotaFlag collects interface=size pairs from repeated or comma-separated --quota flags
+type quotaFlag map[string]uint64
+
+func (q quotaFlag) String() string {
+	pairs := make(map[string]string, len(q))
+	for name, size := range q {
+		pairs[name] = strconv.FormatUint(size, 10)
+	}
+	return formatPairs(pairs)
+}
+
+func (q quotaFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, size, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid quota %q, expected interface=size", pair)
+		}
+		bytes, err := parseByteSize(size)
+		if err != nil {
+			return err
+		}
+		q[name] = bytes
+	}
+	return nil
+}
+
+// Multipliers for byte size suffixes; SI units are powers of 1000, IEC units powers of 1024
+var byteSizeUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"PB":  1e15,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+	"PIB": 1 << 50,
+}
+
+// parseByteSize parses sizes like 500GB, 1.5TiB or 1073741824
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := byteSizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return uint64(value * unit), nil
+}
+
+var (
+	quotas         = quotaFlag{}
+	quotaDirection = flag.String("quota.direction", "total", "Traffic counted against quotas: total, receive or transmit")
+
+	networkQuota = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_quota_bytes",
+			Help: "Configured monthly traffic quota of a network interface",
+		},
+		[]string{"interface"},
+	)
+
+	networkQuotaUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_quota_used_bytes",
+			Help: "Traffic counted against the quota in the current month",
+		},
+		[]string{"interface"},
+	)
+
+	networkQuotaRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_quota_remaining_bytes",
+			Help: "Traffic left of the monthly quota, zero once exceeded",
+		},
+		[]string{"interface"},
+	)
+
+	networkQuotaProjected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_quota_projected_bytes",
+			Help: "Projected traffic at the end of the month if the average rate of the month so far continues",
+		},
+		[]string{"interface"},
+	)
+)
+
+func init() {
+	flag.Var(quotas, "quota", "Monthly traffic quota as interface=size, e.g. eth0=2TB; repeatable or comma-separated, requires --accounting.file")
+
+	registerMetrics("quota", networkQuota)
+	registerMetrics("quota", networkQuotaUsed)
+	registerMetrics("quota", networkQuotaRemaining)
+	registerMetrics("quota", networkQuotaProjected)
+}
+
+// validateQuotaFlags checks that the quota configuration can be honoured
+func validateQuotaFlags() error {
+	if len(quotas) == 0 {
+		return nil
+	}
+	if *accountingFile == "" {
+		return fmt.Errorf("--quota requires --accounting.file")
+	}
+	switch *quotaDirection {
+	case "total", "receive", "transmit":
+		return nil
+	}
+	return fmt.Errorf("invalid --quota.direction %q, expected total, receive or transmit", *quotaDirection)
+}
+
+// monthProgress returns the fraction of the calendar month of t that has elapsed
+func monthProgress(t time.Time) float64 {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	end := start.AddDate(0, 1, 0)
+	return float64(t.Sub(start)) / float64(end.Sub(start))
+}
+
+// updateQuotas refreshes the quota metrics from the accounted monthly totals
+func updateQuotas(now time.Time) {
+	if len(quotas) == 0 {
+		return
+	}
+	month := now.Local().Format(accountingMonthLayout)
+	progress := monthProgress(now.Local())
+
+	accounting.Lock()
+	defer accounting.Unlock()
+	for name, quota := range quotas {
+		var used uint64
+		if acct, ok := accounting.state.Interfaces[name]; ok {
+			if t, ok := acct.Months[month]; ok {
+				switch *quotaDirection {
+				case "receive":
+					used = t.RxBytes
+				case "transmit":
+					used = t.TxBytes
+				default:
+					used = t.RxBytes + t.TxBytes
+				}
+			}
+		}
+		remaining := uint64(0)
+		if used < quota {
+			remaining = quota - used
+		}
+
+		networkQuota.WithLabelValues(name).Set(float64(quota))
+		networkQuotaUsed.WithLabelValues(name).Set(float64(used))
+		networkQuotaRemaining.WithLabelValues(name).Set(float64(remaining))
+		if progress > 0 {
+			networkQuotaProjected.WithLabelValues(name).Set(float64(used) / progress)
+		}
+	}
+}
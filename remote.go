@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	remoteHosts      = flag.String("remote.hosts", "", "Comma-separated SSH destinations to read the interface counters of, e.g. admin@fw1,ssh://admin@fw2:2222")
+	remoteInterval   = flag.Duration("remote.interval", 5*time.Second, "How often to read the interface counters of the remote hosts")
+	remoteSSHCommand = flag.String("remote.ssh-command", "ssh", "SSH client command with its options, e.g. \"ssh -i /etc/vyosexporter/id_ed25519\"; runs non-interactively with BatchMode=yes")
+)
+
+// remoteScript prints /proc/net/dev and a line per interface with its flags,
+// MTU, operstate, link speed and ifalias. It only needs a POSIX shell and
+// cat, which appliances without room for an exporter still have.
+const remoteScript = `cat /proc/net/dev; echo @@; for d in /sys/class/net/*; do printf '%s %s %s %s %s %s\n' "${d##*/}" "$(cat $d/flags)" "$(cat $d/mtu)" "$(cat $d/operstate)" "$(cat $d/speed 2>/dev/null || echo -1)" "$(cat $d/ifalias 2>/dev/null)"; done; echo @@end
+`
+
+// The per-interface series of the remote hosts, read over SSH, SNMP or gNMI,
+// with the names and help of the local ones and a host label
+var (
+	remoteRegistry = prometheus.NewRegistry()
+
+	remoteSpeedDesc     = prometheus.NewDesc("network_interface_speed_bits", "Network interface speed in bits per second", []string{"host", "interface", "direction"}, nil)
+	remoteErrorsDesc    = prometheus.NewDesc("network_interface_errors_total", "Total number of network interface errors", []string{"host", "interface", "direction"}, nil)
+	remoteDropsDesc     = prometheus.NewDesc("network_interface_drops_total", "Total number of network interface drops", []string{"host", "interface", "direction"}, nil)
+	remotePacketsDesc   = prometheus.NewDesc("network_interface_packets_total", "Total number of network interface packets", []string{"host", "interface", "direction"}, nil)
+	remoteInfoDesc      = prometheus.NewDesc("network_interface_info", "Information about network interfaces", []string{"host", "interface", "description", "mtu", "operstate"}, nil)
+	remoteLinkSpeedDesc = prometheus.NewDesc("network_interface_link_speed_bits", "Negotiated link speed of the interface in bits per second", []string{"host", "interface"}, nil)
+	remoteUpDesc        = prometheus.NewDesc("network_remote_up", "1 if the last read of the remote host succeeded, 0 otherwise", []string{"host"}, nil)
+	remoteGapsDesc      = prometheus.NewDesc("network_remote_collection_gaps_total", "Number of reads of the remote host whose speeds were skipped because they came longer than --speed.max-gap after they were due", []string{"host"}, nil)
+
+	// Hosts of --remote.hosts, --snmp.targets and --gnmi.targets in flag order
+	remoteSnapshot struct {
+		sync.Mutex
+		hosts []*remoteHost
+	}
+	registerRemoteCollector sync.Once
+)
+
+func init() {
+	registerCollector("remote", "interface counters of remote hosts read over SSH, with a host label", false, startRemoteCollector).
+		checks(checkRemoteFlags)
+}
+
+// remoteLink is the state of a link of a remote host
+type remoteLink struct {
+	up, loopback                bool
+	description, mtu, operstate string
+	// Link speed in bits per second, 0 if unknown
+	speed float64
+}
+
+// remoteInterface is the state of an interface of a remote host
+type remoteInterface struct {
+	netspeed.Counters
+	remoteLink
+	rxSpeed, txSpeed float64
+	hasSpeed         bool
+}
+
+// remoteSample is one reading of the counters and links of a host
+type remoteSample struct {
+	counters map[string]netspeed.Counters
+	links    map[string]remoteLink
+	time     time.Time
+	// Read times of single interfaces overriding time, for sources that
+	// timestamp each interface
+	times map[string]time.Time
+}
+
+// readTime returns when the counters of an interface were read
+func (s *remoteSample) readTime(name string) time.Time {
+	if t, ok := s.times[name]; ok {
+		return t
+	}
+	return s.time
+}
+
+// remoteHost is a host read over SSH, SNMP or gNMI, guarded by the snapshot
+// lock
+type remoteHost struct {
+	destination string
+	// ssh, snmp or gnmi
+	source     string
+	up         bool
+	interfaces map[string]remoteInterface
+	previous   *remoteSample
+	// Reads skipped for a gap
+	gaps uint64
+}
+
+// maxGap returns the interval beyond which the reads of the host are a gap:
+// --speed.max-gap after the next read was due
+func (h *remoteHost) maxGap() time.Duration {
+	if *speedMaxGap <= 0 {
+		return 0
+	}
+	interval := *remoteInterval
+	switch h.source {
+	case "snmp":
+		interval = *snmpInterval
+	case "gnmi":
+		interval = *gnmiInterval
+	}
+	return interval + *speedMaxGap
+}
+
+// parseRemoteSample parses the output of remoteScript up to the end marker
+func parseRemoteSample(lines []string) remoteSample {
+	s := remoteSample{counters: make(map[string]netspeed.Counters), links: make(map[string]remoteLink)}
+	links := false
+	for _, line := range lines {
+		if line == "@@" {
+			links = true
+			continue
+		}
+		if !links {
+			if name, counters, ok := netspeed.ParseNetDevLine(line); ok {
+				s.counters[name] = counters
+			}
+			continue
+		}
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 32)
+		if err != nil {
+			continue
+		}
+		link := remoteLink{
+			up:          flags&unix.IFF_UP != 0,
+			loopback:    flags&unix.IFF_LOOPBACK != 0,
+			mtu:         fields[2],
+			operstate:   fields[3],
+			description: fields[5],
+		}
+		// Mbit/s, -1 or an error without a link
+		if mbits, err := strconv.ParseFloat(fields[4], 64); err == nil && mbits > 0 {
+			link.speed = mbits * 1e6
+		}
+		s.links[fields[0]] = link
+	}
+	return s
+}
+
+// update computes the interfaces of the host from a sample and the previous
+// one, leaving out loopback and down interfaces as the dev collector does.
+// Only the goroutine reading the host calls it, so the interfaces can be read
+// without the lock.
+func (h *remoteHost) update(s remoteSample) {
+	interfaces := make(map[string]remoteInterface)
+	gap := false
+	for name, counters := range s.counters {
+		link, ok := s.links[name]
+		if !ok || link.loopback || !link.up {
+			continue
+		}
+		iface := remoteInterface{Counters: counters, remoteLink: link}
+		if h.previous != nil {
+			if prev, ok := h.previous.counters[name]; ok {
+				now, then := s.readTime(name), h.previous.readTime(name)
+				old, known := h.interfaces[name]
+				switch {
+				case netspeed.IsGap(now, then, h.maxGap()):
+					// The average over the gap isn't the current speed;
+					// the last one stays, as with the dev collector
+					gap = true
+					if known {
+						iface.rxSpeed, iface.txSpeed, iface.hasSpeed = old.rxSpeed, old.txSpeed, old.hasSpeed
+					}
+				case now.Equal(then):
+					// Not read again since, keep the last speed
+					if known {
+						iface.rxSpeed, iface.txSpeed, iface.hasSpeed = old.rxSpeed, old.txSpeed, old.hasSpeed
+					}
+				default:
+					iface.rxSpeed, iface.txSpeed, iface.hasSpeed = netspeed.Speeds(counters, prev, now.Sub(then))
+				}
+			}
+		}
+		interfaces[name] = iface
+	}
+	h.previous = &s
+	remoteSnapshot.Lock()
+	h.up, h.interfaces = true, interfaces
+	if gap {
+		h.gaps++
+	}
+	remoteSnapshot.Unlock()
+}
+
+// down marks the host unreachable and drops its series
+func (h *remoteHost) down() {
+	h.previous = nil
+	remoteSnapshot.Lock()
+	h.up, h.interfaces = false, nil
+	remoteSnapshot.Unlock()
+}
+
+// session runs remoteScript every --remote.interval over one SSH connection
+// until it fails
+func (h *remoteHost) session(command []string) error {
+	args := append(append([]string(nil), command[1:]...), "-T", "-o", "BatchMode=yes", h.destination, "sh")
+	cmd := exec.Command(command[0], args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = h.poll(stdin, stdout)
+	stdin.Close()
+	cmd.Process.Kill()
+	cmd.Wait()
+	// ssh explains failures to connect or authenticate on stderr
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
+// poll writes remoteScript to the shell every --remote.interval and parses
+// its output
+func (h *remoteHost) poll(stdin io.Writer, stdout io.Reader) error {
+	samples := make(chan []string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(samples)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1024*1024)
+		var lines []string
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "@@end" {
+				lines = append(lines, line)
+				continue
+			}
+			select {
+			case samples <- lines:
+			case <-done:
+				return
+			}
+			lines = nil
+		}
+	}()
+
+	// Connecting and the first run may take a while
+	timeout := 30 * time.Second
+	for ; ; time.Sleep(*remoteInterval) {
+		if _, err := io.WriteString(stdin, remoteScript); err != nil {
+			return err
+		}
+		select {
+		case lines, ok := <-samples:
+			if !ok {
+				return errors.New("session closed")
+			}
+			// Stamped on arrival; the round trip is the same every time
+			s := parseRemoteSample(lines)
+			s.time = time.Now()
+			h.update(s)
+		case <-time.After(timeout):
+			return errors.New("timed out")
+		}
+		timeout = *remoteInterval + 10*time.Second
+	}
+}
+
+// run keeps a session to the host, reconnecting after failures
+func (h *remoteHost) run(command []string) {
+	for {
+		err := h.session(command)
+		log.Printf("Error reading remote host %s: %v", h.destination, err)
+		h.down()
+		time.Sleep(max(*remoteInterval, 10*time.Second))
+	}
+}
+
+// isRemoteSeries reports whether a series is one of a remote host
+func isRemoteSeries(m *dto.Metric) bool {
+	for _, lp := range m.Label {
+		if lp.GetName() == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemoteFlags validates --remote.ssh-command and --remote.hosts
+func checkRemoteFlags() error {
+	if len(strings.Fields(*remoteSSHCommand)) == 0 {
+		return errors.New("--remote.ssh-command is empty")
+	}
+	if strings.Trim(*remoteHosts, ", ") == "" {
+		return errors.New("--remote.hosts is required")
+	}
+	return nil
+}
+
+// startRemoteCollector starts a session to each of --remote.hosts
+func startRemoteCollector() error {
+	command := strings.Fields(*remoteSSHCommand)
+	var hosts []*remoteHost
+	for _, destination := range strings.Split(*remoteHosts, ",") {
+		if destination = strings.TrimSpace(destination); destination != "" {
+			hosts = append(hosts, &remoteHost{destination: destination, source: "ssh"})
+		}
+	}
+	addRemoteHosts(hosts)
+	for _, h := range hosts {
+		go h.run(command)
+	}
+	return nil
+}
+
+// addRemoteHosts adds hosts to the exported ones
+func addRemoteHosts(hosts []*remoteHost) {
+	remoteSnapshot.Lock()
+	remoteSnapshot.hosts = append(remoteSnapshot.hosts, hosts...)
+	remoteSnapshot.Unlock()
+	registerRemoteCollector.Do(func() {
+		remoteRegistry.MustRegister(remoteCollector{})
+	})
+}
+
+// remoteCollector exports the interfaces of the remote hosts
+type remoteCollector struct{}
+
+func (remoteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- remoteSpeedDesc
+	ch <- remoteErrorsDesc
+	ch <- remoteDropsDesc
+	ch <- remotePacketsDesc
+	ch <- remoteInfoDesc
+	ch <- remoteLinkSpeedDesc
+	ch <- remoteUpDesc
+	ch <- remoteGapsDesc
+}
+
+func (remoteCollector) Collect(ch chan<- prometheus.Metric) {
+	remoteSnapshot.Lock()
+	defer remoteSnapshot.Unlock()
+	for _, h := range remoteSnapshot.hosts {
+		ch <- prometheus.MustNewConstMetric(remoteUpDesc, prometheus.GaugeValue, boolToFloat(h.up), h.destination)
+		ch <- prometheus.MustNewConstMetric(remoteGapsDesc, prometheus.CounterValue, float64(h.gaps), h.destination)
+		for name, iface := range h.interfaces {
+			ch <- prometheus.MustNewConstMetric(remoteInfoDesc, prometheus.GaugeValue, 1, h.destination, name, iface.description, iface.mtu, iface.operstate)
+			if iface.speed > 0 {
+				ch <- prometheus.MustNewConstMetric(remoteLinkSpeedDesc, prometheus.GaugeValue, iface.speed, h.destination, name)
+			}
+			if !iface.hasSpeed {
+				continue
+			}
+			for _, d := range []struct {
+				direction              string
+				speed                  float64
+				errors, drops, packets uint64
+			}{
+				{"receive", iface.rxSpeed, iface.RxErrors, iface.RxDrops, iface.RxPackets},
+				{"transmit", iface.txSpeed, iface.TxErrors, iface.TxDrops, iface.TxPackets},
+			} {
+				ch <- prometheus.MustNewConstMetric(remoteSpeedDesc, prometheus.GaugeValue, d.speed, h.destination, name, d.direction)
+				ch <- prometheus.MustNewConstMetric(remoteErrorsDesc, prometheus.GaugeValue, float64(d.errors), h.destination, name, d.direction)
+				ch <- prometheus.MustNewConstMetric(remoteDropsDesc, prometheus.GaugeValue, float64(d.drops), h.destination, name, d.direction)
+				ch <- prometheus.MustNewConstMetric(remotePacketsDesc, prometheus.GaugeValue, float64(d.packets), h.destination, name, d.direction)
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var routeInterval = flag.Duration("route.interval", time.Minute, "How often to dump the routing tables to count the routes")
+
+var (
+	routesDesc = prometheus.NewDesc("network_routes",
+		"Number of routes in the routing table", []string{"family", "table", "protocol"}, nil)
+	routeChangesDesc = prometheus.NewDesc("network_route_changes_total",
+		"Number of routes added or deleted, from route notifications", []string{"family", "table", "action"}, nil)
+
+	// Counts of the last dump and the changes since the start
+	routeSnapshot = struct {
+		sync.Mutex
+		counts  map[routeKey]int
+		changes map[routeChangeKey]uint64
+	}{
+		counts:  make(map[routeKey]int),
+		changes: make(map[routeChangeKey]uint64),
+	}
+)
+
+func init() {
+	registerCollector("route", "route counts per table and protocol and route changes via rtnetlink", false, startRouteCollector)
+}
+
+type routeKey struct{ family, table, protocol string }
+
+type routeChangeKey struct{ family, table, action string }
+
+// Names of the RTPROT_* values as in /etc/iproute2/rt_protos
+var routeProtocols = map[uint8]string{
+	unix.RTPROT_UNSPEC:   "unspec",
+	unix.RTPROT_REDIRECT: "redirect",
+	unix.RTPROT_KERNEL:   "kernel",
+	unix.RTPROT_BOOT:     "boot",
+	unix.RTPROT_STATIC:   "static",
+	unix.RTPROT_RA:       "ra",
+	unix.RTPROT_DHCP:     "dhcp",
+	unix.RTPROT_ZEBRA:    "zebra",
+	unix.RTPROT_BIRD:     "bird",
+	unix.RTPROT_BABEL:    "babel",
+	unix.RTPROT_BGP:      "bgp",
+	unix.RTPROT_ISIS:     "isis",
+	unix.RTPROT_OSPF:     "ospf",
+	unix.RTPROT_RIP:      "rip",
+	unix.RTPROT_EIGRP:    "eigrp",
+}
+
+// Files naming the routing tables, the second on systems shipping the
+// defaults outside /etc
+var routeTableFiles = []string{"/etc/iproute2/rt_tables", "/usr/share/iproute2/rt_tables"}
+
+// readRouteTableNames reads the table names of iproute2, falling back to the
+// kernel's own tables
+func readRouteTableNames() map[uint32]string {
+	names := map[uint32]string{
+		unix.RT_TABLE_DEFAULT: "default",
+		unix.RT_TABLE_MAIN:    "main",
+		unix.RT_TABLE_LOCAL:   "local",
+	}
+	for _, file := range routeTableFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if id, err := strconv.ParseUint(fields[0], 0, 32); err == nil {
+				names[uint32(id)] = fields[1]
+			}
+		}
+		f.Close()
+		break
+	}
+	return names
+}
+
+// parsedRoute is the part of an RTM_*ROUTE message the counts are made of
+type parsedRoute struct {
+	family, table, protocol string
+	// Cached clones, like IPv6 exceptions, rather than configured routes
+	cloned bool
+}
+
+// parseRoute parses an RTM_*ROUTE message
+func parseRoute(msg []byte, tables map[uint32]string) (parsedRoute, bool) {
+	if len(msg) < unix.SizeofRtMsg {
+		return parsedRoute{}, false
+	}
+	// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope,
+	// type, flags
+	var r parsedRoute
+	switch msg[0] {
+	case unix.AF_INET:
+		r.family = "ipv4"
+	case unix.AF_INET6:
+		r.family = "ipv6"
+	default:
+		return r, false
+	}
+	// Tables above 255 only fit the RTA_TABLE attribute
+	table := uint32(msg[4])
+	if v, ok := nlUint(nlAttrMap(msg[unix.SizeofRtMsg:])[unix.RTA_TABLE]); ok {
+		table = uint32(v)
+	}
+	if r.table = tables[table]; r.table == "" {
+		r.table = strconv.FormatUint(uint64(table), 10)
+	}
+	if r.protocol = routeProtocols[msg[5]]; r.protocol == "" {
+		r.protocol = strconv.Itoa(int(msg[5]))
+	}
+	r.cloned = binary.NativeEndian.Uint32(msg[8:12])&unix.RTM_F_CLONED != 0
+	return r, true
+}
+
+// countRoutes dumps the routes of all tables. The replies are counted as
+// they arrive, a full table doesn't fit in memory twice on small routers.
+func countRoutes(c *netlinkConn, tables map[uint32]string) (map[routeKey]int, error) {
+	req := make([]byte, unix.SizeofRtMsg)
+	req[0] = unix.AF_UNSPEC
+	counts := make(map[routeKey]int)
+	err := c.executeFunc(unix.RTM_GETROUTE, unix.NLM_F_DUMP, req, func(reply []byte) {
+		if r, ok := parseRoute(reply, tables); ok && !r.cloned {
+			counts[routeKey{r.family, r.table, r.protocol}]++
+		}
+	})
+	return counts, err
+}
+
+// startRouteCollector opens the sockets for the route dumps and notifications
+func startRouteCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE}); err != nil {
+		c.Close()
+		unix.Close(fd)
+		return err
+	}
+	// Room for the bursts of a BGP session coming up with a full table
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 8<<20)
+
+	registerMetrics("route", routeCollector{})
+	go collectRoutes(c)
+	go readRouteNotifications(fd)
+	return nil
+}
+
+// collectRoutes periodically refreshes the route counts
+func collectRoutes(c *netlinkConn) {
+	for {
+		counts, err := countRoutes(c, readRouteTableNames())
+		if err != nil {
+			log.Printf("Error dumping routes: %v", err)
+		} else {
+			routeSnapshot.Lock()
+			routeSnapshot.counts = counts
+			routeSnapshot.Unlock()
+		}
+		time.Sleep(*routeInterval)
+	}
+}
+
+// readRouteNotifications counts the added and deleted routes. Notifications
+// lost to an overflowing socket are logged once; the counts of the dumps
+// stay correct.
+func readRouteNotifications(fd int) {
+	defer unix.Close(fd)
+	tables := readRouteTableNames()
+	reportedOverflow := false
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.ENOBUFS) {
+			if !reportedOverflow {
+				log.Printf("Route notifications were lost, network_route_changes_total is short")
+				reportedOverflow = true
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Error receiving route notifications: %v", err)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		routeSnapshot.Lock()
+		for _, msg := range msgs {
+			var action string
+			switch msg.Header.Type {
+			case unix.RTM_NEWROUTE:
+				action = "add"
+			case unix.RTM_DELROUTE:
+				action = "delete"
+			default:
+				continue
+			}
+			if r, ok := parseRoute(msg.Data, tables); ok && !r.cloned {
+				routeSnapshot.changes[routeChangeKey{r.family, r.table, action}]++
+			}
+		}
+		routeSnapshot.Unlock()
+	}
+}
+
+// routeCollector exports the last route counts and the changes
+type routeCollector struct{}
+
+func (routeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- routesDesc
+	ch <- routeChangesDesc
+}
+
+func (routeCollector) Collect(ch chan<- prometheus.Metric) {
+	routeSnapshot.Lock()
+	defer routeSnapshot.Unlock()
+	for k, n := range routeSnapshot.counts {
+		ch <- prometheus.MustNewConstMetric(routesDesc, prometheus.GaugeValue, float64(n), k.family, k.table, k.protocol)
+	}
+	for k, n := range routeSnapshot.changes {
+		ch <- prometheus.MustNewConstMetric(routeChangesDesc, prometheus.CounterValue, float64(n), k.family, k.table, k.action)
+	}
+}
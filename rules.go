@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+var (
+	rulesSaturation   = flag.Float64("rules.saturation", 90, "Percent of the link speed above which the generated rules alert on a saturated interface")
+	rulesErrorRate    = flag.Float64("rules.error-rate", 1, "Percent of the packets with errors above which the generated rules alert")
+	rulesFor          = flag.Duration("rules.for", 5*time.Minute, "How long a condition has to hold before a generated alert fires")
+	rulesRateInterval = flag.Duration("rules.rate-interval", 5*time.Minute, "Range of the rate() calls of the generated rules")
+	rulesSeverity     = flag.String("rules.severity", "warning", "Severity label of the generated alerts")
+)
+
+// promRule is a recording or alerting rule of the generated rule file
+type promRule struct {
+	record, alert string
+	expr          string
+	// For alerts: how long the condition holds first, and a summary
+	// template for the annotation
+	hold    time.Duration
+	summary string
+}
+
+// validateRulesFlags checks the thresholds of the generated rules
+func validateRulesFlags() error {
+	if *rulesSaturation <= 0 || *rulesSaturation > 100 {
+		return fmt.Errorf("invalid --rules.saturation %v, expected a percentage", *rulesSaturation)
+	}
+	if *rulesErrorRate <= 0 || *rulesErrorRate > 100 {
+		return fmt.Errorf("invalid --rules.error-rate %v, expected a percentage", *rulesErrorRate)
+	}
+	if *rulesFor < 0 {
+		return fmt.Errorf("invalid --rules.for %s", *rulesFor)
+	}
+	if *rulesRateInterval <= 0 {
+		return fmt.Errorf("invalid --rules.rate-interval %s", *rulesRateInterval)
+	}
+	return nil
+}
+
+// generateRules returns the recording rules, per-host aggregates and the
+// utilization, and the alerting rules, named after the metrics this instance
+// exports with --metrics.prefix and --speed.unit
+func generateRules() (recording, alerting []promRule) {
+	prefix := *metricsPrefix
+	// With --speed.unit=both the bits keep their names
+	speed, speedBits := prefix+"_speed_bits", prefix+"_speed_bits"
+	if *speedUnit == "bytes" {
+		speed, speedBits = prefix+"_speed_bytes", prefix+"_speed_bytes * 8"
+	}
+	window := model.Duration(*rulesRateInterval).String()
+	utilization := "interface:" + prefix + "_utilization:ratio"
+	rate := func(metric string) string {
+		return fmt.Sprintf("rate(%s_%s_total[%s])", prefix, metric, window)
+	}
+
+	recording = []promRule{
+		{record: "instance:" + speed + ":sum", expr: "sum by (instance, direction) (" + speed + ")"},
+		{record: "instance:" + prefix + "_packets:rate" + window, expr: "sum by (instance, direction) (" + rate("packets") + ")"},
+		{record: "instance:" + prefix + "_errors:rate" + window, expr: "sum by (instance, direction) (" + rate("errors") + ")"},
+		{record: "instance:" + prefix + "_drops:rate" + window, expr: "sum by (instance, direction) (" + rate("drops") + ")"},
+		// Interfaces without a link speed, e.g. virtual ones, are left out
+		{record: utilization, expr: speedBits + " / ignoring (direction) group_left () (" + prefix + "_link_speed_bits > 0)"},
+	}
+	alerting = []promRule{
+		{
+			alert:   "NetworkInterfaceSaturated",
+			expr:    utilization + " > " + formatRuleNumber(*rulesSaturation/100),
+			hold:    *rulesFor,
+			summary: "{{ $labels.interface }} on {{ $labels.instance }} is at {{ $value | humanizePercentage }} of its link speed ({{ $labels.direction }})",
+		},
+		{
+			alert:   "NetworkInterfaceErrors",
+			expr:    rate("errors") + " / " + rate("packets") + " > " + formatRuleNumber(*rulesErrorRate/100),
+			hold:    *rulesFor,
+			summary: "{{ $value | humanizePercentage }} of the packets of {{ $labels.interface }} on {{ $labels.instance }} have errors ({{ $labels.direction }})",
+		},
+		{
+			// Flapping is already judged over --flap.window
+			alert:   "NetworkInterfaceFlapping",
+			expr:    prefix + "_flapping == 1",
+			summary: "{{ $labels.interface }} on {{ $labels.instance }} keeps going up and down",
+		},
+	}
+	return recording, alerting
+}
+
+// formatRuleNumber formats a threshold without a trailing exponent or zeros
+func formatRuleNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// writeRules writes the generated rules as a Prometheus rule file
+func writeRules(w io.Writer) {
+	recording, alerting := generateRules()
+	var b strings.Builder
+	b.WriteString("# Generated by vyosexporter rules\ngroups:\n")
+	b.WriteString("  - name: vyosexporter.rules\n    rules:\n")
+	for _, r := range recording {
+		fmt.Fprintf(&b, "      - record: %s\n        expr: %s\n", r.record, strconv.Quote(r.expr))
+	}
+	b.WriteString("  - name: vyosexporter.alerts\n    rules:\n")
+	for _, r := range alerting {
+		fmt.Fprintf(&b, "      - alert: %s\n        expr: %s\n", r.alert, strconv.Quote(r.expr))
+		if r.hold > 0 {
+			fmt.Fprintf(&b, "        for: %s\n", model.Duration(r.hold))
+		}
+		fmt.Fprintf(&b, "        labels:\n          severity: %s\n", strconv.Quote(*rulesSeverity))
+		fmt.Fprintf(&b, "        annotations:\n          summary: %s\n", strconv.Quote(r.summary))
+	}
+	io.WriteString(w, b.String())
+}
+
+// runRules implements the rules subcommand
+func runRules(w io.Writer) error {
+	if err := validateMetricsPrefix(); err != nil {
+		return err
+	}
+	if err := validateSpeedUnit(); err != nil {
+		return err
+	}
+	if err := validateRulesFlags(); err != nil {
+		return err
+	}
+	writeRules(w)
+	return nil
+}
+
+// handleRules serves the generated rules at /rules.yaml
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	writeRules(w)
+}
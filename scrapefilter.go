@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registries of the groups /metrics?collect[]= selects, holding the same
+// collectors as customRegistry: the collectors by name, the derived metrics
+// by feature, and speed, errors, drops, packets and info for the
+// per-interface basics
+var groupRegistries = make(map[string]*prometheus.Registry)
+
+// Collectors registered with customRegistry, for validateStaticLabels
+var registeredCollectors []prometheus.Collector
+
+// registerMetrics registers collectors with customRegistry and with the
+// registry of their group. Collectors registered once the flags are parsed,
+// by the collectors as they start, have to pass checkStaticLabels.
+func registerMetrics(group string, cs ...prometheus.Collector) {
+	if flag.Parsed() {
+		if err := checkStaticLabels(cs...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	registeredCollectors = append(registeredCollectors, cs...)
+	customRegistry.MustRegister(cs...)
+	r, ok := groupRegistries[group]
+	if !ok {
+		r = prometheus.NewRegistry()
+		groupRegistries[group] = r
+	}
+	r.MustRegister(cs...)
+}
+
+// Groups of the dev collector, whose series main publishes
+var devGroups = []string{"speed", "errors", "drops", "packets", "info"}
+
+// scrapeGroups returns the gatherers of the groups by name, the remote hosts
+// and the exporter's runtime metrics included. Collectors that registered
+// nothing, being disabled, are empty groups.
+func scrapeGroups() map[string]prometheus.Gatherer {
+	groups := map[string]prometheus.Gatherer{"remote": remoteRegistry, "runtime": runtimeRegistry}
+	for name := range collectors {
+		groups[name] = prometheus.Gatherers{}
+	}
+	for name, r := range groupRegistries {
+		groups[name] = r
+	}
+	var dev prometheus.Gatherers
+	for _, name := range devGroups {
+		if r, ok := groupRegistries[name]; ok {
+			dev = append(dev, r)
+		}
+	}
+	groups["dev"] = dev
+	return groups
+}
+
+// scrapeFilter is the subset of the series a scrape asked for
+type scrapeFilter struct {
+	// Selected groups, all if empty
+	groups []string
+	// Matches the interfaces to keep, all if nil
+	iface *regexp.Regexp
+}
+
+// parseScrapeFilter parses the collect[] and interface query parameters of a
+// scrape. It returns nil if the scrape asked for everything.
+func parseScrapeFilter(query url.Values) (*scrapeFilter, error) {
+	if !query.Has("collect[]") && !query.Has("interface") {
+		return nil, nil
+	}
+	f := &scrapeFilter{}
+	groups := scrapeGroups()
+	for _, name := range query["collect[]"] {
+		if _, ok := groups[name]; !ok {
+			names := make([]string, 0, len(groups))
+			for n := range groups {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown collect[] %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		f.groups = append(f.groups, name)
+	}
+	if pattern := query.Get("interface"); pattern != "" {
+		// Anchored like Prometheus label matchers
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface %q: %v", pattern, err)
+		}
+		f.iface = re
+	}
+	return f, nil
+}
+
+// gatherer returns the filtered series of base, the gatherer the scrape
+// would get without collect[] and interface. With collect[] the groups
+// replace base, except on a per-host scrape, where only remote selects
+// anything; remote=false leaves remote out.
+func (f *scrapeFilter) gatherer(base prometheus.Gatherer, remote bool, host string) prometheus.Gatherer {
+	g := base
+	if len(f.groups) > 0 {
+		groups := scrapeGroups()
+		var selected prometheus.Gatherers
+		for _, name := range f.groups {
+			switch {
+			case host != "":
+				// A per-host scrape has only remote series
+				if name == "remote" {
+					selected = append(selected, base)
+				}
+			case name == "remote" && !remote:
+			default:
+				selected = append(selected, groups[name])
+			}
+		}
+		g = selected
+	}
+	if f.iface == nil {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		filtered := families[:0]
+		for _, mf := range families {
+			metrics := mf.Metric[:0]
+			for _, m := range mf.Metric {
+				if f.keeps(m) {
+					metrics = append(metrics, m)
+				}
+			}
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
+
+// keeps reports whether a series passes the interface filter. Series of no
+// interface, like those of the exporter itself, always do; the node_exporter
+// compatible series name the interface device.
+func (f *scrapeFilter) keeps(m *dto.Metric) bool {
+	for _, lp := range m.Label {
+		if name := lp.GetName(); name == "interface" || name == "device" {
+			return f.iface.MatchString(lp.GetValue())
+		}
+	}
+	return true
+}
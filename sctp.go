@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sctpInterval = flag.Duration("sctp.interval", 15*time.Second, "How often to read the SCTP counters and associations from /proc/net/sctp")
+
+// Names of the association states of /proc/net/sctp/assocs, from
+// sctp_state_t in net/sctp/constants.h
+var sctpStates = []string{"closed", "cookie_wait", "cookie_echoed", "established",
+	"shutdown_pending", "shutdown_sent", "shutdown_received", "shutdown_ack_sent"}
+
+var (
+	sctpAssociationsDesc = prometheus.NewDesc("network_sctp_associations",
+		"Number of SCTP associations by state", []string{"state"}, nil)
+	sctpEstablishedDesc = prometheus.NewDesc("network_sctp_established_total",
+		"SCTP associations established, by whether the host initiated them", []string{"mode"}, nil)
+	sctpAbortedDesc = prometheus.NewDesc("network_sctp_aborted_total",
+		"SCTP associations aborted with an ABORT chunk", nil, nil)
+	sctpShutdownsDesc = prometheus.NewDesc("network_sctp_shutdowns_total",
+		"SCTP associations closed gracefully", nil, nil)
+	sctpPacketsDesc = prometheus.NewDesc("network_sctp_packets_total",
+		"SCTP packets received or sent", []string{"direction"}, nil)
+	sctpChunksDesc = prometheus.NewDesc("network_sctp_chunks_total",
+		"SCTP chunks received or sent, by control, ordered data and unordered data", []string{"direction", "type"}, nil)
+	sctpErrorsDesc = prometheus.NewDesc("network_sctp_errors_total",
+		"SCTP packets and chunks received that were discarded, by reason", []string{"reason"}, nil)
+	sctpRetransmitsDesc = prometheus.NewDesc("network_sctp_retransmits_total",
+		"SCTP data chunks retransmitted, by what triggered the retransmission", []string{"reason"}, nil)
+	sctpTimeoutsDesc = prometheus.NewDesc("network_sctp_timer_expirations_total",
+		"SCTP protocol timers that expired, by timer", []string{"timer"}, nil)
+
+	// Counters of /proc/net/sctp/snmp by their series
+	sctpCounters = map[string]struct {
+		desc   *prometheus.Desc
+		labels []string
+	}{
+		"SctpActiveEstabs":            {sctpEstablishedDesc, []string{"active"}},
+		"SctpPassiveEstabs":           {sctpEstablishedDesc, []string{"passive"}},
+		"SctpAborteds":                {sctpAbortedDesc, nil},
+		"SctpShutdowns":               {sctpShutdownsDesc, nil},
+		"SctpInSCTPPacks":             {sctpPacketsDesc, []string{"receive"}},
+		"SctpOutSCTPPacks":            {sctpPacketsDesc, []string{"transmit"}},
+		"SctpInCtrlChunks":            {sctpChunksDesc, []string{"receive", "control"}},
+		"SctpInOrderChunks":           {sctpChunksDesc, []string{"receive", "ordered"}},
+		"SctpInUnorderChunks":         {sctpChunksDesc, []string{"receive", "unordered"}},
+		"SctpOutCtrlChunks":           {sctpChunksDesc, []string{"transmit", "control"}},
+		"SctpOutOrderChunks":          {sctpChunksDesc, []string{"transmit", "ordered"}},
+		"SctpOutUnorderChunks":        {sctpChunksDesc, []string{"transmit", "unordered"}},
+		"SctpOutOfBlues":              {sctpErrorsDesc, []string{"out_of_the_blue"}},
+		"SctpChecksumErrors":          {sctpErrorsDesc, []string{"checksum"}},
+		"SctpInPktDiscards":           {sctpErrorsDesc, []string{"packet_discard"}},
+		"SctpInDataChunkDiscards":     {sctpErrorsDesc, []string{"data_chunk_discard"}},
+		"SctpT3Retransmits":           {sctpRetransmitsDesc, []string{"timeout"}},
+		"SctpFastRetransmits":         {sctpRetransmitsDesc, []string{"fast"}},
+		"SctpPmtudRetransmits":        {sctpRetransmitsDesc, []string{"pmtu"}},
+		"SctpT1InitExpireds":          {sctpTimeoutsDesc, []string{"t1_init"}},
+		"SctpT1CookieExpireds":        {sctpTimeoutsDesc, []string{"t1_cookie"}},
+		"SctpT2ShutdownExpireds":      {sctpTimeoutsDesc, []string{"t2_shutdown"}},
+		"SctpT3RtxExpireds":           {sctpTimeoutsDesc, []string{"t3_rtx"}},
+		"SctpT4RtoExpireds":           {sctpTimeoutsDesc, []string{"t4_rto"}},
+		"SctpT5ShutdownGuardExpireds": {sctpTimeoutsDesc, []string{"t5_shutdown_guard"}},
+		"SctpDelaySackExpireds":       {sctpTimeoutsDesc, []string{"delayed_sack"}},
+		"SctpAutocloseExpireds":       {sctpTimeoutsDesc, []string{"autoclose"}},
+	}
+
+	// Result of the last read of /proc/net/sctp, empty while the sctp
+	// module is not loaded
+	sctpSnapshot struct {
+		sync.Mutex
+		counters     map[string]uint64
+		associations map[string]int
+	}
+)
+
+func init() {
+	registerCollector("sctp", "SCTP association counts and error counters from /proc/net/sctp", false, startSCTPCollector)
+}
+
+// readSCTPCounters reads /proc/net/sctp/snmp, lines of a counter name and
+// its value
+func readSCTPCounters() (map[string]uint64, error) {
+	file, err := os.Open(procFilePath("net/sctp/snmp"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	counters := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			counters[fields[0]] = v
+		}
+	}
+	return counters, scanner.Err()
+}
+
+// readSCTPAssociations counts the associations of /proc/net/sctp/assocs by
+// state, the fifth column
+func readSCTPAssociations() (map[string]int, error) {
+	file, err := os.Open(procFilePath("net/sctp/assocs"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	associations := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if state, err := strconv.Atoi(fields[4]); err == nil && state >= 0 && state < len(sctpStates) {
+			associations[sctpStates[state]]++
+		}
+	}
+	return associations, scanner.Err()
+}
+
+// startSCTPCollector starts reading the SCTP counters
+func startSCTPCollector() error {
+	registerMetrics("sctp", sctpCollector{})
+	go collectSCTP()
+	return nil
+}
+
+// collectSCTP periodically refreshes the SCTP snapshot. /proc/net/sctp
+// appears once the sctp module is loaded, with the first SCTP socket.
+func collectSCTP() {
+	for {
+		counters, err := readSCTPCounters()
+		var associations map[string]int
+		if err == nil {
+			associations, err = readSCTPAssociations()
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading SCTP counters: %v", err)
+		} else {
+			sctpSnapshot.Lock()
+			sctpSnapshot.counters, sctpSnapshot.associations = counters, associations
+			sctpSnapshot.Unlock()
+		}
+		time.Sleep(*sctpInterval)
+	}
+}
+
+// sctpCollector exports the last SCTP counters
+type sctpCollector struct{}
+
+func (sctpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sctpAssociationsDesc
+	ch <- sctpEstablishedDesc
+	ch <- sctpAbortedDesc
+	ch <- sctpShutdownsDesc
+	ch <- sctpPacketsDesc
+	ch <- sctpChunksDesc
+	ch <- sctpErrorsDesc
+	ch <- sctpRetransmitsDesc
+	ch <- sctpTimeoutsDesc
+}
+
+func (sctpCollector) Collect(ch chan<- prometheus.Metric) {
+	sctpSnapshot.Lock()
+	defer sctpSnapshot.Unlock()
+	if sctpSnapshot.counters == nil {
+		return
+	}
+	// Every known state, so an association going away shows as 0
+	for _, state := range sctpStates {
+		ch <- prometheus.MustNewConstMetric(sctpAssociationsDesc, prometheus.GaugeValue, float64(sctpSnapshot.associations[state]), state)
+	}
+	for name, value := range sctpSnapshot.counters {
+		if c, ok := sctpCounters[name]; ok {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(value), c.labels...)
+		}
+	}
+}
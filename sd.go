@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sdTargetGroup is a target group of the Prometheus HTTP service discovery
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// handleSD lists the exporter itself and each remote host as a target for
+// the Prometheus HTTP service discovery. The remote hosts are scraped from
+// the exporter with their host as parameter, so each gets its own up series.
+func handleSD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The exporter is reachable the way Prometheus reached /sd
+	groups := []sdTargetGroup{{
+		Targets: []string{r.Host},
+		Labels:  map[string]string{"__param_remote": "false", "__meta_networkspeed_source": "local"},
+	}}
+	remoteSnapshot.Lock()
+	for _, h := range remoteSnapshot.hosts {
+		groups = append(groups, sdTargetGroup{
+			Targets: []string{r.Host},
+			Labels: map[string]string{
+				"__param_host":               h.destination,
+				"instance":                   h.destination,
+				"__meta_networkspeed_host":   h.destination,
+				"__meta_networkspeed_source": h.source,
+			},
+		})
+	}
+	remoteSnapshot.Unlock()
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// handleMetrics serves all series, those of the remote host of the host
+// parameter, or with remote=false only the ones of the exporter itself,
+// narrowed down to groups by collect[] and to interfaces by interface
+func handleMetrics(all, local prometheus.Gatherer) http.Handler {
+	allHandler := metricsHTTPHandler(metricsGatherer(all))
+	localHandler := metricsHTTPHandler(metricsGatherer(local))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseScrapeFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.Get("remote") == "false" {
+			if filter != nil {
+				metricsHTTPHandler(metricsGatherer(filter.gatherer(local, false, ""))).ServeHTTP(w, r)
+				return
+			}
+			localHandler.ServeHTTP(w, r)
+			return
+		}
+		host := query.Get("host")
+		if host == "" {
+			if filter != nil {
+				metricsHTTPHandler(metricsGatherer(filter.gatherer(all, true, ""))).ServeHTTP(w, r)
+				return
+			}
+			allHandler.ServeHTTP(w, r)
+			return
+		}
+		if !isRemoteHost(host) {
+			http.Error(w, "Unknown host", http.StatusNotFound)
+			return
+		}
+		g := remoteHostGatherer(host)
+		if filter != nil {
+			g = filter.gatherer(g, true, host)
+		}
+		metricsHTTPHandler(metricsGatherer(g)).ServeHTTP(w, r)
+	})
+}
+
+// isRemoteHost reports whether host is one of the remote hosts
+func isRemoteHost(host string) bool {
+	remoteSnapshot.Lock()
+	defer remoteSnapshot.Unlock()
+	for _, h := range remoteSnapshot.hosts {
+		if h.destination == host {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHostGatherer gathers the series of one remote host
+func remoteHostGatherer(host string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := remoteRegistry.Gather()
+		var filtered []*dto.MetricFamily
+		for _, mf := range families {
+			var metrics []*dto.Metric
+			for _, m := range mf.Metric {
+				for _, lp := range m.Label {
+					if lp.GetName() == "host" && lp.GetValue() == host {
+						metrics = append(metrics, m)
+						break
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
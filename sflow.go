@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	sflowVersion = 5
+	// Sample and record formats (enterprise 0)
+	sflowCountersSample      = 2
+	sflowGenericIfCounters   = 1
+	sflowGenericIfRecordSize = 88
+	// Value for counters the exporter doesn't know
+	sflowUnknownCounter = 0xFFFFFFFF
+	// ifType ethernetCsmacd
+	sflowIfTypeEthernet = 6
+
+	sflowMaxPacketSize = 1400
+)
+
+var (
+	sflowCollector    = flag.String("sflow.collector", "", "Address (host:port) of an sFlow collector to push interface counters to; empty disables")
+	sflowInterval     = flag.Duration("sflow.interval", 20*time.Second, "sFlow counter polling interval")
+	sflowAgentAddress = flag.String("sflow.agent-address", "", "Agent IP address reported in sFlow datagrams (default: local address used to reach the collector)")
+)
+
+// sflowAgent pushes counter samples to a collector
+type sflowAgent struct {
+	conn      net.Conn
+	agentIP   net.IP
+	sequence  uint32
+	sampleSeq map[int]uint32
+}
+
+// validateSflowFlags checks --sflow.agent-address
+func validateSflowFlags() error {
+	if *sflowAgentAddress != "" && net.ParseIP(*sflowAgentAddress) == nil {
+		return fmt.Errorf("invalid --sflow.agent-address %q", *sflowAgentAddress)
+	}
+	return nil
+}
+
+// newSflowAgent connects to the collector and determines the agent address
+func newSflowAgent() (*sflowAgent, error) {
+	if err := validateSflowFlags(); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", *sflowCollector)
+	if err != nil {
+		return nil, err
+	}
+	agentIP := conn.LocalAddr().(*net.UDPAddr).IP
+	if *sflowAgentAddress != "" {
+		agentIP = net.ParseIP(*sflowAgentAddress)
+	}
+	return &sflowAgent{conn: conn, agentIP: agentIP, sampleSeq: make(map[int]uint32)}, nil
+}
+
+// appendHeader appends the datagram header for numSamples samples
+func (a *sflowAgent) appendHeader(buf []byte, numSamples int) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, sflowVersion)
+	if ip4 := a.agentIP.To4(); ip4 != nil {
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = append(buf, ip4...)
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, 2)
+		buf = append(buf, a.agentIP.To16()...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, 0) // sub-agent ID
+	buf = binary.BigEndian.AppendUint32(buf, a.sequence)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(time.Since(startTime).Milliseconds()))
+	return binary.BigEndian.AppendUint32(buf, uint32(numSamples))
+}
+
+// appendCountersSample appends a counters sample holding a generic interface counters record
+func (a *sflowAgent) appendCountersSample(buf []byte, s interfaceStats) []byte {
+	a.sampleSeq[s.Index]++
+
+	buf = binary.BigEndian.AppendUint32(buf, sflowCountersSample)
+	buf = binary.BigEndian.AppendUint32(buf, 4*3+8+sflowGenericIfRecordSize)
+	buf = binary.BigEndian.AppendUint32(buf, a.sampleSeq[s.Index])
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.Index)) // source ID type 0 (ifIndex)
+	buf = binary.BigEndian.AppendUint32(buf, 1)               // number of records
+
+	direction := uint32(0) // unknown
+	if duplex, err := readSysfsAttr(s.Name, "duplex"); err == nil {
+		switch duplex {
+		case "full":
+			direction = 1
+		case "half":
+			direction = 2
+		}
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, sflowGenericIfCounters)
+	buf = binary.BigEndian.AppendUint32(buf, sflowGenericIfRecordSize)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.Index))
+	buf = binary.BigEndian.AppendUint32(buf, sflowIfTypeEthernet)
+	buf = binary.BigEndian.AppendUint64(buf, linkSpeedBits(s.Name))
+	buf = binary.BigEndian.AppendUint32(buf, direction)
+	buf = binary.BigEndian.AppendUint32(buf, 3) // admin and oper up, down interfaces are not collected
+	buf = binary.BigEndian.AppendUint64(buf, s.RxBytes)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.RxPackets))
+	buf = binary.BigEndian.AppendUint32(buf, sflowUnknownCounter) // multicast
+	buf = binary.BigEndian.AppendUint32(buf, sflowUnknownCounter) // broadcast
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.RxDrops))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.RxErrors))
+	buf = binary.BigEndian.AppendUint32(buf, sflowUnknownCounter) // unknown protocols
+	buf = binary.BigEndian.AppendUint64(buf, s.TxBytes)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.TxPackets))
+	buf = binary.BigEndian.AppendUint32(buf, sflowUnknownCounter) // multicast
+	buf = binary.BigEndian.AppendUint32(buf, sflowUnknownCounter) // broadcast
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.TxDrops))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.TxErrors))
+	return binary.BigEndian.AppendUint32(buf, 0) // promiscuous mode
+}
+
+// push sends one counters sample per interface, split over as many datagrams as needed
+func (a *sflowAgent) push(stats []interfaceStats) error {
+	const sampleSize = 4*2 + 4*3 + 8 + sflowGenericIfRecordSize
+	perPacket := (sflowMaxPacketSize - 48) / sampleSize
+
+	for len(stats) > 0 {
+		n := len(stats)
+		if n > perPacket {
+			n = perPacket
+		}
+		a.sequence++
+		buf := a.appendHeader(make([]byte, 0, sflowMaxPacketSize), n)
+		for _, s := range stats[:n] {
+			buf = a.appendCountersSample(buf, s)
+		}
+		stats = stats[n:]
+		if _, err := a.conn.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// runPushSink calls push with the latest interface stats every interval. Push
+// errors are logged and retried on the next interval.
+func runPushSink(name string, interval time.Duration, push func([]interfaceStats) error) {
+	for {
+		time.Sleep(interval)
+		stats := currentStats()
+		if len(stats) == 0 {
+			continue
+		}
+		if err := push(stats); err != nil {
+			log.Printf("Error pushing metrics to %s: %v", name, err)
+		}
+	}
+}
+
+// interfaceJSON is the JSON representation of interfaceStats used by the
+// JSON-speaking sinks and the API. The speeds are left out on the first cycle
+// of an interface and after a collection gap.
+type interfaceJSON struct {
+	Interface       string   `json:"interface"`
+	Description     string   `json:"description"`
+	Index           int      `json:"index"`
+	LinkSpeedBits   uint64   `json:"link_speed_bits,omitempty"`
+	RxBitsPerSecond *float64 `json:"rx_bits_per_second,omitempty"`
+	TxBitsPerSecond *float64 `json:"tx_bits_per_second,omitempty"`
+	RxBytes         uint64   `json:"rx_bytes"`
+	TxBytes         uint64   `json:"tx_bytes"`
+	RxPackets       uint64   `json:"rx_packets"`
+	TxPackets       uint64   `json:"tx_packets"`
+	RxErrors        uint64   `json:"rx_errors"`
+	TxErrors        uint64   `json:"tx_errors"`
+	RxDrops         uint64   `json:"rx_drops"`
+	TxDrops         uint64   `json:"tx_drops"`
+	Timestamp       int64    `json:"timestamp"`
+}
+
+func interfaceToJSON(s interfaceStats) interfaceJSON {
+	j := interfaceJSON{
+		Interface:   s.Name,
+		Description: s.Description,
+		Index:       s.Index,
+		RxBytes:     s.RxBytes,
+		TxBytes:     s.TxBytes,
+		RxPackets:   s.RxPackets,
+		TxPackets:   s.TxPackets,
+		RxErrors:    s.RxErrors,
+		TxErrors:    s.TxErrors,
+		RxDrops:     s.RxDrops,
+		TxDrops:     s.TxDrops,
+		Timestamp:   s.Time.Unix(),
+	}
+	if s.HasSpeed {
+		j.RxBitsPerSecond, j.TxBitsPerSecond = &s.RxSpeed, &s.TxSpeed
+	}
+	return j
+}
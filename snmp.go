@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+)
+
+var (
+	snmpTargets  = flag.String("snmp.targets", "", "Comma-separated SNMPv2c devices to poll the IF-MIB of as [community@]host[:port], e.g. public@sw1,10.0.0.2; community public and port 161 by default")
+	snmpInterval = flag.Duration("snmp.interval", 30*time.Second, "How often to poll the SNMP devices")
+	snmpTimeout  = flag.Duration("snmp.timeout", 5*time.Second, "How long to wait for each SNMP response before retrying once")
+)
+
+// BER and SNMP tags
+const (
+	berInteger        = 0x02
+	berOctetString    = 0x04
+	berNull           = 0x05
+	berOID            = 0x06
+	berSequence       = 0x30
+	snmpCounter32     = 0x41
+	snmpGauge32       = 0x42
+	snmpTimeTicks     = 0x43
+	snmpCounter64     = 0x46
+	snmpEndOfMibView  = 0x82
+	snmpGetResponse   = 0xa2
+	snmpGetBulk       = 0xa5
+	snmpVersion2c     = 1
+	snmpMaxRepetition = 25
+)
+
+// IF-MIB columns, indexed by ifIndex
+var (
+	ifDescr              = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 2}
+	ifType               = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 3}
+	ifMtu                = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 4}
+	ifAdminStatus        = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 7}
+	ifOperStatus         = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 8}
+	ifInDiscards         = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 13}
+	ifInErrors           = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 14}
+	ifOutDiscards        = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 19}
+	ifOutErrors          = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 20}
+	ifName               = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 1}
+	ifHCInOctets         = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 6}
+	ifHCInUcastPkts      = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 7}
+	ifHCInMulticastPkts  = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 8}
+	ifHCInBroadcastPkts  = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 9}
+	ifHCOutOctets        = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 10}
+	ifHCOutUcastPkts     = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 11}
+	ifHCOutMulticastPkts = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 12}
+	ifHCOutBroadcastPkts = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 13}
+	ifHighSpeed          = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 15}
+	ifAlias              = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 18}
+)
+
+// ifOperStatus values, named like the operstate of local interfaces
+var snmpOperStates = map[uint64]string{1: "up", 2: "down", 3: "testing", 4: "unknown", 5: "dormant", 6: "notpresent", 7: "lowerlayerdown"}
+
+// softwareLoopback(24) of IANAifType
+const ifTypeSoftwareLoopback = 24
+
+func init() {
+	registerCollector("snmp", "IF-MIB interface counters of switches and routers polled over SNMPv2c, with a host label", false, startSNMPCollector).
+		checks(checkSNMPFlags)
+}
+
+type snmpOID []uint32
+
+func (o snmpOID) hasPrefix(prefix snmpOID) bool {
+	if len(o) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if o[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// snmpValue is a decoded variable binding value
+type snmpValue struct {
+	tag     byte
+	content []byte
+}
+
+// uint decodes an INTEGER, counter, gauge or TimeTicks value
+func (v snmpValue) uint() (uint64, bool) {
+	switch v.tag {
+	case berInteger, snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+	default:
+		return 0, false
+	}
+	if len(v.content) == 0 || len(v.content) > 9 {
+		return 0, false
+	}
+	var n uint64
+	for _, b := range v.content {
+		n = n<<8 | uint64(b)
+	}
+	return n, true
+}
+
+// berAppend appends a BER TLV with a definite length
+func berAppend(b []byte, tag byte, content []byte) []byte {
+	b = append(b, tag)
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+// berInt encodes a non-negative INTEGER
+func berInt(v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 1 && b[0] == 0 && b[1]&0x80 == 0 {
+		b = b[1:]
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berAppend(nil, berInteger, b)
+}
+
+// berEncodeOID encodes an OBJECT IDENTIFIER
+func berEncodeOID(oid snmpOID) []byte {
+	content := []byte{byte(oid[0]*40 + oid[1])}
+	for _, id := range oid[2:] {
+		var sub []byte
+		for sub = []byte{byte(id & 0x7f)}; id >= 0x80; {
+			id >>= 7
+			sub = append([]byte{byte(id&0x7f) | 0x80}, sub...)
+		}
+		content = append(content, sub...)
+	}
+	return berAppend(nil, berOID, content)
+}
+
+// berRead splits the first TLV off b
+func berRead(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, errors.New("invalid BER length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// berDecodeOID decodes the content of an OBJECT IDENTIFIER
+func berDecodeOID(content []byte) snmpOID {
+	if len(content) == 0 {
+		return nil
+	}
+	oid := snmpOID{uint32(content[0]) / 40, uint32(content[0]) % 40}
+	var id uint32
+	for _, c := range content[1:] {
+		id = id<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			oid = append(oid, id)
+			id = 0
+		}
+	}
+	return oid
+}
+
+// snmpTarget is one entry of --snmp.targets
+type snmpTarget struct {
+	host      string
+	address   string
+	community string
+}
+
+// parseSNMPTargets parses --snmp.targets
+func parseSNMPTargets(value string) ([]snmpTarget, error) {
+	var targets []snmpTarget
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		t := snmpTarget{community: "public"}
+		if i := strings.LastIndex(field, "@"); i >= 0 {
+			t.community, field = field[:i], field[i+1:]
+		}
+		t.host, t.address = field, field
+		if _, _, err := net.SplitHostPort(field); err != nil {
+			t.address = net.JoinHostPort(strings.Trim(field, "[]"), "161")
+		}
+		if t.host == "" {
+			return nil, errors.New("missing host")
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	return targets, nil
+}
+
+// snmpClient polls one device over a connected UDP socket
+type snmpClient struct {
+	target snmpTarget
+	conn   net.Conn
+	buf    []byte
+}
+
+// getBulk sends a GetBulkRequest for the successors of oid and returns the
+// variable bindings of the response
+func (c *snmpClient) getBulk(oid snmpOID) ([]snmpOID, []snmpValue, error) {
+	var id [4]byte
+	rand.Read(id[:])
+	requestID := binary.BigEndian.Uint32(id[:]) & 0x7fffffff
+	varbind := berAppend(nil, berSequence, append(berEncodeOID(oid), berNull, 0))
+	pdu := append(berInt(requestID), berInt(0)...)
+	pdu = append(pdu, berInt(snmpMaxRepetition)...)
+	pdu = append(pdu, berAppend(nil, berSequence, varbind)...)
+	msg := append(berInt(snmpVersion2c), berAppend(nil, berOctetString, []byte(c.target.community))...)
+	msg = berAppend(nil, berSequence, berAppend(msg, snmpGetBulk, pdu))
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := c.conn.Write(msg); err != nil {
+			return nil, nil, err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(*snmpTimeout))
+		for {
+			n, err := c.conn.Read(c.buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, nil, err
+			}
+			// The values refer to the response, copy it out of the buffer
+			oids, values, responseID, err := parseSNMPResponse(append([]byte(nil), c.buf[:n]...))
+			if err != nil {
+				return nil, nil, err
+			}
+			// Late responses to an earlier request
+			if responseID == requestID {
+				return oids, values, nil
+			}
+		}
+	}
+	return nil, nil, errors.New("no response")
+}
+
+// parseSNMPResponse decodes a GetResponse message
+func parseSNMPResponse(b []byte) ([]snmpOID, []snmpValue, uint32, error) {
+	tag, msg, _, err := berRead(b)
+	if err != nil || tag != berSequence {
+		return nil, nil, 0, errors.New("invalid SNMP message")
+	}
+	var fields [][]byte
+	for i := 0; i < 3; i++ {
+		var content []byte
+		if tag, content, msg, err = berRead(msg); err != nil {
+			return nil, nil, 0, err
+		}
+		fields = append(fields, content)
+	}
+	if tag != snmpGetResponse {
+		return nil, nil, 0, fmt.Errorf("unexpected PDU type %#x", tag)
+	}
+	pdu := fields[2]
+	var header [3]uint64
+	for i := range header {
+		var content []byte
+		if tag, content, pdu, err = berRead(pdu); err != nil {
+			return nil, nil, 0, err
+		}
+		header[i], _ = snmpValue{tag, content}.uint()
+	}
+	if header[1] != 0 {
+		return nil, nil, 0, fmt.Errorf("SNMP error status %d", header[1])
+	}
+	_, list, _, err := berRead(pdu)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var oids []snmpOID
+	var values []snmpValue
+	for len(list) > 0 {
+		var varbind []byte
+		if _, varbind, list, err = berRead(list); err != nil {
+			return nil, nil, 0, err
+		}
+		_, oid, rest, err := berRead(varbind)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		tag, content, _, err := berRead(rest)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		oids = append(oids, berDecodeOID(oid))
+		values = append(values, snmpValue{tag, content})
+	}
+	return oids, values, uint32(header[0]), nil
+}
+
+// walk returns the values of a table column by ifIndex
+func (c *snmpClient) walk(column snmpOID) (map[uint32]snmpValue, error) {
+	values := make(map[uint32]snmpValue)
+	oid := column
+	for {
+		oids, vals, err := c.getBulk(oid)
+		if err != nil {
+			return nil, err
+		}
+		for i, next := range oids {
+			if !next.hasPrefix(column) || len(next) != len(column)+1 || vals[i].tag == snmpEndOfMibView {
+				return values, nil
+			}
+			values[next[len(column)]] = vals[i]
+			oid = next
+		}
+		if len(oids) == 0 {
+			return values, nil
+		}
+	}
+}
+
+// poll walks the IF-MIB columns and returns them as a sample. Interfaces are
+// named by ifName, or ifDescr on devices without it.
+func (c *snmpClient) poll() (remoteSample, error) {
+	columns := make(map[string]map[uint32]snmpValue)
+	var read time.Time
+	for _, column := range []struct {
+		name string
+		oid  snmpOID
+	}{
+		// The octet counters first, read as close together as possible
+		{"inOctets", ifHCInOctets}, {"outOctets", ifHCOutOctets},
+		{"inUcast", ifHCInUcastPkts}, {"inMulticast", ifHCInMulticastPkts}, {"inBroadcast", ifHCInBroadcastPkts},
+		{"outUcast", ifHCOutUcastPkts}, {"outMulticast", ifHCOutMulticastPkts}, {"outBroadcast", ifHCOutBroadcastPkts},
+		{"inErrors", ifInErrors}, {"outErrors", ifOutErrors}, {"inDiscards", ifInDiscards}, {"outDiscards", ifOutDiscards},
+		{"name", ifName}, {"descr", ifDescr}, {"type", ifType}, {"mtu", ifMtu}, {"admin", ifAdminStatus},
+		{"oper", ifOperStatus}, {"speed", ifHighSpeed}, {"alias", ifAlias},
+	} {
+		start := time.Now()
+		values, err := c.walk(column.oid)
+		if err != nil {
+			return remoteSample{}, fmt.Errorf("walking %s: %w", column.name, err)
+		}
+		columns[column.name] = values
+		// The speeds are relative to the time the octets were read
+		if column.name == "inOctets" {
+			read = start.Add(time.Since(start) / 2)
+		}
+	}
+	counter := func(name string, index uint32) uint64 {
+		v, _ := columns[name][index].uint()
+		return v
+	}
+
+	s := remoteSample{counters: make(map[string]netspeed.Counters), links: make(map[string]remoteLink), time: read}
+	for index := range columns["inOctets"] {
+		name := string(columns["name"][index].content)
+		if name == "" {
+			name = string(columns["descr"][index].content)
+		}
+		if name == "" {
+			name = strconv.FormatUint(uint64(index), 10)
+		}
+		s.counters[name] = netspeed.Counters{
+			RxBytes:   counter("inOctets", index),
+			TxBytes:   counter("outOctets", index),
+			RxPackets: counter("inUcast", index) + counter("inMulticast", index) + counter("inBroadcast", index),
+			TxPackets: counter("outUcast", index) + counter("outMulticast", index) + counter("outBroadcast", index),
+			RxErrors:  counter("inErrors", index),
+			TxErrors:  counter("outErrors", index),
+			RxDrops:   counter("inDiscards", index),
+			TxDrops:   counter("outDiscards", index),
+		}
+		s.links[name] = remoteLink{
+			up:          counter("admin", index) == 1,
+			loopback:    counter("type", index) == ifTypeSoftwareLoopback,
+			description: string(columns["alias"][index].content),
+			mtu:         strconv.FormatUint(counter("mtu", index), 10),
+			operstate:   snmpOperStates[counter("oper", index)],
+			speed:       float64(counter("speed", index)) * 1e6,
+		}
+	}
+	return s, nil
+}
+
+// runSNMP polls the device every --snmp.interval
+func runSNMP(h *remoteHost, t snmpTarget) {
+	for ; ; time.Sleep(*snmpInterval) {
+		conn, err := net.Dial("udp", t.address)
+		if err != nil {
+			log.Printf("Error polling SNMP device %s: %v", t.host, err)
+			h.down()
+			continue
+		}
+		c := &snmpClient{target: t, conn: conn, buf: make([]byte, 65535)}
+		s, err := c.poll()
+		conn.Close()
+		if err != nil {
+			log.Printf("Error polling SNMP device %s: %v", t.host, err)
+			h.down()
+			continue
+		}
+		h.update(s)
+	}
+}
+
+// checkSNMPFlags validates --snmp.targets
+func checkSNMPFlags() error {
+	if _, err := parseSNMPTargets(*snmpTargets); err != nil {
+		return fmt.Errorf("invalid --snmp.targets: %w", err)
+	}
+	return nil
+}
+
+// startSNMPCollector starts polling the SNMP devices
+func startSNMPCollector() error {
+	targets, err := parseSNMPTargets(*snmpTargets)
+	if err != nil {
+		return fmt.Errorf("invalid --snmp.targets: %w", err)
+	}
+	hosts := make([]*remoteHost, len(targets))
+	for i, t := range targets {
+		hosts[i] = &remoteHost{destination: t.host, source: "snmp"}
+	}
+	addRemoteHosts(hosts)
+	for i, t := range targets {
+		go runSNMP(hosts[i], t)
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	speedtestServer    = flag.String("speedtest.server", "", "iperf3 server (host[:port]) to measure the upload and download capacity against")
+	speedtestInterval  = flag.Duration("speedtest.interval", 6*time.Hour, "How often to run the speed test")
+	speedtestDuration  = flag.Duration("speedtest.duration", 10*time.Second, "How long to send in each direction of the speed test")
+	speedtestInterface = flag.String("speedtest.interface", "", "Interface to run the speed test through regardless of the routing table, needs CAP_NET_RAW. The routing table decides when empty")
+)
+
+// iperf3 control protocol states, from iperf_api.h
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+	iperfDone            = 16
+	iperfAccessDenied    = -1
+	iperfServerError     = -2
+	// 36 random characters and a NUL identify the test on each connection
+	iperfCookieSize = 37
+	iperfBlockSize  = 128 * 1024
+)
+
+var (
+	speedtestBitsDesc = prometheus.NewDesc("network_speedtest_speed_bits",
+		"Throughput measured by the last successful speed test in bits per second", []string{"server", "direction"}, nil)
+	speedtestLatencyDesc = prometheus.NewDesc("network_speedtest_latency_seconds",
+		"TCP connection setup time to the speed test server measured by the last successful test", []string{"server"}, nil)
+	speedtestSuccessDesc = prometheus.NewDesc("network_speedtest_success",
+		"1 if the last speed test succeeded, 0 otherwise", []string{"server"}, nil)
+	speedtestTimestampDesc = prometheus.NewDesc("network_speedtest_last_success_timestamp_seconds",
+		"Time the last successful speed test finished", []string{"server"}, nil)
+
+	// Result of the last speed test
+	speedtestSnapshot struct {
+		sync.Mutex
+		ran, success     bool
+		upload, download float64
+		latency          float64
+		lastSuccess      time.Time
+	}
+)
+
+func init() {
+	registerCollector("speedtest", "scheduled upload and download capacity tests against an iperf3 server", false, startSpeedtestCollector).
+		checks(checkSpeedtestFlags)
+}
+
+// iperfParams are the test parameters sent to the server
+type iperfParams struct {
+	TCP           bool   `json:"tcp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Len           int    `json:"len"`
+	ClientVersion string `json:"client_version"`
+}
+
+// iperfResults are the results both sides exchange after the test
+type iperfResults struct {
+	CPUUtilTotal         float64       `json:"cpu_util_total"`
+	CPUUtilUser          float64       `json:"cpu_util_user"`
+	CPUUtilSystem        float64       `json:"cpu_util_system"`
+	SenderHasRetransmits int           `json:"sender_has_retransmits"`
+	Streams              []iperfStream `json:"streams"`
+}
+
+type iperfStream struct {
+	ID          int     `json:"id"`
+	Bytes       uint64  `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+// iperfConn is the control connection of an iperf3 test
+type iperfConn struct {
+	net.Conn
+}
+
+func (c iperfConn) readState() (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return 0, err
+	}
+	state := int8(b[0])
+	switch state {
+	case iperfAccessDenied:
+		return 0, errors.New("server busy")
+	case iperfServerError:
+		// Followed by the iperf3 error number and errno
+		var codes [8]byte
+		io.ReadFull(c, codes[:])
+		return 0, fmt.Errorf("server error %d", int32(binary.BigEndian.Uint32(codes[:])))
+	}
+	return state, nil
+}
+
+func (c iperfConn) writeState(state int8) error {
+	_, err := c.Write([]byte{byte(state)})
+	return err
+}
+
+// writeJSON sends a JSON message, prefixed with its length
+func (c iperfConn) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+	if err == nil {
+		_, err = c.Write(b)
+	}
+	return err
+}
+
+func (c iperfConn) readJSON(v any) error {
+	var n [4]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// speedtestDialer returns a dialer bound to --speedtest.interface if set
+func speedtestDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if *speedtestInterface != "" {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), *speedtestInterface)
+			})
+			return err
+		}
+	}
+	return d
+}
+
+// iperfCookie returns a random test cookie
+func iperfCookie() ([]byte, error) {
+	const chars = "abcdefghijklmnopqrstuvwxyz234567"
+	cookie := make([]byte, iperfCookieSize)
+	if _, err := rand.Read(cookie[:iperfCookieSize-1]); err != nil {
+		return nil, err
+	}
+	for i := range cookie[:iperfCookieSize-1] {
+		cookie[i] = chars[cookie[i]%byte(len(chars))]
+	}
+	cookie[iperfCookieSize-1] = 0
+	return cookie, nil
+}
+
+// runIperf3 runs one single-stream TCP test against the server, receiving
+// with reverse, and returns the throughput in bits per second and the
+// connection setup time of the control connection
+func runIperf3(server string, reverse bool, duration time.Duration) (float64, time.Duration, error) {
+	cookie, err := iperfCookie()
+	if err != nil {
+		return 0, 0, err
+	}
+	dialer := speedtestDialer()
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", server)
+	if err != nil {
+		return 0, 0, err
+	}
+	latency := time.Since(start)
+	c := iperfConn{conn}
+	defer c.Close()
+	// The test itself plus generous time for setup and the result exchange
+	c.SetDeadline(time.Now().Add(duration + time.Minute))
+	if _, err := c.Write(cookie); err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		data    net.Conn
+		bytes   atomic.Uint64
+		running time.Time
+		elapsed time.Duration
+		sent    uint64
+		// The receiver of reverse tests
+		receiver sync.WaitGroup
+	)
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+		receiver.Wait()
+	}()
+	for {
+		state, err := c.readState()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch state {
+		case iperfParamExchange:
+			params := iperfParams{
+				TCP:           true,
+				Time:          int(duration.Seconds()),
+				Parallel:      1,
+				Reverse:       reverse,
+				Len:           iperfBlockSize,
+				ClientVersion: "3.1.3",
+			}
+			if err := c.writeJSON(params); err != nil {
+				return 0, 0, err
+			}
+		case iperfCreateStreams:
+			if data, err = dialer.Dial("tcp", server); err != nil {
+				return 0, 0, err
+			}
+			if _, err := data.Write(cookie); err != nil {
+				return 0, 0, err
+			}
+			if reverse {
+				receiver.Add(1)
+				go func() {
+					defer receiver.Done()
+					buf := make([]byte, iperfBlockSize)
+					for {
+						n, err := data.Read(buf)
+						bytes.Add(uint64(n))
+						if err != nil {
+							return
+						}
+					}
+				}()
+			}
+		case iperfTestStart:
+		case iperfTestRunning:
+			if data == nil {
+				return 0, 0, errors.New("test started without a stream")
+			}
+			running = time.Now()
+			deadline := running.Add(duration)
+			if reverse {
+				time.Sleep(duration)
+				sent = bytes.Load()
+			} else {
+				buf := make([]byte, iperfBlockSize)
+				data.SetWriteDeadline(deadline)
+				for time.Now().Before(deadline) {
+					n, err := data.Write(buf)
+					sent += uint64(n)
+					if err != nil {
+						if !errors.Is(err, net.ErrClosed) && !errors.Is(err, unix.EPIPE) && !isTimeout(err) {
+							return 0, 0, err
+						}
+						break
+					}
+				}
+			}
+			elapsed = time.Since(running)
+			if err := c.writeState(iperfTestEnd); err != nil {
+				return 0, 0, err
+			}
+		case iperfExchangeResults:
+			stream := iperfStream{ID: 1, Bytes: sent, Retransmits: -1, EndTime: elapsed.Seconds()}
+			if err := c.writeJSON(iperfResults{SenderHasRetransmits: -1, Streams: []iperfStream{stream}}); err != nil {
+				return 0, 0, err
+			}
+			var results iperfResults
+			if err := c.readJSON(&results); err != nil {
+				return 0, 0, err
+			}
+			// Uploads count what arrived at the server
+			if !reverse && len(results.Streams) > 0 && results.Streams[0].Bytes > 0 {
+				sent = results.Streams[0].Bytes
+			}
+		case iperfDisplayResults:
+			if err := c.writeState(iperfDone); err != nil {
+				return 0, 0, err
+			}
+			if elapsed <= 0 {
+				return 0, 0, errors.New("test ended before it started")
+			}
+			return float64(sent) * 8 / elapsed.Seconds(), latency, nil
+		default:
+			return 0, 0, fmt.Errorf("unexpected state %d", state)
+		}
+	}
+}
+
+// isTimeout reports whether err is a deadline being exceeded
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// checkSpeedtestFlags validates --speedtest.server and --speedtest.duration
+func checkSpeedtestFlags() error {
+	if *speedtestServer == "" {
+		return errors.New("--speedtest.server is required")
+	}
+	if *speedtestDuration < time.Second {
+		return errors.New("--speedtest.duration must be at least 1s")
+	}
+	return nil
+}
+
+// startSpeedtestCollector starts the scheduled speed tests
+func startSpeedtestCollector() error {
+	if _, _, err := net.SplitHostPort(*speedtestServer); err != nil {
+		*speedtestServer = net.JoinHostPort(*speedtestServer, "5201")
+	}
+	registerMetrics("speedtest", speedtestCollector{})
+	go collectSpeedtest()
+	return nil
+}
+
+// collectSpeedtest runs the upload and then the download test every
+// --speedtest.interval
+func collectSpeedtest() {
+	for {
+		upload, latency, err := runIperf3(*speedtestServer, false, *speedtestDuration)
+		var download float64
+		if err == nil {
+			download, _, err = runIperf3(*speedtestServer, true, *speedtestDuration)
+		}
+		if err != nil {
+			log.Printf("Error running the speed test against %s: %v", *speedtestServer, err)
+		}
+		speedtestSnapshot.Lock()
+		speedtestSnapshot.ran, speedtestSnapshot.success = true, err == nil
+		if err == nil {
+			speedtestSnapshot.upload, speedtestSnapshot.download = upload, download
+			speedtestSnapshot.latency = latency.Seconds()
+			speedtestSnapshot.lastSuccess = time.Now()
+		}
+		speedtestSnapshot.Unlock()
+		time.Sleep(*speedtestInterval)
+	}
+}
+
+// speedtestCollector exports the last speed test result
+type speedtestCollector struct{}
+
+func (speedtestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- speedtestBitsDesc
+	ch <- speedtestLatencyDesc
+	ch <- speedtestSuccessDesc
+	ch <- speedtestTimestampDesc
+}
+
+func (speedtestCollector) Collect(ch chan<- prometheus.Metric) {
+	speedtestSnapshot.Lock()
+	defer speedtestSnapshot.Unlock()
+	if !speedtestSnapshot.ran {
+		return
+	}
+	server := *speedtestServer
+	ch <- prometheus.MustNewConstMetric(speedtestSuccessDesc, prometheus.GaugeValue, boolToFloat(speedtestSnapshot.success), server)
+	if speedtestSnapshot.lastSuccess.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(speedtestBitsDesc, prometheus.GaugeValue, speedtestSnapshot.upload, server, "upload")
+	ch <- prometheus.MustNewConstMetric(speedtestBitsDesc, prometheus.GaugeValue, speedtestSnapshot.download, server, "download")
+	ch <- prometheus.MustNewConstMetric(speedtestLatencyDesc, prometheus.GaugeValue, speedtestSnapshot.latency, server)
+	ch <- prometheus.MustNewConstMetric(speedtestTimestampDesc, prometheus.GaugeValue, float64(speedtestSnapshot.lastSuccess.Unix()), server)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var sriovInterval = flag.Duration("sriov.interval", 15*time.Second, "How often to read the SR-IOV virtual function statistics")
+
+// RTEXT_FILTER_VF of IFLA_EXT_MASK, asking for the VF list in link dumps
+const rtextFilterVF = 1
+
+var (
+	vfBytesDesc = prometheus.NewDesc("network_interface_vf_bytes_total",
+		"Bytes received or transmitted by the SR-IOV virtual function", []string{"interface", "vf", "mac", "direction"}, nil)
+	vfPacketsDesc = prometheus.NewDesc("network_interface_vf_packets_total",
+		"Packets received or transmitted by the SR-IOV virtual function", []string{"interface", "vf", "mac", "direction"}, nil)
+	vfDroppedDesc = prometheus.NewDesc("network_interface_vf_dropped_total",
+		"Packets of the SR-IOV virtual function dropped by the NIC, including spoof-check drops on transmit", []string{"interface", "vf", "mac", "direction"}, nil)
+	vfInfoDesc = prometheus.NewDesc("network_interface_vf_info",
+		"Administrative link state, spoof checking and trust of the SR-IOV virtual function",
+		[]string{"interface", "vf", "mac", "link_state", "spoof_check", "trust"}, nil)
+
+	// Result of the last link dump by physical function
+	sriovSnapshot struct {
+		sync.Mutex
+		byPF map[string][]virtualFunction
+	}
+)
+
+func init() {
+	registerCollector("sriov", "SR-IOV virtual function traffic, drops and link state via rtnetlink", false, startSRIOVCollector)
+}
+
+// Names of the IFLA_VF_LINK_STATE_* states
+var vfLinkStates = map[uint32]string{
+	unix.IFLA_VF_LINK_STATE_AUTO:    "auto",
+	unix.IFLA_VF_LINK_STATE_ENABLE:  "enable",
+	unix.IFLA_VF_LINK_STATE_DISABLE: "disable",
+}
+
+type virtualFunction struct {
+	vf                   uint32
+	mac                  string
+	linkState            string
+	spoofCheck, trust    string
+	hasStats             bool
+	rxBytes, txBytes     uint64
+	rxPackets, txPackets uint64
+	rxDropped, txDropped uint64
+}
+
+// vfSetting decodes one of the struct ifla_vf_* attributes of a VF: the VF
+// number followed by a u32 setting, which is -1 when the driver does not
+// report it
+func vfSetting(b []byte) (uint32, bool) {
+	if len(b) < 8 {
+		return 0, false
+	}
+	v := binary.NativeEndian.Uint32(b[4:8])
+	return v, v != ^uint32(0)
+}
+
+// onOff names a boolean VF setting, empty if the driver does not report it
+func onOff(v uint32, ok bool) string {
+	switch {
+	case !ok:
+		return ""
+	case v != 0:
+		return "on"
+	}
+	return "off"
+}
+
+// parseVFInfo decodes an IFLA_VF_INFO attribute
+func parseVFInfo(b []byte) (virtualFunction, bool) {
+	attrs := nlAttrMap(b)
+	// struct ifla_vf_mac: vf, mac[32]
+	mac := attrs[unix.IFLA_VF_MAC]
+	if len(mac) < 10 {
+		return virtualFunction{}, false
+	}
+	vf := virtualFunction{
+		vf:  binary.NativeEndian.Uint32(mac[0:4]),
+		mac: net.HardwareAddr(mac[4:10]).String(),
+	}
+	if v, ok := vfSetting(attrs[unix.IFLA_VF_LINK_STATE]); ok {
+		vf.linkState = vfLinkStates[v]
+	}
+	vf.spoofCheck = onOff(vfSetting(attrs[unix.IFLA_VF_SPOOFCHK]))
+	vf.trust = onOff(vfSetting(attrs[unix.IFLA_VF_TRUST]))
+	if b, ok := attrs[unix.IFLA_VF_STATS]; ok {
+		stats := nlAttrMap(b)
+		vf.hasStats = true
+		vf.rxBytes, _ = nlUint(stats[unix.IFLA_VF_STATS_RX_BYTES])
+		vf.txBytes, _ = nlUint(stats[unix.IFLA_VF_STATS_TX_BYTES])
+		vf.rxPackets, _ = nlUint(stats[unix.IFLA_VF_STATS_RX_PACKETS])
+		vf.txPackets, _ = nlUint(stats[unix.IFLA_VF_STATS_TX_PACKETS])
+		vf.rxDropped, _ = nlUint(stats[unix.IFLA_VF_STATS_RX_DROPPED])
+		vf.txDropped, _ = nlUint(stats[unix.IFLA_VF_STATS_TX_DROPPED])
+	}
+	return vf, true
+}
+
+// readVirtualFunctions dumps the links with their VF lists and returns the
+// VFs by physical function
+func readVirtualFunctions(c *netlinkConn) (map[string][]virtualFunction, error) {
+	links, err := dumpLinks(c, nlAttrU32(unix.IFLA_EXT_MASK, rtextFilterVF))
+	if err != nil {
+		return nil, err
+	}
+	byPF := make(map[string][]virtualFunction)
+	for _, link := range links {
+		attrs := link.attrs
+		if n, _ := nlUint(attrs[unix.IFLA_NUM_VF]); n == 0 {
+			continue
+		}
+		name := nlString(attrs[unix.IFLA_IFNAME])
+		var vfs []virtualFunction
+		for _, info := range nlAttrs(attrs[unix.IFLA_VFINFO_LIST]) {
+			if info.typ != unix.IFLA_VF_INFO {
+				continue
+			}
+			if vf, ok := parseVFInfo(info.value); ok {
+				vfs = append(vfs, vf)
+			}
+		}
+		byPF[name] = vfs
+	}
+	return byPF, nil
+}
+
+// startSRIOVCollector starts reading the VF statistics
+func startSRIOVCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("sriov", sriovCollector{})
+	go collectSRIOV(c)
+	return nil
+}
+
+// collectSRIOV periodically refreshes the SR-IOV snapshot
+func collectSRIOV(c *netlinkConn) {
+	for {
+		byPF, err := readVirtualFunctions(c)
+		if err != nil {
+			log.Printf("Error reading SR-IOV virtual functions: %v", err)
+		} else {
+			sriovSnapshot.Lock()
+			sriovSnapshot.byPF = byPF
+			sriovSnapshot.Unlock()
+		}
+		time.Sleep(*sriovInterval)
+	}
+}
+
+// sriovCollector exports the last SR-IOV snapshot
+type sriovCollector struct{}
+
+func (sriovCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vfBytesDesc
+	ch <- vfPacketsDesc
+	ch <- vfDroppedDesc
+	ch <- vfInfoDesc
+}
+
+func (sriovCollector) Collect(ch chan<- prometheus.Metric) {
+	sriovSnapshot.Lock()
+	defer sriovSnapshot.Unlock()
+	for pf, vfs := range sriovSnapshot.byPF {
+		for _, vf := range vfs {
+			num := strconv.FormatUint(uint64(vf.vf), 10)
+			ch <- prometheus.MustNewConstMetric(vfInfoDesc, prometheus.GaugeValue, 1, pf, num, vf.mac, vf.linkState, vf.spoofCheck, vf.trust)
+			if !vf.hasStats {
+				continue
+			}
+			for _, c := range []struct {
+				desc   *prometheus.Desc
+				rx, tx uint64
+			}{
+				{vfBytesDesc, vf.rxBytes, vf.txBytes},
+				{vfPacketsDesc, vf.rxPackets, vf.txPackets},
+				{vfDroppedDesc, vf.rxDropped, vf.txDropped},
+			} {
+				ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(c.rx), pf, num, vf.mac, "receive")
+				ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(c.tx), pf, num, vf.mac, "transmit")
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+)
+
+// Keep datagrams below a typical path MTU
+const statsdMaxPacketSize = 1432
+
+var (
+	statsdAddress   = flag.String("statsd.address", "", "Address (host:port) of a StatsD/DogStatsD server; empty disables")
+	statsdTagFormat = flag.String("statsd.tag-format", "dogstatsd", "How to encode tags: dogstatsd, influxdb, graphite or none (tags folded into the metric name)")
+	statsdPrefix    = flag.String("statsd.prefix", "network.", "Prefix prepended to all StatsD metric names")
+	statsdInterval  = flag.Duration("statsd.interval", 10*time.Second, "How often to emit metrics to StatsD")
+
+	// StatsD uses ':' and '|' as separators, tag formats add ',', '=', ';' and '#'
+	statsdEscaper = strings.NewReplacer(":", "_", "|", "_", ",", "_", "=", "_", ";", "_", "#", "_", " ", "_")
+)
+
+// statsdTag is a tag attached to a StatsD metric
+type statsdTag struct {
+	key, value string
+}
+
+// formatStatsdLine renders a single metric line in the configured tag format
+func formatStatsdLine(name, value, metricType string, tags []statsdTag) string {
+	switch *statsdTagFormat {
+	case "dogstatsd":
+		parts := make([]string, len(tags))
+		for i, t := range tags {
+			parts[i] = t.key + ":" + statsdEscaper.Replace(t.value)
+		}
+		return fmt.Sprintf("%s%s:%s|%s|#%s", *statsdPrefix, name, value, metricType, strings.Join(parts, ","))
+	case "influxdb":
+		for _, t := range tags {
+			name += "," + t.key + "=" + statsdEscaper.Replace(t.value)
+		}
+	case "graphite":
+		for _, t := range tags {
+			name += ";" + t.key + "=" + statsdEscaper.Replace(t.value)
+		}
+	default:
+		// Fold the tag values into the name: <prefix><interface>.<direction>.<metric>
+		path := ""
+		for _, t := range tags {
+			path += strings.ReplaceAll(statsdEscaper.Replace(t.value), ".", "_") + "."
+		}
+		name = path + name
+	}
+	return fmt.Sprintf("%s%s:%s|%s", *statsdPrefix, name, value, metricType)
+}
+
+// statsdEmitter sends speeds as gauges and the counter increases since the
+// previous emit as StatsD counters
+type statsdEmitter struct {
+	conn net.Conn
+	prev map[string]netspeed.Counters
+}
+
+// validateStatsdFlags checks --statsd.tag-format
+func validateStatsdFlags() error {
+	switch *statsdTagFormat {
+	case "dogstatsd", "influxdb", "graphite", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown --statsd.tag-format %q, expected dogstatsd, influxdb, graphite or none", *statsdTagFormat)
+}
+
+// newStatsdEmitter validates the flags and opens the UDP socket
+func newStatsdEmitter() (*statsdEmitter, error) {
+	if err := validateStatsdFlags(); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", *statsdAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{conn: conn, prev: make(map[string]netspeed.Counters)}, nil
+}
+
+// lines renders all metric lines for the stats
+func (e *statsdEmitter) lines(stats []interfaceStats) []string {
+	var lines []string
+	next := make(map[string]netspeed.Counters, len(stats))
+	for _, s := range stats {
+		next[s.Name] = s.Counters
+		// No speed gauges on the first cycle of an interface and after a gap
+		if s.HasSpeed {
+			for _, dir := range []struct {
+				name  string
+				speed float64
+			}{{"receive", s.RxSpeed}, {"transmit", s.TxSpeed}} {
+				tags := []statsdTag{{"interface", s.Name}, {"direction", dir.name}}
+				lines = append(lines, formatStatsdLine("speed_bits", strconv.FormatFloat(dir.speed, 'f', -1, 64), "g", tags))
+			}
+		}
+
+		// Counters need a previous value to compute the increase
+		prev, ok := e.prev[s.Name]
+		if !ok {
+			continue
+		}
+		for _, c := range []struct {
+			name, direction string
+			cur, prev       uint64
+		}{
+			{"bytes", "receive", s.RxBytes, prev.RxBytes},
+			{"bytes", "transmit", s.TxBytes, prev.TxBytes},
+			{"packets", "receive", s.RxPackets, prev.RxPackets},
+			{"packets", "transmit", s.TxPackets, prev.TxPackets},
+			{"errors", "receive", s.RxErrors, prev.RxErrors},
+			{"errors", "transmit", s.TxErrors, prev.TxErrors},
+			{"drops", "receive", s.RxDrops, prev.RxDrops},
+			{"drops", "transmit", s.TxDrops, prev.TxDrops},
+		} {
+			if c.cur < c.prev {
+				// Counter reset, e.g. the interface was recreated
+				continue
+			}
+			tags := []statsdTag{{"interface", s.Name}, {"direction", c.direction}}
+			lines = append(lines, formatStatsdLine(c.name, strconv.FormatUint(c.cur-c.prev, 10), "c", tags))
+		}
+	}
+	e.prev = next
+	return lines
+}
+
+// push emits the stats, packing lines into as few datagrams as possible
+func (e *statsdEmitter) push(stats []interfaceStats) error {
+	var packet []byte
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := e.conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+	for _, line := range e.lines(stats) {
+		if len(packet)+len(line)+1 > statsdMaxPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	return flush()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients waiting for the next collection cycle
+var statsSubscribers = struct {
+	sync.Mutex
+	chans map[chan struct{}]struct{}
+}{
+	chans: make(map[chan struct{}]struct{}),
+}
+
+// subscribeStats returns a channel signalled after every collection cycle and
+// a function to unsubscribe
+func subscribeStats() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	statsSubscribers.Lock()
+	statsSubscribers.chans[ch] = struct{}{}
+	statsSubscribers.Unlock()
+	return ch, func() {
+		statsSubscribers.Lock()
+		delete(statsSubscribers.chans, ch)
+		statsSubscribers.Unlock()
+	}
+}
+
+// notifyStatsSubscribers wakes up all subscribers without blocking on slow ones
+func notifyStatsSubscribers() {
+	statsSubscribers.Lock()
+	defer statsSubscribers.Unlock()
+	for ch := range statsSubscribers.chans {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleStream pushes the interface stats as Server-Sent Events after every
+// collection cycle. ?interface=eth0,eth1 limits the stream to some interfaces.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var only map[string]bool
+	if filter := r.URL.Query().Get("interface"); filter != "" {
+		only = make(map[string]bool)
+		for _, name := range strings.Split(filter, ",") {
+			only[strings.TrimSpace(name)] = true
+		}
+	}
+
+	updates, unsubscribe := subscribeStats()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+		}
+
+		resp := interfacesResponse{Timestamp: time.Now().Unix(), Interfaces: []interfaceJSON{}}
+		for _, s := range currentStats() {
+			if only == nil || only[s.Name] {
+				resp.Interfaces = append(resp.Interfaces, interfaceToJSON(s))
+			}
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: interfaces\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
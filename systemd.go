@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// lastCycle is the UnixNano time of the last successful collection cycle,
+// which the watchdog pings are tied to
+var lastCycle atomic.Int64
+
+// markCycleDone records a successful collection cycle for the watchdog
+func markCycleDone() {
+	lastCycle.Store(time.Now().UnixNano())
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// or none when not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// Not inherited by child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state to the systemd notification socket, if the service
+// is Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract namespace sockets start with @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error connecting to the systemd notification socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns the WatchdogSec= of the service, or zero if the
+// watchdog is disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog twice per WatchdogSec= as long as
+// collection cycles complete, so systemd restarts the exporter if collection
+// hangs. Without the dev collector, whose loop marks the cycles, it pings as
+// long as the exporter runs.
+func runWatchdog(interval time.Duration) {
+	cycles := speedCollector != nil
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !cycles || time.Since(time.Unix(0, lastCycle.Load())) < interval {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// notifyReady tells systemd the exporter is up and starts the watchdog
+func notifyReady() {
+	sdNotify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(interval)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var tcFilterInterval = flag.Duration("tcfilter.interval", 15*time.Second, "How often to dump the tc filters and their actions")
+
+// Filter and action attributes, from linux/rtnetlink.h, linux/pkt_cls.h and
+// linux/tc_act/tc_police.h
+const (
+	tcaOptions      = 2
+	tcaChain        = 11
+	tcaActKind      = 1
+	tcaActOptions   = 2
+	tcaActStats     = 4
+	tcaActParms     = 2
+	tcaPoliceTBF    = 1
+	tcaPoliceRate64 = 8
+	sizeofTcPolice  = 32
+)
+
+// Attributes of the actions and, where the classifier counts them itself,
+// the hits of a filter kind, with the offset of the hit count in the
+// latter; 0 when the kind has none
+var tcFilterKinds = map[string]struct {
+	act, pcnt  uint16
+	pcntOffset int
+}{
+	"u32":      {7, 9, 8}, // struct tc_u32_pcnt: rcnt, rhit, ...
+	"flower":   {3, 0, 0},
+	"matchall": {2, 4, 0},
+	"bpf":      {1, 0, 0},
+	"basic":    {3, 5, 8}, // struct tc_basic_pcnt: rcnt, rhit
+	"fw":       {4, 0, 0},
+	"route":    {6, 0, 0},
+	"cgroup":   {1, 0, 0},
+	"flow":     {9, 0, 0},
+}
+
+// Names of the protocols of filters as tc shows them
+var tcProtocols = map[uint16]string{
+	unix.ETH_P_ALL:    "all",
+	unix.ETH_P_IP:     "ip",
+	unix.ETH_P_ARP:    "arp",
+	unix.ETH_P_8021Q:  "802.1q",
+	unix.ETH_P_IPV6:   "ipv6",
+	unix.ETH_P_8021AD: "802.1ad",
+}
+
+var (
+	tcFilterLabels = []string{"interface", "parent", "chain", "priority", "protocol", "kind", "handle"}
+	tcActionLabels = append(tcFilterLabels, "action", "index")
+
+	tcFilterHitsDesc = prometheus.NewDesc("network_tc_filter_hits_total",
+		"Packets matched by the tc filter, for the classifiers counting them", tcFilterLabels, nil)
+	tcActionBytesDesc = prometheus.NewDesc("network_tc_action_bytes_total",
+		"Bytes that went through the action of the tc filter", tcActionLabels, nil)
+	tcActionPacketsDesc = prometheus.NewDesc("network_tc_action_packets_total",
+		"Packets that went through the action of the tc filter", tcActionLabels, nil)
+	tcActionDropsDesc = prometheus.NewDesc("network_tc_action_drops_total",
+		"Packets dropped by the action of the tc filter, e.g. over the rate of a policer", tcActionLabels, nil)
+	tcActionOverlimitsDesc = prometheus.NewDesc("network_tc_action_overlimits_total",
+		"Packets over the rate of the police action of the tc filter", tcActionLabels, nil)
+	tcPoliceRateDesc = prometheus.NewDesc("network_tc_police_rate_bits",
+		"Rate the police action of the tc filter limits to in bits per second", tcActionLabels, nil)
+
+	// Result of the last filter dump
+	tcFilterSnapshot struct {
+		sync.Mutex
+		metrics []prometheus.Metric
+	}
+)
+
+func init() {
+	registerCollector("tcfilter", "tc filter hits and police and other action counters via rtnetlink", false, startTCFilterCollector)
+}
+
+// tcFilterParents returns the parents to dump the filters of a qdisc at:
+// the qdisc itself, or the ingress and egress hooks of clsact. Default
+// qdiscs, without a handle, can't have filters.
+func tcFilterParents(q tcObject) []uint32 {
+	switch {
+	case q.handle == 0:
+		return nil
+	case q.kind == "clsact":
+		return []uint32{tcHClsactIngress, tcHClsactEgress}
+	case q.kind == "ingress":
+		return []uint32{tcHIngress}
+	}
+	return []uint32{q.handle}
+}
+
+// tcFilterHandle formats the handle of a filter like tc does, u32 handles
+// as hash table, bucket and node
+func tcFilterHandle(kind string, h uint32) string {
+	if kind != "u32" {
+		return fmt.Sprintf("0x%x", h)
+	}
+	part := func(v uint32) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(v), 16)
+	}
+	return part(h>>20) + ":" + part(h>>12&0xff) + ":" + part(h&0xfff)
+}
+
+// readTCFilters dumps the filters of all qdiscs into metrics
+func readTCFilters(c *netlinkConn) ([]prometheus.Metric, error) {
+	names, err := linkNames(c)
+	if err != nil {
+		return nil, err
+	}
+	qdiscs, err := dumpTC(c, unix.RTM_GETQDISC, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []prometheus.Metric
+	for _, q := range qdiscs {
+		name, ok := names[q.ifindex]
+		if !ok {
+			continue
+		}
+		for _, parent := range tcFilterParents(q) {
+			filters, err := dumpTC(c, unix.RTM_GETTFILTER, q.ifindex, parent)
+			if err != nil {
+				return nil, fmt.Errorf("filters of %s: %w", name, err)
+			}
+			for _, f := range filters {
+				metrics = tcFilterMetrics(metrics, f, name, tcHandle(parent))
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// tcFilterMetrics appends the metrics of a filter and its actions
+func tcFilterMetrics(metrics []prometheus.Metric, f tcObject, iface, parent string) []prometheus.Metric {
+	chain, _ := nlUint(f.attrs[tcaChain])
+	protocol, ok := tcProtocols[htons(uint16(f.info))]
+	if !ok {
+		protocol = fmt.Sprintf("0x%04x", htons(uint16(f.info)))
+	}
+	labels := []string{iface, parent, strconv.FormatUint(chain, 10), strconv.FormatUint(uint64(f.info>>16), 10),
+		protocol, f.kind, tcFilterHandle(f.kind, f.handle)}
+	options := nlAttrMap(f.attrs[tcaOptions])
+	attrs := tcFilterKinds[f.kind]
+	if pcnt := options[attrs.pcnt]; attrs.pcnt != 0 && len(pcnt) >= attrs.pcntOffset+8 {
+		metrics = append(metrics, prometheus.MustNewConstMetric(tcFilterHitsDesc, prometheus.CounterValue,
+			float64(binary.NativeEndian.Uint64(pcnt[attrs.pcntOffset:])), labels...))
+	}
+
+	actionMetrics := func(kind, index string, stats, actOptions []byte) {
+		labels := append(labels[:len(labels):len(labels)], kind, index)
+		st := parseTCStats(nlAttrMap(stats))
+		if st.hasBasic {
+			metrics = append(metrics,
+				prometheus.MustNewConstMetric(tcActionBytesDesc, prometheus.CounterValue, float64(st.bytes), labels...),
+				prometheus.MustNewConstMetric(tcActionPacketsDesc, prometheus.CounterValue, float64(st.packets), labels...))
+		}
+		if st.hasQueue {
+			metrics = append(metrics, prometheus.MustNewConstMetric(tcActionDropsDesc, prometheus.CounterValue, float64(st.drops), labels...))
+			if kind == "police" {
+				metrics = append(metrics, prometheus.MustNewConstMetric(tcActionOverlimitsDesc, prometheus.CounterValue, float64(st.overlimits), labels...))
+			}
+		}
+		if kind == "police" {
+			if rate, ok := tcPoliceRate(actOptions); ok {
+				metrics = append(metrics, prometheus.MustNewConstMetric(tcPoliceRateDesc, prometheus.GaugeValue, rate, labels...))
+			}
+		}
+	}
+	if attrs.act != 0 {
+		// Nested by their order in the filter
+		for _, a := range nlAttrs(options[attrs.act]) {
+			act := nlAttrMap(a.value)
+			kind := nlString(act[tcaActKind])
+			// The parameters of every action start with struct tc_gen and its
+			// index; police has its own attribute number
+			parms := tcaActParms
+			if kind == "police" {
+				parms = tcaPoliceTBF
+			}
+			index := ""
+			if p := nlAttrMap(act[tcaActOptions])[uint16(parms)]; len(p) >= 4 {
+				index = strconv.FormatUint(uint64(binary.NativeEndian.Uint32(p)), 10)
+			}
+			actionMetrics(kind, index, act[tcaActStats], act[tcaActOptions])
+		}
+	}
+	// Filters with a police of the old syntax report its statistics as
+	// those of the filter
+	if stats, ok := f.attrs[tcaStats2]; ok {
+		actionMetrics("police", "", stats, nil)
+	}
+	return metrics
+}
+
+// tcPoliceRate returns the rate of a police action in bits per second from
+// its struct tc_police and, above 4 GB/s, the 64-bit rate
+func tcPoliceRate(b []byte) (float64, bool) {
+	attrs := nlAttrMap(b)
+	if v, ok := nlUint(attrs[tcaPoliceRate64]); ok {
+		return float64(v) * 8, true
+	}
+	// struct tc_police: index, action, limit, burst, mtu, then the rate as
+	// struct tc_ratespec ending in the rate in bytes per second
+	if tbf := attrs[tcaPoliceTBF]; len(tbf) >= sizeofTcPolice {
+		if rate := binary.NativeEndian.Uint32(tbf[28:32]); rate != 0 {
+			return float64(rate) * 8, true
+		}
+	}
+	return 0, false
+}
+
+// startTCFilterCollector opens the netlink socket for the filter dumps
+func startTCFilterCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	registerMetrics("tcfilter", tcFilterCollector{})
+	go collectTCFilters(c)
+	return nil
+}
+
+// collectTCFilters periodically refreshes the filter snapshot
+func collectTCFilters(c *netlinkConn) {
+	for {
+		metrics, err := readTCFilters(c)
+		if err != nil {
+			log.Printf("Error reading tc filters: %v", err)
+		} else {
+			tcFilterSnapshot.Lock()
+			tcFilterSnapshot.metrics = metrics
+			tcFilterSnapshot.Unlock()
+		}
+		time.Sleep(*tcFilterInterval)
+	}
+}
+
+// tcFilterCollector exports the metrics of the last filter dump
+type tcFilterCollector struct{}
+
+func (tcFilterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tcFilterHitsDesc
+	ch <- tcActionBytesDesc
+	ch <- tcActionPacketsDesc
+	ch <- tcActionDropsDesc
+	ch <- tcActionOverlimitsDesc
+	ch <- tcPoliceRateDesc
+}
+
+func (tcFilterCollector) Collect(ch chan<- prometheus.Metric) {
+	tcFilterSnapshot.Lock()
+	defer tcFilterSnapshot.Unlock()
+	for _, m := range tcFilterSnapshot.metrics {
+		ch <- m
+	}
+}
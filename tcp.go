@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	tcpInterval     = flag.Duration("tcp.interval", 15*time.Second, "How often to dump the TCP sockets and aggregate their RTT, retransmits and congestion windows")
+	tcpDestinations = flag.Int("tcp.destinations", 0, "Break the TCP statistics of each interface down by destination /24 (IPv4) or /48 (IPv6), keeping this many destinations with the most connections and the rest as other. Disabled when 0")
+)
+
+// inet_diag request and reply layout, from linux/inet_diag.h
+const (
+	sockDiagByFamily    = 20
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+	inetDiagInfo        = 2
+	// States of connections that carry traffic: all but LISTEN, TIME_WAIT,
+	// SYN_RECV and CLOSE
+	tcpDiagStates = 1<<1 | 1<<2 | 1<<4 | 1<<5 | 1<<8 | 1<<9 | 1<<11
+)
+
+// Offsets in struct tcp_info
+const (
+	tcpInfoRTT          = 68
+	tcpInfoSndCwnd      = 80
+	tcpInfoTotalRetrans = 100
+	tcpInfoSegsOut      = 136
+	// Up to segs_out, Linux 4.2
+	tcpInfoMinLen = 140
+)
+
+var (
+	tcpLabels            = []string{"interface", "destination"}
+	tcpConnectionsDesc   = prometheus.NewDesc("network_tcp_connections", "TCP connections through the interface, excluding listening and TIME_WAIT sockets", tcpLabels, nil)
+	tcpRTTAverageDesc    = prometheus.NewDesc("network_tcp_rtt_average_seconds", "Average smoothed round-trip time of the TCP connections through the interface", tcpLabels, nil)
+	tcpRTTMaxDesc        = prometheus.NewDesc("network_tcp_rtt_max_seconds", "Highest smoothed round-trip time of the TCP connections through the interface", tcpLabels, nil)
+	tcpCwndAverageDesc   = prometheus.NewDesc("network_tcp_cwnd_average_segments", "Average congestion window of the TCP connections through the interface in segments", tcpLabels, nil)
+	tcpSegmentsSentDesc  = prometheus.NewDesc("network_tcp_segments_sent_total", "Segments sent by the TCP connections through the interface, including retransmits", tcpLabels, nil)
+	tcpRetransmittedDesc = prometheus.NewDesc("network_tcp_segments_retransmitted_total", "Segments retransmitted by the TCP connections through the interface", tcpLabels, nil)
+	tcpRetransmitDesc    = prometheus.NewDesc("network_tcp_retransmit_ratio", "Share of the segments sent over the last --tcp.interval that were retransmits", tcpLabels, nil)
+
+	// Aggregates of the last dump by interface and destination
+	tcpSnapshot struct {
+		sync.Mutex
+		groups map[[2]string]*tcpGroup
+	}
+)
+
+func init() {
+	registerCollector("tcp", "TCP round-trip time, retransmit and congestion window statistics per interface via inet_diag", false, startTCPCollector).
+		checks(checkTCPFlags)
+}
+
+// tcpSocket is the part of a socket dump the collector aggregates
+type tcpSocket struct {
+	cookie               uint64
+	src, dst             net.IP
+	rtt, cwnd            uint32
+	segsOut, retransmits uint32
+}
+
+// tcpGroup aggregates the sockets of an interface or destination
+type tcpGroup struct {
+	connections     int
+	rttSum, rttMax  float64
+	rttSockets      int
+	cwndSum         float64
+	sent, retrans   uint64
+	intervalSent    uint64
+	intervalRetrans uint64
+}
+
+// parseTCPSocket decodes a struct inet_diag_msg and its INET_DIAG_INFO
+func parseTCPSocket(b []byte) (tcpSocket, bool) {
+	if len(b) < sizeofInetDiagMsg {
+		return tcpSocket{}, false
+	}
+	family := b[0]
+	s := tcpSocket{cookie: binary.NativeEndian.Uint64(b[44:52])}
+	if family == unix.AF_INET {
+		s.src, s.dst = net.IP(b[8:12]), net.IP(b[24:28])
+	} else {
+		s.src, s.dst = net.IP(b[8:24]), net.IP(b[24:40])
+	}
+	info := nlAttrMap(b[sizeofInetDiagMsg:])[inetDiagInfo]
+	if len(info) < tcpInfoMinLen {
+		return tcpSocket{}, false
+	}
+	s.rtt = binary.NativeEndian.Uint32(info[tcpInfoRTT:])
+	s.cwnd = binary.NativeEndian.Uint32(info[tcpInfoSndCwnd:])
+	s.retransmits = binary.NativeEndian.Uint32(info[tcpInfoTotalRetrans:])
+	s.segsOut = binary.NativeEndian.Uint32(info[tcpInfoSegsOut:])
+	return s, true
+}
+
+// dumpTCPSockets dumps the TCP sockets of both address families
+func dumpTCPSockets(c *netlinkConn) ([]tcpSocket, error) {
+	var sockets []tcpSocket
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		req := make([]byte, sizeofInetDiagReqV2)
+		req[0], req[1], req[2] = family, unix.IPPROTO_TCP, 1<<(inetDiagInfo-1)
+		binary.NativeEndian.PutUint32(req[4:], tcpDiagStates)
+		replies, err := c.execute(sockDiagByFamily, unix.NLM_F_DUMP, req)
+		if err != nil {
+			// Without IPv6
+			if family == unix.AF_INET6 && errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, err
+		}
+		for _, reply := range replies {
+			if s, ok := parseTCPSocket(reply); ok {
+				sockets = append(sockets, s)
+			}
+		}
+	}
+	return sockets, nil
+}
+
+// interfacesByAddress maps the local addresses to their interfaces, leaving
+// out loopback ones
+func interfacesByAddress() (map[string]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]string)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				byAddr[ipnet.IP.String()] = iface.Name
+			}
+		}
+	}
+	return byAddr, nil
+}
+
+// tcpDestination returns the /24 or /48 of the address
+func tcpDestination(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// tcpKeys returns the group of each socket by its index. The source address
+// tells the interface; connections to local addresses are left out with
+// the loopback interface.
+func tcpKeys(sockets []tcpSocket, byAddr map[string]string, destinations int) map[int][2]string {
+	keys := make(map[int][2]string)
+	counts := make(map[[2]string]int)
+	for i, s := range sockets {
+		src := s.src
+		if ip4 := src.To4(); ip4 != nil {
+			src = ip4
+		}
+		iface, ok := byAddr[src.String()]
+		if !ok {
+			continue
+		}
+		key := [2]string{iface, ""}
+		if destinations > 0 {
+			key[1] = tcpDestination(s.dst)
+		}
+		keys[i] = key
+		counts[key]++
+	}
+	if destinations <= 0 {
+		return keys
+	}
+	// Keep the destinations with the most connections per interface
+	ranked := make(map[string][][2]string)
+	for key := range counts {
+		ranked[key[0]] = append(ranked[key[0]], key)
+	}
+	kept := make(map[[2]string]bool)
+	for _, list := range ranked {
+		sort.Slice(list, func(i, j int) bool {
+			if counts[list[i]] != counts[list[j]] {
+				return counts[list[i]] > counts[list[j]]
+			}
+			return list[i][1] < list[j][1]
+		})
+		for i := 0; i < len(list) && i < destinations; i++ {
+			kept[list[i]] = true
+		}
+	}
+	for i, key := range keys {
+		if !kept[key] {
+			keys[i] = [2]string{key[0], "other"}
+		}
+	}
+	return keys
+}
+
+// checkTCPFlags validates --tcp.destinations
+func checkTCPFlags() error {
+	if *tcpDestinations < 0 {
+		return errors.New("--tcp.destinations must not be negative")
+	}
+	return nil
+}
+
+// startTCPCollector starts dumping the TCP sockets
+func startTCPCollector() error {
+	c, err := dialNetlink(unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return err
+	}
+	registerMetrics("tcp", tcpCollector{})
+	go collectTCP(c)
+	return nil
+}
+
+// collectTCP periodically refreshes the TCP snapshot. Retransmits and sent
+// segments are counted from the difference to the previous dump of each
+// socket, so closed connections keep their share in the counters.
+func collectTCP(c *netlinkConn) {
+	previous := make(map[uint64]tcpSocket)
+	totals := make(map[[2]string][2]uint64)
+	for {
+		sockets, err := dumpTCPSockets(c)
+		if err != nil {
+			log.Printf("Error dumping TCP sockets: %v", err)
+			time.Sleep(*tcpInterval)
+			continue
+		}
+		byAddr, err := interfacesByAddress()
+		if err != nil {
+			log.Printf("Error reading interface addresses: %v", err)
+		}
+		groups := make(map[[2]string]*tcpGroup)
+		current := make(map[uint64]tcpSocket, len(sockets))
+		for i, key := range tcpKeys(sockets, byAddr, *tcpDestinations) {
+			s := sockets[i]
+			current[s.cookie] = s
+			g := groups[key]
+			if g == nil {
+				g = &tcpGroup{}
+				groups[key] = g
+			}
+			g.connections++
+			if s.rtt > 0 {
+				rtt := float64(s.rtt) / 1e6
+				g.rttSum += rtt
+				g.rttMax = max(g.rttMax, rtt)
+				g.rttSockets++
+				g.cwndSum += float64(s.cwnd)
+			}
+			// Counters of new sockets count in full
+			prev := previous[s.cookie]
+			g.intervalSent += uint64(s.segsOut - prev.segsOut)
+			g.intervalRetrans += uint64(s.retransmits - prev.retransmits)
+		}
+		for key, g := range groups {
+			t := totals[key]
+			t[0] += g.intervalSent
+			t[1] += g.intervalRetrans
+			totals[key] = t
+			g.sent, g.retrans = t[0], t[1]
+		}
+		// Groups without connections are dropped, bounding the destinations
+		for key := range totals {
+			if groups[key] == nil {
+				delete(totals, key)
+			}
+		}
+		previous = current
+		tcpSnapshot.Lock()
+		tcpSnapshot.groups = groups
+		tcpSnapshot.Unlock()
+		time.Sleep(*tcpInterval)
+	}
+}
+
+// tcpCollector exports the last TCP snapshot
+type tcpCollector struct{}
+
+func (tcpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tcpConnectionsDesc
+	ch <- tcpRTTAverageDesc
+	ch <- tcpRTTMaxDesc
+	ch <- tcpCwndAverageDesc
+	ch <- tcpSegmentsSentDesc
+	ch <- tcpRetransmittedDesc
+	ch <- tcpRetransmitDesc
+}
+
+func (tcpCollector) Collect(ch chan<- prometheus.Metric) {
+	tcpSnapshot.Lock()
+	defer tcpSnapshot.Unlock()
+	for key, g := range tcpSnapshot.groups {
+		ch <- prometheus.MustNewConstMetric(tcpConnectionsDesc, prometheus.GaugeValue, float64(g.connections), key[:]...)
+		if g.rttSockets > 0 {
+			ch <- prometheus.MustNewConstMetric(tcpRTTAverageDesc, prometheus.GaugeValue, g.rttSum/float64(g.rttSockets), key[:]...)
+			ch <- prometheus.MustNewConstMetric(tcpRTTMaxDesc, prometheus.GaugeValue, g.rttMax, key[:]...)
+			ch <- prometheus.MustNewConstMetric(tcpCwndAverageDesc, prometheus.GaugeValue, g.cwndSum/float64(g.rttSockets), key[:]...)
+		}
+		ch <- prometheus.MustNewConstMetric(tcpSegmentsSentDesc, prometheus.CounterValue, float64(g.sent), key[:]...)
+		ch <- prometheus.MustNewConstMetric(tcpRetransmittedDesc, prometheus.CounterValue, float64(g.retrans), key[:]...)
+		var ratio float64
+		if g.intervalSent > 0 {
+			ratio = float64(g.intervalRetrans) / float64(g.intervalSent)
+		}
+		ch <- prometheus.MustNewConstMetric(tcpRetransmitDesc, prometheus.GaugeValue, ratio, key[:]...)
+	}
+}
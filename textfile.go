@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Name of the file written to --output.textfile-directory; the textfile
+// collector only reads files ending in .prom
+const textfileName = "vyosexporter.prom"
+
+var textfileDirectory = flag.String("output.textfile-directory", "", "Directory to write the metrics to as "+textfileName+" after every collection, for node_exporter's textfile collector; empty disables")
+
+// writeTextfile atomically replaces the textfile with the current metrics
+func writeTextfile() {
+	if *textfileDirectory == "" {
+		return
+	}
+	path := filepath.Join(*textfileDirectory, textfileName)
+	if err := prometheus.WriteToTextfile(path, metricsGatherer(prometheus.Gatherers{customRegistry, remoteRegistry})); err != nil {
+		log.Printf("Error writing %s: %v", path, err)
+	}
+}
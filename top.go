@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/isnugr/linux-networkspeed-exporter/pkg/netspeed"
+	"golang.org/x/sys/unix"
+)
+
+var topInterval = flag.Duration("top.interval", time.Second, "Refresh interval of the top subcommand")
+
+// Sort orders of the top view, selected by key
+const (
+	topSortThroughput = "throughput"
+	topSortErrors     = "errors"
+	topSortDrops      = "drops"
+	topSortName       = "name"
+)
+
+// topRow is an interface line of the top view; errors and drops are per second
+type topRow struct {
+	interfaceStats
+	errorRate, dropRate float64
+}
+
+// topState is what the user selected with keys
+type topState struct {
+	sortBy    string
+	filter    string
+	editing   bool // typing a filter
+	filterBuf string
+}
+
+// handleKey applies a key press and reports whether top should quit
+func (st *topState) handleKey(key byte) bool {
+	if st.editing {
+		switch key {
+		case '\r', '\n':
+			st.filter, st.editing = st.filterBuf, false
+		case 0x1b: // Esc
+			st.editing = false
+		case 0x7f, 0x08: // Backspace
+			if st.filterBuf != "" {
+				st.filterBuf = st.filterBuf[:len(st.filterBuf)-1]
+			}
+		default:
+			if key >= ' ' && key < 0x7f {
+				st.filterBuf += string(key)
+			}
+		}
+		return false
+	}
+	switch key {
+	case 'q', 'Q':
+		return true
+	case 't':
+		st.sortBy = topSortThroughput
+	case 'e':
+		st.sortBy = topSortErrors
+	case 'd':
+		st.sortBy = topSortDrops
+	case 'n':
+		st.sortBy = topSortName
+	case '/':
+		st.editing, st.filterBuf = true, st.filter
+	case 0x1b:
+		st.filter = ""
+	}
+	return false
+}
+
+// sortRows orders the rows by the selected column, busiest first
+func sortRows(rows []topRow, sortBy string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch sortBy {
+		case topSortErrors:
+			return a.errorRate > b.errorRate
+		case topSortDrops:
+			return a.dropRate > b.dropRate
+		case topSortName:
+			return a.Name < b.Name
+		}
+		return a.RxSpeed+a.TxSpeed > b.RxSpeed+b.TxSpeed
+	})
+}
+
+// renderTop draws one frame of the top view, limited to height lines
+func renderTop(rows []topRow, st *topState, height int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J") // cursor home, clear screen
+
+	fmt.Fprintf(&buf, "vyosexporter top - %s - sort: %s", time.Now().Format("15:04:05"), st.sortBy)
+	if st.filter != "" {
+		fmt.Fprintf(&buf, " - filter: %s", st.filter)
+	}
+	buf.WriteString("\n\n")
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tRECEIVE\tTRANSMIT\tERRORS/s\tDROPS/s\tDESCRIPTION")
+	// Title, blank line, header and the two footer lines
+	maxRows := height - 5
+	for i, r := range rows {
+		if maxRows > 0 && i >= maxRows {
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%.1f\t%s\n", r.Name, formatBitRate(r.RxSpeed), formatBitRate(r.TxSpeed),
+			r.errorRate, r.dropRate, r.Description)
+	}
+	tw.Flush()
+
+	buf.WriteString("\n")
+	if st.editing {
+		fmt.Fprintf(&buf, "Filter: %s_", st.filterBuf)
+	} else {
+		buf.WriteString("t: throughput  e: errors  d: drops  n: name  /: filter  Esc: clear filter  q: quit")
+	}
+	return buf.Bytes()
+}
+
+// runTop implements the top subcommand: a live table of the interfaces,
+// sampled every --top.interval with the same code as the exporter
+func runTop() error {
+	fd := int(os.Stdin.Fd())
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("top needs a terminal: %w", err)
+	}
+	// Unbuffered input without echo; output processing stays on so "\n" works
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return err
+	}
+	restore := func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, saved)
+		os.Stdout.WriteString("\x1b[?25h\n") // show the cursor again
+	}
+	defer restore()
+	os.Stdout.WriteString("\x1b[?25l") // hide the cursor
+
+	keys := make(chan byte)
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(b); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- b[0]
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH)
+
+	st := &topState{sortBy: topSortThroughput}
+	c := newCollector()
+	previous := make(map[string]netspeed.Counters)
+	var previousTime time.Time
+	var rows []topRow
+
+	ticker := time.NewTicker(*topInterval)
+	defer ticker.Stop()
+	sample := func() error {
+		stats, err := c.Collect()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		elapsed := now.Sub(previousTime).Seconds()
+		rows = rows[:0]
+		for _, s := range stats {
+			r := topRow{interfaceStats: s}
+			if prev, ok := previous[s.Name]; ok {
+				r.errorRate = float64(counterDelta(s.RxErrors+s.TxErrors, prev.RxErrors+prev.TxErrors)) / elapsed
+				r.dropRate = float64(counterDelta(s.RxDrops+s.TxDrops, prev.RxDrops+prev.TxDrops)) / elapsed
+			}
+			rows = append(rows, r)
+			previous[s.Name] = s.Counters
+		}
+		previousTime = now
+		return nil
+	}
+	draw := func() {
+		height := 0
+		if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+			height = int(ws.Row)
+		}
+		var shown []topRow
+		for _, r := range rows {
+			if st.filter == "" || strings.Contains(r.Name, st.filter) || strings.Contains(r.Description, st.filter) {
+				shown = append(shown, r)
+			}
+		}
+		sortRows(shown, st.sortBy)
+		os.Stdout.Write(renderTop(shown, st, height))
+	}
+
+	if err := sample(); err != nil {
+		return err
+	}
+	draw()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sample(); err != nil {
+				return err
+			}
+			draw()
+		case key, ok := <-keys:
+			if !ok || st.handleKey(key) {
+				return nil
+			}
+			draw()
+		case sig := <-signals:
+			if sig != syscall.SIGWINCH {
+				return nil
+			}
+			draw()
+		}
+	}
+}
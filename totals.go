@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// aggregatesFlag collects name=regex pairs from repeated --speed.aggregate
+// flags; not comma-separated, as the expressions may contain commas
+type aggregatesFlag map[string]*regexp.Regexp
+
+func (a aggregatesFlag) String() string {
+	pairs := make(map[string]string, len(a))
+	for name, re := range a {
+		pairs[name] = re.String()
+	}
+	return formatPairs(pairs)
+}
+
+func (a aggregatesFlag) Set(value string) error {
+	name, expr, ok := strings.Cut(value, "=")
+	if !ok || name == "" || expr == "" {
+		return fmt.Errorf("invalid aggregate %q, expected name=regex", value)
+	}
+	if !model.LabelValue(name).IsValid() {
+		return fmt.Errorf("invalid aggregate name %q", name)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid aggregate %q: %w", name, err)
+	}
+	a[name] = re
+	return nil
+}
+
+var (
+	speedTotal      = flag.Bool("speed.total", false, "Also export the receive plus transmit speed of each interface as direction=\"total\"")
+	speedAggregates = aggregatesFlag{}
+
+	networkSpeedAggregate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_aggregate_bits",
+			Help: "Summed speed of the interfaces of an aggregate in bits per second",
+		},
+		[]string{"aggregate", "direction"},
+	)
+	networkAggregateInterfaces = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_aggregate_interfaces",
+			Help: "Number of interfaces summed into an aggregate",
+		},
+		[]string{"aggregate"},
+	)
+)
+
+func init() {
+	flag.Var(speedAggregates, "speed.aggregate", "Export the summed speed of the interfaces matching a regular expression as name=regex, e.g. uplinks=^(eth0|eth1)$; repeatable")
+
+	registerMetrics("totals", networkSpeedAggregate)
+	registerMetrics("totals", networkAggregateInterfaces)
+}
+
+// updateTotals publishes the total speed of each interface and the speeds of
+// the aggregates for a collection cycle
+func updateTotals(stats []interfaceStats) {
+	if *speedTotal {
+		for _, s := range stats {
+			if s.HasSpeed {
+				networkSpeedBits.With(prometheus.Labels{"interface": s.Name, "direction": "total"}).Set(s.RxSpeed + s.TxSpeed)
+			}
+		}
+	}
+
+	for name, selected := range speedAggregates {
+		var rx, tx float64
+		var count int
+		for _, s := range stats {
+			if s.HasSpeed && selected.MatchString(s.Name) {
+				rx += s.RxSpeed
+				tx += s.TxSpeed
+				count++
+			}
+		}
+		networkSpeedAggregate.With(prometheus.Labels{"aggregate": name, "direction": "receive"}).Set(rx)
+		networkSpeedAggregate.With(prometheus.Labels{"aggregate": name, "direction": "transmit"}).Set(tx)
+		networkSpeedAggregate.With(prometheus.Labels{"aggregate": name, "direction": "total"}).Set(rx + tx)
+		networkAggregateInterfaces.With(prometheus.Labels{"aggregate": name}).Set(float64(count))
+	}
+}
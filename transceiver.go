@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var transceiverInterval = flag.Duration("transceiver.interval", time.Minute, "How often to read the module EEPROM of SFP/QSFP transceivers")
+
+// ETH_MODULE_SFF_* module types of struct ethtool_modinfo
+const (
+	ethModuleSFF8079 = 0x1
+	ethModuleSFF8472 = 0x2
+	ethModuleSFF8636 = 0x3
+	ethModuleSFF8436 = 0x4
+)
+
+var (
+	transceiverInfoDesc = prometheus.NewDesc("network_transceiver_info",
+		"Standard, vendor, part and serial number of the transceiver module",
+		[]string{"interface", "standard", "vendor", "part_number", "serial_number"}, nil)
+	transceiverTemperatureDesc = prometheus.NewDesc("network_transceiver_temperature_celsius",
+		"Internal temperature of the transceiver module", []string{"interface"}, nil)
+	transceiverVoltageDesc = prometheus.NewDesc("network_transceiver_supply_voltage_volts",
+		"Supply voltage of the transceiver module", []string{"interface"}, nil)
+	transceiverBiasDesc = prometheus.NewDesc("network_transceiver_tx_bias_amperes",
+		"Laser bias current of the transceiver lane", []string{"interface", "lane"}, nil)
+	transceiverTxPowerDesc = prometheus.NewDesc("network_transceiver_tx_power_watts",
+		"Optical transmit power of the transceiver lane", []string{"interface", "lane"}, nil)
+	transceiverRxPowerDesc = prometheus.NewDesc("network_transceiver_rx_power_watts",
+		"Optical receive power of the transceiver lane", []string{"interface", "lane"}, nil)
+
+	// Result of the last EEPROM reads by interface
+	transceiverSnapshot struct {
+		sync.Mutex
+		byIface map[string]transceiverDOM
+	}
+)
+
+func init() {
+	registerCollector("transceiver", "SFP/QSFP temperature, voltage, bias and optical power from the module EEPROM", false, startTransceiverCollector).
+		requires(capNetAdmin)
+}
+
+// transceiverDOM is the digital optical monitoring data of a module
+type transceiverDOM struct {
+	standard, vendor, partNumber, serialNumber string
+	temperature, voltage                       float64
+	// Per lane, in amperes and watts
+	bias, txPower, rxPower []float64
+}
+
+// readModuleEEPROM reads the module EEPROM like ethtool -m
+func readModuleEEPROM(ifaceName string) (moduleType uint32, eeprom []byte, err error) {
+	// struct ethtool_modinfo: cmd, type, eeprom_len, reserved[8]
+	modinfo := ethtoolCommand(unix.ETHTOOL_GMODULEINFO, 44)
+	if err := ethtool(ifaceName, modinfo); err != nil {
+		return 0, nil, err
+	}
+	moduleType = binary.NativeEndian.Uint32(modinfo[4:8])
+	length := min(binary.NativeEndian.Uint32(modinfo[8:12]), 640)
+
+	// struct ethtool_eeprom: cmd, magic, offset, len, data[len]
+	cmd := ethtoolCommand(unix.ETHTOOL_GMODULEEEPROM, 16+int(length))
+	binary.NativeEndian.PutUint32(cmd[12:16], length)
+	if err := ethtool(ifaceName, cmd); err != nil {
+		return 0, nil, err
+	}
+	return moduleType, cmd[16:], nil
+}
+
+// eepromString decodes a space padded ASCII field
+func eepromString(b []byte) string {
+	return strings.TrimSpace(strings.ToValidUTF8(string(b), ""))
+}
+
+// parseSFF8472 decodes the diagnostics of an SFP module: page A0h followed
+// by the diagnostics page A2h. Externally calibrated modules report raw
+// values with calibration constants, which are applied here.
+func parseSFF8472(eeprom []byte) (transceiverDOM, error) {
+	if len(eeprom) < 512 {
+		return transceiverDOM{}, fmt.Errorf("SFF-8472 EEPROM too short")
+	}
+	a0, a2 := eeprom[:256], eeprom[256:512]
+	dom := transceiverDOM{
+		standard:     "sff-8472",
+		vendor:       eepromString(a0[20:36]),
+		partNumber:   eepromString(a0[40:56]),
+		serialNumber: eepromString(a0[68:84]),
+	}
+	// Byte 92: bit 6 diagnostics implemented, bit 4 externally calibrated
+	if a0[92]&0x40 == 0 {
+		return dom, nil
+	}
+	external := a0[92]&0x10 != 0
+
+	u16 := func(b []byte, off int) float64 { return float64(binary.BigEndian.Uint16(b[off:])) }
+	s16 := func(b []byte, off int) float64 { return float64(int16(binary.BigEndian.Uint16(b[off:]))) }
+	// value = slope * raw + offset, slope an unsigned 8.8 fixed point number
+	calibrate := func(raw float64, slopeOff int) float64 {
+		if !external {
+			return raw
+		}
+		return u16(a2, slopeOff)/256*raw + s16(a2, slopeOff+2)
+	}
+
+	temperature := calibrate(s16(a2, 96), 84)
+	voltage := calibrate(u16(a2, 98), 88)
+	bias := calibrate(u16(a2, 100), 76)
+	txPower := calibrate(u16(a2, 102), 80)
+	rxPower := u16(a2, 104)
+	if external {
+		// Rx_PWR(4) down to Rx_PWR(0), IEEE 754 floats at bytes 56-75
+		raw, sum := rxPower, 0.0
+		for i := 0; i < 5; i++ {
+			c := float64(math.Float32frombits(binary.BigEndian.Uint32(a2[56+4*i:])))
+			sum += c * math.Pow(raw, float64(4-i))
+		}
+		rxPower = sum
+	}
+
+	dom.temperature = temperature / 256     // 1/256 °C
+	dom.voltage = voltage * 100e-6          // 100 µV
+	dom.bias = []float64{bias * 2e-6}       // 2 µA
+	dom.txPower = []float64{txPower * 1e-7} // 0.1 µW
+	dom.rxPower = []float64{rxPower * 1e-7}
+	return dom, nil
+}
+
+// parseSFF8636 decodes the diagnostics of a QSFP/QSFP+/QSFP28 module: lower
+// page 00h followed by upper page 00h
+func parseSFF8636(eeprom []byte, standard string) (transceiverDOM, error) {
+	if len(eeprom) < 256 {
+		return transceiverDOM{}, fmt.Errorf("%s EEPROM too short", strings.ToUpper(standard))
+	}
+	u16 := func(off int) float64 { return float64(binary.BigEndian.Uint16(eeprom[off:])) }
+	dom := transceiverDOM{
+		standard:     standard,
+		vendor:       eepromString(eeprom[148:164]),
+		partNumber:   eepromString(eeprom[168:184]),
+		serialNumber: eepromString(eeprom[196:212]),
+		temperature:  float64(int16(binary.BigEndian.Uint16(eeprom[22:]))) / 256,
+		voltage:      u16(26) * 100e-6,
+	}
+	for lane := 0; lane < 4; lane++ {
+		dom.rxPower = append(dom.rxPower, u16(34+2*lane)*1e-7)
+		dom.bias = append(dom.bias, u16(42+2*lane)*2e-6)
+		dom.txPower = append(dom.txPower, u16(50+2*lane)*1e-7)
+	}
+	return dom, nil
+}
+
+// readTransceiver reads and decodes the module of an interface
+func readTransceiver(ifaceName string) (transceiverDOM, error) {
+	moduleType, eeprom, err := readModuleEEPROM(ifaceName)
+	if err != nil {
+		return transceiverDOM{}, err
+	}
+	switch moduleType {
+	case ethModuleSFF8472:
+		return parseSFF8472(eeprom)
+	case ethModuleSFF8636:
+		return parseSFF8636(eeprom, "sff-8636")
+	case ethModuleSFF8436:
+		return parseSFF8636(eeprom, "sff-8436")
+	case ethModuleSFF8079:
+		// SFP without diagnostics, only the identification
+		if len(eeprom) < 256 {
+			return transceiverDOM{}, fmt.Errorf("SFF-8079 EEPROM too short")
+		}
+		return transceiverDOM{
+			standard:     "sff-8079",
+			vendor:       eepromString(eeprom[20:36]),
+			partNumber:   eepromString(eeprom[40:56]),
+			serialNumber: eepromString(eeprom[68:84]),
+		}, nil
+	}
+	return transceiverDOM{}, fmt.Errorf("unsupported module type %#x", moduleType)
+}
+
+// startTransceiverCollector starts reading the module EEPROMs
+func startTransceiverCollector() error {
+	transceiverSnapshot.byIface = make(map[string]transceiverDOM)
+	registerMetrics("transceiver", transceiverCollector{})
+	go collectTransceivers()
+	return nil
+}
+
+// collectTransceivers periodically reads the modules of all interfaces
+func collectTransceivers() {
+	// Interfaces without a module are only reported once
+	reported := make(map[string]bool)
+	for {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			log.Printf("Error listing interfaces: %v", err)
+		}
+		// EEPROM reads over I2C take milliseconds each, so several modules
+		// are read at a time
+		doms := make([]transceiverDOM, len(ifaces))
+		errs := make([]error, len(ifaces))
+		forEachParallel(len(ifaces), func(i int) {
+			if ifaces[i].Flags&net.FlagLoopback == 0 {
+				doms[i], errs[i] = readTransceiver(ifaces[i].Name)
+			}
+		})
+		modules := make(map[string]transceiverDOM)
+		// Including interfaces that are down, which may be down because of the optics
+		for i, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			dom, err := doms[i], errs[i]
+			if err != nil {
+				// Virtual interfaces, empty cages and drivers without module access
+				if !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.ENODEV) && !reported[iface.Name] {
+					log.Printf("Error reading the transceiver of %s: %v", iface.Name, err)
+				}
+				reported[iface.Name] = true
+				continue
+			}
+			modules[iface.Name] = dom
+		}
+		transceiverSnapshot.Lock()
+		transceiverSnapshot.byIface = modules
+		transceiverSnapshot.Unlock()
+		time.Sleep(*transceiverInterval)
+	}
+}
+
+// transceiverCollector exports the last EEPROM reads
+type transceiverCollector struct{}
+
+func (transceiverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- transceiverInfoDesc
+	ch <- transceiverTemperatureDesc
+	ch <- transceiverVoltageDesc
+	ch <- transceiverBiasDesc
+	ch <- transceiverTxPowerDesc
+	ch <- transceiverRxPowerDesc
+}
+
+func (transceiverCollector) Collect(ch chan<- prometheus.Metric) {
+	transceiverSnapshot.Lock()
+	defer transceiverSnapshot.Unlock()
+	for name, dom := range transceiverSnapshot.byIface {
+		ch <- prometheus.MustNewConstMetric(transceiverInfoDesc, prometheus.GaugeValue, 1, name, dom.standard, dom.vendor, dom.partNumber, dom.serialNumber)
+		if dom.bias == nil {
+			continue // no diagnostics
+		}
+		ch <- prometheus.MustNewConstMetric(transceiverTemperatureDesc, prometheus.GaugeValue, dom.temperature, name)
+		ch <- prometheus.MustNewConstMetric(transceiverVoltageDesc, prometheus.GaugeValue, dom.voltage, name)
+		for i := range dom.bias {
+			lane := strconv.Itoa(i + 1)
+			ch <- prometheus.MustNewConstMetric(transceiverBiasDesc, prometheus.GaugeValue, dom.bias[i], name, lane)
+			ch <- prometheus.MustNewConstMetric(transceiverTxPowerDesc, prometheus.GaugeValue, dom.txPower[i], name, lane)
+			ch <- prometheus.MustNewConstMetric(transceiverRxPowerDesc, prometheus.GaugeValue, dom.rxPower[i], name, lane)
+		}
+	}
+}
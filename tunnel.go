@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sys/unix"
+)
+
+// IFLA_GRE_*, IFLA_IPTUN_* and IFLA_VTI_* attributes of the tunnel link
+// data, from linux/if_tunnel.h
+const (
+	iflaGREIFlags   = 2
+	iflaGREIKey     = 4
+	iflaGRELocal    = 6
+	iflaGRERemote   = 7
+	iflaIPTunLocal  = 2
+	iflaIPTunRemote = 3
+	iflaVTIIKey     = 2
+	iflaVTILocal    = 4
+	iflaVTIRemote   = 5
+	// GRE_KEY of the big-endian GRE flags
+	greKeyFlag = 0x2000
+)
+
+var (
+	networkTunnelInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_tunnel_info",
+			Help: "Type, local and remote endpoints and VNI or key of the tunnel interface",
+		},
+		[]string{"interface", "tunnel_type", "tunnel_local", "tunnel_remote", "tunnel_id"},
+	)
+
+	// Tunnel endpoints by interface name, refreshed from a link dump after
+	// link changes
+	tunnels = struct {
+		sync.Mutex
+		conn    *netlinkConn
+		byIface map[string]tunnelEndpoints
+	}{
+		byIface: make(map[string]tunnelEndpoints),
+	}
+
+	tunnelsEnabled atomic.Bool
+	tunnelsStale   atomic.Bool
+)
+
+func init() {
+	registerCollector("tunnel", "type, endpoints and VNI/key of GRE, VXLAN, Geneve and IP tunnels, as labels of their series", false, startTunnelCollector)
+}
+
+type tunnelEndpoints struct {
+	kind, local, remote, id string
+}
+
+// startTunnelCollector opens the netlink socket for the link dumps
+func startTunnelCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	tunnels.conn = c
+	registerMetrics("tunnel", networkTunnelInfo)
+	tunnelsStale.Store(true)
+	tunnelsEnabled.Store(true)
+	return nil
+}
+
+// markTunnelsStale schedules a new link dump for the next collection cycle
+func markTunnelsStale() {
+	tunnelsStale.Store(true)
+}
+
+// tunnelAddr formats an IPv4 or IPv6 endpoint attribute, empty if unset
+func tunnelAddr(b []byte) string {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok || addr.IsUnspecified() {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+// parseTunnel decodes the endpoints of a tunnel link, false for other links
+func parseTunnel(l rtLink) (tunnelEndpoints, bool) {
+	kind := l.kind()
+	data := nlAttrMap(nlAttrMap(l.attrs[unix.IFLA_LINKINFO])[unix.IFLA_INFO_DATA])
+	t := tunnelEndpoints{kind: kind}
+	switch kind {
+	case "vxlan":
+		t.local = tunnelAddr(data[unix.IFLA_VXLAN_LOCAL])
+		if t.local == "" {
+			t.local = tunnelAddr(data[unix.IFLA_VXLAN_LOCAL6])
+		}
+		// The remote endpoint or multicast group, none with a learned FDB
+		t.remote = tunnelAddr(data[unix.IFLA_VXLAN_GROUP])
+		if t.remote == "" {
+			t.remote = tunnelAddr(data[unix.IFLA_VXLAN_GROUP6])
+		}
+		if vni, ok := nlUint(data[unix.IFLA_VXLAN_ID]); ok {
+			t.id = strconv.FormatUint(vni, 10)
+		}
+	case "geneve":
+		t.remote = tunnelAddr(data[unix.IFLA_GENEVE_REMOTE])
+		if t.remote == "" {
+			t.remote = tunnelAddr(data[unix.IFLA_GENEVE_REMOTE6])
+		}
+		if vni, ok := nlUint(data[unix.IFLA_GENEVE_ID]); ok {
+			t.id = strconv.FormatUint(vni, 10)
+		}
+	case "gre", "gretap", "ip6gre", "ip6gretap", "erspan", "ip6erspan":
+		t.local = tunnelAddr(data[iflaGRELocal])
+		t.remote = tunnelAddr(data[iflaGRERemote])
+		// Keys are big-endian and only valid with the key flag
+		if flags := data[iflaGREIFlags]; len(flags) == 2 && binary.BigEndian.Uint16(flags)&greKeyFlag != 0 {
+			if key := data[iflaGREIKey]; len(key) == 4 {
+				t.id = strconv.FormatUint(uint64(binary.BigEndian.Uint32(key)), 10)
+			}
+		}
+	case "ipip", "sit", "ip6tnl":
+		t.local = tunnelAddr(data[iflaIPTunLocal])
+		t.remote = tunnelAddr(data[iflaIPTunRemote])
+	case "vti", "vti6":
+		t.local = tunnelAddr(data[iflaVTILocal])
+		t.remote = tunnelAddr(data[iflaVTIRemote])
+		if key := data[iflaVTIIKey]; len(key) == 4 && binary.BigEndian.Uint32(key) != 0 {
+			t.id = strconv.FormatUint(uint64(binary.BigEndian.Uint32(key)), 10)
+		}
+	default:
+		return tunnelEndpoints{}, false
+	}
+	return t, true
+}
+
+// updateTunnels refreshes the tunnel endpoints if links changed
+func updateTunnels() {
+	if !tunnelsEnabled.Load() || !tunnelsStale.Swap(false) {
+		return
+	}
+	links, err := dumpLinks(tunnels.conn)
+	if err != nil {
+		log.Printf("Error reading tunnel interfaces: %v", err)
+		tunnelsStale.Store(true)
+		return
+	}
+	byIface := make(map[string]tunnelEndpoints)
+	for _, l := range links {
+		if t, ok := parseTunnel(l); ok {
+			byIface[nlString(l.attrs[unix.IFLA_IFNAME])] = t
+		}
+	}
+	tunnels.Lock()
+	tunnels.byIface = byIface
+	tunnels.Unlock()
+
+	networkTunnelInfo.Reset()
+	for name, t := range byIface {
+		networkTunnelInfo.WithLabelValues(name, t.kind, t.local, t.remote, t.id).Set(1)
+	}
+}
+
+// tunnelLabels returns the tunnel labels to add to a series of a tunnel
+// interface, like aliasLabel
+func tunnelLabels(m *dto.Metric) []*dto.LabelPair {
+	if !tunnelsEnabled.Load() {
+		return nil
+	}
+	for _, lp := range m.Label {
+		if lp.GetName() == "tunnel_type" {
+			return nil
+		}
+	}
+	for _, lp := range m.Label {
+		if name := lp.GetName(); name == "interface" || name == "device" {
+			tunnels.Lock()
+			t, ok := tunnels.byIface[lp.GetValue()]
+			tunnels.Unlock()
+			if !ok {
+				return nil
+			}
+			return []*dto.LabelPair{
+				{Name: stringPtr("tunnel_type"), Value: stringPtr(t.kind)},
+				{Name: stringPtr("tunnel_local"), Value: stringPtr(t.local)},
+				{Name: stringPtr("tunnel_remote"), Value: stringPtr(t.remote)},
+				{Name: stringPtr("tunnel_id"), Value: stringPtr(t.id)},
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	networkVRFSpeed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_vrf_speed_bits",
+			Help: "Sum of the speeds of the member interfaces of the VRF in bits per second",
+		},
+		[]string{"vrf", "direction"},
+	)
+
+	// VRF of each enslaved interface and of the VRF devices themselves,
+	// refreshed from a link dump after link changes
+	vrfMembership = struct {
+		sync.Mutex
+		conn    *netlinkConn
+		byIface map[string]string
+	}{
+		byIface: make(map[string]string),
+	}
+
+	vrfEnabled atomic.Bool
+	vrfStale   atomic.Bool
+)
+
+func init() {
+	registerCollector("vrf", "vrf label on the series of VRF member interfaces and per-VRF speeds", false, startVRFCollector)
+}
+
+// startVRFCollector opens the netlink socket for the link dumps
+func startVRFCollector() error {
+	c, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	vrfMembership.conn = c
+	registerMetrics("vrf", networkVRFSpeed)
+	vrfStale.Store(true)
+	vrfEnabled.Store(true)
+	return nil
+}
+
+// markVRFsStale schedules a new link dump for the next collection cycle,
+// after an interface was enslaved, released, added or removed
+func markVRFsStale() {
+	vrfStale.Store(true)
+}
+
+// readVRFMembership dumps the links and maps the members of VRF devices,
+// and the VRF devices, to the VRF name
+func readVRFMembership(c *netlinkConn) (map[string]string, error) {
+	dump, err := dumpLinks(c)
+	if err != nil {
+		return nil, err
+	}
+	type link struct {
+		name   string
+		master uint64
+	}
+	links := make(map[uint32]link, len(dump))
+	vrfs := make(map[uint32]string)
+	for _, dl := range dump {
+		l := link{name: nlString(dl.attrs[unix.IFLA_IFNAME])}
+		l.master, _ = nlUint(dl.attrs[unix.IFLA_MASTER])
+		links[dl.index] = l
+		if dl.kind() == "vrf" {
+			vrfs[dl.index] = l.name
+		}
+	}
+	byIface := make(map[string]string)
+	for index, l := range links {
+		if vrf, ok := vrfs[index]; ok {
+			byIface[l.name] = vrf
+		} else if vrf, ok := vrfs[uint32(l.master)]; ok {
+			byIface[l.name] = vrf
+		}
+	}
+	return byIface, nil
+}
+
+// updateVRFs refreshes the membership if links changed and sums up the
+// speeds of the members of each VRF. The VRF devices themselves are left
+// out of the sums, as their traffic also passes a member.
+func updateVRFs(stats []interfaceStats) {
+	if !vrfEnabled.Load() {
+		return
+	}
+	vrfMembership.Lock()
+	defer vrfMembership.Unlock()
+	if vrfStale.Swap(false) {
+		byIface, err := readVRFMembership(vrfMembership.conn)
+		if err != nil {
+			log.Printf("Error reading VRF membership: %v", err)
+			vrfStale.Store(true)
+		} else {
+			vrfMembership.byIface = byIface
+		}
+	}
+
+	sums := make(map[string]*[2]float64)
+	for _, vrf := range vrfMembership.byIface {
+		if sums[vrf] == nil {
+			sums[vrf] = &[2]float64{}
+		}
+	}
+	for _, s := range stats {
+		vrf, ok := vrfMembership.byIface[s.Name]
+		if !ok || vrf == s.Name || !s.HasSpeed {
+			continue
+		}
+		sums[vrf][0] += s.RxSpeed
+		sums[vrf][1] += s.TxSpeed
+	}
+	networkVRFSpeed.Reset()
+	for vrf, sum := range sums {
+		networkVRFSpeed.WithLabelValues(vrf, "receive").Set(sum[0])
+		networkVRFSpeed.WithLabelValues(vrf, "transmit").Set(sum[1])
+	}
+}
+
+// vrfLabel returns the vrf label to add to a series of a VRF member
+// interface, like aliasLabel
+func vrfLabel(m *dto.Metric) (*dto.LabelPair, bool) {
+	if !vrfEnabled.Load() {
+		return nil, false
+	}
+	for _, lp := range m.Label {
+		if lp.GetName() == "vrf" {
+			return nil, false
+		}
+	}
+	for _, lp := range m.Label {
+		if name := lp.GetName(); name == "interface" || name == "device" {
+			vrfMembership.Lock()
+			vrf, ok := vrfMembership.byIface[lp.GetValue()]
+			vrfMembership.Unlock()
+			if ok {
+				return &dto.LabelPair{Name: stringPtr("vrf"), Value: stringPtr(vrf)}, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// webListener is a --web.listen-address: an address to serve on with its
+// own TLS certificate and access policy. Unset options inherit the global
+// flags.
+type webListener struct {
+	address string
+	// nil inherits --allowed-ips, --auth.token and --auth.token-file; an
+	// empty value allows all clients or requires no token
+	allowedIPs, authToken, authTokenFile *string
+	tlsCert, tlsKey                      string
+}
+
+// webListenersFlag collects the repeatable --web.listen-address
+type webListenersFlag []*webListener
+
+func (f *webListenersFlag) String() string {
+	addresses := make([]string, len(*f))
+	for i, l := range *f {
+		addresses[i] = l.address
+	}
+	return strings.Join(addresses, " ")
+}
+
+// Set parses address[;option=value...], e.g.
+// ":9443;tls.cert=server.crt;tls.key=server.key;allowed-ips=10.0.0.0/8"
+func (f *webListenersFlag) Set(value string) error {
+	fields := strings.Split(value, ";")
+	l := &webListener{address: strings.TrimSpace(fields[0])}
+	if _, _, err := net.SplitHostPort(l.address); err != nil {
+		return fmt.Errorf("invalid address %q, expected host:port or :port", l.address)
+	}
+	for _, field := range fields[1:] {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid option %q of %s, expected key=value", field, l.address)
+		}
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(key) {
+		case "allowed-ips":
+			l.allowedIPs = &v
+		case "auth.token":
+			l.authToken = &v
+		case "auth.token-file":
+			l.authTokenFile = &v
+		case "tls.cert":
+			l.tlsCert = v
+		case "tls.key":
+			l.tlsKey = v
+		default:
+			return fmt.Errorf("unknown option %q of %s, expected allowed-ips, auth.token, auth.token-file, tls.cert or tls.key", key, l.address)
+		}
+	}
+	if (l.tlsCert == "") != (l.tlsKey == "") {
+		return fmt.Errorf("%s needs both tls.cert and tls.key", l.address)
+	}
+	if l.authToken != nil && l.authTokenFile != nil {
+		return fmt.Errorf("auth.token and auth.token-file of %s are mutually exclusive", l.address)
+	}
+	*f = append(*f, l)
+	return nil
+}
+
+var webListenAddresses webListenersFlag
+
+func init() {
+	flag.Var(&webListenAddresses, "web.listen-address", `Address to serve on as "host:port[;option=value...]" with the options allowed-ips, auth.token, auth.token-file, tls.cert and tls.key overriding the global access policy for this address; repeatable, replaces --port unless it is set`)
+}
+
+// accessPolicy is what the requests of a listener are checked against
+type accessPolicy struct {
+	allow *addrList
+	token string
+}
+
+// accessPolicyKey is the context key of the access policy of a listener
+type accessPolicyKey struct{}
+
+// requestPolicy returns the access policy of the listener a request came
+// in on, the global one for --port and systemd sockets
+func requestPolicy(r *http.Request) accessPolicy {
+	if p, ok := r.Context().Value(accessPolicyKey{}).(*accessPolicy); ok {
+		return *p
+	}
+	return accessPolicy{allow: allowList, token: bearerToken}
+}
+
+// validateWebListeners checks the certificates, token files and address
+// lists of --web.listen-address
+func validateWebListeners() error {
+	for _, l := range webListenAddresses {
+		if l.allowedIPs != nil {
+			for _, host := range parseAddrList(*l.allowedIPs).hosts {
+				if !validateHostname(host) {
+					return fmt.Errorf("invalid allowed-ips entry %q of %s, expected an address, CIDR or hostname", host, l.address)
+				}
+			}
+		}
+		if _, err := l.policy(); err != nil {
+			return err
+		}
+		if l.tlsCert != "" {
+			if _, err := tls.LoadX509KeyPair(l.tlsCert, l.tlsKey); err != nil {
+				return fmt.Errorf("loading the certificate of %s: %w", l.address, err)
+			}
+		}
+	}
+	return nil
+}
+
+// policy returns the access policy of the listener, with its own settings
+// in place of the global ones
+func (l *webListener) policy() (*accessPolicy, error) {
+	p := &accessPolicy{allow: allowList, token: bearerToken}
+	if l.allowedIPs != nil {
+		p.allow = parseAddrList(*l.allowedIPs)
+	}
+	switch {
+	case l.authToken != nil:
+		p.token = *l.authToken
+	case l.authTokenFile != nil && *l.authTokenFile != "":
+		token, err := secretValue("auth.token", "", *l.authTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.address, err)
+		}
+		p.token = token
+	case l.authTokenFile != nil:
+		p.token = ""
+	}
+	return p, nil
+}
+
+// policyListener is a bound --web.listen-address
+type policyListener struct {
+	net.Listener
+	policy *accessPolicy
+	// For the startup log
+	allowedIPs string
+	tls        bool
+}
+
+// bindWebListeners binds --web.listen-address and loads the certificates,
+// while still privileged, and starts resolving the hostnames of their
+// allowed IPs
+func bindWebListeners() ([]policyListener, error) {
+	var listeners []policyListener
+	for _, l := range webListenAddresses {
+		policy, err := l.policy()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowedIPs != nil && len(policy.allow.hosts) > 0 {
+			policy.allow.resolve()
+			go policy.allow.resolvePeriodically()
+		}
+		var config *tls.Config
+		if l.tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(l.tlsCert, l.tlsKey)
+			if err != nil {
+				return nil, fmt.Errorf("loading the certificate of %s: %w", l.address, err)
+			}
+			config = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		ln, err := net.Listen("tcp", l.address)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			ln = tls.NewListener(ln, config)
+		}
+		allowed := *allowedIPs
+		if l.allowedIPs != nil {
+			allowed = *l.allowedIPs
+		}
+		listeners = append(listeners, policyListener{Listener: ln, policy: policy, allowedIPs: allowed, tls: config != nil})
+	}
+	return listeners, nil
+}
+
+// serve serves the handler on the listener, its requests carrying its
+// access policy
+func (l policyListener) serve(handler http.Handler) error {
+	srv := &http.Server{
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), accessPolicyKey{}, l.policy)
+		},
+	}
+	return srv.Serve(l)
+}
+
+// describe summarizes the listener for the startup log
+func (l policyListener) describe() string {
+	var parts []string
+	if l.tls {
+		parts = append(parts, "TLS")
+	}
+	if l.policy.token != "" {
+		parts = append(parts, "bearer token")
+	}
+	return strings.Join(append(parts, "IP whitelist: "+l.allowedIPs), ", ")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Each window is tracked as this many buckets, so it slides in steps of 1/60th
+const windowBuckets = 60
+
+var (
+	speedWindows = flag.String("speed.windows", "", "Comma-separated sliding windows (e.g. 5m,1h) to export max/min/avg speed over; empty disables")
+
+	networkSpeedMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_max_bits",
+			Help: "Highest per-second network interface speed within the window in bits per second",
+		},
+		[]string{"interface", "direction", "window"},
+	)
+
+	networkSpeedMin = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_min_bits",
+			Help: "Lowest per-second network interface speed within the window in bits per second",
+		},
+		[]string{"interface", "direction", "window"},
+	)
+
+	networkSpeedAvg = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_interface_speed_avg_bits",
+			Help: "Mean of the per-second network interface speeds within the window in bits per second",
+		},
+		[]string{"interface", "direction", "window"},
+	)
+
+	// Configured windows, parsed from --speed.windows
+	windows []speedWindow
+
+	// Trackers per interface, one per configured window
+	windowTrackers = struct {
+		sync.Mutex
+		byIface map[string][]*windowTracker
+	}{
+		byIface: make(map[string][]*windowTracker),
+	}
+)
+
+func init() {
+	registerMetrics("window", networkSpeedMax)
+	registerMetrics("window", networkSpeedMin)
+	registerMetrics("window", networkSpeedAvg)
+}
+
+// speedWindow is a configured window and its label value
+type speedWindow struct {
+	label    string
+	duration time.Duration
+}
+
+// parseSpeedWindows parses the --speed.windows flag
+func parseSpeedWindows(value string) ([]speedWindow, error) {
+	var parsed []speedWindow
+	for _, w := range strings.Split(value, ",") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		d, err := time.ParseDuration(w)
+		if err != nil || d < windowBuckets*time.Second {
+			return nil, fmt.Errorf("invalid speed window %q, expected a duration of at least %s", w, windowBuckets*time.Second)
+		}
+		parsed = append(parsed, speedWindow{label: w, duration: d})
+	}
+	return parsed, nil
+}
+
+// windowBucket aggregates the samples of one slice of a window; index 0 is
+// receive and index 1 transmit
+type windowBucket struct {
+	start    int64 // unix nanoseconds
+	min, max [2]float64
+	sum      [2]float64
+	count    int
+}
+
+// windowTracker keeps the buckets of one interface for one window
+type windowTracker struct {
+	window  speedWindow
+	buckets [windowBuckets]windowBucket
+}
+
+func (t *windowTracker) add(now time.Time, rx, tx float64) {
+	width := int64(t.window.duration) / windowBuckets
+	start := now.UnixNano() / width * width
+	b := &t.buckets[(start/width)%windowBuckets]
+	if b.start != start {
+		*b = windowBucket{start: start, min: [2]float64{math.Inf(1), math.Inf(1)}}
+	}
+	for i, v := range [2]float64{rx, tx} {
+		b.min[i] = math.Min(b.min[i], v)
+		b.max[i] = math.Max(b.max[i], v)
+		b.sum[i] += v
+	}
+	b.count++
+}
+
+// summary returns max, min and mean per direction over the buckets still inside the window
+func (t *windowTracker) summary(now time.Time) (max, min, avg [2]float64, ok bool) {
+	cutoff := now.Add(-t.window.duration).UnixNano()
+	min = [2]float64{math.Inf(1), math.Inf(1)}
+	var sum [2]float64
+	count := 0
+	for _, b := range t.buckets {
+		if b.count == 0 || b.start <= cutoff {
+			continue
+		}
+		for i := range sum {
+			max[i] = math.Max(max[i], b.max[i])
+			min[i] = math.Min(min[i], b.min[i])
+			sum[i] += b.sum[i]
+		}
+		count += b.count
+	}
+	if count == 0 {
+		return max, min, avg, false
+	}
+	for i := range sum {
+		avg[i] = sum[i] / float64(count)
+	}
+	return max, min, avg, true
+}
+
+// updateSpeedWindows feeds the speeds of a collection cycle into the windows
+func updateSpeedWindows(stats []interfaceStats) {
+	if len(windows) == 0 {
+		return
+	}
+	windowTrackers.Lock()
+	defer windowTrackers.Unlock()
+
+	for _, s := range stats {
+		if !s.HasSpeed {
+			continue
+		}
+		trackers, ok := windowTrackers.byIface[s.Name]
+		if !ok {
+			for _, w := range windows {
+				trackers = append(trackers, &windowTracker{window: w})
+			}
+			windowTrackers.byIface[s.Name] = trackers
+		}
+		for _, t := range trackers {
+			t.add(s.Time, s.RxSpeed, s.TxSpeed)
+			max, min, avg, ok := t.summary(s.Time)
+			if !ok {
+				continue
+			}
+			for i, direction := range []string{"receive", "transmit"} {
+				labels := prometheus.Labels{"interface": s.Name, "direction": direction, "window": t.window.label}
+				networkSpeedMax.With(labels).Set(max[i])
+				networkSpeedMin.With(labels).Set(min[i])
+				networkSpeedAvg.With(labels).Set(avg[i])
+			}
+		}
+	}
+}
+
+// forgetSpeedWindows drops the windows of a removed interface
+func forgetSpeedWindows(name string) {
+	windowTrackers.Lock()
+	defer windowTrackers.Unlock()
+	delete(windowTrackers.byIface, name)
+	for _, vec := range []*prometheus.GaugeVec{networkSpeedMax, networkSpeedMin, networkSpeedAvg} {
+		vec.DeletePartialMatch(prometheus.Labels{"interface": name})
+	}
+}
+
+// handleResetSpeedWindows discards the window statistics of all interfaces,
+// or of a single one with ?iface=eth0, so they restart from the next sample
+func handleResetSpeedWindows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := r.URL.Query().Get("iface")
+
+	windowTrackers.Lock()
+	var names []string
+	for name := range windowTrackers.byIface {
+		if only == "" || name == only {
+			names = append(names, name)
+		}
+	}
+	windowTrackers.Unlock()
+	for _, name := range names {
+		forgetSpeedWindows(name)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
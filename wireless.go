@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var wirelessInterval = flag.Duration("wireless.interval", 15*time.Second, "How often to query nl80211 for wireless interfaces and stations")
+
+var (
+	wirelessInfoDesc = prometheus.NewDesc("network_wireless_info",
+		"Mode, SSID and, for a client, the BSSID of the access point of a wireless interface",
+		[]string{"interface", "mode", "ssid", "bssid"}, nil)
+	wirelessFrequencyDesc = prometheus.NewDesc("network_wireless_frequency_hertz",
+		"Frequency of the channel of the wireless interface", []string{"interface"}, nil)
+	wirelessChannelDesc = prometheus.NewDesc("network_wireless_channel",
+		"Channel number of the wireless interface", []string{"interface"}, nil)
+	wirelessStationSignalDesc = prometheus.NewDesc("network_wireless_station_signal_dbm",
+		"Signal strength of the last packets received from the station", []string{"interface", "station"}, nil)
+	wirelessStationBitrateDesc = prometheus.NewDesc("network_wireless_station_bitrate_bits",
+		"Bitrate of the last unicast packets to or from the station", []string{"interface", "station", "direction"}, nil)
+	wirelessStationBytesDesc = prometheus.NewDesc("network_wireless_station_bytes_total",
+		"Bytes received from or transmitted to the station", []string{"interface", "station", "direction"}, nil)
+
+	// Result of the last nl80211 query
+	wirelessSnapshot struct {
+		sync.Mutex
+		ifaces []wirelessInterface
+	}
+)
+
+func init() {
+	registerCollector("wireless", "signal, bitrate, channel and stations of Wi-Fi interfaces via nl80211", false, startWirelessCollector)
+}
+
+// Names of the NL80211_IFTYPE_* modes
+var wirelessModes = map[uint64]string{
+	unix.NL80211_IFTYPE_ADHOC:      "adhoc",
+	unix.NL80211_IFTYPE_STATION:    "station",
+	unix.NL80211_IFTYPE_AP:         "ap",
+	unix.NL80211_IFTYPE_AP_VLAN:    "ap_vlan",
+	unix.NL80211_IFTYPE_WDS:        "wds",
+	unix.NL80211_IFTYPE_MONITOR:    "monitor",
+	unix.NL80211_IFTYPE_MESH_POINT: "mesh_point",
+	unix.NL80211_IFTYPE_P2P_CLIENT: "p2p_client",
+	unix.NL80211_IFTYPE_P2P_GO:     "p2p_go",
+	unix.NL80211_IFTYPE_P2P_DEVICE: "p2p_device",
+	unix.NL80211_IFTYPE_OCB:        "ocb",
+	unix.NL80211_IFTYPE_NAN:        "nan",
+}
+
+type wirelessInterface struct {
+	name, mode, ssid string
+	index            uint32
+	frequencyMHz     uint64
+	// Clients in AP mode, the access point in station mode
+	stations []wirelessStation
+}
+
+type wirelessStation struct {
+	mac                  string
+	signal               int8
+	hasSignal            bool
+	rxBitrate, txBitrate uint64 // bits per second
+	rxBytes, txBytes     uint64
+}
+
+// wifiChannel converts a frequency to the channel number, zero if unknown
+func wifiChannel(mhz uint64) uint64 {
+	switch {
+	case mhz == 2484:
+		return 14
+	case mhz >= 2412 && mhz < 2484:
+		return (mhz - 2407) / 5
+	case mhz == 5935:
+		return 2
+	case mhz > 5950 && mhz <= 7115:
+		return (mhz - 5950) / 5
+	case mhz >= 5000 && mhz <= 5900:
+		return (mhz - 5000) / 5
+	}
+	return 0
+}
+
+// parseBitrate decodes a nested NL80211_STA_INFO_*_BITRATE, in 100 kbit/s units
+func parseBitrate(b []byte) uint64 {
+	rate := nlAttrMap(b)
+	if v, ok := nlUint(rate[unix.NL80211_RATE_INFO_BITRATE32]); ok {
+		return v * 100000
+	}
+	v, _ := nlUint(rate[unix.NL80211_RATE_INFO_BITRATE])
+	return v * 100000
+}
+
+// parseStation decodes an NL80211_CMD_NEW_STATION reply
+func parseStation(b []byte) (wirelessStation, bool) {
+	attrs := nlAttrMap(b)
+	mac, info := attrs[unix.NL80211_ATTR_MAC], attrs[unix.NL80211_ATTR_STA_INFO]
+	if len(mac) != 6 || info == nil {
+		return wirelessStation{}, false
+	}
+	st := wirelessStation{mac: net.HardwareAddr(mac).String()}
+	sta := nlAttrMap(info)
+	if v, ok := sta[unix.NL80211_STA_INFO_SIGNAL]; ok && len(v) == 1 {
+		st.signal, st.hasSignal = int8(v[0]), true
+	}
+	if v, ok := sta[unix.NL80211_STA_INFO_RX_BITRATE]; ok {
+		st.rxBitrate = parseBitrate(v)
+	}
+	if v, ok := sta[unix.NL80211_STA_INFO_TX_BITRATE]; ok {
+		st.txBitrate = parseBitrate(v)
+	}
+	// The 32 bit counters wrap after 4 GiB, use the 64 bit ones when present
+	if v, ok := nlUint(sta[unix.NL80211_STA_INFO_RX_BYTES64]); ok {
+		st.rxBytes = v
+	} else {
+		st.rxBytes, _ = nlUint(sta[unix.NL80211_STA_INFO_RX_BYTES])
+	}
+	if v, ok := nlUint(sta[unix.NL80211_STA_INFO_TX_BYTES64]); ok {
+		st.txBytes = v
+	} else {
+		st.txBytes, _ = nlUint(sta[unix.NL80211_STA_INFO_TX_BYTES])
+	}
+	return st, true
+}
+
+// readWireless dumps the wireless interfaces and their stations
+func readWireless(c *genlConn) ([]wirelessInterface, error) {
+	replies, err := c.execute(unix.NL80211_CMD_GET_INTERFACE, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []wirelessInterface
+	for _, reply := range replies {
+		attrs := nlAttrMap(reply)
+		index, ok := nlUint(attrs[unix.NL80211_ATTR_IFINDEX])
+		if !ok {
+			continue
+		}
+		iface := wirelessInterface{
+			name:  nlString(attrs[unix.NL80211_ATTR_IFNAME]),
+			index: uint32(index),
+			ssid:  string(attrs[unix.NL80211_ATTR_SSID]),
+		}
+		mode, _ := nlUint(attrs[unix.NL80211_ATTR_IFTYPE])
+		iface.mode = wirelessModes[mode]
+		iface.frequencyMHz, _ = nlUint(attrs[unix.NL80211_ATTR_WIPHY_FREQ])
+
+		stations, err := c.execute(unix.NL80211_CMD_GET_STATION, unix.NLM_F_DUMP, nlAttrU32(unix.NL80211_ATTR_IFINDEX, iface.index))
+		if err != nil {
+			log.Printf("Error reading stations of %s: %v", iface.name, err)
+		}
+		for _, s := range stations {
+			if st, ok := parseStation(s); ok {
+				iface.stations = append(iface.stations, st)
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// startWirelessCollector starts querying nl80211
+func startWirelessCollector() error {
+	c, err := dialGenetlink("nl80211")
+	if err != nil {
+		return err
+	}
+	registerMetrics("wireless", wirelessCollector{})
+	go collectWireless(c)
+	return nil
+}
+
+// collectWireless periodically refreshes the wireless snapshot
+func collectWireless(c *genlConn) {
+	for {
+		ifaces, err := readWireless(c)
+		if err != nil {
+			log.Printf("Error reading wireless interfaces: %v", err)
+		} else {
+			wirelessSnapshot.Lock()
+			wirelessSnapshot.ifaces = ifaces
+			wirelessSnapshot.Unlock()
+		}
+		time.Sleep(*wirelessInterval)
+	}
+}
+
+// wirelessCollector exports the last wireless snapshot
+type wirelessCollector struct{}
+
+func (wirelessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- wirelessInfoDesc
+	ch <- wirelessFrequencyDesc
+	ch <- wirelessChannelDesc
+	ch <- wirelessStationSignalDesc
+	ch <- wirelessStationBitrateDesc
+	ch <- wirelessStationBytesDesc
+}
+
+func (wirelessCollector) Collect(ch chan<- prometheus.Metric) {
+	wirelessSnapshot.Lock()
+	defer wirelessSnapshot.Unlock()
+	for _, iface := range wirelessSnapshot.ifaces {
+		// A client's only station is its access point
+		bssid := ""
+		if iface.mode == "station" && len(iface.stations) == 1 {
+			bssid = iface.stations[0].mac
+		}
+		ch <- prometheus.MustNewConstMetric(wirelessInfoDesc, prometheus.GaugeValue, 1, iface.name, iface.mode, iface.ssid, bssid)
+		if iface.frequencyMHz > 0 {
+			ch <- prometheus.MustNewConstMetric(wirelessFrequencyDesc, prometheus.GaugeValue, float64(iface.frequencyMHz)*1e6, iface.name)
+			ch <- prometheus.MustNewConstMetric(wirelessChannelDesc, prometheus.GaugeValue, float64(wifiChannel(iface.frequencyMHz)), iface.name)
+		}
+		for _, st := range iface.stations {
+			if st.hasSignal {
+				ch <- prometheus.MustNewConstMetric(wirelessStationSignalDesc, prometheus.GaugeValue, float64(st.signal), iface.name, st.mac)
+			}
+			ch <- prometheus.MustNewConstMetric(wirelessStationBitrateDesc, prometheus.GaugeValue, float64(st.rxBitrate), iface.name, st.mac, "receive")
+			ch <- prometheus.MustNewConstMetric(wirelessStationBitrateDesc, prometheus.GaugeValue, float64(st.txBitrate), iface.name, st.mac, "transmit")
+			ch <- prometheus.MustNewConstMetric(wirelessStationBytesDesc, prometheus.CounterValue, float64(st.rxBytes), iface.name, st.mac, "receive")
+			ch <- prometheus.MustNewConstMetric(wirelessStationBytesDesc, prometheus.CounterValue, float64(st.txBytes), iface.name, st.mac, "transmit")
+		}
+	}
+}
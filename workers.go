@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+var collectionWorkers = flag.Int("collection.workers", 4, "Number of interfaces whose sysfs metadata, statistics and transceiver EEPROMs are read concurrently; /proc/net/dev is always read in one pass")
+
+// validateCollectionWorkers checks --collection.workers
+func validateCollectionWorkers() error {
+	if *collectionWorkers < 1 {
+		return fmt.Errorf("invalid --collection.workers %d, expected at least 1", *collectionWorkers)
+	}
+	return nil
+}
+
+// forEachParallel calls f for 0 to n-1 on up to --collection.workers goroutines
+func forEachParallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < min(max(*collectionWorkers, 1), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
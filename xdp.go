@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var xdpInterval = flag.Duration("xdp.interval", 15*time.Second, "How often to read the XDP programs, driver XDP counters and AF_XDP sockets")
+
+// AF_XDP socket diagnostics, from linux/xdp_diag.h
+const (
+	sizeofXDPDiagReq = 20
+	sizeofXDPDiagMsg = 16
+	xdpShowInfo      = 1 << 0
+	xdpShowStats     = 1 << 4
+	xdpDiagInfo      = 1
+	xdpDiagStats     = 9
+)
+
+// Reasons of the struct xdp_diag_stats counters, in order
+var afXDPDropReasons = []string{"rx_dropped", "rx_invalid", "rx_ring_full", "fill_ring_empty", "tx_invalid", "tx_ring_empty"}
+
+// Modes of the per-mode program IDs of IFLA_XDP
+var xdpModes = map[uint16]string{
+	unix.IFLA_XDP_DRV_PROG_ID: "native",
+	unix.IFLA_XDP_SKB_PROG_ID: "generic",
+	unix.IFLA_XDP_HW_PROG_ID:  "offload",
+}
+
+var (
+	xdpAttachedDesc = prometheus.NewDesc("network_interface_xdp_attached",
+		"1 if an XDP program is attached to the interface, 0 otherwise", []string{"interface"}, nil)
+	xdpProgramDesc = prometheus.NewDesc("network_interface_xdp_program_info",
+		"XDP program attached to the interface, by mode", []string{"interface", "mode", "id", "name"}, nil)
+	xdpRunsDesc = prometheus.NewDesc("network_interface_xdp_program_runs_total",
+		"Times the XDP program of the interface ran, with kernel.bpf_stats_enabled", []string{"interface", "mode"}, nil)
+	xdpRunTimeDesc = prometheus.NewDesc("network_interface_xdp_program_run_seconds_total",
+		"Time the XDP program of the interface ran, with kernel.bpf_stats_enabled", []string{"interface", "mode"}, nil)
+	xdpDriverDesc = prometheus.NewDesc("network_interface_xdp_driver_stat_total",
+		"XDP counter of the driver of the interface, as named by ethtool -S", []string{"interface", "stat"}, nil)
+	afXDPSocketsDesc = prometheus.NewDesc("network_interface_af_xdp_sockets",
+		"Number of AF_XDP sockets bound to the queue of the interface", []string{"interface", "queue"}, nil)
+	afXDPDropsDesc = prometheus.NewDesc("network_interface_af_xdp_drops_total",
+		"Descriptors the AF_XDP sockets of the queue of the interface dropped or found invalid, by reason", []string{"interface", "queue", "reason"}, nil)
+
+	// Result of the last XDP read
+	xdpSnapshot struct {
+		sync.Mutex
+		metrics []prometheus.Metric
+	}
+)
+
+func init() {
+	registerCollector("xdp", "attached XDP programs, driver XDP counters and AF_XDP socket statistics", false, startXDPCollector)
+}
+
+// bpfStatsEnabled reports whether the kernel counts the runs of programs
+func bpfStatsEnabled() bool {
+	b, err := os.ReadFile(procFilePath("sys/kernel/bpf_stats_enabled"))
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+// xdpCollectorState is what collectXDP keeps between reads
+type xdpCollectorState struct {
+	rt, diag *netlinkConn
+	// Whether an error reading the programs was already logged
+	reportedProgramError bool
+}
+
+// readXDPPrograms reads the attached programs and the driver XDP counters
+// of all interfaces
+func (s *xdpCollectorState) readXDPPrograms(metrics []prometheus.Metric) ([]prometheus.Metric, error) {
+	links, err := dumpLinks(s.rt)
+	if err != nil {
+		return nil, err
+	}
+	statsEnabled := bpfStatsEnabled()
+	for _, l := range links {
+		name := nlString(l.attrs[unix.IFLA_IFNAME])
+		if name == "lo" {
+			continue
+		}
+		xdp := nlAttrMap(l.attrs[unix.IFLA_XDP])
+		attached, _ := nlUint(xdp[unix.IFLA_XDP_ATTACHED])
+		metrics = append(metrics, prometheus.MustNewConstMetric(xdpAttachedDesc, prometheus.GaugeValue, boolToFloat(attached != 0), name))
+		for attr, mode := range xdpModes {
+			id, ok := nlUint(xdp[attr])
+			if !ok || id == 0 {
+				continue
+			}
+			p, err := bpfProgramInfo(uint32(id))
+			if err != nil && !s.reportedProgramError {
+				log.Printf("Error reading XDP program of %s, leaving out names and run statistics: %v", name, err)
+				s.reportedProgramError = true
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(xdpProgramDesc, prometheus.GaugeValue, 1, name, mode, strconv.FormatUint(id, 10), p.name))
+			if err == nil && statsEnabled && p.hasRunCounter {
+				metrics = append(metrics,
+					prometheus.MustNewConstMetric(xdpRunsDesc, prometheus.CounterValue, float64(p.runCount), name, mode),
+					prometheus.MustNewConstMetric(xdpRunTimeDesc, prometheus.CounterValue, float64(p.runTime)/1e9, name, mode))
+			}
+		}
+
+		// Interfaces without driver statistics, e.g. bridges
+		stats, err := ethtoolStats(name)
+		if err != nil {
+			continue
+		}
+		for stat, v := range stats {
+			if strings.Contains(strings.ToLower(stat), "xdp") {
+				metrics = append(metrics, prometheus.MustNewConstMetric(xdpDriverDesc, prometheus.CounterValue, float64(v), name, stat))
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// afXDPQueue identifies the queue of an interface AF_XDP sockets are bound to
+type afXDPQueue struct {
+	ifindex, queue uint32
+}
+
+// readAFXDPSockets dumps the AF_XDP sockets and sums them by queue
+func (s *xdpCollectorState) readAFXDPSockets(metrics []prometheus.Metric) ([]prometheus.Metric, error) {
+	// struct xdp_diag_req: family, protocol, padding, inode, show, cookie
+	req := make([]byte, sizeofXDPDiagReq)
+	req[0] = unix.AF_XDP
+	binary.NativeEndian.PutUint32(req[8:], xdpShowInfo|xdpShowStats)
+	replies, err := s.diag.execute(sockDiagByFamily, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	sockets := make(map[afXDPQueue]int)
+	drops := make(map[afXDPQueue][]uint64)
+	for _, reply := range replies {
+		if len(reply) < sizeofXDPDiagMsg {
+			continue
+		}
+		attrs := nlAttrMap(reply[sizeofXDPDiagMsg:])
+		// struct xdp_diag_info: ifindex, queue_id; sockets that are not
+		// bound have none
+		info := attrs[xdpDiagInfo]
+		if len(info) < 8 || binary.NativeEndian.Uint32(info) == 0 {
+			continue
+		}
+		q := afXDPQueue{binary.NativeEndian.Uint32(info[0:4]), binary.NativeEndian.Uint32(info[4:8])}
+		sockets[q]++
+		if drops[q] == nil {
+			drops[q] = make([]uint64, len(afXDPDropReasons))
+		}
+		if stats := attrs[xdpDiagStats]; len(stats) >= 8*len(afXDPDropReasons) {
+			for i := range afXDPDropReasons {
+				drops[q][i] += binary.NativeEndian.Uint64(stats[8*i:])
+			}
+		}
+	}
+	if len(sockets) == 0 {
+		return metrics, nil
+	}
+	names, err := linkNames(s.rt)
+	if err != nil {
+		return nil, err
+	}
+	for q, n := range sockets {
+		name, ok := names[q.ifindex]
+		if !ok {
+			continue
+		}
+		queue := strconv.FormatUint(uint64(q.queue), 10)
+		metrics = append(metrics, prometheus.MustNewConstMetric(afXDPSocketsDesc, prometheus.GaugeValue, float64(n), name, queue))
+		for i, reason := range afXDPDropReasons {
+			metrics = append(metrics, prometheus.MustNewConstMetric(afXDPDropsDesc, prometheus.CounterValue, float64(drops[q][i]), name, queue, reason))
+		}
+	}
+	return metrics, nil
+}
+
+// startXDPCollector opens the netlink sockets for the link and AF_XDP socket
+// dumps
+func startXDPCollector() error {
+	rt, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	diag, err := dialNetlink(unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		rt.Close()
+		return err
+	}
+	registerMetrics("xdp", xdpCollector{})
+	go collectXDP(&xdpCollectorState{rt: rt, diag: diag})
+	return nil
+}
+
+// collectXDP periodically refreshes the XDP snapshot. Kernels without
+// AF_XDP socket diagnostics still get the programs and driver counters.
+func collectXDP(s *xdpCollectorState) {
+	reportedDiagError := false
+	for {
+		metrics, err := s.readXDPPrograms(nil)
+		if err != nil {
+			log.Printf("Error reading XDP programs: %v", err)
+		} else {
+			if withSockets, err := s.readAFXDPSockets(metrics); err == nil {
+				metrics = withSockets
+			} else if !reportedDiagError {
+				log.Printf("Error reading AF_XDP sockets: %v", err)
+				reportedDiagError = true
+			}
+			xdpSnapshot.Lock()
+			xdpSnapshot.metrics = metrics
+			xdpSnapshot.Unlock()
+		}
+		time.Sleep(*xdpInterval)
+	}
+}
+
+// xdpCollector exports the metrics of the last XDP read
+type xdpCollector struct{}
+
+func (xdpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- xdpAttachedDesc
+	ch <- xdpProgramDesc
+	ch <- xdpRunsDesc
+	ch <- xdpRunTimeDesc
+	ch <- xdpDriverDesc
+	ch <- afXDPSocketsDesc
+	ch <- afXDPDropsDesc
+}
+
+func (xdpCollector) Collect(ch chan<- prometheus.Metric) {
+	xdpSnapshot.Lock()
+	defer xdpSnapshot.Unlock()
+	for _, m := range xdpSnapshot.metrics {
+		ch <- m
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+const xfrmStatFile = "net/xfrm_stat"
+
+var xfrmInterval = flag.Duration("xfrm.interval", 15*time.Second, "How often to read the IPsec (xfrm) statistics and security associations")
+
+const (
+	xfrmMsgGetSA = 0x12
+	// sizeof(struct xfrm_usersa_info)
+	sizeofXfrmUsersaInfo = 224
+)
+
+// Names of the IPsec protocols of an SA
+var xfrmProtocols = map[uint8]string{
+	unix.IPPROTO_ESP:  "esp",
+	unix.IPPROTO_AH:   "ah",
+	unix.IPPROTO_COMP: "comp",
+}
+
+var (
+	xfrmErrorsDesc = prometheus.NewDesc("network_xfrm_errors_total",
+		"IPsec transformation errors by cause, from "+xfrmStatFile, []string{"error"}, nil)
+	xfrmSABytesDesc = prometheus.NewDesc("network_xfrm_sa_bytes_total",
+		"Bytes processed by the IPsec security association", []string{"src", "dst", "spi", "proto", "reqid"}, nil)
+	xfrmSAPacketsDesc = prometheus.NewDesc("network_xfrm_sa_packets_total",
+		"Packets processed by the IPsec security association", []string{"src", "dst", "spi", "proto", "reqid"}, nil)
+	xfrmSAReplayDesc = prometheus.NewDesc("network_xfrm_sa_replay_errors_total",
+		"Packets of the IPsec security association dropped as replayed", []string{"src", "dst", "spi", "proto", "reqid"}, nil)
+	xfrmSAIntegrityDesc = prometheus.NewDesc("network_xfrm_sa_integrity_failures_total",
+		"Packets of the IPsec security association that failed the integrity check", []string{"src", "dst", "spi", "proto", "reqid"}, nil)
+
+	// Result of the last xfrm reads
+	xfrmSnapshot struct {
+		sync.Mutex
+		errors map[string]uint64
+		sas    []xfrmSA
+	}
+)
+
+func init() {
+	registerCollector("xfrm", "IPsec error counters from /proc/net/xfrm_stat and per-SA traffic via netlink", false, startXfrmCollector).
+		requires(capNetAdmin)
+}
+
+type xfrmSA struct {
+	src, dst, spi, proto, reqid string
+	bytes, packets              uint64
+	replay, integrityFailed     uint64
+}
+
+// readXfrmStat reads the error counters of /proc/net/xfrm_stat
+func readXfrmStat() (map[string]uint64, error) {
+	file, err := os.Open(procFilePath(xfrmStatFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	counters := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			counters[fields[0]] = v
+		}
+	}
+	return counters, scanner.Err()
+}
+
+// xfrmAddr decodes an xfrm_address_t of the given family
+func xfrmAddr(b []byte, family uint16) string {
+	if family == unix.AF_INET {
+		return netip.AddrFrom4([4]byte(b[:4])).String()
+	}
+	return netip.AddrFrom16([16]byte(b[:16])).String()
+}
+
+// parseXfrmSA decodes a struct xfrm_usersa_info
+func parseXfrmSA(b []byte) (xfrmSA, bool) {
+	if len(b) < sizeofXfrmUsersaInfo {
+		return xfrmSA{}, false
+	}
+	// Offsets: sel 0, id.daddr 56, id.spi 72, id.proto 76, saddr 80,
+	// lft 96, curlft 160, stats 192, seq 204, reqid 208, family 212
+	family := binary.NativeEndian.Uint16(b[212:214])
+	proto, ok := xfrmProtocols[b[76]]
+	if !ok {
+		proto = strconv.Itoa(int(b[76]))
+	}
+	return xfrmSA{
+		src:             xfrmAddr(b[80:96], family),
+		dst:             xfrmAddr(b[56:72], family),
+		spi:             fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(b[72:76])),
+		proto:           proto,
+		reqid:           strconv.FormatUint(uint64(binary.NativeEndian.Uint32(b[208:212])), 10),
+		bytes:           binary.NativeEndian.Uint64(b[160:168]),
+		packets:         binary.NativeEndian.Uint64(b[168:176]),
+		replay:          uint64(binary.NativeEndian.Uint32(b[196:200])),
+		integrityFailed: uint64(binary.NativeEndian.Uint32(b[200:204])),
+	}, true
+}
+
+// readXfrmSAs dumps the security associations
+func readXfrmSAs(c *netlinkConn) ([]xfrmSA, error) {
+	replies, err := c.execute(xfrmMsgGetSA, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	var sas []xfrmSA
+	for _, reply := range replies {
+		if sa, ok := parseXfrmSA(reply); ok {
+			sas = append(sas, sa)
+		}
+	}
+	return sas, nil
+}
+
+// startXfrmCollector starts reading the IPsec statistics
+func startXfrmCollector() error {
+	c, err := dialNetlink(unix.NETLINK_XFRM)
+	if err != nil {
+		return err
+	}
+	registerMetrics("xfrm", xfrmCollector{})
+	go collectXfrm(c)
+	return nil
+}
+
+// collectXfrm periodically refreshes the xfrm snapshot
+func collectXfrm(c *netlinkConn) {
+	for {
+		// Without CONFIG_XFRM_STATISTICS only the SAs are available
+		counters, err := readXfrmStat()
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", procFilePath(xfrmStatFile), err)
+		}
+		sas, err := readXfrmSAs(c)
+		if err != nil {
+			log.Printf("Error reading IPsec security associations: %v", err)
+		}
+		xfrmSnapshot.Lock()
+		xfrmSnapshot.errors, xfrmSnapshot.sas = counters, sas
+		xfrmSnapshot.Unlock()
+		time.Sleep(*xfrmInterval)
+	}
+}
+
+// xfrmCollector exports the last xfrm snapshot
+type xfrmCollector struct{}
+
+func (xfrmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- xfrmErrorsDesc
+	ch <- xfrmSABytesDesc
+	ch <- xfrmSAPacketsDesc
+	ch <- xfrmSAReplayDesc
+	ch <- xfrmSAIntegrityDesc
+}
+
+func (xfrmCollector) Collect(ch chan<- prometheus.Metric) {
+	xfrmSnapshot.Lock()
+	defer xfrmSnapshot.Unlock()
+	for name, v := range xfrmSnapshot.errors {
+		ch <- prometheus.MustNewConstMetric(xfrmErrorsDesc, prometheus.CounterValue, float64(v), name)
+	}
+	for _, sa := range xfrmSnapshot.sas {
+		labels := []string{sa.src, sa.dst, sa.spi, sa.proto, sa.reqid}
+		ch <- prometheus.MustNewConstMetric(xfrmSABytesDesc, prometheus.CounterValue, float64(sa.bytes), labels...)
+		ch <- prometheus.MustNewConstMetric(xfrmSAPacketsDesc, prometheus.CounterValue, float64(sa.packets), labels...)
+		ch <- prometheus.MustNewConstMetric(xfrmSAReplayDesc, prometheus.CounterValue, float64(sa.replay), labels...)
+		ch <- prometheus.MustNewConstMetric(xfrmSAIntegrityDesc, prometheus.CounterValue, float64(sa.integrityFailed), labels...)
+	}
+}